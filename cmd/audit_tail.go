@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	ssh_agent "github.com/off-the-grid-inc/murmur/ssh-agent/ssh-agent"
+)
+
+// auditPollInterval is how often a followed audit log is checked for new
+// entries once its end was reached.
+const auditPollInterval = 500 * time.Millisecond
+
+// parseSince accepts either a duration relative to now, e.g. "1h", or an
+// RFC3339 timestamp. An empty value means no filter.
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, errors.New(fmt.Sprintf("Invalid since value %q, use a duration like 1h or an RFC3339 time", since))
+	}
+	return t, nil
+}
+
+// formatAuditEntry renders an audit entry as a single human readable line.
+func formatAuditEntry(e *ssh_agent.AuditEntry) string {
+	key := e.Fingerprint
+	if e.Comment != "" {
+		key = fmt.Sprintf("%s (%s)", e.Comment, e.Fingerprint)
+	}
+	peer := e.Peer
+	if peer == "" {
+		peer = "-"
+	}
+	result := "ok"
+	if !e.Success {
+		result = "FAILED: " + e.Error
+	}
+	return fmt.Sprintf("%s  %s  %s  peer=%s  %s", e.Time.Local().Format("2006-01-02 15:04:05"), key, e.Algorithm, peer, result)
+}
+
+// tailAudit prints the entries of the JSON lines audit log read from r that
+// happened after since. When follow is set it keeps waiting for new entries.
+func tailAudit(r io.Reader, w io.Writer, since time.Time, follow bool) error {
+	reader := bufio.NewReader(r)
+	var line string
+	for {
+		// Incomplete lines are kept until the agent finishes writing them
+		chunk, err := reader.ReadString('\n')
+		line += chunk
+		if err == io.EOF {
+			if follow {
+				time.Sleep(auditPollInterval)
+				continue
+			}
+			if strings.TrimSpace(line) != "" {
+				printAuditLine(w, line, since)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		printAuditLine(w, line, since)
+		line = ""
+	}
+}
+
+func printAuditLine(w io.Writer, line string, since time.Time) {
+	var entry ssh_agent.AuditEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		fmt.Fprintf(w, "unreadable audit entry: %s\n", strings.TrimSpace(line))
+		return
+	}
+	if !entry.Time.Before(since) {
+		fmt.Fprintln(w, formatAuditEntry(&entry))
+	}
+}
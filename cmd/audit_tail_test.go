@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTailAudit(t *testing.T) {
+	require := require.New(t)
+
+	log := strings.Join([]string{
+		`{"time":"2019-05-01T10:00:00Z","fingerprint":"SHA256:old","algorithm":"ecdsa-sha2-nistp256","data_length":32,"success":true}`,
+		`{"time":"2019-05-02T10:00:00Z","fingerprint":"SHA256:abc","comment":"work","algorithm":"rsa-sha2-512","data_length":32,"peer":"pid=42","success":true}`,
+		`not json`,
+		`{"time":"2019-05-02T11:00:00Z","fingerprint":"SHA256:def","algorithm":"ssh-ed25519","data_length":32,"success":false,"error":"denied"}`,
+	}, "\n")
+
+	since, err := parseSince("2019-05-02T00:00:00Z", time.Now())
+	require.NoError(err)
+	var out bytes.Buffer
+	require.NoError(tailAudit(strings.NewReader(log), &out, since, false))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(lines, 3)
+	require.Contains(lines[0], "work (SHA256:abc)  rsa-sha2-512  peer=pid=42  ok")
+	require.Equal("unreadable audit entry: not json", lines[1])
+	require.Contains(lines[2], "SHA256:def  ssh-ed25519  peer=-  FAILED: denied")
+	require.NotContains(out.String(), "SHA256:old")
+
+	now := time.Date(2019, 5, 2, 12, 0, 0, 0, time.UTC)
+	since, err = parseSince("90m", now)
+	require.NoError(err)
+	require.Equal(now.Add(-90*time.Minute), since)
+	_, err = parseSince("yesterday", now)
+	require.Error(err)
+}
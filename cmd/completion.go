@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// completedFlags are the flags whose value is taken from the storage, by
+// the flag printing the candidates: stored secret names for most of them and
+// their fingerprints for whois.
+var completedFlags = map[string]string{
+	"exportKey":      "completeSecrets",
+	"group":          "completeSecrets",
+	"removeBunkrKey": "completeSecrets",
+	"testSign":       "completeSecrets",
+	"whois":          "completeFingerprints",
+}
+
+// writeCompletion prints a completion script for shell covering every flag
+// of fs. Stored secret names and fingerprints are completed through
+// -completeSecrets and -completeFingerprints.
+func writeCompletion(w io.Writer, shell, prog string, fs *flag.FlagSet) error {
+	var names []string
+	usages := make(map[string]string)
+	completed := make(map[string][]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+		usages[f.Name] = f.Usage
+		if completer, ok := completedFlags[f.Name]; ok {
+			completed[completer] = append(completed[completer], f.Name)
+		}
+	})
+	sort.Strings(names)
+	var completers []string
+	for completer := range completed {
+		completers = append(completers, completer)
+		sort.Strings(completed[completer])
+	}
+	sort.Strings(completers)
+	fn := "_" + strings.Replace(prog, "-", "_", -1)
+
+	switch shell {
+	case "bash":
+		fmt.Fprintf(w, "%s() {\n", fn)
+		fmt.Fprintf(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+		fmt.Fprintf(w, "    case \"$prev\" in\n")
+		for _, completer := range completers {
+			fmt.Fprintf(w, "        -%s)\n", strings.Join(completed[completer], "|-"))
+			fmt.Fprintf(w, "            COMPREPLY=($(compgen -W \"$(%s -%s 2>/dev/null)\" -- \"$cur\"))\n", prog, completer)
+			fmt.Fprintf(w, "            return ;;\n")
+		}
+		fmt.Fprintf(w, "    esac\n")
+		fmt.Fprintf(w, "    COMPREPLY=($(compgen -W \"-%s\" -- \"$cur\"))\n", strings.Join(names, " -"))
+		fmt.Fprintf(w, "}\n")
+		fmt.Fprintf(w, "complete -F %s %s\n", fn, prog)
+	case "zsh":
+		fmt.Fprintf(w, "#compdef %s\n\n", prog)
+		for _, completer := range completers {
+			fmt.Fprintf(w, "%s_%s() {\n", fn, completer)
+			fmt.Fprintf(w, "    local -a values\n")
+			fmt.Fprintf(w, "    values=(${(f)\"$(%s -%s 2>/dev/null)\"})\n", prog, completer)
+			fmt.Fprintf(w, "    _describe 'value' values\n")
+			fmt.Fprintf(w, "}\n\n")
+		}
+		fmt.Fprintf(w, "_arguments \\\n")
+		for _, name := range names {
+			action := ""
+			if completer, ok := completedFlags[name]; ok {
+				action = fmt.Sprintf(":value:%s_%s", fn, completer)
+			}
+			fmt.Fprintf(w, "    '-%s[%s]%s' \\\n", name, zshEscape(usages[name]), action)
+		}
+		fmt.Fprintf(w, "    && return 0\n")
+	case "fish":
+		for _, name := range names {
+			fmt.Fprintf(w, "complete -c %s -o %s -d '%s'", prog, name, fishEscape(usages[name]))
+			if completer, ok := completedFlags[name]; ok {
+				fmt.Fprintf(w, " -x -a '(%s -%s 2>/dev/null)'", prog, completer)
+			}
+			fmt.Fprintln(w)
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unsupported shell %q for completion, use bash, zsh or fish", shell))
+	}
+	return nil
+}
+
+func zshEscape(s string) string {
+	return strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:").Replace(s)
+}
+
+func fishEscape(s string) string {
+	return strings.Replace(s, "'", "\\'", -1)
+}
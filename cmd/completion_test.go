@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCompletion(t *testing.T) {
+	require := require.New(t)
+
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		var out bytes.Buffer
+		require.NoError(writeCompletion(&out, shell, "bssh-agent", flag.CommandLine))
+		script := out.String()
+		flag.CommandLine.VisitAll(func(f *flag.Flag) {
+			require.Contains(script, f.Name, "%s completion misses -%s", shell, f.Name)
+		})
+		require.Contains(script, "bssh-agent -completeSecrets", shell)
+		require.Contains(script, "bssh-agent -completeFingerprints", shell)
+	}
+
+	var out bytes.Buffer
+	require.NoError(writeCompletion(&out, "bash", "bssh-agent", flag.CommandLine))
+	require.Contains(out.String(), "-exportKey|-group|-removeBunkrKey|-testSign)\n            COMPREPLY=($(compgen -W \"$(bssh-agent -completeSecrets")
+	require.Contains(out.String(), "-whois)\n            COMPREPLY=($(compgen -W \"$(bssh-agent -completeFingerprints")
+
+	require.Error(writeCompletion(&bytes.Buffer{}, "tcsh", "bssh-agent", flag.CommandLine))
+}
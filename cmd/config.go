@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// defaultConfigPath is the configuration file read when -config is not given.
+// It is optional, unlike a file given explicitly.
+const defaultConfigPath = "~/.bunkr/agent.json"
+
+// envFlags are the flags that can be set through an environment variable,
+// with their variable.
+var envFlags = map[string]string{
+	"bunkrSocketAddr": "BUNKR_SOCKET_ADDR",
+	"agentSocketAddr": "AGENT_SOCKET_ADDR",
+	"storageAddr":     "STORAGE_ADDR",
+}
+
+// applyEnv sets the flags of fs from their environment variable, found with
+// lookup, unless they are in skip. The names of the flags set are added to
+// skip.
+func applyEnv(fs *flag.FlagSet, lookup func(key string) (string, bool), skip map[string]bool) error {
+	for name, key := range envFlags {
+		value, ok := lookup(key)
+		if !ok || value == "" || skip[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return errors.New(fmt.Sprintf("Invalid value for %s in %s: %v", name, key, err))
+		}
+		skip[name] = true
+	}
+	return nil
+}
+
+// setFlags returns the names of the flags of fs set on the command line.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// oneOffFlags are the flags running a one-off command, or only changing how
+// one runs. They are not settings of the agent: they are never passed to the
+// generated systemd service nor accepted in the configuration file.
+var oneOffFlags = map[string]bool{
+	"genSystemd":           true,
+	"completion":           true,
+	"list":                 true,
+	"removeBunkrKey":       true,
+	"completeSecrets":      true,
+	"completeFingerprints": true,
+	"version":              true,
+	"json":                 true,
+	"addBunkrKey":          true,
+	"importManifest":       true,
+	"testSign":             true,
+	"health":               true,
+	"healthTimeout":        true,
+	"auditTail":            true,
+	"since":                true,
+	"groups":               true,
+	"exportKey":            true,
+	"exportPath":           true,
+	"exportAuthorizedKeys": true,
+	"overwrite":            true,
+	"whois":                true,
+	"restoreBackup":        true,
+	"importBackend":        true,
+}
+
+// applyConfig sets the flags of fs from the JSON configuration file at path,
+// an object of flag names and values such as
+//
+//	{"agentSocketAddr": "/run/user/1000/agent.sock", "signTimeout": "10s", "scopedSocket": ["a.sock:group=ci"]}
+//
+// The flags in skip, already set from a higher precedence source, keep their
+// value. One-off commands such as restoreBackup are refused, see
+// oneOffFlags. A missing file is only an error if required.
+func applyConfig(fs *flag.FlagSet, path string, required bool, skip map[string]bool) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+		return errors.New(fmt.Sprintf("Error reading the configuration file: %v", err))
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(content, &settings); err != nil {
+		return errors.New(fmt.Sprintf("Invalid configuration file %s: %v", path, err))
+	}
+	for name, value := range settings {
+		if name == "config" || fs.Lookup(name) == nil {
+			return errors.New(fmt.Sprintf("Unknown setting %q in the configuration file %s", name, path))
+		}
+		if oneOffFlags[name] {
+			return errors.New(fmt.Sprintf("%q runs a one-off command, give it on the command line instead of in the configuration file %s", name, path))
+		}
+		if skip[name] {
+			continue
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+				return errors.New(fmt.Sprintf("Invalid value for %s in the configuration file %s: %v", name, path, err))
+			}
+		}
+	}
+	return nil
+}
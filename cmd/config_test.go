@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyConfig(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "config-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.json")
+	require.NoError(ioutil.WriteFile(path, []byte(`{
+		"agentSocketAddr": "/from/config.sock",
+		"storageAddr": "/from/config.json",
+		"signTimeout": "10s",
+		"trace": true,
+		"scopedSocket": ["a.sock:group=ci", "b.sock:type=rsa"]
+	}`), 0600))
+
+	newFlags := func() (*flag.FlagSet, map[string]*string, *time.Duration, *bool, *stringList) {
+		fs := flag.NewFlagSet("bssh-agent", flag.ContinueOnError)
+		addrs := map[string]*string{
+			"bunkrSocketAddr": fs.String("bunkrSocketAddr", "/default/bunkr.sock", ""),
+			"agentSocketAddr": fs.String("agentSocketAddr", "/default/agent.sock", ""),
+			"storageAddr":     fs.String("storageAddr", "/default/storage.json", ""),
+		}
+		timeout := fs.Duration("signTimeout", 0, "")
+		trace := fs.Bool("trace", false, "")
+		var scoped stringList
+		fs.Var(&scoped, "scopedSocket", "")
+		return fs, addrs, timeout, trace, &scoped
+	}
+
+	// Defaults are kept for the settings missing from the file, the file
+	// overrides the others and the command line overrides the file
+	fs, addrs, timeout, trace, scoped := newFlags()
+	require.NoError(fs.Parse([]string{"-storageAddr", "/from/flag.json"}))
+	require.NoError(applyConfig(fs, path, true, setFlags(fs)))
+	require.Equal("/default/bunkr.sock", *addrs["bunkrSocketAddr"])
+	require.Equal("/from/config.sock", *addrs["agentSocketAddr"])
+	require.Equal("/from/flag.json", *addrs["storageAddr"])
+	require.Equal(10*time.Second, *timeout)
+	require.True(*trace)
+	require.Equal(stringList{"a.sock:group=ci", "b.sock:type=rsa"}, *scoped)
+
+	// The default configuration file is optional, one given is not
+	fs, addrs, _, _, _ = newFlags()
+	missing := filepath.Join(dir, "missing.json")
+	require.NoError(applyConfig(fs, missing, false, nil))
+	require.Equal("/default/agent.sock", *addrs["agentSocketAddr"])
+	require.Error(applyConfig(fs, missing, true, nil))
+
+	require.NoError(ioutil.WriteFile(path, []byte(`{"agentSocket": "/typo.sock"}`), 0600))
+	require.EqualError(applyConfig(fs, path, true, nil), `Unknown setting "agentSocket" in the configuration file `+path)
+	require.NoError(ioutil.WriteFile(path, []byte(`{"signTimeout": "soon"}`), 0600))
+	require.Error(applyConfig(fs, path, true, nil))
+
+	// One-off commands are not settings
+	restore := fs.Bool("restoreBackup", false, "")
+	require.NoError(ioutil.WriteFile(path, []byte(`{"restoreBackup": true}`), 0600))
+	err = applyConfig(fs, path, true, nil)
+	require.Error(err)
+	require.Contains(err.Error(), `"restoreBackup" runs a one-off command`)
+	require.False(*restore)
+}
+
+func TestApplyEnv(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "config-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.json")
+	require.NoError(ioutil.WriteFile(path, []byte(`{"bunkrSocketAddr": "/from/config.sock", "agentSocketAddr": "/from/config.sock"}`), 0600))
+
+	fs := flag.NewFlagSet("bssh-agent", flag.ContinueOnError)
+	bunkrAddr := fs.String("bunkrSocketAddr", "/default/bunkr.sock", "")
+	agentAddr := fs.String("agentSocketAddr", "/default/agent.sock", "")
+	storageAddr := fs.String("storageAddr", "/default/storage.json", "")
+	require.NoError(fs.Parse([]string{"-storageAddr", "/from/flag.json"}))
+	env := map[string]string{
+		"AGENT_SOCKET_ADDR": "/from/env.sock",
+		"STORAGE_ADDR":      "/from/env.json",
+	}
+	lookup := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	// Flags override the environment, which overrides the configuration file
+	set := setFlags(fs)
+	require.NoError(applyEnv(fs, lookup, set))
+	require.NoError(applyConfig(fs, path, true, set))
+	require.Equal("/from/config.sock", *bunkrAddr)
+	require.Equal("/from/env.sock", *agentAddr)
+	require.Equal("/from/flag.json", *storageAddr)
+}
+
+func TestGetOptsFromEnv(t *testing.T) {
+	require := require.New(t)
+	home, err := ioutil.TempDir("", "config-test")
+	require.NoError(err)
+	defer os.RemoveAll(home)
+
+	for key, value := range map[string]string{
+		"HOME":              home,
+		"BUNKR_SOCKET_ADDR": "/run/bunkr/daemon.sock",
+		"AGENT_SOCKET_ADDR": "/run/bunkr/agent.sock",
+		"STORAGE_ADDR":      "/var/lib/bunkr/storage.json",
+	} {
+		previous, ok := os.LookupEnv(key)
+		require.NoError(os.Setenv(key, value))
+		if ok {
+			defer os.Setenv(key, previous)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+
+	opts := getOpts()
+	require.Equal("/run/bunkr/daemon.sock", opts.BunkrAddr)
+	require.Equal("/run/bunkr/agent.sock", opts.AgentAddr)
+	require.Equal("/var/lib/bunkr/storage.json", opts.StorageAddr)
+}
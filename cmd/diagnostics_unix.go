@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	ssh_agent "github.com/off-the-grid-inc/murmur/ssh-agent/ssh-agent"
+)
+
+// dumpDiagnosticsOnSignal writes the agent diagnostics to path every time
+// the process receives SIGUSR2.
+func dumpDiagnosticsOnSignal(ssha *ssh_agent.SSHAgent, path string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	go func() {
+		for range sigs {
+			if err := ssha.DumpDiagnostics(path); err != nil {
+				log.Print(fmt.Sprintf("Could not write diagnostics: %v", err))
+				continue
+			}
+			log.Print(fmt.Sprintf("Diagnostics written to %s", path))
+		}
+	}()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+// listKeys prints the name, type, group, SHA256 fingerprint, creation and
+// last use times of the keys of the stored secrets, as the agent would load
+// them, sorted by name.
+func listKeys(w io.Writer, secrets []*storage.Secret) error {
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tGROUP\tFINGERPRINT\tCREATED\tLAST USED")
+	for _, secret := range secrets {
+		sshPub, _, _, _, err := ssh.ParseAuthorizedKey(secret.PublicData)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid public key for secret %s: %v", secret.Name, err))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", secret.Name, secret.SecretType, groupName(secret), ssh.FingerprintSHA256(sshPub), listTime(secret.CreatedAt), listTime(secret.LastUsedAt))
+	}
+	return tw.Flush()
+}
+
+// listTime formats a time of the key list, "-" if it is unknown.
+func listTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+// printGroups prints every group of store with its members.
+func printGroups(w io.Writer, store storage.Store) error {
+	groups, err := store.ListGroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		members, err := store.GroupMembers(group)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: %s\n", group, strings.Join(members, ", "))
+	}
+	return nil
+}
+
+// printFingerprints prints the SHA256 fingerprints of the keys of secrets,
+// the secrets holding no ssh public key are skipped.
+func printFingerprints(w io.Writer, secrets []*storage.Secret) {
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	for _, secret := range secrets {
+		if sshPub, _, _, _, err := ssh.ParseAuthorizedKey(secret.PublicData); err == nil {
+			fmt.Fprintln(w, ssh.FingerprintSHA256(sshPub))
+		}
+	}
+}
+
+// printWhois prints the name and group of the secret found by -whois.
+func printWhois(w io.Writer, secret *storage.Secret) {
+	fmt.Fprintf(w, "%s\t%s\n", secret.Name, groupName(secret))
+}
+
+// groupName returns the name of the group of secret, "-" if it has none.
+func groupName(secret *storage.Secret) string {
+	if secret.Group == nil {
+		return "-"
+	}
+	return secret.Group.Name
+}
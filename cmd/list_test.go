@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+func TestListKeys(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "list-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	agentStorage, err := storage.NewBunkrStorage(filepath.Join(dir, "storage.json"))
+	require.NoError(err)
+
+	fingerprints := map[string]string{}
+	var group *storage.Secret
+	for _, name := range []string{"team", "deploy"} {
+		pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(err)
+		sshPub, err := ssh.NewPublicKey(&pk.PublicKey)
+		require.NoError(err)
+		secret := &storage.Secret{Name: name, SecretType: "ECDSA-P256", PublicData: ssh.MarshalAuthorizedKey(sshPub), Group: group}
+		require.NoError(agentStorage.StoreSecret(secret))
+		fingerprints[name] = ssh.FingerprintSHA256(sshPub)
+		group = secret
+	}
+
+	secrets, err := agentStorage.GetSecrets()
+	require.NoError(err)
+	var out bytes.Buffer
+	require.NoError(listKeys(&out, secrets))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(lines, 3)
+	columns := regexp.MustCompile(`\s{2,}`)
+	require.Equal([]string{"NAME", "TYPE", "GROUP", "FINGERPRINT", "CREATED", "LAST USED"}, columns.Split(lines[0], -1))
+	created := listTime(secrets[0].CreatedAt)
+	require.NotEqual("-", created)
+	require.Equal([]string{"deploy", "ECDSA-P256", "team", fingerprints["deploy"], created, "-"}, columns.Split(lines[1], -1))
+	require.Equal([]string{"team", "ECDSA-P256", "-", fingerprints["team"], listTime(secrets[1].CreatedAt), "-"}, columns.Split(lines[2], -1))
+
+	require.Error(listKeys(&out, []*storage.Secret{{Name: "broken", PublicData: []byte("garbage")}}))
+}
+
+func TestPrintWhois(t *testing.T) {
+	require := require.New(t)
+	var out bytes.Buffer
+	printWhois(&out, &storage.Secret{Name: "runner", Group: &storage.Secret{Name: "ci"}})
+	printWhois(&out, &storage.Secret{Name: "personal"})
+	require.Equal("runner\tci\npersonal\t-\n", out.String())
+}
+
+func TestPrintGroups(t *testing.T) {
+	require := require.New(t)
+	store := storage.NewInMemoryStore()
+	prod := &storage.Secret{Name: "prod", SecretType: "ECDSA-P256"}
+	require.NoError(store.StoreSecret(prod))
+	require.NoError(store.StoreSecret(&storage.Secret{Name: "web", SecretType: "ECDSA-P256", Group: prod}))
+	require.NoError(store.StoreSecret(&storage.Secret{Name: "db", SecretType: "ECDSA-P256", Group: prod}))
+
+	var out bytes.Buffer
+	require.NoError(printGroups(&out, store))
+	require.Equal("prod: db, web\n", out.String())
+}
+
+func TestPrintFingerprints(t *testing.T) {
+	require := require.New(t)
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	sshPub, err := ssh.NewPublicKey(&pk.PublicKey)
+	require.NoError(err)
+	secrets := []*storage.Secret{
+		{Name: "group", SecretType: "GENERIC-GF256"},
+		{Name: "key", SecretType: "ECDSA-P256", PublicData: ssh.MarshalAuthorizedKey(sshPub)},
+	}
+
+	var out bytes.Buffer
+	printFingerprints(&out, secrets)
+	require.Equal(ssh.FingerprintSHA256(sshPub)+"\n", out.String())
+}
+
+func TestOpenStorageEncrypted(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "list-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.json")
+	encrypted, err := storage.NewBunkrStorage(path, storage.WithEncryption("hunter2"))
+	require.NoError(err)
+	require.NoError(encrypted.StoreSecret(&storage.Secret{Name: "deploy", SecretType: "ECDSA-P256"}))
+	passFile := filepath.Join(dir, "storage.pass")
+	require.NoError(ioutil.WriteFile(passFile, []byte("hunter2\n"), 0600))
+
+	_, err = openStorage(&options{StorageAddr: path})
+	require.Error(err)
+	agentStorage, err := openStorage(&options{StorageAddr: path, StoragePassFile: passFile})
+	require.NoError(err)
+	require.True(agentStorage.SecretExists("deploy"))
+	_, err = openStorage(&options{StorageAddr: path, StoragePassFile: filepath.Join(dir, "missing")})
+	require.Error(err)
+}
@@ -1,66 +1,397 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	ssh_agent "github.com/off-the-grid-inc/murmur/ssh-agent/ssh-agent"
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
 )
 
-var Version string
-
 func main() {
 	opts := getOpts()
 	if opts.Version {
-		fmt.Printf("Version: %s\n", Version)
+		if err := writeVersion(os.Stdout, opts.VersionJSON); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if opts.Completion != "" {
+		if err := writeCompletion(os.Stdout, opts.Completion, filepath.Base(os.Args[0]), flag.CommandLine); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if opts.GenSystemd {
+		binary, err := executablePath()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeSystemdUnits(os.Stdout, binary, flag.CommandLine); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if opts.RestoreBackup {
+		if err := storage.RestoreBackup(opts.StorageAddr); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := openStorage(opts); err != nil {
+			log.Fatalf("Restored the backup of %s but it does not load either: %v", opts.StorageAddr, err)
+		}
+		fmt.Printf("Restored %s from %s\n", opts.StorageAddr, storage.BackupPath(opts.StorageAddr))
+		return
+	}
+
+	if opts.ListNames {
+		agentStorage, err := openStorage(opts)
+		if err != nil {
+			log.Fatalf("Error loading storage: %v", err)
+		}
+		secrets, _ := agentStorage.GetSecretsLenient()
+		for _, secret := range secrets {
+			fmt.Println(secret.Name)
+		}
+		return
+	}
+
+	if opts.ListFingerprints {
+		agentStorage, err := openStorage(opts)
+		if err != nil {
+			log.Fatalf("Error loading storage: %v", err)
+		}
+		secrets, _ := agentStorage.GetSecretsLenient()
+		printFingerprints(os.Stdout, secrets)
+		return
+	}
+
+	if opts.List {
+		agentStorage, err := openStorage(opts)
+		if err != nil {
+			log.Fatalf("Error loading storage: %v", err)
+		}
+		secrets, failed := agentStorage.GetSecretsLenient()
+		for name, err := range failed {
+			log.Print(fmt.Sprintf("Skipping secret %s, it could not be decoded: %v", name, err))
+		}
+		if err := listKeys(os.Stdout, secrets); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 
+	if opts.Whois != "" {
+		agentStorage, err := openStorage(opts)
+		if err != nil {
+			log.Fatalf("Error loading storage: %v", err)
+		}
+		secret, err := agentStorage.GetSecretByFingerprint(opts.Whois)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printWhois(os.Stdout, secret)
+		return
+	}
+
+	if opts.Health {
+		report := ssh_agent.CheckHealth(opts.AgentAddr, opts.BunkrAddr, opts.HealthTimeout)
+		fmt.Println(report)
+		if report.Status != ssh_agent.HealthOK {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.AuditTail != "" {
+		since, err := parseSince(opts.Since, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		f, err := os.Open(opts.AuditTail)
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		defer f.Close()
+		if err := tailAudit(f, os.Stdout, since, true); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if opts.ListGroups {
+		agentStorage, err := openStorage(opts)
+		if err != nil {
+			log.Fatalf("Error loading storage: %v", err)
+		}
+		if err := printGroups(os.Stdout, agentStorage); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	fingerprintFormat, err := ssh_agent.ParseFingerprintFormat(opts.FingerprintFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	offerOrder, err := ssh_agent.ParseOfferOrder(opts.OfferOrder)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logLevel, err := ssh_agent.ParseLogLevel(opts.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.Trace {
+		// Requests are traced at debug level
+		logLevel = ssh_agent.LogDebug
+	}
+	logFormat, err := ssh_agent.ParseLogFormat(opts.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	agentOpts := []ssh_agent.Option{
+		ssh_agent.WithLogger(ssh_agent.NewLogger(nil, logLevel, logFormat)),
+		ssh_agent.WithSignCoalescing(opts.CoalesceWindow),
+		ssh_agent.WithTrace(opts.Trace),
+		ssh_agent.WithHostnameInComment(opts.HostComment),
+		ssh_agent.WithAllowEmpty(opts.AllowEmpty),
+		ssh_agent.WithStrict(opts.Strict),
+		ssh_agent.WithImmutableStorage(opts.Immutable),
+		ssh_agent.WithLogFingerprintFormat(fingerprintFormat),
+		ssh_agent.WithOfferOrder(offerOrder),
+		ssh_agent.WithUpstreamAgent(opts.UpstreamAgent),
+		ssh_agent.WithSignTimeout(opts.SignTimeout),
+		ssh_agent.WithBunkrTimeout(opts.BunkrTimeout),
+		ssh_agent.WithBunkrRetries(opts.BunkrRetries, ssh_agent.DefaultBunkrBackoff),
+		ssh_agent.WithStorageReadRetries(opts.ReadRetries),
+		ssh_agent.WithAuditLog(opts.AuditLog),
+		ssh_agent.WithMaxConnections(opts.MaxConnections),
+		ssh_agent.WithIdleTimeout(opts.IdleTimeout),
+		ssh_agent.WithGroups(opts.Groups...),
+		ssh_agent.WithTags(opts.Tags...),
+	}
+	for name, path := range opts.BunkrBackends {
+		agentOpts = append(agentOpts, ssh_agent.WithBunkrBackendAddr(name, path))
+	}
+	if opts.ImportBackend != "" {
+		agentOpts = append(agentOpts, ssh_agent.WithImportBackend(opts.ImportBackend))
+	}
+	for _, scoped := range opts.ScopedSockets {
+		parts := strings.SplitN(scoped, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid scoped socket %q, expected path:selector", scoped)
+		}
+		filter, err := ssh_agent.ParseKeyFilter(parts[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		agentOpts = append(agentOpts, ssh_agent.WithScopedSocket(parts[0], filter))
+	}
+
+	if opts.StartLocked {
+		if opts.LockFile == "" {
+			log.Fatal("startLocked requires lockPassphraseFile")
+		}
+		passphrase, err := ioutil.ReadFile(opts.LockFile)
+		if err != nil {
+			log.Fatalf("Error reading the lock passphrase: %v", err)
+		}
+		agentOpts = append(agentOpts,
+			ssh_agent.WithStartLocked(true),
+			ssh_agent.WithLockPassphrase(bytes.TrimRight(passphrase, "\r\n")))
+	}
+	if opts.StoragePassFile != "" {
+		passphrase, err := readStoragePassphrase(opts.StoragePassFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		agentOpts = append(agentOpts, ssh_agent.WithStorageEncryption(passphrase))
+	}
+	if opts.PeerCheck {
+		agentOpts = append(agentOpts, ssh_agent.WithPeerCheck(true, opts.AllowedUIDs...))
+	}
+	if opts.RemoteTCP {
+		agentOpts = append(agentOpts, ssh_agent.WithRemoteTCP(true))
+	}
+	if opts.StatsdAddr != "" {
+		agentOpts = append(agentOpts, ssh_agent.WithStatsd(opts.StatsdAddr, opts.StatsdPrefix))
+	}
+	if opts.MetricsAddr != "" {
+		agentOpts = append(agentOpts, ssh_agent.WithPrometheus(opts.MetricsAddr))
+	}
+	if opts.ConfirmFifo != "" {
+		parts := strings.SplitN(opts.ConfirmFifo, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid confirmation pipes %q, expected challengePath:responsePath", opts.ConfirmFifo)
+		}
+		agentOpts = append(agentOpts, ssh_agent.WithConfirmer(ssh_agent.NewFIFOConfirmer(parts[0], parts[1], opts.ConfirmTimeout)))
+	} else if opts.ConfirmCommand != "" {
+		agentOpts = append(agentOpts, ssh_agent.WithConfirmer(ssh_agent.NewCommandConfirmer(opts.ConfirmCommand, opts.ConfirmTimeout)))
+	}
+
 	ssha, err := ssh_agent.NewSSHAgent(
 		opts.BunkrAddr,
 		opts.AgentAddr,
 		opts.StorageAddr,
+		agentOpts...,
 	)
 	if err != nil {
 		log.Fatalf("Error loading ssh-agent: %v", err)
 	}
 
-	if opts.AddKey != "" {
-		if err := ssha.ImportKey(opts.AddKey); err != nil {
+	if opts.TestSign != "" {
+		if !ssha.TestSignOK(opts.TestSign) {
+			log.Fatalf("Signing with %s failed", opts.TestSign)
+		}
+		fmt.Printf("Signing with %s works\n", opts.TestSign)
+		return
+	}
+
+	if len(opts.AddKeys) > 0 {
+		var group string
+		switch len(opts.Groups) {
+		case 0:
+		case 1:
+			group = opts.Groups[0]
+		default:
+			log.Fatal("addBunkrKey takes a single group")
+		}
+		report, err := ssha.ImportKeys(opts.AddKeys, group)
+		if err != nil {
 			log.Fatal(err)
 		}
+		printReport(report)
+		if report.Failed() {
+			os.Exit(1)
+		}
 		return
 	}
 
-	if err := ssha.Start(); err != nil {
-		log.Fatalf("Error starting ssh-agent: %v", err)
+	if opts.RemoveKey != "" {
+		removed, err := ssha.RemoveStoredKey(opts.RemoveKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range removed {
+			fmt.Printf("Removed %s\n", name)
+		}
+		return
 	}
 
-	var once sync.Once
-	defer once.Do(ssha.Shutdown)
+	if opts.Manifest != "" {
+		report, err := ssha.ImportFromManifest(opts.Manifest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printReport(report)
+		if report.Failed() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.ExportAuthKeys {
+		if err := ssha.ExportAuthorizedKeys(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	var closeFileOnce sync.Once
-	closeFile := func() {
-		if err := os.Remove(opts.AgentAddr); err != nil {
-			log.Print(err)
+	if opts.ExportKey != "" {
+		path := opts.ExportPath
+		if path == "" {
+			path = opts.ExportKey + ".pub"
+		}
+		if err := ssha.ExportPublicKeyFile(opts.ExportKey, path, opts.Overwrite); err != nil {
+			log.Fatal(err)
 		}
+		return
 	}
-	defer closeFileOnce.Do(closeFile)
 
+	if err := ssha.Start(); err != nil {
+		log.Fatalf("Error starting ssh-agent: %v", err)
+	}
+
+	dumpDiagnosticsOnSignal(ssha, opts.Diagnostics)
+	reloadOnSignal(ssha)
+
+	// Cancelled on SIGINT or SIGTERM, stopping the agent and the storage
+	// watcher.
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		once.Do(ssha.Shutdown)
-		defer closeFileOnce.Do(closeFile)
-		os.Exit(-1)
-	}()
-
-	if err := ssha.Run(); err != nil {
+	ctx, cancel := cancelOnSignal(context.Background(), sigs)
+	defer cancel()
+
+	if opts.WatchStorage {
+		go func() {
+			if err := ssha.WatchStorage(ctx); err != nil {
+				log.Print(fmt.Sprintf("Not watching the storage: %v", err))
+			}
+		}()
+	}
+
+	if err := ssha.Run(ctx); err != nil {
+		if ctx.Err() == nil {
+			// Run failed before being asked to stop, clean what it set up
+			ssha.Shutdown()
+		}
 		log.Fatal(err)
 	}
 }
+
+// openStorage opens the storage configured by opts for the commands reading
+// it without starting the agent.
+func openStorage(opts *options) (*storage.AgentStorage, error) {
+	var storageOpts []storage.StorageOption
+	if opts.StoragePassFile != "" {
+		passphrase, err := readStoragePassphrase(opts.StoragePassFile)
+		if err != nil {
+			return nil, err
+		}
+		storageOpts = append(storageOpts, storage.WithEncryption(passphrase))
+	}
+	agentStorage, err := storage.NewBunkrStorage(opts.StorageAddr, storageOpts...)
+	if err != nil {
+		return nil, err
+	}
+	agentStorage.SetReadRetries(opts.ReadRetries)
+	return agentStorage, nil
+}
+
+// readStoragePassphrase reads the storage passphrase from the file path,
+// without the line ending.
+func readStoragePassphrase(path string) (string, error) {
+	passphrase, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error reading the storage passphrase: %v", err))
+	}
+	return string(bytes.TrimRight(passphrase, "\r\n")), nil
+}
+
+// printReport prints the result of every imported secret.
+func printReport(report ssh_agent.Report) {
+	for _, result := range report {
+		if result.Err != nil {
+			fmt.Printf("%s: %s (%v)\n", result.Secret, result.Status, result.Err)
+			continue
+		}
+		fmt.Printf("%s: %s\n", result.Secret, result.Status)
+	}
+}
@@ -1,34 +1,325 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	ssh_agent "github.com/off-the-grid-inc/murmur/ssh-agent/ssh-agent"
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
 )
 
+// stringList is a flag that can be repeated, collecting every value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var scopedSockets, groups, tags, addKeys, bunkrBackends stringList
+
+func init() {
+	flag.Var(&scopedSockets, "scopedSocket", "Additional socket presenting a subset of keys, as path:group=NAME,type=KEYTYPE (can be repeated)")
+	flag.Var(&addKeys, "addBunkrKey", "Import the given Bunkr secret as an ssh key, a comma separated list or repeated flags import several")
+	flag.Var(&groups, "group", "Only load the keys of this group (can be repeated), with addBunkrKey the group the imported key belongs to, it must already be stored")
+	flag.Var(&tags, "tag", "Only load the keys tagged with this tag (can be repeated), with group the keys must match both")
+	flag.Var(&bunkrBackends, "bunkrBackend", "Additional Bunkr daemon, as name=socketPath, signing with the keys imported from it (can be repeated)")
+}
+
 var (
-	bunkrSocketAddr = flag.String("bunkrSocketAddr", "/tmp/bunkr_daemon.sock", "The address where the client will run")
-	agentSocketAddr = flag.String("agentSocketAddr", "/tmp/agent.sock", "The address where the ssh-agent will run")
-	storageAddr     = flag.String("storageAddr", "~/.bunkr/agent_storage.json", "The address where the client will run")
-	version         = flag.Bool("version", false, "Show version information")
-	addKey          = flag.String("addBunkrKey", "", "Enables importing and ssh key fomr Bunkr")
+	configPath      = flag.String("config", defaultConfigPath, "JSON file of flag names and values, flags and environment variables given take precedence")
+	bunkrSocketAddr = flag.String("bunkrSocketAddr", "/tmp/bunkr_daemon.sock", "The address where the client will run (env BUNKR_SOCKET_ADDR)")
+	agentSocketAddr = flag.String("agentSocketAddr", "/tmp/agent.sock", "The address where the ssh-agent will run, a unix socket path or tcp://host:port (env AGENT_SOCKET_ADDR)")
+	storageAddr     = flag.String("storageAddr", "~/.bunkr/agent_storage.json", "The address where the client will run (env STORAGE_ADDR)")
+	completion      = flag.String("completion", "", "Print a completion script for the given shell: bash, zsh or fish")
+	completeSecrets = flag.Bool("completeSecrets", false, "Print the names of the stored secrets, used by the completion scripts")
+	completeFps     = flag.Bool("completeFingerprints", false, "Print the SHA256 fingerprints of the stored keys, used by the completion scripts")
+	genSystemd      = flag.Bool("genSystemd", false, "Print a systemd user service and socket unit running the agent with the given flags")
+	showVersion     = flag.Bool("version", false, "Show version information")
+	versionJSON     = flag.Bool("json", false, "With version, print the version information as JSON")
+	removeKey       = flag.String("removeBunkrKey", "", "Remove a stored key, and the keys of its group members, unloading them from the running agent")
+	logLevel        = flag.String("logLevel", "info", "Lowest severity logged: debug, info, warn or error")
+	logFormat       = flag.String("logFormat", "text", "Format of the log messages: text or json")
+	auditLog        = flag.String("auditLog", "", "Append a JSON line describing every sign request to this file")
+	auditTail       = flag.String("auditTail", "", "Follow the given audit log printing its entries in a readable format")
+	since           = flag.String("since", "", "Only show audit entries newer than a duration (e.g. 1h) or an RFC3339 time")
+	health          = flag.Bool("health", false, "Check that the running agent answers and Bunkr is reachable, exiting with status 1 if not")
+	healthTimeout   = flag.Duration("healthTimeout", 5*time.Second, "Maximum time each health check may take")
+	testSign        = flag.String("testSign", "", "Check that Bunkr signs with the given stored key and exit")
+	importManifest  = flag.String("importManifest", "", "Import every key described by the given JSON manifest")
+	listGroups      = flag.Bool("groups", false, "List the groups defined in the storage and their members")
+	listStored      = flag.Bool("list", false, "List the stored keys with their type, group and fingerprint without starting the agent")
+	exportKey       = flag.String("exportKey", "", "Name of the stored key to export as an OpenSSH public key file")
+	exportPath      = flag.String("exportPath", "", "The file where the exported public key will be written")
+	exportAuthKeys  = flag.Bool("exportAuthorizedKeys", false, "Print the public keys of every stored secret in authorized_keys format")
+	whois           = flag.String("whois", "", "Print the name and group of the stored secret with the given SHA256 fingerprint")
+	restoreBackup   = flag.Bool("restoreBackup", false, "Swap the storage file with the backup made before its last write")
+	overwrite       = flag.Bool("overwrite", false, "Allow exportKey to replace an existing file")
+	upstreamAgent   = flag.String("upstreamAgent", "", "Socket of another ssh-agent whose keys are also served")
+	readRetries     = flag.Int("storageReadRetries", storage.DefaultReadRetries, "Times a storage read failing with a transient error is retried")
+	startLocked     = flag.Bool("startLocked", false, "Start locked, presenting no keys until unlocked (ssh-add -X) with the lockPassphraseFile passphrase")
+	lockPassphrase  = flag.String("lockPassphraseFile", "", "File holding the passphrase the agent is locked with on startup")
+	storagePassFile = flag.String("storagePassphraseFile", "", "File holding the passphrase the storage file is encrypted with, a plaintext storage is encrypted when next written")
+	importBackend   = flag.String("importBackend", "", "With addBunkrKey or importManifest, import from the bunkrBackend of this name instead of bunkrSocketAddr")
+	remoteTCP       = flag.Bool("allowRemoteTCP", false, "Allow a tcp:// agentSocketAddr that is not a loopback address, the agent protocol is not encrypted")
+	peerCheck       = flag.Bool("checkPeerUID", false, "Only serve unix socket clients running as the agent user or one of allowedUIDs (Linux only)")
+	allowedUIDs     = flag.String("allowedUIDs", "", "Comma separated user ids checkPeerUID lets connect instead of the agent user")
+	watchStorage    = flag.Bool("watchStorage", false, "Reload the keys when the storage file changes on disk")
+	immutable       = flag.Bool("immutableStorage", false, "Reject any change to the storage file")
+	confirmFifo     = flag.String("confirmFifo", "", "Approve signatures through the named pipes challengePath:responsePath")
+	confirmCommand  = flag.String("confirmCommand", ssh_agent.DefaultConfirmCommand(), "Program approving signatures by exiting with status 0, SSH_ASKPASS by default (confirmFifo takes precedence)")
+	confirmTimeout  = flag.Duration("confirmTimeout", 30*time.Second, "Time to wait for a signature approval before denying it")
+	statsdAddr      = flag.String("statsdAddr", "", "Send metrics to the statsd server at this UDP address")
+	metricsAddr     = flag.String("metricsAddr", "", "Serve Prometheus metrics on http://ADDR/metrics, e.g. 127.0.0.1:9100")
+	statsdPrefix    = flag.String("statsdPrefix", "bunkr_agent", "Prefix of the metric names sent to statsd")
+	signTimeout     = flag.Duration("signTimeout", 0, "Maximum time Bunkr may take to sign, unless the key sets its own (0 uses bunkrTimeout)")
+	bunkrRetries    = flag.Int("bunkrRetries", ssh_agent.DefaultBunkrRetries, "Times a Bunkr call is attempted while the daemon can not be reached, e.g. restarting")
+	bunkrTimeout    = flag.Duration("bunkrTimeout", ssh_agent.DefaultBunkrTimeout, "Maximum time any Bunkr call may take (0 waits forever)")
+	maxConnections  = flag.Int("maxConnections", ssh_agent.DefaultMaxConnections, "Connections served at once, further ones are closed after waiting a second (0 is unlimited)")
+	idleTimeout     = flag.Duration("idleTimeout", 0, "Close agent connections on which no request arrived for this long (0 keeps them open)")
+	allowEmpty      = flag.Bool("allowEmpty", false, "Keep serving even if no keys could be loaded at startup")
+	fingerprintFmt  = flag.String("logFingerprintFormat", "sha256", "How key fingerprints are shown in logs: sha256, sha256-hex or md5")
+	strict          = flag.Bool("strict", false, "Fail instead of warning on unsafe setups, like a storage file owned by another user")
+	hostnameComment = flag.Bool("hostnameInComment", false, "Append the host name to the comment of the listed keys")
+	diagnostics     = flag.String("diagnosticsPath", defaultDiagnosticsPath(), "File the agent state is written to on SIGUSR2")
+	offerOrder      = flag.String("offerOrder", "default", "Order keys are offered in: default, or lru for the most recently used first")
+	trace           = flag.Bool("trace", false, "Log every agent protocol request and its outcome, implies -logLevel debug")
+	coalesceWindow  = flag.Duration("signCoalesceWindow", 0, "Group sign requests for the same key arriving within this window into one Bunkr call (0 disables it)")
 )
 
 type options struct {
 	BunkrAddr   string
 	AgentAddr   string
 	StorageAddr string
-	AddKey      string
+	AddKeys     []string
+	RemoveKey   string
+	Manifest    string
+	TestSign    string
+	ListGroups  bool
+	ListNames   bool
+	List        bool
+	AuditLog    string
+	Health      bool
+	LogLevel    string
+	LogFormat   string
+	AuditTail   string
+	Since       string
+	ExportKey   string
+	ExportPath  string
+	Overwrite   bool
 	Version     bool
+	Completion  string
+	GenSystemd  bool
+	Trace       bool
+	HostComment bool
+	Diagnostics string
+	AllowEmpty  bool
+	Strict      bool
+	Immutable   bool
+	StartLocked bool
+	LockFile    string
+
+	FingerprintFormat string
+	OfferOrder        string
+	CoalesceWindow    time.Duration
+	ScopedSockets     []string
+	UpstreamAgent     string
+	ConfirmFifo       string
+	ConfirmCommand    string
+	ConfirmTimeout    time.Duration
+	StatsdAddr        string
+	StatsdPrefix      string
+	MetricsAddr       string
+	SignTimeout       time.Duration
+	BunkrTimeout      time.Duration
+	BunkrRetries      int
+	ReadRetries       int
+	WatchStorage      bool
+	RemoteTCP         bool
+	PeerCheck         bool
+	AllowedUIDs       []uint32
+	HealthTimeout     time.Duration
+	MaxConnections    int
+	IdleTimeout       time.Duration
+	Groups            []string
+	Tags              []string
+	ExportAuthKeys    bool
+	Whois             string
+	RestoreBackup     bool
+	VersionJSON       bool
+	ListFingerprints  bool
+	StoragePassFile   string
+	BunkrBackends     map[string]string
+	ImportBackend     string
 }
 
 func getOpts() *options {
 
 	flag.Parse()
+	set := setFlags(flag.CommandLine)
+	configRequired := set["config"]
+	if err := applyEnv(flag.CommandLine, os.LookupEnv, set); err != nil {
+		log.Fatal(err)
+	}
+	config, err := storage.ExpandPath(*configPath)
+	if err != nil {
+		log.Fatalf("Error expanding path %s: %v", *configPath, err)
+	}
+	if err := applyConfig(flag.CommandLine, config, configRequired, set); err != nil {
+		log.Fatal(err)
+	}
+
 	opts := &options{
 		BunkrAddr:   *bunkrSocketAddr,
 		AgentAddr:   *agentSocketAddr,
 		StorageAddr: *storageAddr,
-		AddKey:      *addKey,
-		Version:     *version,
+		AddKeys:     splitList(addKeys),
+		RemoveKey:   *removeKey,
+		Manifest:    *importManifest,
+		TestSign:    *testSign,
+		ListGroups:  *listGroups,
+		ListNames:   *completeSecrets,
+		List:        *listStored,
+		AuditLog:    *auditLog,
+		Health:      *health,
+		LogLevel:    *logLevel,
+		LogFormat:   *logFormat,
+		AuditTail:   *auditTail,
+		Since:       *since,
+		ExportKey:   *exportKey,
+		ExportPath:  *exportPath,
+		Overwrite:   *overwrite,
+		Version:     *showVersion,
+		Completion:  *completion,
+		GenSystemd:  *genSystemd,
+		Trace:       *trace,
+		HostComment: *hostnameComment,
+		Diagnostics: *diagnostics,
+		AllowEmpty:  *allowEmpty,
+		Strict:      *strict,
+		Immutable:   *immutable,
+		StartLocked: *startLocked,
+		LockFile:    *lockPassphrase,
+
+		FingerprintFormat: *fingerprintFmt,
+		OfferOrder:        *offerOrder,
+		CoalesceWindow:    *coalesceWindow,
+		ScopedSockets:     scopedSockets,
+		UpstreamAgent:     *upstreamAgent,
+		ConfirmFifo:       *confirmFifo,
+		ConfirmCommand:    *confirmCommand,
+		ConfirmTimeout:    *confirmTimeout,
+		StatsdAddr:        *statsdAddr,
+		StatsdPrefix:      *statsdPrefix,
+		MetricsAddr:       *metricsAddr,
+		SignTimeout:       *signTimeout,
+		BunkrTimeout:      *bunkrTimeout,
+		BunkrRetries:      *bunkrRetries,
+		ReadRetries:       *readRetries,
+		WatchStorage:      *watchStorage,
+		RemoteTCP:         *remoteTCP,
+		PeerCheck:         *peerCheck,
+		HealthTimeout:     *healthTimeout,
+		MaxConnections:    *maxConnections,
+		IdleTimeout:       *idleTimeout,
+		Groups:            groups,
+		Tags:              tags,
+		ExportAuthKeys:    *exportAuthKeys,
+		Whois:             *whois,
+		RestoreBackup:     *restoreBackup,
+		VersionJSON:       *versionJSON,
+		ListFingerprints:  *completeFps,
+		StoragePassFile:   *storagePassFile,
+		ImportBackend:     *importBackend,
+	}
+	if opts.AllowedUIDs, err = parseUIDs(*allowedUIDs); err != nil {
+		log.Fatal(err)
+	}
+	if opts.BunkrBackends, err = parseBackends(bunkrBackends); err != nil {
+		log.Fatal(err)
+	}
+	for name, path := range opts.BunkrBackends {
+		expanded, err := storage.ExpandPath(path)
+		if err != nil {
+			log.Fatalf("Error expanding path %s: %v", path, err)
+		}
+		opts.BunkrBackends[name] = expanded
+	}
+	for _, path := range []*string{&opts.BunkrAddr, &opts.AgentAddr, &opts.StorageAddr, &opts.AuditLog, &opts.Diagnostics, &opts.StoragePassFile} {
+		expanded, err := storage.ExpandPath(*path)
+		if err != nil {
+			log.Fatalf("Error expanding path %s: %v", *path, err)
+		}
+		*path = expanded
 	}
 	return opts
 }
+
+// defaultDiagnosticsPath is in the runtime directory of the user, or the
+// storage directory without one, never in the temporary directory shared
+// with the other users.
+func defaultDiagnosticsPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "bunkr-agent-diagnostics.json")
+	}
+	return "~/.bunkr/agent-diagnostics.json"
+}
+
+// splitList returns the values of a repeatable flag, each of which may be a
+// comma separated list.
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				list = append(list, field)
+			}
+		}
+	}
+	return list
+}
+
+// parseUIDs parses a comma separated list of user ids.
+func parseUIDs(list string) ([]uint32, error) {
+	var uids []uint32
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		uid, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid user id %q", field))
+		}
+		uids = append(uids, uint32(uid))
+	}
+	return uids, nil
+}
+
+// parseBackends parses the name=socketPath values of -bunkrBackend into the
+// socket paths by backend name.
+func parseBackends(values []string) (map[string]string, error) {
+	backends := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid Bunkr backend %q, expected name=socketPath", value))
+		}
+		if _, ok := backends[parts[0]]; ok {
+			return nil, errors.New(fmt.Sprintf("Bunkr backend %s is given twice", parts[0]))
+		}
+		backends[parts[0]] = parts[1]
+	}
+	return backends, nil
+}
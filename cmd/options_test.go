@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUIDs(t *testing.T) {
+	require := require.New(t)
+	uids, err := parseUIDs("1000, 1001,")
+	require.NoError(err)
+	require.Equal([]uint32{1000, 1001}, uids)
+	uids, err = parseUIDs("")
+	require.NoError(err)
+	require.Empty(uids)
+	_, err = parseUIDs("1000,root")
+	require.EqualError(err, `Invalid user id "root"`)
+}
+
+func TestSplitList(t *testing.T) {
+	require := require.New(t)
+	require.Equal([]string{"a", "b", "c"}, splitList([]string{"a, b", "c", ""}))
+	require.Empty(splitList(nil))
+}
+
+func TestParseBackends(t *testing.T) {
+	require := require.New(t)
+	backends, err := parseBackends([]string{"office=/run/bunkr/office.sock", "lab=~/lab.sock"})
+	require.NoError(err)
+	require.Equal(map[string]string{"office": "/run/bunkr/office.sock", "lab": "~/lab.sock"}, backends)
+	_, err = parseBackends([]string{"office"})
+	require.EqualError(err, `Invalid Bunkr backend "office", expected name=socketPath`)
+	_, err = parseBackends([]string{"=/run/bunkr.sock"})
+	require.Error(err)
+	_, err = parseBackends([]string{"office=/a.sock", "office=/b.sock"})
+	require.EqualError(err, "Bunkr backend office is given twice")
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	ssh_agent "github.com/off-the-grid-inc/murmur/ssh-agent/ssh-agent"
+)
+
+// reloadOnSignal reloads the agent keys from the storage every time the
+// process receives SIGHUP.
+func reloadOnSignal(ssha *ssh_agent.SSHAgent) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			if err := ssha.Reload(); err != nil {
+				log.Print(fmt.Sprintf("Could not reload the keys: %v", err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	ssh_agent "github.com/off-the-grid-inc/murmur/ssh-agent/ssh-agent"
+)
+
+// reloadOnSignal does nothing on Windows, which has no SIGHUP.
+func reloadOnSignal(ssha *ssh_agent.SSHAgent) {}
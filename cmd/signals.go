@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+)
+
+// cancelOnSignal returns a context cancelled when the first signal arrives on
+// sigs. Later signals are ignored, the shutdown is already under way, so a
+// repeated Ctrl-C does not interrupt it.
+func cancelOnSignal(parent context.Context, sigs <-chan os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Print(fmt.Sprintf("Received %v, shutting down", sig))
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		for range sigs {
+			log.Print("Already shutting down")
+		}
+	}()
+	return ctx, cancel
+}
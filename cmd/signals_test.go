@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveUntilDone listens on path until ctx is done, then removes the socket
+// like the agent does when stopped.
+func serveUntilDone(ctx context.Context, path string) error {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	l.Close()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func TestCancelOnSignal(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "signals-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.sock")
+
+	sigs := make(chan os.Signal)
+	ctx, cancel := cancelOnSignal(context.Background(), sigs)
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() {
+		ran <- serveUntilDone(ctx, path)
+	}()
+	require.Eventually(func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	sigs <- syscall.SIGINT
+	// A second Ctrl-C while stopping is ignored
+	sigs <- syscall.SIGINT
+	select {
+	case err := <-ran:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the signal did not stop the agent")
+	}
+	_, err = os.Stat(path)
+	require.True(os.IsNotExist(err))
+}
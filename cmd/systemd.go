@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+// systemdUnitName is the name of the generated service and socket units.
+const systemdUnitName = "bunkr-ssh-agent"
+
+// pathFlags are the flags holding paths, resolved to absolute paths in the
+// generated units as systemd does not expand them.
+var pathFlags = map[string]bool{
+	"bunkrSocketAddr": true,
+	"agentSocketAddr": true,
+	"storageAddr":     true,
+}
+
+// tcpAddrPrefix marks a TCP agent address, which is not a path.
+const tcpAddrPrefix = "tcp://"
+
+// writeSystemdUnits prints a systemd user service running binary with the
+// configuration of fs, and the socket unit activating it on the agent socket.
+func writeSystemdUnits(w io.Writer, binary string, fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var args []string
+	var agentSocket string
+	var resolveErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if oneOffFlags[f.Name] || (!set[f.Name] && !pathFlags[f.Name]) {
+			return
+		}
+		value := f.Value.String()
+		if f.Name == "agentSocketAddr" && strings.HasPrefix(value, tcpAddrPrefix) {
+			resolveErr = errors.New(fmt.Sprintf("Cannot generate units for the TCP agent address %s: socket activation only supports a unix socket agentSocketAddr", value))
+			return
+		}
+		if pathFlags[f.Name] && !strings.HasPrefix(value, tcpAddrPrefix) {
+			resolved, err := resolvePath(value)
+			if err != nil {
+				resolveErr = err
+				return
+			}
+			value = resolved
+		}
+		if f.Name == "agentSocketAddr" {
+			agentSocket = value
+		}
+		if list, ok := f.Value.(*stringList); ok {
+			// Repeatable flags are given once per value
+			for _, v := range *list {
+				args = append(args, fmt.Sprintf("-%s=%s", f.Name, v))
+			}
+			return
+		}
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, value))
+	})
+	if resolveErr != nil {
+		return resolveErr
+	}
+	sort.Strings(args)
+	command := []string{systemdQuote(binary)}
+	for _, arg := range args {
+		command = append(command, systemdQuote(arg))
+	}
+
+	fmt.Fprintf(w, "# %s.socket\n", systemdUnitName)
+	fmt.Fprintf(w, "[Unit]\n")
+	fmt.Fprintf(w, "Description=Bunkr ssh-agent socket\n\n")
+	fmt.Fprintf(w, "[Socket]\n")
+	fmt.Fprintf(w, "ListenStream=%s\n", strings.Replace(agentSocket, "%", "%%", -1))
+	fmt.Fprintf(w, "SocketMode=0600\n")
+	fmt.Fprintf(w, "DirectoryMode=0700\n\n")
+	fmt.Fprintf(w, "[Install]\n")
+	fmt.Fprintf(w, "WantedBy=sockets.target\n\n")
+
+	fmt.Fprintf(w, "# %s.service\n", systemdUnitName)
+	fmt.Fprintf(w, "[Unit]\n")
+	fmt.Fprintf(w, "Description=Bunkr ssh-agent\n")
+	fmt.Fprintf(w, "Requires=%s.socket\n", systemdUnitName)
+	fmt.Fprintf(w, "After=%s.socket\n\n", systemdUnitName)
+	fmt.Fprintf(w, "[Service]\n")
+	fmt.Fprintf(w, "ExecStart=%s\n", strings.Join(command, " "))
+	fmt.Fprintf(w, "Restart=on-failure\n\n")
+	fmt.Fprintf(w, "[Install]\n")
+	fmt.Fprintf(w, "Also=%s.socket\n", systemdUnitName)
+	fmt.Fprintf(w, "WantedBy=default.target\n")
+	return nil
+}
+
+// systemdQuote quotes arg for an ExecStart line when it has characters
+// systemd splits or unescapes on, and escapes the specifiers and variables
+// systemd would otherwise expand.
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`).Replace(arg) + `"`
+}
+
+// resolvePath expands p like the agent does and makes it absolute.
+func resolvePath(p string) (string, error) {
+	expanded, err := storage.ExpandPath(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(expanded)
+}
+
+// executablePath returns the absolute path of the running binary.
+func executablePath() (string, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(binary)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSystemdUnits(t *testing.T) {
+	require := require.New(t)
+	home, err := os.UserHomeDir()
+	require.NoError(err)
+
+	fs := flag.NewFlagSet("bssh-agent", flag.ContinueOnError)
+	fs.String("bunkrSocketAddr", "/tmp/bunkr_daemon.sock", "")
+	fs.String("agentSocketAddr", "/tmp/agent.sock", "")
+	fs.String("storageAddr", "~/.bunkr/agent_storage.json", "")
+	fs.Bool("trace", false, "")
+	fs.Duration("signTimeout", 0, "")
+	fs.Bool("genSystemd", false, "")
+	require.NoError(fs.Parse([]string{
+		"-agentSocketAddr", "/run/user/1000/bunkr/agent.sock",
+		"-signTimeout", "5s",
+		"-genSystemd",
+	}))
+
+	var out bytes.Buffer
+	require.NoError(writeSystemdUnits(&out, "/usr/local/bin/bssh-agent", fs))
+	units := out.String()
+
+	storage := filepath.Join(home, ".bunkr", "agent_storage.json")
+	require.Contains(units, "ListenStream=/run/user/1000/bunkr/agent.sock\n")
+	require.Contains(units, "Requires=bunkr-ssh-agent.socket\n")
+	require.Contains(units, "ExecStart=/usr/local/bin/bssh-agent "+
+		"-agentSocketAddr=/run/user/1000/bunkr/agent.sock "+
+		"-bunkrSocketAddr=/tmp/bunkr_daemon.sock "+
+		"-signTimeout="+(5*time.Second).String()+" "+
+		"-storageAddr="+storage+"\n")
+	require.NotContains(units, "-genSystemd")
+	require.NotContains(units, "-trace")
+}
+
+func TestWriteSystemdUnitsTCP(t *testing.T) {
+	require := require.New(t)
+	fs := flag.NewFlagSet("bssh-agent", flag.ContinueOnError)
+	fs.String("agentSocketAddr", "/tmp/agent.sock", "")
+	require.NoError(fs.Parse([]string{"-agentSocketAddr", "tcp://127.0.0.1:4444"}))
+
+	// A socket activated TCP address would skip the checks of tcp:// addresses
+	var out bytes.Buffer
+	err := writeSystemdUnits(&out, "/usr/local/bin/bssh-agent", fs)
+	require.Error(err)
+	require.Contains(err.Error(), "tcp://127.0.0.1:4444")
+}
+
+func TestWriteSystemdUnitsQuoting(t *testing.T) {
+	require := require.New(t)
+	fs := flag.NewFlagSet("bssh-agent", flag.ContinueOnError)
+	fs.String("agentSocketAddr", "/tmp/agent.sock", "")
+	fs.String("confirmCommand", "", "")
+	fs.Bool("list", false, "")
+	fs.Bool("removeBunkrKey", false, "")
+	require.NoError(fs.Parse([]string{
+		"-agentSocketAddr", "/tmp/100%/agent.sock",
+		"-confirmCommand", `/opt/my tools/confirm "$USER"`,
+		"-list", "-removeBunkrKey",
+	}))
+
+	var out bytes.Buffer
+	require.NoError(writeSystemdUnits(&out, "/opt/bunkr agent/bssh-agent", fs))
+	units := out.String()
+	require.Contains(units, "ListenStream=/tmp/100%%/agent.sock\n")
+	require.Contains(units, `ExecStart="/opt/bunkr agent/bssh-agent" -agentSocketAddr=/tmp/100%%/agent.sock "-confirmCommand=/opt/my tools/confirm \"$$USER\""`+"\n")
+	require.NotContains(units, "-list")
+	require.NotContains(units, "-removeBunkrKey")
+}
+
+func TestWriteSystemdUnitsRepeatedFlags(t *testing.T) {
+	require := require.New(t)
+	fs := flag.NewFlagSet("bssh-agent", flag.ContinueOnError)
+	fs.String("agentSocketAddr", "/tmp/agent.sock", "")
+	var groups stringList
+	fs.Var(&groups, "group", "")
+	require.NoError(fs.Parse([]string{"-agentSocketAddr", "/tmp/agent.sock", "-group", "ci", "-group", "deploy"}))
+
+	var out bytes.Buffer
+	require.NoError(writeSystemdUnits(&out, "/usr/local/bin/bssh-agent", fs))
+	require.Contains(out.String(), "ExecStart=/usr/local/bin/bssh-agent -agentSocketAddr=/tmp/agent.sock -group=ci -group=deploy\n")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// version, commit and buildDate describe the build, they are set with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...",
+// see the Makefile.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// versionInfo is what -version prints.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+func currentVersion() versionInfo {
+	return versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// writeVersion prints the build information, as a JSON object if asJSON.
+func writeVersion(w io.Writer, asJSON bool) error {
+	info := currentVersion()
+	if asJSON {
+		return json.NewEncoder(w).Encode(info)
+	}
+	_, err := fmt.Fprintf(w, "Version:    %s\nCommit:     %s\nBuild date: %s\nGo version: %s\nPlatform:   %s\n",
+		info.Version, orUnknown(info.Commit), orUnknown(info.BuildDate), info.GoVersion, info.Platform)
+	return err
+}
+
+// orUnknown returns value, or "unknown" for the build information not set.
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteVersion(t *testing.T) {
+	require := require.New(t)
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.2.0", "3f2c1ab", "2024-03-01T12:00:00Z"
+
+	var out bytes.Buffer
+	require.NoError(writeVersion(&out, false))
+	text := out.String()
+	require.Contains(text, "Version:    1.2.0\n")
+	require.Contains(text, "Commit:     3f2c1ab\n")
+	require.Contains(text, "Build date: 2024-03-01T12:00:00Z\n")
+	require.Contains(text, runtime.Version())
+	require.Contains(text, runtime.GOOS+"/"+runtime.GOARCH)
+
+	out.Reset()
+	require.NoError(writeVersion(&out, true))
+	var info versionInfo
+	require.NoError(json.Unmarshal(out.Bytes(), &info))
+	require.Equal("3f2c1ab", info.Commit)
+	require.Equal("1.2.0", info.Version)
+	require.Equal(runtime.Version(), info.GoVersion)
+
+	// A build without the metadata says so
+	commit, buildDate = "", ""
+	out.Reset()
+	require.NoError(writeVersion(&out, false))
+	require.True(strings.Contains(out.String(), "Commit:     unknown\n"))
+}
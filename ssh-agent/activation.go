@@ -0,0 +1,32 @@
+package ssh_agent
+
+import (
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFdsStart = 3
+
+// activationListener returns the socket passed by systemd socket activation,
+// or nil if the agent was not started that way.
+func activationListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	// The variables are meant for this process only
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
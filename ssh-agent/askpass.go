@@ -0,0 +1,67 @@
+package ssh_agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// commandConfirmer approves signatures by running an askpass style program,
+// the signature proceeds only if it exits with status 0. Like OpenSSH the
+// program gets the prompt as its only argument and SSH_ASKPASS_PROMPT=confirm
+// in its environment, the fingerprint and comment are also passed as
+// BUNKR_AGENT_FINGERPRINT and BUNKR_AGENT_COMMENT. A program still running
+// after the timeout is killed and the signature denied. Only one
+// confirmation is in progress at a time.
+type commandConfirmer struct {
+	command string
+	timeout time.Duration
+	logger  *Logger
+
+	mu sync.Mutex
+}
+
+// NewCommandConfirmer returns a Confirmer running command to approve each
+// signature.
+func NewCommandConfirmer(command string, timeout time.Duration) Confirmer {
+	return &commandConfirmer{command: command, timeout: timeout}
+}
+
+// DefaultConfirmCommand returns the program set in SSH_ASKPASS, if any.
+func DefaultConfirmCommand() string {
+	return os.Getenv("SSH_ASKPASS")
+}
+
+func (c *commandConfirmer) setLogger(l *Logger) {
+	c.logger = l
+}
+
+func (c *commandConfirmer) Confirm(fingerprint, comment string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	prompt := fmt.Sprintf("Allow use of key %s?\nKey fingerprint %s.", comment, fingerprint)
+	cmd := exec.CommandContext(ctx, c.command, prompt)
+	cmd.Env = append(os.Environ(),
+		"SSH_ASKPASS_PROMPT=confirm",
+		"BUNKR_AGENT_FINGERPRINT="+fingerprint,
+		"BUNKR_AGENT_COMMENT="+comment,
+	)
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		c.logger.Warn(fmt.Sprintf("Confirmation for %s timed out, denying", fingerprint))
+		return false
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			c.logger.Error(fmt.Sprintf("Could not run confirmation command %s: %v", c.command, err))
+		}
+		return false
+	}
+	return true
+}
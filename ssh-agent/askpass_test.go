@@ -0,0 +1,71 @@
+package ssh_agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeAskpass writes an executable shell script with body to dir.
+func writeAskpass(t *testing.T, dir, name, body string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700))
+	return path
+}
+
+func TestCommandConfirmer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("askpass scripts are shell scripts")
+	}
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "askpass-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	seen := filepath.Join(dir, "seen")
+	approve := writeAskpass(t, dir, "approve", `printf '%s|%s|%s' "$SSH_ASKPASS_PROMPT" "$BUNKR_AGENT_FINGERPRINT" "$1" > `+seen)
+	require.True(NewCommandConfirmer(approve, time.Second).Confirm("SHA256:abc", "deploy"))
+	b, err := ioutil.ReadFile(seen)
+	require.NoError(err)
+	require.Equal("confirm|SHA256:abc|Allow use of key deploy?\nKey fingerprint SHA256:abc.", string(b))
+
+	deny := writeAskpass(t, dir, "deny", "exit 1")
+	require.False(NewCommandConfirmer(deny, time.Second).Confirm("SHA256:abc", "deploy"))
+
+	slow := writeAskpass(t, dir, "slow", "exec sleep 5")
+	start := time.Now()
+	require.False(NewCommandConfirmer(slow, 100*time.Millisecond).Confirm("SHA256:abc", "deploy"))
+	require.True(time.Since(start) < 2*time.Second)
+
+	require.False(NewCommandConfirmer(filepath.Join(dir, "missing"), time.Second).Confirm("SHA256:abc", "deploy"))
+}
+
+func TestCommandConfirmerSign(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("askpass scripts are shell scripts")
+	}
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "guarded")
+	confirm := true
+	secret.ConfirmBeforeUse = &confirm
+	secret.RequireConfirm = true
+	require.NoError(ssha.AddKey(secret))
+
+	WithConfirmer(NewCommandConfirmer(writeAskpass(t, dir, "deny", "exit 1"), time.Second))(ssha)
+	_, err := ssha.Agent.Sign(pub, []byte("data"))
+	require.Error(err)
+
+	WithConfirmer(NewCommandConfirmer(writeAskpass(t, dir, "approve", "exit 0"), time.Second))(ssha)
+	_, err = ssha.Agent.Sign(pub, []byte("data"))
+	require.NoError(err)
+}
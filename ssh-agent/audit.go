@@ -0,0 +1,112 @@
+package ssh_agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AuditEntry is a record of one sign operation, written as a JSON line to the
+// audit log. It never contains the signed data nor the signature.
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	Fingerprint string    `json:"fingerprint"`
+	Comment     string    `json:"comment,omitempty"`
+	Algorithm   string    `json:"algorithm"`
+	DataLength  int       `json:"data_length"`
+	Peer        string    `json:"peer,omitempty"`
+	Success     bool      `json:"success"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// auditLog appends audit entries to a file. Every entry is written with a
+// single unbuffered write, so the entries logged before a crash are kept.
+type auditLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	logger *Logger
+}
+
+// openAuditLog opens path for appending, creating it readable only by the
+// user if needed.
+func openAuditLog(path string, logger *Logger) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error opening the audit log %s: %v", path, err))
+	}
+	return &auditLog{w: f, logger: logger}, nil
+}
+
+func (l *auditLog) record(entry *AuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		l.logger.Error(fmt.Sprintf("Error encoding audit entry: %v", err))
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		l.logger.Error(fmt.Sprintf("Error writing audit entry: %v", err))
+	}
+}
+
+// auditingAgent wraps the BunkrAgent serving one connection recording every
+// sign request to the audit log together with the peer of the connection.
+type auditingAgent struct {
+	BunkrAgent
+	ssha *SSHAgent
+	peer string
+}
+
+func newAuditingAgent(a BunkrAgent, ssha *SSHAgent, peer string) *auditingAgent {
+	return &auditingAgent{a, ssha, peer}
+}
+
+func (a *auditingAgent) audit(key ssh.PublicKey, data []byte, flags SignatureFlags, err error) {
+	entry := &AuditEntry{
+		Time:        time.Now().UTC(),
+		Fingerprint: a.ssha.fingerprintFormat.Fingerprint(key),
+		Algorithm:   signAlgorithm(key, flags),
+		DataLength:  len(data),
+		Peer:        a.peer,
+		Success:     err == nil,
+	}
+	if kr, ok := a.ssha.Agent.(*keyring); ok {
+		entry.Comment = kr.comment(key)
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	a.ssha.auditLog.record(entry)
+}
+
+func (a *auditingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	sig, err := a.BunkrAgent.Sign(key, data)
+	a.audit(key, data, 0, err)
+	return sig, err
+}
+
+func (a *auditingAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error) {
+	extended, ok := a.BunkrAgent.(agent.ExtendedAgent)
+	if !ok {
+		return a.Sign(key, data)
+	}
+	sig, err := extended.SignWithFlags(key, data, flags)
+	a.audit(key, data, flags, err)
+	return sig, err
+}
+
+func (a *auditingAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	extended, ok := a.BunkrAgent.(agent.ExtendedAgent)
+	if !ok {
+		return nil, ErrExtensionUnsupported
+	}
+	return extended.Extension(extensionType, contents)
+}
@@ -0,0 +1,103 @@
+package ssh_agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestAuditLogSign(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+	path := filepath.Join(dir, "audit.log")
+	auditLog, err := openAuditLog(path, nil)
+	require.NoError(err)
+	ssha.auditLog = auditLog
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	require.NoError(ssha.Agent.Add(AddedKey{PrivateKey: key, Comment: "work"}))
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	require.NoError(err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	otherPub, err := ssh.NewPublicKey(&other.PublicKey)
+	require.NoError(err)
+
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+	require.NoError(ssha.WaitReady(ctx))
+	conn := dialTestAgent(t, ssha.agentSocketPath)
+	client := agent.NewClient(conn)
+	_, err = client.Sign(pub, []byte("secret payload"))
+	require.NoError(err)
+	_, err = client.Sign(otherPub, []byte("secret payload"))
+	require.Error(err)
+	conn.Close()
+	require.NoError(ssha.Stop())
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.NotContains(string(content), "secret payload")
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(lines, 2)
+
+	var ok AuditEntry
+	require.NoError(json.Unmarshal([]byte(lines[0]), &ok))
+	require.True(ok.Success)
+	require.Equal(ssh.FingerprintSHA256(pub), ok.Fingerprint)
+	require.Equal("work", ok.Comment)
+	require.Equal(ssh.KeyAlgoECDSA256, ok.Algorithm)
+	require.Equal(len("secret payload"), ok.DataLength)
+	if runtime.GOOS == "linux" {
+		require.Contains(ok.Peer, "pid=")
+	}
+	require.WithinDuration(time.Now(), ok.Time, time.Minute)
+
+	var failed AuditEntry
+	require.NoError(json.Unmarshal([]byte(lines[1]), &failed))
+	require.False(failed.Success)
+	require.Equal(ssh.FingerprintSHA256(otherPub), failed.Fingerprint)
+	require.NotEmpty(failed.Error)
+}
+
+func TestAuditLogFingerprintFormat(t *testing.T) {
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+	ssha.fingerprintFormat = FingerprintMD5
+	path := filepath.Join(dir, "audit.log")
+	auditLog, err := openAuditLog(path, nil)
+	require.NoError(err)
+	ssha.auditLog = auditLog
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	require.NoError(ssha.Agent.Add(AddedKey{PrivateKey: key}))
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	require.NoError(err)
+	_, err = newAuditingAgent(ssha.Agent, ssha, "").Sign(pub, []byte("data"))
+	require.NoError(err)
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	var entry AuditEntry
+	require.NoError(json.Unmarshal(content, &entry))
+	require.Equal("MD5:"+ssh.FingerprintLegacyMD5(pub), entry.Fingerprint)
+}
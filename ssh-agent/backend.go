@@ -0,0 +1,206 @@
+package ssh_agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	bunkr_client "github.com/off-the-grid-inc/bunkr-client"
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+// defaultBackendRetryInterval is how often a Bunkr backend unreachable when
+// the keys were loaded is tried again.
+const defaultBackendRetryInterval = 30 * time.Second
+
+// bunkrBackend is a Bunkr daemon other than the default one, holding the
+// secrets stored with its name, see storage.Secret.Backend.
+type bunkrBackend struct {
+	name       string
+	client     BunkrClient
+	signClient bunkrSigner
+	// ping checks that the daemon answers.
+	ping func() error
+
+	mu sync.Mutex
+	// err is why the daemon could not be reached the last time it was
+	// checked, nil if it answered.
+	err error
+}
+
+func (b *bunkrBackend) setErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+func (b *bunkrBackend) lastErr() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// WithBunkrBackend adds the Bunkr backend name, the secrets stored with it
+// as their backend being signed with client. When it can not be reached at
+// startup its keys are skipped with a warning, and loaded once it answers.
+func WithBunkrBackend(name string, client BunkrClient) Option {
+	return func(ssha *SSHAgent) {
+		ssha.addBackend(name, client, nil)
+	}
+}
+
+// WithBunkrBackendAddr adds the Bunkr backend name like WithBunkrBackend,
+// connecting to the daemon listening on socketPath. The daemon does not need
+// to be running when the agent starts.
+func WithBunkrBackendAddr(name, socketPath string) Option {
+	return func(ssha *SSHAgent) {
+		dial := func() (BunkrClient, error) {
+			return bunkr_client.NewBunkrClient(socketPath)
+		}
+		ssha.addBackend(name, newReconnectingClient(nil, dial), dial)
+	}
+}
+
+// WithImportBackend imports the Bunkr secrets from the backend name, added
+// with WithBunkrBackend, instead of the default daemon.
+func WithImportBackend(name string) Option {
+	return func(ssha *SSHAgent) {
+		ssha.importBackend = name
+	}
+}
+
+// addBackend registers the backend name, dial being how a new connection to
+// it is made to check it answers, nil to ask client.
+func (ssha *SSHAgent) addBackend(name string, client BunkrClient, dial func() (BunkrClient, error)) {
+	if ssha.backends == nil {
+		ssha.backends = make(map[string]*bunkrBackend)
+	}
+	b := &bunkrBackend{name: name, client: client, signClient: client}
+	b.ping = func() error {
+		if dial != nil {
+			return pingBunkr(dial, ssha.bunkrTimeout)
+		}
+		_, err := callBunkr(ssha.bunkrTimeout, retryPolicy{}, func() (string, error) {
+			return "", checkBunkrVersion(client)
+		})
+		if err == context.DeadlineExceeded {
+			return errors.New(fmt.Sprintf("no answer within %v", ssha.bunkrTimeout))
+		}
+		return err
+	}
+	ssha.backends[name] = b
+}
+
+// setupBackends finishes the configuration of the backends once every
+// option is applied.
+func (ssha *SSHAgent) setupBackends() error {
+	for name, b := range ssha.backends {
+		if name == "" {
+			return errors.New("A Bunkr backend needs a name, the default one is the Bunkr socket")
+		}
+		if ssha.coalesceWindow > 0 {
+			b.signClient = newSignCoalescer(b.client, ssha.coalesceWindow)
+		}
+	}
+	if ssha.importBackend != "" && ssha.backends[ssha.importBackend] == nil {
+		return errors.New(fmt.Sprintf("Unknown Bunkr backend %s to import from", ssha.importBackend))
+	}
+	return nil
+}
+
+// backendClients returns the clients of the backend name, the default one
+// if it is empty.
+func (ssha *SSHAgent) backendClients(name string) (BunkrClient, bunkrSigner, error) {
+	if name == "" {
+		return ssha.bunkrClient, ssha.signClient, nil
+	}
+	b, ok := ssha.backends[name]
+	if !ok {
+		return nil, nil, errors.New(fmt.Sprintf("Unknown Bunkr backend %s", name))
+	}
+	return b.client, b.signClient, nil
+}
+
+// backendReachable reports whether the keys of secret can be loaded, they
+// are not while its backend is unreachable. Unknown backends are reported
+// when loading the key.
+func (ssha *SSHAgent) backendReachable(secret *storage.Secret) bool {
+	b, ok := ssha.backends[secret.Backend]
+	return !ok || b.lastErr() == nil
+}
+
+// checkBackends checks that every backend answers. The unreachable ones are
+// tried again in the background until they answer, their keys are loaded
+// then.
+func (ssha *SSHAgent) checkBackends() {
+	for _, b := range ssha.backends {
+		err := b.ping()
+		b.setErr(err)
+		if err == nil {
+			continue
+		}
+		ssha.logger.Warn(fmt.Sprintf("Bunkr backend %s is unreachable, its keys are loaded once it answers: %v", b.name, err))
+		go ssha.retryBackend(b, ssha.stoppedChan())
+	}
+}
+
+// retryBackend checks the unreachable backend b every retry interval until
+// it answers, then loads the keys, or until done is closed.
+func (ssha *SSHAgent) retryBackend(b *bunkrBackend, done <-chan struct{}) {
+	interval := ssha.backendRetryInterval
+	if interval <= 0 {
+		interval = defaultBackendRetryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		err := b.ping()
+		b.setErr(err)
+		if err != nil {
+			ssha.logger.Debug(fmt.Sprintf("Bunkr backend %s is still unreachable: %v", b.name, err))
+			continue
+		}
+		ssha.logger.Info(fmt.Sprintf("Bunkr backend %s answers, loading its keys", b.name))
+		if err := ssha.loadKeys(); err != nil {
+			ssha.logger.Warn(fmt.Sprintf("Error loading the keys of Bunkr backend %s: %v", b.name, err))
+		}
+		return
+	}
+}
+
+// closeBackends closes the backend clients holding resources.
+func (ssha *SSHAgent) closeBackends() error {
+	var err error
+	for _, b := range ssha.backends {
+		if closer, ok := b.client.(io.Closer); ok {
+			if cerr := closer.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// backendsDiagnostics returns the health of the backends sorted by name.
+func (ssha *SSHAgent) backendsDiagnostics() []DiagnosticsBackend {
+	var backends []DiagnosticsBackend
+	for _, b := range ssha.backends {
+		backend := DiagnosticsBackend{Name: b.name, Reachable: true}
+		if err := b.lastErr(); err != nil {
+			backend.Reachable = false
+			backend.Error = err.Error()
+		}
+		backends = append(backends, backend)
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Name < backends[j].Name })
+	return backends
+}
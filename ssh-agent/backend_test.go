@@ -0,0 +1,124 @@
+package ssh_agent
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// switchableBunkr is a fakeBunkr that can be made unreachable.
+type switchableBunkr struct {
+	*fakeBunkr
+
+	mu   sync.Mutex
+	down bool
+}
+
+func (b *switchableBunkr) setDown(down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down = down
+}
+
+func (b *switchableBunkr) isDown() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.down
+}
+
+func (b *switchableBunkr) DaemonVersion() (string, error) {
+	if b.isDown() {
+		return "", syscall.ECONNREFUSED
+	}
+	return "1.0.0", nil
+}
+
+func (b *switchableBunkr) ExportPublicData(secretName string) (string, error) {
+	if b.isDown() {
+		return "", syscall.ECONNREFUSED
+	}
+	return b.fakeBunkr.ExportPublicData(secretName)
+}
+
+func (b *switchableBunkr) SignECDSA(secretName, digest, groupName string) (string, error) {
+	if b.isDown() {
+		return "", syscall.ECONNREFUSED
+	}
+	return b.fakeBunkr.SignECDSA(secretName, digest, groupName)
+}
+
+func TestBunkrBackendDown(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	healthy := newFakeBunkr()
+	ssha.bunkrClient = healthy
+	ssha.signClient = healthy
+	office := &switchableBunkr{fakeBunkr: newFakeBunkr(), down: true}
+	WithBunkrBackend("office", office)(ssha)
+	ssha.backendRetryInterval = 10 * time.Millisecond
+	require.NoError(ssha.setupBackends())
+	defer ssha.closeBackends()
+
+	home, homePub := healthy.newSecret(t, "home")
+	require.NoError(ssha.storage.StoreSecret(home))
+	work, workPub := office.newSecret(t, "work")
+	work.Backend = "office"
+	require.NoError(ssha.storage.StoreSecret(work))
+
+	// The keys of the healthy backend are loaded
+	require.NoError(ssha.Start())
+	kr := ssha.Agent.(*keyring)
+	require.True(kr.hasKey(homePub))
+	require.False(kr.hasKey(workPub))
+	backends := ssha.Diagnostics().Backends
+	require.Len(backends, 1)
+	require.Equal("office", backends[0].Name)
+	require.False(backends[0].Reachable)
+	require.NotEmpty(backends[0].Error)
+	toAdd, _, err := ssha.ReloadPlan()
+	require.NoError(err)
+	require.Empty(toAdd)
+
+	// And the others once their backend answers
+	office.setDown(false)
+	require.Eventually(func() bool {
+		return kr.hasKey(workPub)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal([]DiagnosticsBackend{{Name: "office", Reachable: true}}, ssha.Diagnostics().Backends)
+	sig, err := ssha.Agent.Sign(workPub, []byte("data"))
+	require.NoError(err)
+	require.NoError(workPub.Verify([]byte("data"), sig))
+}
+
+func TestImportBackend(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	ssha.bunkrClient = newFakeBunkr()
+	office := newFakeBunkr()
+	WithBunkrBackend("office", office)(ssha)
+	WithImportBackend("office")(ssha)
+	require.NoError(ssha.setupBackends())
+
+	_, pub := office.newSecret(t, "work")
+	require.NoError(ssha.ImportKey("work"))
+	stored, err := ssha.storage.GetSecret("work")
+	require.NoError(err)
+	require.Equal("office", stored.Backend)
+	require.True(ssha.Agent.(*keyring).hasKey(pub))
+	require.NoError(ssha.ReloadKey("work"))
+
+	// Secrets of unknown backends can not be loaded
+	secret, _ := office.newSecret(t, "lost")
+	secret.Backend = "lab"
+	require.Error(ssha.AddKey(secret))
+
+	WithImportBackend("lab")(ssha)
+	require.Error(ssha.setupBackends())
+}
@@ -0,0 +1,48 @@
+package ssh_agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+// secretCertificate returns the certificate stored for secret, nil if it has
+// none. The certificate must be for pub, the stored key of the secret.
+func secretCertificate(secret *storage.Secret, pub ssh.PublicKey) (*ssh.Certificate, error) {
+	if len(secret.Certificate) == 0 {
+		return nil, nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(secret.Certificate)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid certificate for secret %s: %v", secret.Name, err))
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid certificate for secret %s: got a %s public key", secret.Name, key.Type()))
+	}
+	if !bytes.Equal(cert.Key.Marshal(), pub.Marshal()) {
+		return nil, errors.New(fmt.Sprintf("The certificate of secret %s is not for its key", secret.Name))
+	}
+	return cert, nil
+}
+
+// secretPublicKey returns the public key the agent serves for secret, its
+// certificate if it has one.
+func secretPublicKey(secret *storage.Secret) (ssh.PublicKey, error) {
+	sshPub, _, _, _, err := ssh.ParseAuthorizedKey(secret.PublicData)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := secretCertificate(secret, sshPub)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		return cert, nil
+	}
+	return sshPub, nil
+}
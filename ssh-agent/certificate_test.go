@@ -0,0 +1,72 @@
+package ssh_agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestCertificate returns a user certificate for pub signed by a new CA.
+func newTestCertificate(t *testing.T, pub ssh.PublicKey) *ssh.Certificate {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           "deploy",
+		ValidPrincipals: []string{"deploy"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestCertificate(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "deploy")
+	cert := newTestCertificate(t, pub)
+	secret.Certificate = ssh.MarshalAuthorizedKey(cert)
+	require.NoError(ssha.storage.StoreSecret(secret))
+
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal(ssh.CertAlgoECDSA256v01, keys[0].Format)
+	require.Equal(cert.Marshal(), keys[0].Blob)
+
+	// Signing with the certificate uses the Bunkr key
+	sig, err := ssha.Agent.Sign(cert, []byte("data"))
+	require.NoError(err)
+	require.NoError(pub.Verify([]byte("data"), sig))
+
+	// Reloading keeps the certificate loaded
+	require.NoError(ssha.Reload())
+	require.Len(ssha.Agent.(*keyring).bunkrKeys()["deploy"], 1)
+}
+
+func TestCertificateKeyMismatch(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, _ := bunkr.newSecret(t, "deploy")
+	_, otherPub := bunkr.newSecret(t, "other")
+	secret.Certificate = ssh.MarshalAuthorizedKey(newTestCertificate(t, otherPub))
+	require.EqualError(ssha.AddKey(secret), "The certificate of secret deploy is not for its key")
+
+	secret.Certificate = secret.PublicData
+	require.EqualError(ssha.AddKey(secret), "Invalid certificate for secret deploy: got a ecdsa-sha2-nistp256 public key")
+}
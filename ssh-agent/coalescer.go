@@ -0,0 +1,175 @@
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// bunkrSigner is the Bunkr operation used to produce ECDSA signatures.
+type bunkrSigner interface {
+	SignECDSA(secretName, digest, groupName string) (string, error)
+}
+
+// bunkrBatchSigner is implemented by Bunkr clients able to sign several
+// digests with the same secret in a single call.
+type bunkrBatchSigner interface {
+	SignECDSABatch(secretName string, digests []string, groupName string) ([]string, error)
+}
+
+type signResult struct {
+	signature string
+	err       error
+}
+
+type signBatch struct {
+	secretName string
+	groupName  string
+	digests    []string
+	waiters    map[string][]chan signResult
+	// touch holds, by digest, the callbacks of the waiters wanting to know
+	// when Bunkr waits for a touch.
+	touch map[string][]func()
+}
+
+// signCoalescer is a bunkrSigner that delays sign requests for a short window
+// and sends every request received for the same key in that window together.
+// Identical digests are only signed once. If the client can not batch, each
+// distinct digest is still sent as an individual call.
+//
+// Batched calls can not report that Bunkr waits for a touch. A batch of a
+// single digest, or of several when the client can not batch, is signed with
+// SignECDSAWithTouch if any of its waiters asked for touch reports. Those
+// digests are signed one after the other, as a hardware token waits for one
+// touch at a time, and a touch is reported to the waiters of the digest
+// being signed.
+type signCoalescer struct {
+	client bunkrSigner
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*signBatch
+}
+
+func newSignCoalescer(client bunkrSigner, window time.Duration) *signCoalescer {
+	return &signCoalescer{
+		client:  client,
+		window:  window,
+		pending: make(map[string]*signBatch),
+	}
+}
+
+func (c *signCoalescer) SignECDSA(secretName, digest, groupName string) (string, error) {
+	return c.sign(secretName, digest, groupName, nil)
+}
+
+// SignECDSAWithTouch signs like SignECDSA, calling waitingForTouch when Bunkr
+// waits for the user to touch the hardware token, see signCoalescer.
+func (c *signCoalescer) SignECDSAWithTouch(secretName, digest, groupName string, waitingForTouch func()) (string, error) {
+	return c.sign(secretName, digest, groupName, waitingForTouch)
+}
+
+func (c *signCoalescer) sign(secretName, digest, groupName string, waitingForTouch func()) (string, error) {
+	result := make(chan signResult, 1)
+	batchKey := secretName + "\x00" + groupName
+
+	c.mu.Lock()
+	batch, ok := c.pending[batchKey]
+	if !ok {
+		batch = &signBatch{
+			secretName: secretName,
+			groupName:  groupName,
+			waiters:    make(map[string][]chan signResult),
+			touch:      make(map[string][]func()),
+		}
+		c.pending[batchKey] = batch
+		time.AfterFunc(c.window, func() { c.flush(batchKey) })
+	}
+	if _, seen := batch.waiters[digest]; !seen {
+		batch.digests = append(batch.digests, digest)
+	}
+	batch.waiters[digest] = append(batch.waiters[digest], result)
+	if waitingForTouch != nil {
+		batch.touch[digest] = append(batch.touch[digest], waitingForTouch)
+	}
+	c.mu.Unlock()
+
+	r := <-result
+	return r.signature, r.err
+}
+
+func (c *signCoalescer) flush(batchKey string) {
+	c.mu.Lock()
+	batch := c.pending[batchKey]
+	delete(c.pending, batchKey)
+	c.mu.Unlock()
+	if batch == nil {
+		return
+	}
+
+	deliver := func(digest string, r signResult) {
+		for _, w := range batch.waiters[digest] {
+			w <- r
+		}
+	}
+
+	if batchSigner, ok := c.client.(bunkrBatchSigner); ok && len(batch.digests) > 1 {
+		signatures, err := batchSigner.SignECDSABatch(batch.secretName, batch.digests, batch.groupName)
+		if err == nil && len(signatures) != len(batch.digests) {
+			err = errors.New(fmt.Sprintf("Bunkr returned %d signatures for %d digests", len(signatures), len(batch.digests)))
+		}
+		for i, digest := range batch.digests {
+			r := signResult{err: err}
+			if err == nil {
+				r.signature = signatures[i]
+			}
+			deliver(digest, r)
+		}
+		return
+	}
+
+	if touchSigner, ok := c.client.(bunkrTouchSigner); ok && len(batch.touch) > 0 {
+		for _, digest := range batch.digests {
+			touch := batch.touch[digest]
+			signature, err := touchSigner.SignECDSAWithTouch(batch.secretName, digest, batch.groupName, func() {
+				for _, fn := range touch {
+					fn()
+				}
+			})
+			deliver(digest, signResult{signature, err})
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, digest := range batch.digests {
+		wg.Add(1)
+		go func(digest string) {
+			defer wg.Done()
+			signature, err := c.client.SignECDSA(batch.secretName, digest, batch.groupName)
+			deliver(digest, signResult{signature, err})
+		}(digest)
+	}
+	wg.Wait()
+}
+
+// SignRSA is not coalesced, it is passed on to the client if it can sign with
+// RSA keys.
+func (c *signCoalescer) SignRSA(secretName, digest, hash, groupName string) (string, error) {
+	rsaSigner, ok := c.client.(bunkrRSASigner)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("The Bunkr client can not sign with the RSA key %s", secretName))
+	}
+	return rsaSigner.SignRSA(secretName, digest, hash, groupName)
+}
+
+// SignEd25519 is not coalesced, it is passed on to the client if it can sign
+// with Ed25519 keys.
+func (c *signCoalescer) SignEd25519(secretName, data, groupName string) (string, error) {
+	edSigner, ok := c.client.(bunkrEd25519Signer)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("The Bunkr client can not sign with the Ed25519 key %s", secretName))
+	}
+	return edSigner.SignEd25519(secretName, data, groupName)
+}
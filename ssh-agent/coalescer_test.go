@@ -0,0 +1,137 @@
+package ssh_agent
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type countingSigner struct {
+	calls int32
+}
+
+func (s *countingSigner) SignECDSA(secretName, digest, groupName string) (string, error) {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(time.Millisecond)
+	return fmt.Sprintf("%s/%s/%s", secretName, digest, groupName), nil
+}
+
+type countingBatchSigner struct {
+	countingSigner
+	batches int32
+}
+
+func (s *countingBatchSigner) SignECDSABatch(secretName string, digests []string, groupName string) ([]string, error) {
+	atomic.AddInt32(&s.batches, 1)
+	time.Sleep(time.Millisecond)
+	signatures := make([]string, len(digests))
+	for i, digest := range digests {
+		signatures[i] = fmt.Sprintf("%s/%s/%s", secretName, digest, groupName)
+	}
+	return signatures, nil
+}
+
+func runConcurrentSigns(t *testing.T, signer bunkrSigner, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			digest := fmt.Sprintf("digest%d", i%4)
+			signature, err := signer.SignECDSA("key", digest, "group")
+			require.NoError(t, err)
+			require.Equal(t, "key/"+digest+"/group", signature)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSignCoalescer(t *testing.T) {
+	require := require.New(t)
+
+	// Without batching support identical digests are deduplicated
+	client := &countingSigner{}
+	runConcurrentSigns(t, newSignCoalescer(client, 50*time.Millisecond), 32)
+	require.True(atomic.LoadInt32(&client.calls) < 32)
+	require.True(atomic.LoadInt32(&client.calls) >= 4)
+
+	// With batching support a window produces a single call
+	batchClient := &countingBatchSigner{}
+	runConcurrentSigns(t, newSignCoalescer(batchClient, 50*time.Millisecond), 32)
+	require.Equal(int32(0), atomic.LoadInt32(&batchClient.calls))
+	require.True(atomic.LoadInt32(&batchClient.batches) >= 1)
+	require.True(atomic.LoadInt32(&batchClient.batches) < 32)
+}
+
+func BenchmarkSignCoalescer(b *testing.B) {
+	b.Run("direct", func(b *testing.B) {
+		client := &countingSigner{}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, _ = client.SignECDSA("key", "digest", "")
+			}
+		})
+	})
+	b.Run("coalesced", func(b *testing.B) {
+		coalescer := newSignCoalescer(&countingBatchSigner{}, time.Millisecond)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, _ = coalescer.SignECDSA("key", "digest", "")
+			}
+		})
+	})
+}
+
+type touchCountingSigner struct {
+	countingSigner
+	inFlight, maxInFlight int32
+}
+
+func (s *touchCountingSigner) SignECDSAWithTouch(secretName, digest, groupName string, waitingForTouch func()) (string, error) {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&s.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&s.maxInFlight, max, n) {
+			break
+		}
+	}
+	waitingForTouch()
+	return s.SignECDSA(secretName, digest, groupName)
+}
+
+func TestSignCoalescerTouch(t *testing.T) {
+	require := require.New(t)
+	client := &touchCountingSigner{}
+	c := newSignCoalescer(client, 50*time.Millisecond)
+
+	var touches int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			digest := fmt.Sprintf("digest%d", i%2)
+			signature, err := c.SignECDSAWithTouch("key", digest, "group", func() {
+				atomic.AddInt32(&touches, 1)
+			})
+			require.NoError(err)
+			require.Equal("key/"+digest+"/group", signature)
+		}(i)
+	}
+	wg.Wait()
+
+	// Every waiter heard of the touch, the digests were signed one by one
+	require.Equal(int32(8), atomic.LoadInt32(&touches))
+	require.Equal(int32(1), atomic.LoadInt32(&client.maxInFlight))
+	require.True(atomic.LoadInt32(&client.calls) >= 2)
+
+	// Without touch reports the client is not asked for them
+	plain := &touchCountingSigner{}
+	runConcurrentSigns(t, newSignCoalescer(plain, 10*time.Millisecond), 4)
+	require.Zero(atomic.LoadInt32(&plain.maxInFlight))
+}
@@ -0,0 +1,140 @@
+package ssh_agent
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Confirmer asks the user whether a signature with a key that requires
+// confirmation may proceed. Any failure or timeout must be a denial.
+type Confirmer interface {
+	Confirm(fingerprint, comment string) bool
+}
+
+// fifoConfirmer implements the named pipe confirmation protocol:
+//
+// For every signature needing confirmation the agent opens the challenge
+// FIFO for writing and sends a single line
+//
+//	confirm <nonce> <fingerprint> <comment>
+//
+// where nonce is a random hex string. It then opens the response FIFO for
+// reading and waits for a line "approve <nonce>" or "deny <nonce>". Lines
+// carrying any other nonce are ignored so stale answers can not approve a
+// new request. If no answer arrives within the timeout the signature is
+// denied and the exchange is abandoned, closing the pipes it opened. Only
+// one confirmation is in progress at a time.
+type fifoConfirmer struct {
+	// openChallenge and openResponse open the pipes, giving up once done
+	// is closed.
+	openChallenge func(done <-chan struct{}) (io.WriteCloser, error)
+	openResponse  func(done <-chan struct{}) (io.ReadCloser, error)
+	timeout       time.Duration
+	logger        *Logger
+
+	mu sync.Mutex
+}
+
+// NewFIFOConfirmer returns a Confirmer speaking the FIFO protocol over the
+// named pipes at challengePath and responsePath.
+func NewFIFOConfirmer(challengePath, responsePath string, timeout time.Duration) Confirmer {
+	return &fifoConfirmer{
+		openChallenge: func(done <-chan struct{}) (io.WriteCloser, error) {
+			return openChallengeFIFO(challengePath, done)
+		},
+		openResponse: func(done <-chan struct{}) (io.ReadCloser, error) {
+			return openResponseFIFO(responsePath)
+		},
+		timeout: timeout,
+	}
+}
+
+func (c *fifoConfirmer) setLogger(l *Logger) {
+	c.logger = l
+}
+
+func (c *fifoConfirmer) Confirm(fingerprint, comment string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		c.logger.Error(fmt.Sprintf("Could not generate confirmation nonce: %v", err))
+		return false
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+
+	done := make(chan struct{})
+	result := make(chan bool, 1)
+	go func() {
+		result <- c.exchange(done, nonce, fingerprint, comment)
+	}()
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case approved := <-result:
+		return approved
+	case <-timer.C:
+		c.logger.Warn(fmt.Sprintf("Confirmation for %s timed out, denying", fingerprint))
+		// Wait for the abandoned exchange so it does not read the answer
+		// to the next confirmation
+		close(done)
+		<-result
+		return false
+	}
+}
+
+func (c *fifoConfirmer) exchange(done <-chan struct{}, nonce, fingerprint, comment string) bool {
+	challenge, err := c.openChallenge(done)
+	if err != nil {
+		c.logger.Error(fmt.Sprintf("Could not open confirmation challenge pipe: %v", err))
+		return false
+	}
+	stop := closeOnDone(done, challenge)
+	_, err = fmt.Fprintf(challenge, "confirm %s %s %s\n", nonce, fingerprint, comment)
+	stop()
+	challenge.Close()
+	if err != nil {
+		c.logger.Error(fmt.Sprintf("Could not write confirmation challenge: %v", err))
+		return false
+	}
+
+	response, err := c.openResponse(done)
+	if err != nil {
+		c.logger.Error(fmt.Sprintf("Could not open confirmation response pipe: %v", err))
+		return false
+	}
+	defer closeOnDone(done, response)()
+	defer response.Close()
+	scanner := bufio.NewScanner(response)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[1] != nonce {
+			continue
+		}
+		return fields[0] == "approve"
+	}
+	return false
+}
+
+// closeOnDone closes pipe once done is closed, making a blocked read or write
+// on it return, until the returned function is called.
+func closeOnDone(done <-chan struct{}, pipe io.Closer) func() {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			pipe.Close()
+		case <-finished:
+		}
+	}()
+	return func() {
+		close(finished)
+	}
+}
@@ -0,0 +1,113 @@
+package ssh_agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pipeConfirmer returns a fifoConfirmer over in memory pipes and a function
+// answering its next challenge with the given verb.
+func pipeConfirmer(timeout time.Duration) (*fifoConfirmer, func(t *testing.T, verb string) string) {
+	challenges := make(chan *io.PipeReader, 1)
+	responses := make(chan *io.PipeWriter, 1)
+	c := &fifoConfirmer{
+		openChallenge: func(done <-chan struct{}) (io.WriteCloser, error) {
+			r, w := io.Pipe()
+			challenges <- r
+			return w, nil
+		},
+		openResponse: func(done <-chan struct{}) (io.ReadCloser, error) {
+			r, w := io.Pipe()
+			responses <- w
+			return r, nil
+		},
+		timeout: timeout,
+	}
+	answer := func(t *testing.T, verb string) string {
+		line, err := bufio.NewReader(<-challenges).ReadString('\n')
+		require.NoError(t, err)
+		fields := strings.Fields(line)
+		require.Equal(t, "confirm", fields[0])
+		w := <-responses
+		// A stale answer for another request is ignored
+		fmt.Fprintf(w, "approve deadbeef\n")
+		fmt.Fprintf(w, "%s %s\n", verb, fields[1])
+		w.Close()
+		return line
+	}
+	return c, answer
+}
+
+func TestFIFOConfirmer(t *testing.T) {
+	require := require.New(t)
+
+	c, answer := pipeConfirmer(time.Second)
+	go answer(t, "approve")
+	require.True(c.Confirm("SHA256:abc", "work key"))
+
+	go answer(t, "deny")
+	require.False(c.Confirm("SHA256:abc", "work key"))
+
+	// Nobody answering is a denial
+	c, _ = pipeConfirmer(50 * time.Millisecond)
+	require.False(c.Confirm("SHA256:abc", "work key"))
+}
+
+func TestFIFOConfirmerTimeoutClosesPipes(t *testing.T) {
+	require := require.New(t)
+	responses := make(chan *io.PipeWriter, 1)
+	c := &fifoConfirmer{
+		openChallenge: func(done <-chan struct{}) (io.WriteCloser, error) {
+			r, w := io.Pipe()
+			go io.Copy(ioutil.Discard, r)
+			return w, nil
+		},
+		openResponse: func(done <-chan struct{}) (io.ReadCloser, error) {
+			r, w := io.Pipe()
+			responses <- w
+			return r, nil
+		},
+		timeout: 50 * time.Millisecond,
+	}
+	require.False(c.Confirm("SHA256:abc", "work key"))
+
+	// The abandoned exchange closed the response pipe instead of waiting
+	// for an answer
+	_, err := fmt.Fprintf(<-responses, "approve deadbeef\n")
+	require.Equal(io.ErrClosedPipe, err)
+}
+
+func TestConfirmBeforeUse(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	yes := true
+	secret, sshPub := bunkr.newSecret(t, "guarded")
+	secret.ConfirmBeforeUse = &yes
+	require.NoError(ssha.storage.StoreSecret(secret))
+	require.NoError(ssha.Start())
+
+	// Without a confirmation method signatures are denied
+	_, err := ssha.Agent.Sign(sshPub, []byte("data"))
+	require.Error(err)
+
+	c, answer := pipeConfirmer(time.Second)
+	WithConfirmer(c)(ssha)
+	challenge := make(chan string, 1)
+	go func() {
+		challenge <- answer(t, "approve")
+	}()
+	_, err = ssha.Agent.Sign(sshPub, []byte("data"))
+	require.NoError(err)
+	require.Contains(<-challenge, ssha.fingerprintFormat.Fingerprint(sshPub))
+}
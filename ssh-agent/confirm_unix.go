@@ -0,0 +1,66 @@
+//go:build !windows
+// +build !windows
+
+package ssh_agent
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fifoPollInterval is how often the challenge FIFO is opened again while
+// nobody reads it.
+const fifoPollInterval = 50 * time.Millisecond
+
+var errConfirmAbandoned = errors.New("confirmation abandoned")
+
+// openChallengeFIFO opens the FIFO at path for writing. Opening a FIFO
+// blocks until it has a reader, so it is opened without blocking instead,
+// again every fifoPollInterval until a reader appears or done is closed.
+func openChallengeFIFO(path string, done <-chan struct{}) (io.WriteCloser, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			return f, nil
+		}
+		if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.ENXIO {
+			return nil, err
+		}
+		select {
+		case <-done:
+			return nil, errConfirmAbandoned
+		case <-time.After(fifoPollInterval):
+		}
+	}
+}
+
+// responseFIFO is the response FIFO opened for reading, also held open for
+// writing so that reading waits for an answer instead of ending while no
+// writer has it open.
+type responseFIFO struct {
+	*os.File
+	writer *os.File
+}
+
+func (f *responseFIFO) Close() error {
+	f.writer.Close()
+	return f.File.Close()
+}
+
+// openResponseFIFO opens the FIFO at path for reading without waiting for a
+// writer, reads block until an answer arrives or the FIFO is closed.
+func openResponseFIFO(path string) (io.ReadCloser, error) {
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	w, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &responseFIFO{File: r, writer: w}, nil
+}
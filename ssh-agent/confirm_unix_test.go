@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package ssh_agent
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFIFOConfirmerNamedPipes(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "confirm-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	challengePath := filepath.Join(dir, "challenge")
+	responsePath := filepath.Join(dir, "response")
+	require.NoError(syscall.Mkfifo(challengePath, 0600))
+	require.NoError(syscall.Mkfifo(responsePath, 0600))
+
+	// Nobody reading the challenge is a denial once the timeout passes
+	c := NewFIFOConfirmer(challengePath, responsePath, 100*time.Millisecond)
+	start := time.Now()
+	require.False(c.Confirm("SHA256:abc", "work key"))
+	require.WithinDuration(start.Add(100*time.Millisecond), time.Now(), time.Second)
+
+	// Nor is reading it without ever answering
+	challenges := make(chan string, 1)
+	readChallenge := func() {
+		challenge, err := os.Open(challengePath)
+		if err != nil {
+			return
+		}
+		defer challenge.Close()
+		line, _ := bufio.NewReader(challenge).ReadString('\n')
+		challenges <- line
+	}
+	go readChallenge()
+	require.False(c.Confirm("SHA256:abc", "work key"))
+	require.Contains(<-challenges, "SHA256:abc")
+
+	c = NewFIFOConfirmer(challengePath, responsePath, 5*time.Second)
+	go func() {
+		readChallenge()
+		line := <-challenges
+		response, err := os.OpenFile(responsePath, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer response.Close()
+		fmt.Fprintf(response, "approve %s\n", strings.Fields(line)[1])
+	}()
+	require.True(c.Confirm("SHA256:abc", "work key"))
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package ssh_agent
+
+import (
+	"io"
+	"os"
+)
+
+// openChallengeFIFO opens the challenge pipe at path for writing, there are
+// no FIFOs to wait for a reader of on windows.
+func openChallengeFIFO(path string, done <-chan struct{}) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY, 0)
+}
+
+// openResponseFIFO opens the response pipe at path for reading.
+func openResponseFIFO(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
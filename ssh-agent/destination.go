@@ -0,0 +1,265 @@
+package ssh_agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// constraintRestrictDestination is the key constraint extension ssh-add -h
+// adds to limit the hosts a forwarded key can be used for.
+const constraintRestrictDestination = "restrict-destination-v00@openssh.com"
+
+// destinationKey is a host key of a hop, or the CA signing the host
+// certificates of the hop.
+type destinationKey struct {
+	key  ssh.PublicKey
+	isCA bool
+}
+
+// destinationHop is one side of a destination constraint. An empty hostname
+// with no keys is the host running the agent.
+type destinationHop struct {
+	user     string
+	hostname string
+	keys     []destinationKey
+}
+
+// destinationConstraint permits using a key to authenticate from the from
+// hop to the to hop.
+type destinationConstraint struct {
+	from destinationHop
+	to   destinationHop
+}
+
+// parseKeyConstraints returns the destination constraints of the constraint
+// extensions of an added key. Other extensions are refused, ignoring a
+// constraint would let the key be used more widely than asked.
+func parseKeyConstraints(extensions []ConstraintExtension) ([]destinationConstraint, error) {
+	var constraints []destinationConstraint
+	for _, ext := range extensions {
+		if ext.ExtensionName != constraintRestrictDestination {
+			return nil, errors.New(fmt.Sprintf("agent: unsupported key constraint %s", ext.ExtensionName))
+		}
+		parsed, err := parseDestinationConstraints(ext.ExtensionDetails)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("agent: invalid destination constraint: %v", err))
+		}
+		constraints = append(constraints, parsed...)
+	}
+	return constraints, nil
+}
+
+func parseDestinationConstraints(details []byte) ([]destinationConstraint, error) {
+	var constraints []destinationConstraint
+	for len(details) > 0 {
+		var msg struct {
+			Constraint []byte
+			Rest       []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(details, &msg); err != nil {
+			return nil, err
+		}
+		details = msg.Rest
+		var hops struct {
+			From     []byte
+			To       []byte
+			Reserved []byte
+			Rest     []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(msg.Constraint, &hops); err != nil {
+			return nil, err
+		}
+		var c destinationConstraint
+		var err error
+		if c.from, err = parseDestinationHop(hops.From); err != nil {
+			return nil, err
+		}
+		if c.to, err = parseDestinationHop(hops.To); err != nil {
+			return nil, err
+		}
+		if c.from.user != "" {
+			return nil, errors.New("a user can not be given for the from host")
+		}
+		if c.from.hostname != "" && len(c.from.keys) == 0 {
+			return nil, errors.New(fmt.Sprintf("no host key for the from host %s", c.from.hostname))
+		}
+		if c.to.hostname == "" || len(c.to.keys) == 0 {
+			return nil, errors.New("the to host and its keys are required")
+		}
+		constraints = append(constraints, c)
+	}
+	return constraints, nil
+}
+
+func parseDestinationHop(b []byte) (destinationHop, error) {
+	var msg struct {
+		User     string
+		Hostname string
+		Reserved []byte
+		Rest     []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(b, &msg); err != nil {
+		return destinationHop{}, err
+	}
+	hop := destinationHop{user: msg.User, hostname: msg.Hostname}
+	for rest := msg.Rest; len(rest) > 0; {
+		var spec struct {
+			Blob []byte
+			IsCA bool
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &spec); err != nil {
+			return destinationHop{}, err
+		}
+		key, err := ssh.ParsePublicKey(spec.Blob)
+		if err != nil {
+			return destinationHop{}, err
+		}
+		hop.keys = append(hop.keys, destinationKey{key, spec.IsCA})
+		rest = spec.Rest
+	}
+	return hop, nil
+}
+
+// matches tells if hostKey is one of the keys of the hop, or a certificate
+// for the hop signed by one of its CAs.
+func (hop destinationHop) matches(hostKey ssh.PublicKey) bool {
+	for _, k := range hop.keys {
+		if !k.isCA {
+			if bytes.Equal(k.key.Marshal(), hostKey.Marshal()) {
+				return true
+			}
+			continue
+		}
+		cert, ok := hostKey.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.HostCert || !bytes.Equal(cert.SignatureKey.Marshal(), k.key.Marshal()) {
+			continue
+		}
+		for _, principal := range cert.ValidPrincipals {
+			if principal == hop.hostname {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// permitsHop tells if one of the constraints allows authenticating from the
+// host with the key from, nil for the agent host, to the host with the key
+// to as user.
+func permitsHop(constraints []destinationConstraint, from, to ssh.PublicKey, user string) bool {
+	for _, c := range constraints {
+		if from == nil {
+			if c.from.hostname != "" || len(c.from.keys) != 0 {
+				continue
+			}
+		} else if !c.from.matches(from) {
+			continue
+		}
+		if !c.to.matches(to) {
+			continue
+		}
+		if c.to.user != "" && user != "" && c.to.user != user {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// userAuthRequest is the start of the data signed for a publickey user
+// authentication.
+type userAuthRequest struct {
+	SessionID []byte
+	Type      byte
+	User      string
+	Service   string
+	Method    string
+	Signed    bool
+	Algorithm string
+	KeyBlob   []byte
+	Rest      []byte `ssh:"rest"`
+}
+
+// methodPublicKeyHostbound is the authentication method of OpenSSH 8.9 and
+// later, which signs the host key of the server too.
+const methodPublicKeyHostbound = "publickey-hostbound-v00@openssh.com"
+
+// parseUserAuthRequest parses data as a user authentication request for key,
+// returning the host key it is bound to, if any.
+func parseUserAuthRequest(data []byte, key ssh.PublicKey) (*userAuthRequest, ssh.PublicKey, error) {
+	var req userAuthRequest
+	if err := ssh.Unmarshal(data, &req); err != nil {
+		return nil, nil, err
+	}
+	if req.Type != msgUserAuthRequest || !req.Signed || (req.Method != "publickey" && req.Method != methodPublicKeyHostbound) {
+		return nil, nil, errors.New("not a publickey user authentication request")
+	}
+	if !bytes.Equal(req.KeyBlob, key.Marshal()) {
+		return nil, nil, errors.New("user authentication request for another key")
+	}
+	if req.Method != methodPublicKeyHostbound {
+		return &req, nil, nil
+	}
+	var hostKey struct {
+		Blob []byte
+		Rest []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(req.Rest, &hostKey); err != nil {
+		return nil, nil, err
+	}
+	parsed, err := ssh.ParsePublicKey(hostKey.Blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &req, parsed, nil
+}
+
+// checkDestination tells if a key restricted to constraints may sign data
+// on a connection bound to the sessions of bindings, following the hops
+// like OpenSSH: every forwarding hop and the final destination must be
+// permitted, and data must authenticate the last bound session.
+func checkDestination(constraints []destinationConstraint, bindings []sessionBinding, bindAttempted bool, key ssh.PublicKey, data []byte) error {
+	if len(bindings) == 0 {
+		if bindAttempted {
+			return errors.New("Refusing to use a destination constrained key, binding the connection to a session failed")
+		}
+		return errors.New("Refusing to use a destination constrained key on a connection not bound to a session")
+	}
+	req, hostKey, err := parseUserAuthRequest(data, key)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Refusing to use a destination constrained key to sign data that is not a user authentication: %v", err))
+	}
+	var from ssh.PublicKey
+	for i, b := range bindings {
+		last := i == len(bindings)-1
+		if last && b.forwarding {
+			return errors.New("Refusing to use a destination constrained key to sign on a forwarding hop")
+		}
+		if !last && !b.forwarding {
+			return errors.New("Refusing to use a destination constrained key forwarded through a session bound for authentication")
+		}
+		user := ""
+		if last {
+			user = req.User
+		}
+		if !permitsHop(constraints, from, b.hostKey, user) {
+			return errors.New(fmt.Sprintf("Refusing to use a destination constrained key for host key %s", ssh.FingerprintSHA256(b.hostKey)))
+		}
+		from = b.hostKey
+	}
+	last := bindings[len(bindings)-1]
+	if !bytes.Equal(req.SessionID, last.sessionID) {
+		return errors.New("Refusing to use a destination constrained key for a session the connection is not bound to")
+	}
+	if len(bindings) > 1 && hostKey == nil {
+		return errors.New("Refusing to use a destination constrained key on a forwarded connection without host bound authentication")
+	}
+	if hostKey != nil && !bytes.Equal(hostKey.Marshal(), last.hostKey.Marshal()) {
+		return errors.New("Refusing to use a destination constrained key, the host key of the request is not the bound one")
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package ssh_agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// marshalHop encodes a destination constraint hop.
+func marshalHop(user, hostname string, keys ...ssh.PublicKey) []byte {
+	hop := ssh.Marshal(struct {
+		User     string
+		Hostname string
+		Reserved []byte
+	}{user, hostname, nil})
+	for _, key := range keys {
+		hop = append(hop, ssh.Marshal(struct {
+			Blob []byte
+			IsCA bool
+		}{key.Marshal(), false})...)
+	}
+	return hop
+}
+
+// restrictDestination returns the ssh-add -h constraint allowing to
+// authenticate from the agent host to the host with hostKey only.
+func restrictDestination(hostname string, hostKey ssh.PublicKey) ConstraintExtension {
+	constraint := ssh.Marshal(struct {
+		From     []byte
+		To       []byte
+		Reserved []byte
+	}{marshalHop("", ""), marshalHop("", hostname, hostKey), nil})
+	return ConstraintExtension{
+		ExtensionName:    constraintRestrictDestination,
+		ExtensionDetails: ssh.Marshal(struct{ Constraint []byte }{constraint}),
+	}
+}
+
+// hostboundAuth returns the data signed by key to authenticate as user in
+// sessionID to the server with hostKey.
+func hostboundAuth(sessionID []byte, user string, key, hostKey ssh.PublicKey) []byte {
+	return ssh.Marshal(struct {
+		SessionID []byte
+		Type      byte
+		User      string
+		Service   string
+		Method    string
+		Signed    bool
+		Algorithm string
+		KeyBlob   []byte
+		HostKey   []byte
+	}{sessionID, msgUserAuthRequest, user, "ssh-connection", methodPublicKeyHostbound, true, key.Type(), key.Marshal(), hostKey.Marshal()})
+}
+
+func TestDestinationConstraints(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	allowed, denied := newHostKey(t), newHostKey(t)
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	pub, err := ssh.NewPublicKey(&pk.PublicKey)
+	require.NoError(err)
+	require.NoError(ssha.Agent.Add(AddedKey{
+		PrivateKey:           pk,
+		Comment:              "restricted",
+		ConstraintExtensions: []ConstraintExtension{restrictDestination("allowed.example.com", allowed.PublicKey())},
+	}))
+	require.Len(ssha.Agent.(*keyring).destinations(pub), 1)
+
+	// The permitted destination
+	bound := newSessionBoundAgent(ssha.Agent, ssha)
+	_, err = bound.Extension(extensionSessionBind, sessionBind(t, allowed, []byte("s1"), false))
+	require.NoError(err)
+	sig, err := bound.Sign(pub, hostboundAuth([]byte("s1"), "user", pub, allowed.PublicKey()))
+	require.NoError(err)
+	require.NoError(pub.Verify(hostboundAuth([]byte("s1"), "user", pub, allowed.PublicKey()), sig))
+	// Other data or sessions are refused
+	_, err = bound.Sign(pub, []byte("not a user authentication"))
+	require.Error(err)
+	_, err = bound.Sign(pub, hostboundAuth([]byte("s2"), "user", pub, allowed.PublicKey()))
+	require.Error(err)
+
+	// A denied destination
+	bound = newSessionBoundAgent(ssha.Agent, ssha)
+	_, err = bound.Extension(extensionSessionBind, sessionBind(t, denied, []byte("s3"), false))
+	require.NoError(err)
+	_, err = bound.Sign(pub, hostboundAuth([]byte("s3"), "user", pub, denied.PublicKey()))
+	require.Error(err)
+	require.Contains(err.Error(), "Refusing to use a destination constrained key")
+
+	// Forwarded to the allowed host, which tries to use the key further
+	bound = newSessionBoundAgent(ssha.Agent, ssha)
+	_, err = bound.Extension(extensionSessionBind, sessionBind(t, allowed, []byte("s4"), true))
+	require.NoError(err)
+	_, err = bound.Extension(extensionSessionBind, sessionBind(t, denied, []byte("s5"), false))
+	require.NoError(err)
+	_, err = bound.Sign(pub, hostboundAuth([]byte("s5"), "user", pub, denied.PublicKey()))
+	require.Error(err)
+
+	// Unbound connections can not use the key
+	_, err = newSessionBoundAgent(ssha.Agent, ssha).Sign(pub, hostboundAuth([]byte("s1"), "user", pub, allowed.PublicKey()))
+	require.Error(err)
+}
+
+func TestUnconstrainedKeys(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "key")
+	require.NoError(ssha.AddKey(secret))
+	require.Empty(ssha.Agent.(*keyring).destinations(pub))
+
+	bound := newSessionBoundAgent(ssha.Agent, ssha)
+	_, err := bound.Sign(pub, []byte("data"))
+	require.NoError(err)
+	_, err = bound.Extension(extensionSessionBind, sessionBind(t, newHostKey(t), []byte("s1"), false))
+	require.NoError(err)
+	_, err = bound.Sign(pub, hostboundAuth([]byte("s1"), "user", pub, newHostKey(t).PublicKey()))
+	require.NoError(err)
+
+	// Unknown constraints are refused instead of ignored
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	err = ssha.Agent.Add(AddedKey{PrivateKey: pk, ConstraintExtensions: []ConstraintExtension{{ExtensionName: "unknown@example.com"}}})
+	require.Error(err)
+	// Constraints without a destination are invalid
+	err = ssha.Agent.AddFromBunkr(BunkrAddedKey{Signer: nil, Name: "broken", ConstraintExtensions: []ConstraintExtension{{ExtensionName: constraintRestrictDestination, ExtensionDetails: []byte("garbage")}}})
+	require.Error(err)
+}
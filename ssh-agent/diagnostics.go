@@ -0,0 +1,133 @@
+package ssh_agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxRecentErrors bounds the errors kept for diagnostics snapshots.
+const maxRecentErrors = 20
+
+// Diagnostics is the snapshot written by DumpDiagnostics. It never holds
+// private key material nor the lock passphrase.
+type Diagnostics struct {
+	Time         time.Time        `json:"time"`
+	Locked       bool             `json:"locked"`
+	Keys         []DiagnosticsKey `json:"keys"`
+	RecentErrors []RecordedError  `json:"recent_errors"`
+	// Backends are the Bunkr backends added besides the default one.
+	Backends []DiagnosticsBackend `json:"backends,omitempty"`
+}
+
+// DiagnosticsKey describes a loaded key and its constraints.
+type DiagnosticsKey struct {
+	Fingerprint string     `json:"fingerprint"`
+	Type        string     `json:"type"`
+	Name        string     `json:"name"`
+	Group       string     `json:"group,omitempty"`
+	Comment     string     `json:"comment"`
+	Confirm     bool       `json:"confirm"`
+	Expire      *time.Time `json:"expire,omitempty"`
+	FromBunkr   bool       `json:"from_bunkr"`
+}
+
+// DiagnosticsBackend describes whether a Bunkr backend answered the last
+// time it was checked.
+type DiagnosticsBackend struct {
+	Name      string `json:"name"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RecordedError is an error seen while serving requests.
+type RecordedError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// errorLog keeps the last maxRecentErrors errors.
+type errorLog struct {
+	mu     sync.Mutex
+	errors []RecordedError
+}
+
+func (l *errorLog) record(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, RecordedError{Time: time.Now(), Error: err.Error()})
+	if len(l.errors) > maxRecentErrors {
+		l.errors = l.errors[len(l.errors)-maxRecentErrors:]
+	}
+}
+
+func (l *errorLog) recent() []RecordedError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]RecordedError{}, l.errors...)
+}
+
+// Diagnostics returns a snapshot of the agent state, it is safe to call
+// while requests are being served.
+func (ssha *SSHAgent) Diagnostics() Diagnostics {
+	d := Diagnostics{
+		Time:         time.Now(),
+		Keys:         []DiagnosticsKey{},
+		RecentErrors: ssha.recentErrors.recent(),
+		Backends:     ssha.backendsDiagnostics(),
+	}
+	kr := ssha.Agent.(*keyring)
+	kr.mu.Lock()
+	d.Locked = kr.locked
+	for _, k := range kr.keys {
+		pub := k.signer.PublicKey()
+		key := DiagnosticsKey{
+			Fingerprint: ssha.fingerprintFormat.Fingerprint(pub),
+			Type:        pub.Type(),
+			Name:        k.name,
+			Group:       k.group,
+			Comment:     k.comment,
+			Confirm:     k.confirm,
+			FromBunkr:   k.fromBunkr,
+		}
+		if k.expire != nil {
+			expire := k.expire.Round(0)
+			key.Expire = &expire
+		}
+		d.Keys = append(d.Keys, key)
+	}
+	kr.mu.Unlock()
+	return d
+}
+
+// DumpDiagnostics writes the Diagnostics snapshot as JSON to path, readable
+// only by the current user. The snapshot is written to a new file created
+// next to path and renamed over it, so neither a symbolic link nor a file
+// another user created at path is written through.
+func (ssha *SSHAgent) DumpDiagnostics(path string) error {
+	data, err := json.MarshalIndent(ssha.Diagnostics(), "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package ssh_agent
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpDiagnostics(t *testing.T) {
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "deploy")
+	secret.RequireConfirm = true
+	require.NoError(ssha.AddKey(secret))
+	_, err := ssha.Agent.Sign(pub, []byte("data"))
+	require.Error(err)
+	require.NoError(ssha.Agent.Lock([]byte("very secret passphrase")))
+
+	// Snapshots can be taken while the agent is used
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = ssha.Agent.Sign(pub, []byte("data"))
+			ssha.Diagnostics()
+		}()
+	}
+	wg.Wait()
+
+	path := filepath.Join(dir, "diagnostics.json")
+	require.NoError(ssha.DumpDiagnostics(path))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.False(strings.Contains(string(data), "very secret passphrase"))
+	for name, k := range bunkr.keys {
+		require.False(strings.Contains(string(data), k.D.String()), name)
+	}
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Lstat(path)
+		require.NoError(err)
+		require.Equal(os.FileMode(0600), info.Mode())
+
+		// A symbolic link at the path is replaced, not written through
+		target := filepath.Join(dir, "target")
+		require.NoError(ioutil.WriteFile(target, []byte("keep"), 0644))
+		require.NoError(os.Remove(path))
+		require.NoError(os.Symlink(target, path))
+		require.NoError(ssha.DumpDiagnostics(path))
+		kept, err := ioutil.ReadFile(target)
+		require.NoError(err)
+		require.Equal("keep", string(kept))
+		info, err = os.Lstat(path)
+		require.NoError(err)
+		require.True(info.Mode().IsRegular())
+	}
+
+	var d Diagnostics
+	require.NoError(json.Unmarshal(data, &d))
+	require.True(d.Locked)
+	require.Len(d.Keys, 1)
+	require.Equal(DiagnosticsKey{
+		Fingerprint: ssha.fingerprintFormat.Fingerprint(pub),
+		Type:        pub.Type(),
+		Name:        "deploy",
+		Comment:     "deploy",
+		Confirm:     true,
+		FromBunkr:   true,
+	}, d.Keys[0])
+	require.NotEmpty(d.RecentErrors)
+	require.Equal("agent: signature not confirmed", d.RecentErrors[0].Error)
+	require.True(len(d.RecentErrors) <= maxRecentErrors)
+}
+
+func TestErrorLogBounded(t *testing.T) {
+	require := require.New(t)
+	var l errorLog
+	for i := 0; i < maxRecentErrors+5; i++ {
+		l.record(errors.New("failure"))
+	}
+	require.Len(l.recent(), maxRecentErrors)
+}
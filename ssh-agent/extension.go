@@ -0,0 +1,48 @@
+package ssh_agent
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// agentSuccess is the SSH_AGENT_SUCCESS message byte starting the replies to
+// extension requests.
+const agentSuccess = 6
+
+// The extensions the agent handles. query is the name of the draft agent
+// protocol, OpenSSH clients send the vendor name. session-bind is handled
+// per connection by sessionBoundAgent.
+const (
+	extensionQuery        = "query"
+	extensionQueryOpenSSH = "query@openssh.com"
+	extensionSessionBind  = "session-bind@openssh.com"
+)
+
+// supportedExtensions are listed in the reply to the query extension.
+var supportedExtensions = []string{
+	extensionQuery,
+	extensionQueryOpenSSH,
+	extensionSessionBind,
+}
+
+// Extension answers the query extension with the supported extensions, all
+// the other extension types are unsupported, which the agent protocol
+// reports with a plain failure instead of an error. The keyring is shared by
+// the connections, so session-bind only reaches it outside of serve.
+func (r *keyring) Extension(extensionType string, contents []byte) ([]byte, error) {
+	switch extensionType {
+	case extensionQuery, extensionQueryOpenSSH:
+		return queryReply(supportedExtensions), nil
+	default:
+		return nil, ErrExtensionUnsupported
+	}
+}
+
+// queryReply encodes the reply to the query extension, SSH_AGENT_SUCCESS
+// followed by the names of the extensions.
+func queryReply(names []string) []byte {
+	reply := []byte{agentSuccess}
+	for _, name := range names {
+		reply = append(reply, ssh.Marshal(struct{ Name string }{name})...)
+	}
+	return reply
+}
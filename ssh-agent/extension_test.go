@@ -0,0 +1,53 @@
+package ssh_agent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveTestAgent serves a over a pipe, returning the client side.
+func serveTestAgent(a agent.Agent) (agent.ExtendedAgent, func()) {
+	server, client := net.Pipe()
+	go agent.ServeAgent(a, server)
+	return agent.NewClient(client), func() {
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestQueryExtension(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	client, closeClient := serveTestAgent(ssha.Agent)
+	defer closeClient()
+
+	for _, query := range []string{"query", "query@openssh.com"} {
+		reply, err := client.Extension(query, nil)
+		require.NoError(err)
+		require.Equal(byte(agentSuccess), reply[0])
+		var names []string
+		for rest := reply[1:]; len(rest) > 0; {
+			var name struct {
+				Name string
+				Rest []byte `ssh:"rest"`
+			}
+			require.NoError(ssh.Unmarshal(rest, &name))
+			names = append(names, name.Name)
+			rest = name.Rest
+		}
+		require.Equal(supportedExtensions, names)
+	}
+
+	// Unknown extensions get the standard failure, the connection keeps
+	// being served
+	_, err := client.Extension("unknown@example.com", nil)
+	require.Equal(agent.ErrExtensionUnsupported, err)
+	keys, err := client.List()
+	require.NoError(err)
+	require.Empty(keys)
+}
@@ -0,0 +1,47 @@
+package ssh_agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// FingerprintFormat selects how key fingerprints are rendered in logs.
+type FingerprintFormat string
+
+const (
+	// FingerprintSHA256 is the OpenSSH default, e.g. "SHA256:base64...".
+	FingerprintSHA256 FingerprintFormat = "sha256"
+	// FingerprintSHA256Hex is the hex encoded SHA256 digest of the key.
+	FingerprintSHA256Hex FingerprintFormat = "sha256-hex"
+	// FingerprintMD5 is the legacy colon separated MD5 representation.
+	FingerprintMD5 FingerprintFormat = "md5"
+)
+
+// ParseFingerprintFormat validates a fingerprint format name.
+func ParseFingerprintFormat(name string) (FingerprintFormat, error) {
+	switch format := FingerprintFormat(name); format {
+	case FingerprintSHA256, FingerprintSHA256Hex, FingerprintMD5:
+		return format, nil
+	case "":
+		return FingerprintSHA256, nil
+	default:
+		return "", errors.New(fmt.Sprintf("Unknown fingerprint format %q, use one of sha256, sha256-hex or md5", name))
+	}
+}
+
+// Fingerprint renders the fingerprint of key in the given format.
+func (format FingerprintFormat) Fingerprint(key ssh.PublicKey) string {
+	switch format {
+	case FingerprintSHA256Hex:
+		sum := sha256.Sum256(key.Marshal())
+		return "SHA256:" + hex.EncodeToString(sum[:])
+	case FingerprintMD5:
+		return "MD5:" + ssh.FingerprintLegacyMD5(key)
+	default:
+		return ssh.FingerprintSHA256(key)
+	}
+}
@@ -0,0 +1,107 @@
+package ssh_agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+
+	bunkr_client "github.com/off-the-grid-inc/bunkr-client"
+)
+
+// HealthStatus summarises a health check.
+type HealthStatus string
+
+const (
+	// HealthOK means the agent serves its socket and Bunkr answers.
+	HealthOK HealthStatus = "ok"
+	// HealthDegraded means the agent serves its socket but Bunkr can not be
+	// reached, so signing fails.
+	HealthDegraded HealthStatus = "degraded"
+	// HealthDown means nothing answers on the agent socket.
+	HealthDown HealthStatus = "down"
+)
+
+// HealthReport is the outcome of CheckHealth.
+type HealthReport struct {
+	Status HealthStatus
+	// Keys is the number of keys the agent lists.
+	Keys int
+	// AgentError is why the agent socket could not be used, if it could not.
+	AgentError error
+	// BunkrError is why Bunkr could not be reached, if it could not.
+	BunkrError error
+}
+
+func (r *HealthReport) String() string {
+	if r.AgentError != nil {
+		return fmt.Sprintf("%s: agent not reachable: %v", r.Status, r.AgentError)
+	}
+	if r.BunkrError != nil {
+		return fmt.Sprintf("%s: agent serving %d keys, Bunkr not reachable: %v", r.Status, r.Keys, r.BunkrError)
+	}
+	return fmt.Sprintf("%s: agent serving %d keys, Bunkr reachable", r.Status, r.Keys)
+}
+
+// CheckHealth lists the keys of the agent at agentAddr and checks that the
+// Bunkr daemon at bunkrAddr answers, each check taking at most timeout.
+func CheckHealth(agentAddr, bunkrAddr string, timeout time.Duration) *HealthReport {
+	return checkHealth(agentAddr, func() (BunkrClient, error) {
+		return bunkr_client.NewBunkrClient(bunkrAddr)
+	}, timeout)
+}
+
+func checkHealth(agentAddr string, dialBunkr func() (BunkrClient, error), timeout time.Duration) *HealthReport {
+	report := &HealthReport{Status: HealthOK}
+	keys, err := listAgentKeys(agentAddr, timeout)
+	if err != nil {
+		report.Status = HealthDown
+		report.AgentError = err
+		return report
+	}
+	report.Keys = keys
+	if err := pingBunkr(dialBunkr, timeout); err != nil {
+		report.Status = HealthDegraded
+		report.BunkrError = err
+	}
+	return report
+}
+
+// listAgentKeys returns how many keys the agent at addr lists.
+func listAgentKeys(addr string, timeout time.Duration) (int, error) {
+	conn, err := dialAgent(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// pingBunkr connects to Bunkr and asks for its version, the cheapest call it
+// answers.
+func pingBunkr(dialBunkr func() (BunkrClient, error), timeout time.Duration) error {
+	_, err := callBunkr(timeout, retryPolicy{}, func() (string, error) {
+		client, err := dialBunkr()
+		if err != nil {
+			return "", err
+		}
+		if closer, ok := client.(io.Closer); ok {
+			defer closer.Close()
+		}
+		return "", checkBunkrVersion(client)
+	})
+	if err == context.DeadlineExceeded {
+		return errors.New(fmt.Sprintf("no answer within %v", timeout))
+	}
+	return err
+}
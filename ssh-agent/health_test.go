@@ -0,0 +1,63 @@
+package ssh_agent
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type versionedBunkr struct {
+	*fakeBunkr
+	*mockVersionClient
+}
+
+func TestCheckHealth(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	// Nothing listening yet
+	report := checkHealth(ssha.agentSocketPath, nil, time.Second)
+	require.Equal(HealthDown, report.Status)
+	require.Error(report.AgentError)
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, _ := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.AddKey(secret))
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+	defer ssha.Stop()
+	require.NoError(ssha.WaitReady(ctx))
+
+	healthy := func() (BunkrClient, error) {
+		return &versionedBunkr{bunkr, &mockVersionClient{version: "1.2.0"}}, nil
+	}
+	report = checkHealth(ssha.agentSocketPath, healthy, time.Second)
+	require.Equal(HealthOK, report.Status)
+	require.Equal(1, report.Keys)
+	require.Equal("ok: agent serving 1 keys, Bunkr reachable", report.String())
+
+	// Bunkr down while the agent socket is up
+	refused := func() (BunkrClient, error) {
+		return nil, syscall.ECONNREFUSED
+	}
+	report = checkHealth(ssha.agentSocketPath, refused, time.Second)
+	require.Equal(HealthDegraded, report.Status)
+	require.Equal(1, report.Keys)
+	require.Equal(syscall.ECONNREFUSED, report.BunkrError)
+
+	failing := func() (BunkrClient, error) {
+		return &versionedBunkr{bunkr, &mockVersionClient{err: errors.New("broken pipe")}}, nil
+	}
+	report = checkHealth(ssha.agentSocketPath, failing, time.Second)
+	require.Equal(HealthDegraded, report.Status)
+	require.Contains(report.String(), "Bunkr not reachable")
+}
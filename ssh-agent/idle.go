@@ -0,0 +1,27 @@
+package ssh_agent
+
+import (
+	"net"
+	"time"
+)
+
+// idleConn is a connection whose reads fail once no data arrived for the
+// idle timeout. The deadline is pushed back before every read, so time spent
+// answering a request, e.g. waiting for Bunkr, does not count as idle.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// isTimeout reports whether err is a connection deadline being reached.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -10,10 +10,11 @@ import (
 	"crypto/subtle"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"sync"
 	"time"
 
+	"golang.org/x/crypto/scrypt"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
@@ -22,6 +23,7 @@ type Key = agent.Key
 type Agent = agent.Agent
 type AddedKey = agent.AddedKey
 type SignatureFlags = agent.SignatureFlags
+type ConstraintExtension = agent.ConstraintExtension
 
 var ErrExtensionUnsupported = agent.ErrExtensionUnsupported
 
@@ -30,8 +32,21 @@ const SignatureFlagRsaSha512 = agent.SignatureFlagRsaSha512
 
 type privKey struct {
 	signer  ssh.Signer
+	name    string
+	group   string
 	comment string
 	expire  *time.Time
+	timer   *time.Timer
+	confirm bool
+	// lifetimeSecs is the lifetime the key was loaded with, zero if none.
+	lifetimeSecs uint32
+	// destinations restrict the hosts the key can authenticate to, see
+	// checkDestination.
+	destinations []destinationConstraint
+	// fromBunkr is set for the keys loaded from the agent storage.
+	fromBunkr bool
+	// inFlight tracks the sign operations currently using the key.
+	inFlight *sync.WaitGroup
 }
 
 type keyring struct {
@@ -39,11 +54,54 @@ type keyring struct {
 	ssha *SSHAgent
 	keys map[string]privKey
 
-	locked     bool
-	passphrase []byte
+	locked bool
+	// lockSalt and lockHash hold the salted hash of the lock passphrase, the
+	// passphrase itself is never kept.
+	lockSalt []byte
+	lockHash []byte
+
+	// lastUsed holds when each key last signed, it outlives the keys being
+	// loaded again from the storage.
+	lastUsed map[string]time.Time
+	// persistedUse holds when the last use of each stored key was last
+	// written to the storage, by secret name.
+	persistedUse map[string]time.Time
+	// dismissed holds the names of the stored secrets whose keys were
+	// removed through the agent protocol (ssh-add -d/-D), they are not loaded
+	// from the storage again until imported or reloaded explicitly.
+	dismissed map[string]bool
+
+	// now is the clock used for key lifetimes, replaceable in tests.
+	now func() time.Time
+	// watchingClock is set while watchClock runs.
+	watchingClock bool
 }
 
+// clockJumpThreshold is how far the wall clock may drift from the monotonic
+// clock between two checks before it is considered a jump (suspend/resume,
+// NTP step, manual change).
+const clockJumpThreshold = 2 * time.Second
+
+// defaultRemovalGracePeriod is how long removing a key waits for the sign
+// operations in flight with it.
+const defaultRemovalGracePeriod = 30 * time.Second
+
 var errLocked = errors.New("agent: locked")
+var errAlreadyLocked = errors.New("agent: already locked")
+
+// Parameters of the scrypt hash of the lock passphrase.
+const (
+	lockSaltSize = 16
+	lockHashSize = 32
+	lockScryptN  = 1 << 15
+	lockScryptR  = 8
+	lockScryptP  = 1
+)
+
+// hashPassphrase returns the scrypt hash of passphrase with salt.
+func hashPassphrase(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, lockScryptN, lockScryptR, lockScryptP, lockHashSize)
+}
 
 type BunkrAgent interface {
 	Agent
@@ -54,20 +112,42 @@ type BunkrAgent interface {
 // for concurrent use by multiple goroutines.
 func NewKeyring(ssha *SSHAgent) BunkrAgent {
 	return &keyring{
-		ssha: ssha,
-		keys: make(map[string]privKey),
+		ssha:      ssha,
+		keys:      make(map[string]privKey),
+		lastUsed:  make(map[string]time.Time),
+		dismissed: make(map[string]bool),
+		now:       time.Now,
 	}
 }
 
-// RemoveAll removes all identities.
+// RemoveAll removes all identities. The keys loaded from the storage are
+// not loaded again, see dismissed.
 func (r *keyring) RemoveAll() error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 	if r.locked {
+		r.mu.Unlock()
 		return errLocked
 	}
 
-	r.keys = nil
+	removed := make([]privKey, 0, len(r.keys))
+	for _, k := range r.keys {
+		if k.timer != nil {
+			k.timer.Stop()
+		}
+		if k.fromBunkr {
+			r.dismissed[k.name] = true
+		}
+		removed = append(removed, k)
+	}
+	r.keys = make(map[string]privKey)
+	r.lastUsed = make(map[string]time.Time)
+	r.keysMetricLocked()
+	r.mu.Unlock()
+	// Wait for the signs in flight without the lock, so the keyring keeps
+	// answering meanwhile.
+	for _, k := range removed {
+		r.waitInFlight(k)
+	}
 	return nil
 }
 
@@ -75,37 +155,207 @@ func (r *keyring) RemoveAll() error {
 // keyring mutex.
 func (r *keyring) removeLocked(want []byte) error {
 	key := string(want)
-	if _, exists := r.keys[key]; exists {
+	if k, exists := r.keys[key]; exists {
+		if k.timer != nil {
+			k.timer.Stop()
+		}
 		delete(r.keys, key)
+		delete(r.lastUsed, key)
+		r.keysMetricLocked()
 		return nil
 	}
 	return errors.New("agent: key not found")
 }
 
+// keysMetricLocked reports the number of keys held. The caller must be
+// holding the keyring mutex.
+func (r *keyring) keysMetricLocked() {
+	if r.ssha == nil {
+		return
+	}
+	count := len(r.keys)
+	r.ssha.agentMetrics(func(sink AgentMetricsSink) { sink.KeysLoaded(count) })
+}
+
+// hasKey reports whether key is currently held by the keyring.
+func (r *keyring) hasKey(key ssh.PublicKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, exists := r.keys[string(key.Marshal())]
+	return exists
+}
+
 // Remove removes all identities with the given public key.
+// It returns once the sign operations in flight with the key are done. A key
+// loaded from the storage is not loaded again, see dismissed.
 func (r *keyring) Remove(key ssh.PublicKey) error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 	if r.locked {
+		r.mu.Unlock()
 		return errLocked
 	}
 
-	return r.removeLocked(key.Marshal())
+	k, exists := r.keys[string(key.Marshal())]
+	if exists && k.fromBunkr {
+		r.dismissed[k.name] = true
+	}
+	err := r.removeLocked(key.Marshal())
+	r.mu.Unlock()
+	if exists {
+		r.waitInFlight(k)
+	}
+	return err
+}
+
+// removeNamed removes the identities backed by the secret name, waiting for
+// the sign operations in flight with them.
+func (r *keyring) removeNamed(name string) {
+	var removed []privKey
+	r.mu.Lock()
+	for key, k := range r.keys {
+		if k.name != name {
+			continue
+		}
+		if k.timer != nil {
+			k.timer.Stop()
+		}
+		delete(r.keys, key)
+		delete(r.lastUsed, key)
+		removed = append(removed, k)
+	}
+	if len(removed) > 0 {
+		r.keysMetricLocked()
+	}
+	r.mu.Unlock()
+	for _, k := range removed {
+		r.waitInFlight(k)
+	}
+}
+
+// restore allows the keys of the secret name to be loaded again after being
+// removed through the agent protocol.
+func (r *keyring) restore(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.dismissed, name)
+}
+
+// pruneDismissed forgets the dismissed secrets that are no longer stored, so
+// that a secret imported again under the same name is loaded.
+func (r *keyring) pruneDismissed(stored map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name := range r.dismissed {
+		if !stored[name] {
+			delete(r.dismissed, name)
+		}
+	}
+}
+
+// isDismissed reports whether the keys of the secret name were removed
+// through the agent protocol.
+func (r *keyring) isDismissed(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dismissed[name]
+}
+
+// bunkrKeys returns the marshalled public keys of the keys loaded from the
+// storage, by secret name.
+func (r *keyring) bunkrKeys() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make(map[string][]string)
+	for key, k := range r.keys {
+		if k.fromBunkr {
+			keys[k.name] = append(keys[k.name], key)
+		}
+	}
+	return keys
+}
+
+// loadedKey is the configuration a key is loaded from the storage with.
+type loadedKey struct {
+	publicKey    string
+	group        string
+	comment      string
+	lifetimeSecs uint32
+	confirm      bool
+}
+
+// bunkrLoaded returns the configuration of the keys loaded from the storage,
+// by secret name.
+func (r *keyring) bunkrLoaded() map[string][]loadedKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	loaded := make(map[string][]loadedKey)
+	for key, k := range r.keys {
+		if k.fromBunkr {
+			loaded[k.name] = append(loaded[k.name], loadedKey{
+				publicKey:    key,
+				group:        k.group,
+				comment:      k.comment,
+				lifetimeSecs: k.lifetimeSecs,
+				confirm:      k.confirm,
+			})
+		}
+	}
+	return loaded
+}
+
+// waitInFlight waits, at most for the removal grace period, for the sign
+// operations using k to finish. It must be called without holding the
+// keyring mutex.
+func (r *keyring) waitInFlight(k privKey) {
+	if k.inFlight == nil {
+		return
+	}
+	grace := defaultRemovalGracePeriod
+	if r.ssha != nil && r.ssha.removalGracePeriod > 0 {
+		grace = r.ssha.removalGracePeriod
+	}
+	done := make(chan struct{})
+	go func() {
+		k.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		r.logger().Warn(fmt.Sprintf("Removed key %s while a sign operation is still running", k.name))
+	}
 }
 
 // Lock locks the agent. Sign and Remove will fail, and List will return an empty list.
+// Only a salted hash of the passphrase is kept to check Unlock against.
 func (r *keyring) Lock(passphrase []byte) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.locked {
-		return errLocked
+		return errAlreadyLocked
 	}
 
+	salt := make([]byte, lockSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	hash, err := hashPassphrase(passphrase, salt)
+	if err != nil {
+		return err
+	}
 	r.locked = true
-	r.passphrase = passphrase
+	r.lockSalt = salt
+	r.lockHash = hash
 	return nil
 }
 
+// isLocked reports whether the keyring is locked.
+func (r *keyring) isLocked() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.locked
+}
+
 // Unlock undoes the effect of Lock
 func (r *keyring) Unlock(passphrase []byte) error {
 	r.mu.Lock()
@@ -113,30 +363,144 @@ func (r *keyring) Unlock(passphrase []byte) error {
 	if !r.locked {
 		return errors.New("agent: not locked")
 	}
-	if 1 != subtle.ConstantTimeCompare(passphrase, r.passphrase) {
+	hash, err := hashPassphrase(passphrase, r.lockSalt)
+	if err != nil {
+		return err
+	}
+	if 1 != subtle.ConstantTimeCompare(hash, r.lockHash) {
 		return errors.New("agent: incorrect passphrase")
 	}
 
 	r.locked = false
-	r.passphrase = nil
+	r.lockSalt = nil
+	r.lockHash = nil
 	return nil
 }
 
 // expireKeysLocked removes expired keys from the keyring. If a key was added
 // with a lifetimesecs contraint and seconds >= lifetimesecs seconds have
-// ellapsed, it is removed. The caller *must* be holding the keyring mutex.
+// ellapsed, it is removed. Expired keys of stored secrets are dismissed.
+// The caller *must* be holding the keyring mutex.
 func (r *keyring) expireKeysLocked() {
 	for _, k := range r.keys {
-		if k.expire != nil && time.Now().After(*k.expire) {
-			if err := r.removeLocked(k.signer.PublicKey().Marshal()); err != nil {
-				log.Print(err)
+		if k.expire != nil && r.expiredLocked(*k.expire) {
+			pub := k.signer.PublicKey()
+			if err := r.removeLocked(pub.Marshal()); err != nil {
+				r.logger().Error(err.Error())
+				continue
+			}
+			if k.fromBunkr {
+				// Otherwise the next List would load it again
+				r.dismissed[k.name] = true
+			}
+			if r.ssha != nil && r.ssha.onKeyExpired != nil {
+				go r.ssha.onKeyExpired(r.ssha.fingerprintFormat.Fingerprint(pub), k.name)
 			}
 		}
 	}
 }
 
+// expiredLocked reports whether deadline has passed. The monotonic reading
+// of the deadline is honoured, but since the monotonic clock stops while the
+// system is suspended the wall clock deadline is checked too.
+func (r *keyring) expiredLocked(deadline time.Time) bool {
+	now := r.now()
+	return now.After(deadline) || now.Round(0).After(deadline.Round(0))
+}
+
+// watchClock periodically compares the wall and monotonic clocks, when they
+// diverge the system was suspended or the clock stepped, so lifetimes are
+// re-evaluated straight away instead of waiting for the timers. It returns
+// once no key has a lifetime or the agent stops.
+func (r *keyring) watchClock(interval time.Duration) {
+	var done <-chan struct{}
+	if r.ssha != nil {
+		done = r.ssha.stoppedChan()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-done:
+			r.stopWatchingClock(true)
+			return
+		case <-ticker.C:
+		}
+		if r.stopWatchingClock(false) {
+			return
+		}
+		now := time.Now()
+		drift := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		if drift > clockJumpThreshold || drift < -clockJumpThreshold {
+			r.logger().Info(fmt.Sprintf("Clock jump of %v detected, checking key lifetimes", drift))
+			r.expireKeys()
+		}
+		last = now
+	}
+}
+
+// stopWatchingClock reports whether watchClock should return, because the
+// agent stopped or no key has a lifetime, clearing watchingClock if so.
+func (r *keyring) stopWatchingClock(stopped bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !stopped {
+		for _, k := range r.keys {
+			if k.expire != nil {
+				return false
+			}
+		}
+	}
+	r.watchingClock = false
+	return true
+}
+
+// expireKeys is run by the lifetime timers to drop expired keys even if the
+// agent is not being used.
+func (r *keyring) expireKeys() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireKeysLocked()
+}
+
+// insertLocked stores p in the keyring, arming its lifetime timer if
+// lifetimeSecs is not zero. The caller must be holding the keyring mutex.
+func (r *keyring) insertLocked(p privKey, lifetimeSecs uint32) {
+	publicKey := string(p.signer.PublicKey().Marshal())
+	if old, exists := r.keys[publicKey]; exists {
+		if old.timer != nil {
+			old.timer.Stop()
+		}
+		// The key loaded again, e.g. by List, is still being used by the
+		// signs in flight, removing it must wait for them.
+		p.inFlight = old.inFlight
+	}
+	if p.inFlight == nil {
+		p.inFlight = &sync.WaitGroup{}
+	}
+	if lifetimeSecs > 0 {
+		lifetime := time.Duration(lifetimeSecs) * time.Second
+		t := r.now().Add(lifetime)
+		p.expire = &t
+		if !r.watchingClock {
+			r.watchingClock = true
+			go r.watchClock(time.Second)
+		}
+		// Fire slightly after the deadline so expireKeysLocked sees it elapsed
+		p.timer = time.AfterFunc(lifetime+time.Millisecond, r.expireKeys)
+	}
+	r.keys[publicKey] = p
+	r.keysMetricLocked()
+}
+
 func (r *keyring) updateList() error {
 	if err := r.ssha.loadKeys(); err != nil {
+		r.ssha.recentErrors.record(err)
+		if r.ssha.allowEmpty {
+			r.ssha.logger.Warn(fmt.Sprintf("Could not list keys from Bunkr: %v", err))
+			return nil
+		}
 		return errors.New(fmt.Sprintf("agent: error listing keys from Bunkr. %v", err))
 	}
 	return nil
@@ -144,8 +508,10 @@ func (r *keyring) updateList() error {
 
 // List returns the identities known to the agent.
 func (r *keyring) List() ([]*Key, error) {
-	if err := r.updateList(); err != nil {
-		return nil, err
+	if !r.isLocked() {
+		if err := r.updateList(); err != nil {
+			return nil, err
+		}
 	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -156,20 +522,34 @@ func (r *keyring) List() ([]*Key, error) {
 	}
 	r.expireKeysLocked()
 	var ids []*Key
-	for _, k := range r.keys {
+	for _, k := range r.orderedKeysLocked() {
 		pub := k.signer.PublicKey()
 		ids = append(ids, &Key{
 			Format:  pub.Type(),
 			Blob:    pub.Marshal(),
-			Comment: k.comment})
+			Comment: r.listedComment(k)})
 	}
 	return ids, nil
 }
 
+// listedComment returns the comment k is listed with, which includes the
+// host name when configured. Only listings are decorated, the key keeps its
+// own comment.
+func (r *keyring) listedComment(k privKey) string {
+	if r.ssha == nil || r.ssha.commentHostname == "" {
+		return k.comment
+	}
+	return fmt.Sprintf("%s [%s]", k.comment, r.ssha.commentHostname)
+}
+
 type BunkrAddedKey struct {
 	// PrivateKey must be a *rsa.PrivateKey, *dsa.PrivateKey or
 	// *ecdsa.PrivateKey, which will be inserted into the agent.
 	Signer ssh.Signer
+	// Name is the name of the Bunkr secret backing the key.
+	Name string
+	// Group is the name of the Bunkr group of the secret, if any.
+	Group string
 	// Comment is an optional, free-form string.
 	Comment string
 	// LifetimeSecs, if not zero, is the number of seconds that the
@@ -178,36 +558,60 @@ type BunkrAddedKey struct {
 	// ConfirmBeforeUse, if true, requests that the agent confirm with the
 	// user before each use of this key.
 	ConfirmBeforeUse bool
+	// ConstraintExtensions restrict the use of the key, only the destination
+	// constraints of ssh-add -h are supported.
+	ConstraintExtensions []ConstraintExtension
 }
 
 // Insert adds a private key to the keyring from murmur. If a certificate
-// is given, that certificate is added as public key. Note that
-// any constraints given are ignored.
+// is given, that certificate is added as public key. Destination
+// constraints are enforced when signing. Keys of dismissed secrets are
+// skipped.
 func (r *keyring) AddFromBunkr(key BunkrAddedKey) error {
+	destinations, err := parseKeyConstraints(key.ConstraintExtensions)
+	if err != nil {
+		return err
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.locked {
 		return errLocked
 	}
+	if r.dismissed[key.Name] {
+		return nil
+	}
 
 	p := privKey{
 		signer:  key.Signer,
+		name:    key.Name,
+		group:   key.Group,
 		comment: key.Comment,
-	}
+		confirm: key.ConfirmBeforeUse,
 
-	if key.LifetimeSecs > 0 {
-		t := time.Now().Add(time.Duration(key.LifetimeSecs) * time.Second)
-		p.expire = &t
+		lifetimeSecs: key.LifetimeSecs,
+		destinations: destinations,
+		fromBunkr:    true,
 	}
 	publicKey := string(key.Signer.PublicKey().Marshal())
-	r.keys[publicKey] = p
+	if old, exists := r.keys[publicKey]; exists && old.fromBunkr && old.expire != nil && key.LifetimeSecs > 0 {
+		// Loading the storage again, e.g. on List, keeps the deadline of
+		// the loaded key instead of extending its lifetime.
+		p.expire, p.timer, p.inFlight = old.expire, old.timer, old.inFlight
+		r.keys[publicKey] = p
+		return nil
+	}
+	r.insertLocked(p, key.LifetimeSecs)
 	return nil
 }
 
 // Insert adds a private key to the keyring. If a certificate
-// is given, that certificate is added as public key. Note that
-// any constraints given are ignored.
+// is given, that certificate is added as public key. Destination
+// constraints are enforced when signing.
 func (r *keyring) Add(key AddedKey) error {
+	destinations, err := parseKeyConstraints(key.ConstraintExtensions)
+	if err != nil {
+		return err
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.locked {
@@ -228,16 +632,13 @@ func (r *keyring) Add(key AddedKey) error {
 
 	p := privKey{
 		signer:  signer,
+		name:    key.Comment,
 		comment: key.Comment,
-	}
+		confirm: key.ConfirmBeforeUse,
 
-	if key.LifetimeSecs > 0 {
-		t := time.Now().Add(time.Duration(key.LifetimeSecs) * time.Second)
-		p.expire = &t
+		destinations: destinations,
 	}
-
-	publicKey := string(p.signer.PublicKey().Marshal())
-	r.keys[publicKey] = p
+	r.insertLocked(p, key.LifetimeSecs)
 	return nil
 }
 
@@ -247,16 +648,54 @@ func (r *keyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 }
 
 func (r *keyring) SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error) {
+	start := time.Now()
+	var sig *ssh.Signature
+	var err error
+	if r.ssha != nil {
+		err = r.ssha.algorithmAllowed(key, flags)
+	}
+	if err == nil {
+		sig, err = r.signWithFlags(key, data, flags)
+	}
+	if r.ssha != nil {
+		r.ssha.signMetric(key, flags, time.Since(start), err)
+		if err != nil {
+			r.ssha.recentErrors.record(err)
+		}
+	}
+	if err == nil {
+		r.used(key)
+	}
+	return sig, err
+}
+
+func (r *keyring) signWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error) {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 	if r.locked {
+		r.mu.Unlock()
 		return nil, errLocked
 	}
 
 	r.expireKeysLocked()
 	wanted := key.Marshal()
 	pubKey := string(wanted)
-	if k, exists := r.keys[pubKey]; exists {
+	k, exists := r.keys[pubKey]
+	if exists {
+		// Sign without holding the mutex, Bunkr calls may take a while.
+		// Removing the key waits for the operation to finish.
+		k.inFlight.Add(1)
+		defer k.inFlight.Done()
+	}
+	r.mu.Unlock()
+
+	if exists && k.confirm && !r.confirm(k) {
+		return nil, errors.New("agent: signature not confirmed")
+	}
+	if exists {
+		if underlyingKeyType(k.signer.PublicKey()) != ssh.KeyAlgoRSA {
+			// The flags only pick the hash of RSA signatures
+			flags = 0
+		}
 		if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
 			if flags == 0 {
 				return k.signer.Sign(rand.Reader, data)
@@ -281,6 +720,73 @@ func (r *keyring) SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureF
 	return nil, errors.New("not found")
 }
 
+// lastUsedPersistInterval is how often at most the last use of a stored
+// key is written to the storage, signing in a loop does not rewrite it
+// every time.
+const lastUsedPersistInterval = time.Minute
+
+// used records that key just signed, in the storage too for the keys
+// loaded from it.
+func (r *keyring) used(key ssh.PublicKey) {
+	r.mu.Lock()
+	publicKey := string(key.Marshal())
+	k, exists := r.keys[publicKey]
+	if !exists {
+		r.mu.Unlock()
+		return
+	}
+	now := r.now()
+	r.lastUsed[publicKey] = now
+	persist := k.fromBunkr && r.ssha != nil && r.ssha.storage != nil
+	if persist {
+		if r.persistedUse == nil {
+			r.persistedUse = make(map[string]time.Time)
+		}
+		if last, ok := r.persistedUse[k.name]; ok && now.Sub(last) < lastUsedPersistInterval {
+			persist = false
+		} else {
+			r.persistedUse[k.name] = now
+		}
+	}
+	r.mu.Unlock()
+	if persist {
+		r.ssha.persistLastUsed(k.name, now)
+	}
+}
+
+// comment returns the comment of the loaded key, empty if it is not loaded.
+func (r *keyring) comment(key ssh.PublicKey) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keys[string(key.Marshal())].comment
+}
+
+// destinations returns the destination constraints of the loaded key.
+func (r *keyring) destinations(key ssh.PublicKey) []destinationConstraint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keys[string(key.Marshal())].destinations
+}
+
+// logger returns the logger of the agent, nil for a keyring without one
+// which logs through the standard logger.
+func (r *keyring) logger() *Logger {
+	if r.ssha == nil {
+		return nil
+	}
+	return r.ssha.logger
+}
+
+// confirm asks the configured Confirmer whether k may be used, denying if
+// there is none.
+func (r *keyring) confirm(k privKey) bool {
+	if r.ssha == nil || r.ssha.confirmer == nil {
+		r.logger().Warn(fmt.Sprintf("Key %s requires confirmation but no confirmation method is configured", k.name))
+		return false
+	}
+	return r.ssha.confirmer.Confirm(r.ssha.fingerprintFormat.Fingerprint(k.signer.PublicKey()), k.comment)
+}
+
 // Signers returns signers for all the known keys.
 func (r *keyring) Signers() ([]ssh.Signer, error) {
 	r.mu.Lock()
@@ -291,13 +797,8 @@ func (r *keyring) Signers() ([]ssh.Signer, error) {
 
 	r.expireKeysLocked()
 	s := make([]ssh.Signer, 0, len(r.keys))
-	for _, k := range r.keys {
+	for _, k := range r.orderedKeysLocked() {
 		s = append(s, k.signer)
 	}
 	return s, nil
 }
-
-// The keyring does not support any extensions
-func (r *keyring) Extension(extensionType string, contents []byte) ([]byte, error) {
-	return nil, ErrExtensionUnsupported
-}
@@ -0,0 +1,459 @@
+package ssh_agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestOnKeyExpired(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	ssha.fingerprintFormat = FingerprintSHA256Hex
+
+	type expiry struct{ fingerprint, name string }
+	expired := make(chan expiry, 1)
+	WithOnKeyExpired(func(fingerprint, name string) {
+		expired <- expiry{fingerprint, name}
+	})(ssha)
+
+	_, sshPub := newTestSecret(t, "short")
+	signer, err := newBunkrSigner(sshPub, nil, "short", "")
+	require.NoError(err)
+	require.NoError(ssha.Agent.AddFromBunkr(BunkrAddedKey{Signer: signer, Name: "short", LifetimeSecs: 1}))
+
+	select {
+	case e := <-expired:
+		require.Equal(FingerprintSHA256Hex.Fingerprint(sshPub), e.fingerprint)
+		require.Equal("short", e.name)
+	case <-time.After(3 * time.Second):
+		t.Fatal("expiry callback was not called")
+	}
+	require.Len(ssha.Agent.(*keyring).keys, 0)
+}
+
+func TestLifetimeClockJump(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	kr := ssha.Agent.(*keyring)
+	clock := time.Now().Round(0)
+	kr.now = func() time.Time { return clock }
+
+	_, sshPub := newTestSecret(t, "hourly")
+	signer, err := newBunkrSigner(sshPub, nil, "hourly", "")
+	require.NoError(err)
+	require.NoError(kr.AddFromBunkr(BunkrAddedKey{Signer: signer, Name: "hourly", LifetimeSecs: 3600}))
+
+	kr.expireKeys()
+	require.Len(kr.keys, 1)
+
+	// The machine resumes two hours later, the wall clock jumped ahead
+	clock = clock.Add(2 * time.Hour)
+	kr.expireKeys()
+	require.Len(kr.keys, 0)
+}
+
+func TestClockWatchStops(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	kr := ssha.Agent.(*keyring)
+
+	watch := func() chan struct{} {
+		returned := make(chan struct{})
+		go func() {
+			kr.watchClock(10 * time.Millisecond)
+			close(returned)
+		}()
+		return returned
+	}
+	waitReturned := func(returned chan struct{}) {
+		select {
+		case <-returned:
+		case <-time.After(3 * time.Second):
+			t.Fatal("the clock watch did not return")
+		}
+	}
+
+	// Without lifetime keys there is nothing to watch
+	waitReturned(watch())
+
+	// The watch started by a lifetime key ends with the agent
+	_, sshPub := newTestSecret(t, "hourly")
+	signer, err := newBunkrSigner(sshPub, nil, "hourly", "")
+	require.NoError(err)
+	require.NoError(kr.AddFromBunkr(BunkrAddedKey{Signer: signer, Name: "hourly", LifetimeSecs: 3600}))
+	returned := watch()
+	select {
+	case <-returned:
+		t.Fatal("the clock watch returned while a key has a lifetime")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_ = ssha.Stop()
+	waitReturned(returned)
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	require.False(kr.watchingClock)
+}
+
+// blockingBunkr holds every sign until release is closed.
+type blockingBunkr struct {
+	*fakeBunkr
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBunkr) SignECDSA(secretName, digest, groupName string) (string, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.fakeBunkr.SignECDSA(secretName, digest, groupName)
+}
+
+func TestRemoveWaitsForInFlightSign(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := &blockingBunkr{newFakeBunkr(), make(chan struct{}, 1), make(chan struct{})}
+	ssha.signClient = bunkr
+	secret, sshPub := bunkr.newSecret(t, "busy")
+	require.NoError(ssha.AddKey(secret))
+
+	signed := make(chan error, 1)
+	go func() {
+		_, err := ssha.Agent.Sign(sshPub, []byte("data"))
+		signed <- err
+	}()
+	<-bunkr.started
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- ssha.Agent.Remove(sshPub)
+	}()
+	select {
+	case <-removed:
+		t.Fatal("Remove returned while a sign was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(bunkr.release)
+	require.NoError(<-signed)
+	require.NoError(<-removed)
+	_, err := ssha.Agent.Sign(sshPub, []byte("data"))
+	require.Error(err)
+}
+
+func TestRemoveWaitsForSignAfterList(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := &blockingBunkr{newFakeBunkr(), make(chan struct{}, 1), make(chan struct{})}
+	ssha.signClient = bunkr
+	secret, sshPub := bunkr.newSecret(t, "busy")
+	require.NoError(ssha.storage.StoreSecret(secret))
+	require.NoError(ssha.loadKeys())
+
+	signed := make(chan error, 1)
+	go func() {
+		_, err := ssha.Agent.Sign(sshPub, []byte("data"))
+		signed <- err
+	}()
+	<-bunkr.started
+	// Listing loads the stored keys again
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- ssha.Agent.Remove(sshPub)
+	}()
+	select {
+	case <-removed:
+		t.Fatal("Remove returned while a sign was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(bunkr.release)
+	require.NoError(<-signed)
+	require.NoError(<-removed)
+}
+
+func TestRemoveAllWaitsWithoutLocking(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := &blockingBunkr{newFakeBunkr(), make(chan struct{}, 1), make(chan struct{})}
+	ssha.signClient = bunkr
+	secret, sshPub := bunkr.newSecret(t, "busy")
+	require.NoError(ssha.AddKey(secret))
+
+	signed := make(chan error, 1)
+	go func() {
+		_, err := ssha.Agent.Sign(sshPub, []byte("data"))
+		signed <- err
+	}()
+	<-bunkr.started
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- ssha.Agent.RemoveAll()
+	}()
+	// The keyring answers while RemoveAll waits for the sign
+	listed := make(chan error, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_, err := ssha.Agent.(*keyring).List()
+		listed <- err
+	}()
+	select {
+	case err := <-listed:
+		require.NoError(err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("List blocked while RemoveAll waited for a sign")
+	}
+	select {
+	case <-removed:
+		t.Fatal("RemoveAll returned while a sign was in flight")
+	default:
+	}
+
+	close(bunkr.release)
+	require.NoError(<-signed)
+	require.NoError(<-removed)
+}
+
+func TestAllowedAlgorithms(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	WithAllowedAlgorithms([]string{ssh.KeyAlgoECDSA256, ssh.SigAlgoRSASHA2512})(ssha)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	require.NoError(ssha.Agent.Add(AddedKey{PrivateKey: rsaKey}))
+	require.NoError(ssha.Agent.Add(AddedKey{PrivateKey: ecKey}))
+	rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	require.NoError(err)
+	ecPub, err := ssh.NewPublicKey(&ecKey.PublicKey)
+	require.NoError(err)
+
+	kr := ssha.Agent.(*keyring)
+	_, err = kr.Sign(ecPub, []byte("data"))
+	require.NoError(err)
+	_, err = kr.SignWithFlags(rsaPub, []byte("data"), SignatureFlagRsaSha512)
+	require.NoError(err)
+	// The RSA flags do not change the algorithm of other keys
+	_, err = kr.SignWithFlags(ecPub, []byte("data"), SignatureFlagRsaSha256)
+	require.NoError(err)
+
+	// The RSA key can sign with SHA-1 and SHA-256 but the policy forbids them
+	_, err = kr.Sign(rsaPub, []byte("data"))
+	require.EqualError(err, "agent: signature algorithm ssh-rsa is not allowed by the policy")
+	_, err = kr.SignWithFlags(rsaPub, []byte("data"), SignatureFlagRsaSha256)
+	require.EqualError(err, "agent: signature algorithm rsa-sha2-256 is not allowed by the policy")
+}
+
+func TestHostnameInComment(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	hostname, err := os.Hostname()
+	require.NoError(err)
+
+	secret, pub := newTestSecret(t, "deploy")
+	secret.Comment = "deploy key"
+	require.NoError(ssha.AddKey(secret))
+
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal("deploy key", keys[0].Comment)
+
+	WithHostnameInComment(true)(ssha)
+	keys, err = ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal(fmt.Sprintf("deploy key [%s]", hostname), keys[0].Comment)
+
+	// The key itself keeps its comment
+	require.Equal("deploy key", ssha.Agent.(*keyring).keys[string(pub.Marshal())].comment)
+}
+
+func TestOfferOrderLRU(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	WithOfferOrder(OfferOrderLRU)(ssha)
+
+	kr := ssha.Agent.(*keyring)
+	now := time.Now()
+	kr.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	pubs := map[string]ssh.PublicKey{}
+	for _, name := range []string{"a", "b", "c"} {
+		secret, pub := bunkr.newSecret(t, name)
+		require.NoError(ssha.storage.StoreSecret(secret))
+		pubs[name] = pub
+	}
+	listed := func() []string {
+		keys, err := kr.List()
+		require.NoError(err)
+		var names []string
+		for _, k := range keys {
+			names = append(names, k.Comment)
+		}
+		return names
+	}
+	require.Len(listed(), 3)
+
+	for _, name := range []string{"c", "a"} {
+		_, err := kr.Sign(pubs[name], []byte("data"))
+		require.NoError(err)
+	}
+	names := listed()
+	require.Equal([]string{"a", "c"}, names[:2])
+
+	_, err := kr.Sign(pubs["b"], []byte("data"))
+	require.NoError(err)
+	require.Equal([]string{"b", "a", "c"}, listed())
+
+	signers, err := kr.Signers()
+	require.NoError(err)
+	require.Equal(pubs["b"].Marshal(), signers[0].PublicKey().Marshal())
+}
+
+func TestRemoveStoredKey(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	removed, removedPub := bunkr.newSecret(t, "removed")
+	require.NoError(ssha.storage.StoreSecret(removed))
+	kept, keptPub := bunkr.newSecret(t, "kept")
+	require.NoError(ssha.storage.StoreSecret(kept))
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 2)
+
+	// ssh-add -d, the key is not loaded again from the storage
+	require.NoError(ssha.Agent.Remove(removedPub))
+	keys, err = ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal(keptPub.Marshal(), keys[0].Blob)
+	_, err = ssha.Agent.Sign(removedPub, []byte("data"))
+	require.Error(err)
+	require.NoError(ssha.Reload())
+	require.Len(ssha.Agent.(*keyring).bunkrKeys(), 1)
+	require.True(ssha.storage.SecretExists("removed"))
+
+	// ssh-add -D
+	require.NoError(ssha.Agent.RemoveAll())
+	keys, err = ssha.Agent.List()
+	require.NoError(err)
+	require.Empty(keys)
+	_, err = ssha.Agent.Sign(keptPub, []byte("data"))
+	require.Error(err)
+
+	// Reloading the key explicitly brings it back
+	require.NoError(ssha.storeAndAdd(kept))
+	keys, err = ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	_, err = ssha.Agent.Sign(keptPub, []byte("data"))
+	require.NoError(err)
+}
+
+func TestLockUnlock(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.AddKey(secret))
+
+	passphrase := []byte("passphrase")
+	require.NoError(ssha.Agent.Lock(passphrase))
+	kr := ssha.Agent.(*keyring)
+	require.NotEqual(passphrase, kr.lockHash)
+	require.Equal(errAlreadyLocked, ssha.Agent.Lock(passphrase))
+
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Empty(keys)
+	_, err = ssha.Agent.Sign(pub, []byte("data"))
+	require.Equal(errLocked, err)
+
+	require.EqualError(ssha.Agent.Unlock([]byte("wrong")), "agent: incorrect passphrase")
+	require.NoError(ssha.Agent.Unlock(passphrase))
+	require.EqualError(ssha.Agent.Unlock(passphrase), "agent: not locked")
+	keys, err = ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	_, err = ssha.Agent.Sign(pub, []byte("data"))
+	require.NoError(err)
+}
+
+func TestStoredKeyLifetime(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	kr := ssha.Agent.(*keyring)
+	clock := time.Now()
+	kr.now = func() time.Time { return clock }
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	short, shortPub := bunkr.newSecret(t, "short")
+	short.LifetimeSecs = 1
+	require.NoError(ssha.storage.StoreSecret(short))
+	forever, _ := bunkr.newSecret(t, "forever")
+	require.NoError(ssha.storage.StoreSecret(forever))
+
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 2)
+
+	// Listing loads the storage again without extending the lifetime
+	clock = clock.Add(500 * time.Millisecond)
+	keys, err = ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 2)
+
+	clock = clock.Add(time.Second)
+	keys, err = ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal("forever", keys[0].Comment)
+	_, err = ssha.Agent.Sign(shortPub, []byte("data"))
+	require.Error(err)
+	keys, err = ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+}
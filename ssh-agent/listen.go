@@ -0,0 +1,50 @@
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// tcpAddrPrefix marks an agent address as a TCP one, e.g.
+// tcp://127.0.0.1:4444. Anything else is a local path, see listenLocal.
+const tcpAddrPrefix = "tcp://"
+
+// listen listens on the agent address addr, returning the socket file it
+// created, if any, to be removed when stopping.
+func (ssha *SSHAgent) listen(addr string) (net.Listener, string, error) {
+	if !strings.HasPrefix(addr, tcpAddrPrefix) {
+		return listenLocal(addr)
+	}
+	hostPort := strings.TrimPrefix(addr, tcpAddrPrefix)
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("Invalid TCP address %s: %v", addr, err))
+	}
+	if !ssha.remoteTCP && !isLoopback(host) {
+		return nil, "", errors.New(fmt.Sprintf("Refusing to listen on %s, the agent protocol is not encrypted so TCP addresses must be loopback ones", addr))
+	}
+	sock, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("listen error: %v", err))
+	}
+	return sock, "", nil
+}
+
+// dialAgent connects to the agent serving on the agent address addr.
+func dialAgent(addr string) (net.Conn, error) {
+	if strings.HasPrefix(addr, tcpAddrPrefix) {
+		return net.Dial("tcp", strings.TrimPrefix(addr, tcpAddrPrefix))
+	}
+	return dialLocal(addr)
+}
+
+// isLoopback reports whether host is localhost or a loopback IP address.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,59 @@
+package ssh_agent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestListenTCP(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.storage.StoreSecret(secret))
+	ssha.agentSocketPath = "tcp://127.0.0.1:0"
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+	defer ssha.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(ssha.WaitReady(ctx))
+
+	ssha.mu.Lock()
+	addr := ssha.listeners[0].Addr()
+	ssha.mu.Unlock()
+	require.Equal("tcp", addr.Network())
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(err)
+	defer conn.Close()
+	keys, err := agent.NewClient(conn).List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal(pub.Marshal(), keys[0].Blob)
+}
+
+func TestListenTCPLoopbackOnly(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	_, _, err := ssha.listen("tcp://0.0.0.0:0")
+	require.Error(err)
+	_, _, err = ssha.listen("tcp://127.0.0.1")
+	require.Error(err)
+
+	WithRemoteTCP(true)(ssha)
+	l, path, err := ssha.listen("tcp://0.0.0.0:0")
+	require.NoError(err)
+	require.Empty(path)
+	require.NoError(l.Close())
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package ssh_agent
+
+import (
+	"net"
+)
+
+// listenLocal listens on the unix socket path, returned as the socket file
+// to remove when stopping.
+func listenLocal(path string) (net.Listener, string, error) {
+	sock, err := listenUnix(path)
+	return sock, path, err
+}
+
+// dialLocal connects to the unix socket path.
+func dialLocal(path string) (net.Conn, error) {
+	return net.Dial("unix", path)
+}
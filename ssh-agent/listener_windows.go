@@ -0,0 +1,50 @@
+//go:build windows
+// +build windows
+
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// pipePrefix starts the named pipe paths, like the OpenSSH agent default
+// \\.\pipe\openssh-ssh-agent.
+const pipePrefix = `\\.\pipe\`
+
+// pipeSecurityDescriptor only gives access to the pipe to its owner and to
+// the system.
+const pipeSecurityDescriptor = "D:P(A;;GA;;;SY)(A;;GA;;;OW)"
+
+// listenLocal listens on the named pipe path, or on the unix socket path for
+// other paths. Pipes leave no file behind, so no path is returned for them.
+func listenLocal(path string) (net.Listener, string, error) {
+	if !strings.HasPrefix(strings.ToLower(path), pipePrefix) {
+		sock, err := listenUnix(path)
+		return sock, path, err
+	}
+	timeout := 100 * time.Millisecond
+	if con, err := winio.DialPipe(path, &timeout); err == nil {
+		con.Close()
+		return nil, "", ErrAgentAlreadyRunning
+	}
+	sock, err := winio.ListenPipe(path, &winio.PipeConfig{SecurityDescriptor: pipeSecurityDescriptor})
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("listen error: %v", err))
+	}
+	return sock, "", nil
+}
+
+// dialLocal connects to the named pipe or unix socket path.
+func dialLocal(path string) (net.Conn, error) {
+	if !strings.HasPrefix(strings.ToLower(path), pipePrefix) {
+		return net.Dial("unix", path)
+	}
+	timeout := time.Second
+	return winio.DialPipe(path, &timeout)
+}
@@ -0,0 +1,41 @@
+//go:build windows
+// +build windows
+
+package ssh_agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestListenNamedPipe(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	ssha.agentSocketPath = fmt.Sprintf(`\\.\pipe\bunkr-agent-test-%d`, os.Getpid())
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(ssha.WaitReady(ctx))
+
+	conn, err := winio.DialPipe(ssha.agentSocketPath, nil)
+	require.NoError(err)
+	_, err = agent.NewClient(conn).List()
+	require.NoError(err)
+	conn.Close()
+
+	// A second agent on the same pipe is refused
+	_, _, err = listenLocal(ssha.agentSocketPath)
+	require.Equal(ErrAgentAlreadyRunning, err)
+	require.NoError(ssha.Stop())
+}
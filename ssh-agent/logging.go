@@ -0,0 +1,134 @@
+package ssh_agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log message, messages below the level of a
+// Logger are dropped.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogDebug: "debug",
+	LogInfo:  "info",
+	LogWarn:  "warn",
+	LogError: "error",
+}
+
+func (level LogLevel) String() string {
+	return logLevelNames[level]
+}
+
+// ParseLogLevel validates a log level name, info being the default.
+func ParseLogLevel(name string) (LogLevel, error) {
+	if name == "" {
+		return LogInfo, nil
+	}
+	for level, levelName := range logLevelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("Unknown log level %q, use one of debug, info, warn or error", name))
+}
+
+// LogFormat selects how log messages are written.
+type LogFormat string
+
+const (
+	// LogFormatText writes "[level] message" lines through the standard
+	// logger.
+	LogFormatText LogFormat = "text"
+	// LogFormatJSON writes one JSON object per message with its time, level
+	// and message, for log shippers.
+	LogFormatJSON LogFormat = "json"
+)
+
+// ParseLogFormat validates a log format name.
+func ParseLogFormat(name string) (LogFormat, error) {
+	switch format := LogFormat(name); format {
+	case LogFormatText, LogFormatJSON:
+		return format, nil
+	case "":
+		return LogFormatText, nil
+	default:
+		return "", errors.New(fmt.Sprintf("Unknown log format %q, use text or json", name))
+	}
+}
+
+// Logger writes the agent log messages at or above its level. A nil Logger
+// logs text messages of info level and above through the standard logger.
+type Logger struct {
+	level  LogLevel
+	format LogFormat
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogger returns a Logger writing messages of at least level to w in the
+// given format. A nil w writes through the standard logger.
+func NewLogger(w io.Writer, level LogLevel, format LogFormat) *Logger {
+	return &Logger{level: level, format: format, w: w}
+}
+
+type jsonLogLine struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"msg"`
+}
+
+func (l *Logger) log(level LogLevel, msg string) {
+	if l == nil {
+		if level >= LogInfo {
+			log.Print(fmt.Sprintf("[%s] %s", level, msg))
+		}
+		return
+	}
+	if level < l.level {
+		return
+	}
+	if l.format != LogFormatJSON {
+		if l.w == nil {
+			log.Print(fmt.Sprintf("[%s] %s", level, msg))
+			return
+		}
+		l.write([]byte(fmt.Sprintf("%s [%s] %s\n", time.Now().Format("2006/01/02 15:04:05"), level, msg)))
+		return
+	}
+	line, err := json.Marshal(jsonLogLine{time.Now().UTC(), level.String(), msg})
+	if err != nil {
+		log.Print(fmt.Sprintf("[%s] %s", level, msg))
+		return
+	}
+	l.write(append(line, '\n'))
+}
+
+func (l *Logger) write(line []byte) {
+	w := l.w
+	if w == nil {
+		w = log.Writer()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w.Write(line)
+}
+
+// Debug, Info, Warn and Error log msg with their level.
+func (l *Logger) Debug(msg string) { l.log(LogDebug, msg) }
+func (l *Logger) Info(msg string)  { l.log(LogInfo, msg) }
+func (l *Logger) Warn(msg string)  { l.log(LogWarn, msg) }
+func (l *Logger) Error(msg string) { l.log(LogError, msg) }
@@ -0,0 +1,97 @@
+package ssh_agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerLevel(t *testing.T) {
+	require := require.New(t)
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogWarn, LogFormatText)
+
+	logger.Debug("debug message")
+	logger.Info("info message")
+	logger.Warn("warn message")
+	logger.Error("error message")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(lines, 2)
+	require.True(strings.HasSuffix(lines[0], "[warn] warn message"))
+	require.True(strings.HasSuffix(lines[1], "[error] error message"))
+}
+
+func TestLoggerJSON(t *testing.T) {
+	require := require.New(t)
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogDebug, LogFormatJSON)
+
+	logger.Debug("loaded")
+	var line jsonLogLine
+	require.NoError(json.Unmarshal(buf.Bytes(), &line))
+	require.Equal("debug", line.Level)
+	require.Equal("loaded", line.Message)
+	require.False(line.Time.IsZero())
+}
+
+func TestNilLogger(t *testing.T) {
+	require := require.New(t)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	var logger *Logger
+	logger.Debug("hidden")
+	logger.Info("shown")
+	require.NotContains(buf.String(), "hidden")
+	require.Contains(buf.String(), "[info] shown")
+}
+
+func TestParseLogLevel(t *testing.T) {
+	require := require.New(t)
+	level, err := ParseLogLevel("")
+	require.NoError(err)
+	require.Equal(LogInfo, level)
+	level, err = ParseLogLevel("debug")
+	require.NoError(err)
+	require.Equal(LogDebug, level)
+	_, err = ParseLogLevel("verbose")
+	require.Error(err)
+
+	format, err := ParseLogFormat("json")
+	require.NoError(err)
+	require.Equal(LogFormatJSON, format)
+	_, err = ParseLogFormat("xml")
+	require.Error(err)
+}
+
+func TestAgentMessagesUseLogger(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	var buf bytes.Buffer
+	ssha.logger = NewLogger(&buf, LogInfo, LogFormatText)
+
+	var std bytes.Buffer
+	log.SetOutput(&std)
+	defer log.SetOutput(os.Stderr)
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	yes := true
+	secret, sshPub := bunkr.newSecret(t, "guarded")
+	secret.ConfirmBeforeUse = &yes
+	require.NoError(ssha.storage.StoreSecret(secret))
+	require.NoError(ssha.Start())
+	_, err := ssha.Agent.Sign(sshPub, []byte("data"))
+	require.Error(err)
+
+	require.Contains(buf.String(), "[warn] Key guarded requires confirmation but no confirmation method is configured")
+	require.Empty(std.String())
+}
@@ -0,0 +1,133 @@
+package ssh_agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+// Manifest describes a set of Bunkr secrets to import, see
+// ImportFromManifest. Its JSON form is:
+//
+//	{
+//	  "keys": [
+//	    {"secret": "team", "alias": "team keys", "confirm": true},
+//	    {"secret": "deploy", "group": "team", "signTimeout": "10s", "tags": ["ci"]}
+//	  ]
+//	}
+type Manifest struct {
+	Keys []ManifestEntry `json:"keys"`
+}
+
+// ManifestEntry is a secret to import with its settings.
+type ManifestEntry struct {
+	// Secret is the name of the secret in Bunkr, it is stored with it too.
+	Secret string `json:"secret"`
+	// Alias is the comment the key is listed with, the name by default.
+	Alias string `json:"alias,omitempty"`
+	// Group is a stored group, or one imported earlier in the manifest.
+	Group string `json:"group,omitempty"`
+	// Confirm overrides the confirmation policy inherited from the group.
+	Confirm *bool `json:"confirm,omitempty"`
+	// SignTimeout overrides the agent sign timeout, e.g. "10s".
+	SignTimeout string `json:"signTimeout,omitempty"`
+	// Tags are the tags the secret is stored with.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Manifest entry statuses.
+const (
+	ManifestImported = "imported"
+	ManifestPresent  = "present"
+	ManifestFailed   = "failed"
+)
+
+// ManifestResult is the outcome of importing one manifest entry.
+type ManifestResult struct {
+	Secret string
+	Status string
+	Err    error
+}
+
+// Report lists the result of every manifest entry, or name given to
+// ImportKeys, in order.
+type Report []ManifestResult
+
+// Failed reports whether any entry could not be imported.
+func (r Report) Failed() bool {
+	for _, result := range r {
+		if result.Status == ManifestFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportFromManifest imports, in order, every entry of the JSON manifest at
+// path. Secrets already stored are left as they are, so importing the same
+// manifest again is harmless. An error is only returned if the manifest can
+// not be read, failures of single entries are in the report.
+func (ssha *SSHAgent) ImportFromManifest(path string) (Report, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid manifest %s: %v", path, err))
+	}
+	if err := ssha.storage.ReloadStorageData(); err != nil {
+		return nil, err
+	}
+
+	report := make(Report, 0, len(manifest.Keys))
+	for _, entry := range manifest.Keys {
+		result := ManifestResult{Secret: entry.Secret, Status: ManifestImported}
+		if ssha.storage.SecretExists(entry.Secret) {
+			result.Status = ManifestPresent
+		} else if err := ssha.importManifestEntry(entry); err != nil {
+			result.Status = ManifestFailed
+			result.Err = err
+		}
+		report = append(report, result)
+	}
+	return report, nil
+}
+
+func (ssha *SSHAgent) importManifestEntry(entry ManifestEntry) error {
+	if entry.Secret == "" {
+		return errors.New("Manifest entry without secret name")
+	}
+	var signTimeout time.Duration
+	if entry.SignTimeout != "" {
+		var err error
+		if signTimeout, err = time.ParseDuration(entry.SignTimeout); err != nil {
+			return errors.New(fmt.Sprintf("Invalid sign timeout %q: %v", entry.SignTimeout, err))
+		}
+	}
+	var group *storage.Secret
+	if entry.Group != "" {
+		if !ssha.storage.SecretExists(entry.Group) {
+			return errors.New(fmt.Sprintf("Group %s does not exist, import it first", entry.Group))
+		}
+		var err error
+		if group, err = ssha.storage.GetSecret(entry.Group); err != nil {
+			return err
+		}
+	}
+
+	secret, err := ssha.exportSecret(entry.Secret)
+	if err != nil {
+		return err
+	}
+	secret.Group = group
+	secret.Comment = entry.Alias
+	secret.ConfirmBeforeUse = entry.Confirm
+	secret.SignTimeout = signTimeout
+	secret.Tags = entry.Tags
+	return ssha.storeAndAdd(secret)
+}
@@ -0,0 +1,73 @@
+package ssh_agent
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testManifest = `{
+  "keys": [
+    {"secret": "team", "alias": "team keys", "confirm": true},
+    {"secret": "deploy", "group": "team", "signTimeout": "10s", "tags": ["ci"]},
+    {"secret": "existing"},
+    {"secret": "orphan", "group": "missing"}
+  ]
+}`
+
+func TestImportFromManifest(t *testing.T) {
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	for _, name := range []string{"team", "deploy", "orphan"} {
+		bunkr.newSecret(t, name)
+	}
+	existing, _ := bunkr.newSecret(t, "existing")
+	existing.Comment = "kept"
+	require.NoError(ssha.storage.StoreSecret(existing))
+
+	path := filepath.Join(dir, "manifest.json")
+	require.NoError(ioutil.WriteFile(path, []byte(testManifest), 0600))
+	report, err := ssha.ImportFromManifest(path)
+	require.NoError(err)
+	require.True(report.Failed())
+	require.Len(report, 4)
+	require.Equal(ManifestResult{Secret: "team", Status: ManifestImported}, report[0])
+	require.Equal(ManifestResult{Secret: "deploy", Status: ManifestImported}, report[1])
+	require.Equal(ManifestResult{Secret: "existing", Status: ManifestPresent}, report[2])
+	require.Equal(ManifestFailed, report[3].Status)
+	require.Contains(report[3].Err.Error(), "Group missing does not exist")
+
+	team, err := ssha.storage.GetSecret("team")
+	require.NoError(err)
+	require.Equal("team keys", team.Comment)
+	require.True(team.RequireConfirm)
+	deploy, err := ssha.storage.GetSecret("deploy")
+	require.NoError(err)
+	require.Equal("team", deploy.Group.Name)
+	require.True(deploy.RequireConfirm)
+	require.Equal(10*time.Second, deploy.SignTimeout)
+	require.Equal([]string{"ci"}, deploy.Tags)
+	kept, err := ssha.storage.GetSecret("existing")
+	require.NoError(err)
+	require.Equal("kept", kept.Comment)
+	require.False(ssha.storage.SecretExists("orphan"))
+
+	keys, err := ssha.Agent.(*keyring).Signers()
+	require.NoError(err)
+	require.Len(keys, 2)
+
+	// Importing again changes nothing
+	report, err = ssha.ImportFromManifest(path)
+	require.NoError(err)
+	require.Equal(ManifestPresent, report[0].Status)
+	require.Equal(ManifestPresent, report[1].Status)
+	require.Equal(ManifestFailed, report[3].Status)
+}
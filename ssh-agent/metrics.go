@@ -0,0 +1,122 @@
+package ssh_agent
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MetricsSink receives instrumentation events from the agent, there is one
+// implementation per metrics backend. Implementations must be safe for
+// concurrent use.
+type MetricsSink interface {
+	// SignRequest is called once per sign request with the signature
+	// algorithm and key type labels, the time it took and its error if any.
+	SignRequest(algorithm, keyType string, duration time.Duration, err error)
+}
+
+// AgentMetricsSink is a MetricsSink also told about the Bunkr calls, the
+// number of loaded keys and the connections being served.
+type AgentMetricsSink interface {
+	MetricsSink
+	// BunkrCall is called once per Bunkr sign call with the time it took,
+	// retries included, and its error if any.
+	BunkrCall(duration time.Duration, err error)
+	// KeysLoaded is called with the number of keys held whenever it changes.
+	KeysLoaded(count int)
+	// ActiveConnections is called with the number of connections being
+	// served whenever it changes.
+	ActiveConnections(count int)
+}
+
+// agentMetrics calls fn with every configured AgentMetricsSink.
+func (ssha *SSHAgent) agentMetrics(fn func(AgentMetricsSink)) {
+	for _, sink := range ssha.metrics {
+		if agentSink, ok := sink.(AgentMetricsSink); ok {
+			fn(agentSink)
+		}
+	}
+}
+
+// signMetric reports a sign request to every configured sink.
+func (ssha *SSHAgent) signMetric(key ssh.PublicKey, flags SignatureFlags, duration time.Duration, err error) {
+	if len(ssha.metrics) == 0 {
+		return
+	}
+	algorithm, keyType := signAlgorithmLabel(key, flags), keyTypeLabel(key)
+	for _, sink := range ssha.metrics {
+		sink.SignRequest(algorithm, keyType, duration, err)
+	}
+}
+
+// otherLabel replaces any algorithm or key type outside the known sets so
+// the number of distinct metric labels stays bounded.
+const otherLabel = "other"
+
+var knownAlgorithms = map[string]bool{
+	ssh.SigAlgoRSA:        true,
+	ssh.SigAlgoRSASHA2256: true,
+	ssh.SigAlgoRSASHA2512: true,
+	ssh.KeyAlgoDSA:        true,
+	ssh.KeyAlgoECDSA256:   true,
+	ssh.KeyAlgoECDSA384:   true,
+	ssh.KeyAlgoECDSA521:   true,
+	ssh.KeyAlgoED25519:    true,
+}
+
+var knownKeyTypes = map[string]bool{
+	ssh.KeyAlgoRSA:          true,
+	ssh.KeyAlgoDSA:          true,
+	ssh.KeyAlgoECDSA256:     true,
+	ssh.KeyAlgoECDSA384:     true,
+	ssh.KeyAlgoECDSA521:     true,
+	ssh.KeyAlgoED25519:      true,
+	ssh.CertAlgoRSAv01:      true,
+	ssh.CertAlgoDSAv01:      true,
+	ssh.CertAlgoECDSA256v01: true,
+	ssh.CertAlgoECDSA384v01: true,
+	ssh.CertAlgoECDSA521v01: true,
+	ssh.CertAlgoED25519v01:  true,
+}
+
+// signAlgorithm returns the signature algorithm of a sign request for key
+// with the given flags.
+func signAlgorithm(key ssh.PublicKey, flags SignatureFlags) string {
+	if underlyingKeyType(key) != ssh.KeyAlgoRSA {
+		// Only RSA keys have several signature algorithms
+		return underlyingKeyType(key)
+	}
+	switch flags {
+	case SignatureFlagRsaSha256:
+		return ssh.SigAlgoRSASHA2256
+	case SignatureFlagRsaSha512:
+		return ssh.SigAlgoRSASHA2512
+	default:
+		return underlyingKeyType(key)
+	}
+}
+
+// signAlgorithmLabel returns the bounded algorithm label of a sign request
+// for key with the given flags.
+func signAlgorithmLabel(key ssh.PublicKey, flags SignatureFlags) string {
+	algorithm := signAlgorithm(key, flags)
+	if !knownAlgorithms[algorithm] {
+		return otherLabel
+	}
+	return algorithm
+}
+
+// keyTypeLabel returns the bounded key type label of key.
+func keyTypeLabel(key ssh.PublicKey) string {
+	if !knownKeyTypes[key.Type()] {
+		return otherLabel
+	}
+	return key.Type()
+}
+
+func underlyingKeyType(key ssh.PublicKey) string {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return cert.Key.Type()
+	}
+	return key.Type()
+}
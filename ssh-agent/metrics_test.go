@@ -0,0 +1,91 @@
+package ssh_agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+type memoryMetrics struct {
+	mu    sync.Mutex
+	signs map[string]int
+}
+
+func (m *memoryMetrics) SignRequest(algorithm, keyType string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.signs == nil {
+		m.signs = make(map[string]int)
+	}
+	m.signs[algorithm+"|"+keyType]++
+}
+
+func TestSignMetricsByAlgorithm(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	metrics := &memoryMetrics{}
+	WithMetrics(metrics)(ssha)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	require.NoError(ssha.Agent.Add(AddedKey{PrivateKey: rsaKey}))
+	require.NoError(ssha.Agent.Add(AddedKey{PrivateKey: ecKey}))
+	rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	require.NoError(err)
+	ecPub, err := ssh.NewPublicKey(&ecKey.PublicKey)
+	require.NoError(err)
+
+	kr := ssha.Agent.(*keyring)
+	_, err = kr.SignWithFlags(rsaPub, []byte("data"), SignatureFlagRsaSha512)
+	require.NoError(err)
+	_, err = kr.SignWithFlags(rsaPub, []byte("data"), SignatureFlagRsaSha512)
+	require.NoError(err)
+	_, err = kr.Sign(ecPub, []byte("data"))
+	require.NoError(err)
+
+	require.Equal(map[string]int{
+		"rsa-sha2-512|ssh-rsa":                    2,
+		"ecdsa-sha2-nistp256|ecdsa-sha2-nistp256": 1,
+	}, metrics.signs)
+}
+
+func TestStatsdSink(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+
+	sink, err := newStatsdSink(l.LocalAddr().String(), "bunkr.agent.")
+	require.NoError(err)
+	sink.SignRequest("rsa-sha2-512", "ssh-rsa", 12*time.Millisecond, nil)
+	sink.SignRequest("ecdsa-sha2-nistp256", "ecdsa-sha2-nistp256-cert-v01@openssh.com", time.Millisecond, errors.New("denied"))
+
+	var packets []string
+	buf := make([]byte, 512)
+	require.NoError(l.SetReadDeadline(time.Now().Add(2 * time.Second)))
+	for i := 0; i < 5; i++ {
+		n, _, err := l.ReadFrom(buf)
+		require.NoError(err)
+		packets = append(packets, string(buf[:n]))
+	}
+	require.Equal([]string{
+		"bunkr.agent.sign.rsa-sha2-512.ssh-rsa.count:1|c",
+		"bunkr.agent.sign.rsa-sha2-512.ssh-rsa.latency:12|ms",
+		"bunkr.agent.sign.ecdsa-sha2-nistp256.ecdsa-sha2-nistp256-cert-v01_openssh_com.count:1|c",
+		"bunkr.agent.sign.ecdsa-sha2-nistp256.ecdsa-sha2-nistp256-cert-v01_openssh_com.latency:1|ms",
+		"bunkr.agent.sign.ecdsa-sha2-nistp256.ecdsa-sha2-nistp256-cert-v01_openssh_com.failures:1|c",
+	}, packets)
+}
@@ -0,0 +1,54 @@
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// OfferOrder selects the order keys are listed, and so offered by clients,
+// in.
+type OfferOrder string
+
+const (
+	// OfferOrderDefault lists keys in no particular order.
+	OfferOrderDefault OfferOrder = "default"
+	// OfferOrderLRU lists the most recently used keys first, keys never
+	// used come last.
+	OfferOrderLRU OfferOrder = "lru"
+)
+
+// ParseOfferOrder validates an offer order name.
+func ParseOfferOrder(name string) (OfferOrder, error) {
+	switch order := OfferOrder(name); order {
+	case OfferOrderDefault, OfferOrderLRU:
+		return order, nil
+	case "":
+		return OfferOrderDefault, nil
+	default:
+		return "", errors.New(fmt.Sprintf("Unknown offer order %q, use default or lru", name))
+	}
+}
+
+// orderedKeysLocked returns the keys held in the configured offer order. The
+// caller must be holding the keyring mutex.
+func (r *keyring) orderedKeysLocked() []privKey {
+	keys := make([]privKey, 0, len(r.keys))
+	for _, k := range r.keys {
+		keys = append(keys, k)
+	}
+	if r.ssha == nil || r.ssha.offerOrder != OfferOrderLRU {
+		return keys
+	}
+	blob := func(k privKey) string {
+		return string(k.signer.PublicKey().Marshal())
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		ui, uj := r.lastUsed[blob(keys[i])], r.lastUsed[blob(keys[j])]
+		if !ui.Equal(uj) {
+			return ui.After(uj)
+		}
+		return blob(keys[i]) < blob(keys[j])
+	})
+	return keys
+}
@@ -0,0 +1,325 @@
+package ssh_agent
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+// Option configures optional behaviour of an SSHAgent.
+type Option func(*SSHAgent)
+
+// WithSignCoalescing groups sign requests for the same key arriving within
+// window into a single Bunkr call where possible. A zero window disables it.
+func WithSignCoalescing(window time.Duration) Option {
+	return func(ssha *SSHAgent) {
+		ssha.coalesceWindow = window
+	}
+}
+
+// WithTrace logs the type and outcome of every agent request together with
+// the id of the connection it was received on, at debug level.
+func WithTrace(enabled bool) Option {
+	return func(ssha *SSHAgent) {
+		ssha.trace = enabled
+	}
+}
+
+// WithAllowEmpty lets the agent start and serve requests even if no keys
+// could be loaded, the failure is only logged as a warning.
+func WithAllowEmpty(allow bool) Option {
+	return func(ssha *SSHAgent) {
+		ssha.allowEmpty = allow
+	}
+}
+
+// WithMetrics reports instrumentation events to m, it can be given several
+// times to report to more than one sink.
+func WithMetrics(m MetricsSink) Option {
+	return func(ssha *SSHAgent) {
+		ssha.metrics = append(ssha.metrics, m)
+	}
+}
+
+// WithOnKeyExpired registers fn to be called, on its own goroutine, whenever
+// a key is removed because its lifetime elapsed. fn gets the fingerprint of
+// the key in the format set with WithLogFingerprintFormat.
+func WithOnKeyExpired(fn func(fingerprint, name string)) Option {
+	return func(ssha *SSHAgent) {
+		ssha.onKeyExpired = fn
+	}
+}
+
+// WithLogger sets where and from which level the agent logs, by default
+// messages of info level and above go to the standard logger.
+func WithLogger(l *Logger) Option {
+	return func(ssha *SSHAgent) {
+		ssha.logger = l
+	}
+}
+
+// WithLogFingerprintFormat sets how key fingerprints are rendered in logs,
+// the default is the OpenSSH SHA256 base64 representation.
+func WithLogFingerprintFormat(format FingerprintFormat) Option {
+	return func(ssha *SSHAgent) {
+		ssha.fingerprintFormat = format
+	}
+}
+
+// WithScopedSocket serves, besides the main agent socket, an additional
+// socket at path presenting only the keys selected by filter.
+func WithScopedSocket(path string, filter KeyFilter) Option {
+	return func(ssha *SSHAgent) {
+		ssha.scopedSockets = append(ssha.scopedSockets, scopedSocket{path, filter})
+	}
+}
+
+// WithStrict turns startup warnings, like a storage file owned by another
+// user, into errors.
+func WithStrict(strict bool) Option {
+	return func(ssha *SSHAgent) {
+		ssha.strict = strict
+	}
+}
+
+// WithOnTouchRequired registers fn to be called when signing with a key is
+// waiting for the user to touch its hardware token. By default a message is
+// logged.
+func WithOnTouchRequired(fn func(fingerprint, name string)) Option {
+	return func(ssha *SSHAgent) {
+		ssha.onTouch = fn
+	}
+}
+
+// WithRemovalGracePeriod sets how long removing a key waits for the sign
+// operations in flight with it before giving up, 30 seconds by default.
+func WithRemovalGracePeriod(grace time.Duration) Option {
+	return func(ssha *SSHAgent) {
+		ssha.removalGracePeriod = grace
+	}
+}
+
+// WithUpstreamAgent makes the main socket also offer the keys of the
+// ssh-agent listening at path, Bunkr keys take precedence.
+func WithUpstreamAgent(path string) Option {
+	return func(ssha *SSHAgent) {
+		ssha.upstreamAgentPath = path
+	}
+}
+
+// WithStore serves the secrets of store instead of the JSON storage file
+// given to NewSSHAgent.
+func WithStore(store storage.Store) Option {
+	return func(ssha *SSHAgent) {
+		ssha.storage = store
+	}
+}
+
+// WithImmutableStorage rejects any change to the storage, importing or
+// removing keys fails while loading and signing keep working.
+func WithImmutableStorage(immutable bool) Option {
+	return func(ssha *SSHAgent) {
+		ssha.immutableStorage = immutable
+	}
+}
+
+// WithConfirmer sets how the user is asked to approve signatures with keys
+// requiring confirmation. Without one those signatures are denied.
+func WithConfirmer(c Confirmer) Option {
+	return func(ssha *SSHAgent) {
+		ssha.confirmer = c
+	}
+}
+
+// WithStatsd reports the agent metrics as statsd counters and timers sent
+// over UDP to addr, every metric name starts with prefix.
+func WithStatsd(addr, prefix string) Option {
+	return func(ssha *SSHAgent) {
+		ssha.statsdAddr = addr
+		ssha.statsdPrefix = prefix
+	}
+}
+
+// WithAuditLog appends a JSON line describing every sign request served to
+// the file at path, see AuditEntry. An empty path disables the audit log.
+func WithAuditLog(path string) Option {
+	return func(ssha *SSHAgent) {
+		ssha.auditLogPath = path
+	}
+}
+
+// WithPrometheus serves the agent metrics for Prometheus to scrape on
+// http://addr/metrics while the agent runs. An empty addr disables it.
+func WithPrometheus(addr string) Option {
+	return func(ssha *SSHAgent) {
+		ssha.metricsAddr = addr
+	}
+}
+
+// WithMaxConnections limits how many connections are served at once, see
+// DefaultMaxConnections. Further connections wait up to a second for one to
+// finish and are closed otherwise. Zero removes the limit.
+func WithMaxConnections(n int) Option {
+	return func(ssha *SSHAgent) {
+		ssha.maxConns = n
+	}
+}
+
+// WithIdleTimeout closes the connections on which no request arrived for
+// timeout, the wait restarting after each request. Zero keeps idle
+// connections open.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(ssha *SSHAgent) {
+		ssha.idleTimeout = timeout
+	}
+}
+
+// WithGroups only loads the keys of the stored secrets in one of groups, the
+// group secrets included. No groups loads every stored key.
+func WithGroups(groups ...string) Option {
+	return func(ssha *SSHAgent) {
+		ssha.loadGroups = make(map[string]bool)
+		for _, group := range groups {
+			ssha.loadGroups[group] = true
+		}
+	}
+}
+
+// WithTags only loads the keys of the stored secrets tagged with one of tags.
+// Combined with WithGroups a secret must match both. No tags loads every
+// stored key.
+func WithTags(tags ...string) Option {
+	return func(ssha *SSHAgent) {
+		ssha.loadTags = make(map[string]bool)
+		for _, tag := range tags {
+			ssha.loadTags[tag] = true
+		}
+	}
+}
+
+// WithSignTimeout bounds how long Bunkr may take to produce a signature,
+// secrets with their own SignTimeout override it. Zero uses the Bunkr
+// timeout, see WithBunkrTimeout.
+func WithSignTimeout(timeout time.Duration) Option {
+	return func(ssha *SSHAgent) {
+		ssha.signTimeout = timeout
+	}
+}
+
+// WithAllowedAlgorithms restricts the signature algorithms the agent signs
+// with, e.g. ecdsa-sha2-nistp256 or rsa-sha2-512, requests for any other are
+// rejected whatever the key supports, the keys of the upstream agent included.
+// By default all are allowed.
+func WithAllowedAlgorithms(algorithms []string) Option {
+	return func(ssha *SSHAgent) {
+		ssha.allowedAlgorithms = make(map[string]bool)
+		for _, algorithm := range algorithms {
+			ssha.allowedAlgorithms[algorithm] = true
+		}
+	}
+}
+
+// WithHostnameInComment appends the local host name to the comment of every
+// listed key, so listings of a forwarded agent tell where the keys live.
+func WithHostnameInComment(enabled bool) Option {
+	return func(ssha *SSHAgent) {
+		if !enabled {
+			ssha.commentHostname = ""
+			return
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			ssha.logger.Warn(fmt.Sprintf("Could not get the host name for key comments: %v", err))
+			return
+		}
+		ssha.commentHostname = hostname
+	}
+}
+
+// WithStorageReadRetries sets how many times a storage read failing with a
+// transient error is retried, by default storage.DefaultReadRetries.
+func WithStorageReadRetries(retries int) Option {
+	return func(ssha *SSHAgent) {
+		ssha.storageReadRetries = retries
+	}
+}
+
+// WithStorageEncryption opens the storage file given to NewSSHAgent as
+// encrypted with passphrase, see storage.WithEncryption.
+func WithStorageEncryption(passphrase string) Option {
+	return func(ssha *SSHAgent) {
+		ssha.storageOptions = append(ssha.storageOptions, storage.WithEncryption(passphrase))
+	}
+}
+
+// WithStartLocked locks the agent once Start has loaded the keys, nothing is
+// listed nor signed until it is unlocked with the passphrase given through
+// WithLockPassphrase.
+func WithStartLocked(locked bool) Option {
+	return func(ssha *SSHAgent) {
+		ssha.startLocked = locked
+	}
+}
+
+// WithLockPassphrase sets the passphrase the agent is locked with when
+// started locked.
+func WithLockPassphrase(passphrase []byte) Option {
+	return func(ssha *SSHAgent) {
+		ssha.lockPassphrase = passphrase
+	}
+}
+
+// WithOfferOrder sets the order keys are listed in, see OfferOrder.
+func WithOfferOrder(order OfferOrder) Option {
+	return func(ssha *SSHAgent) {
+		ssha.offerOrder = order
+	}
+}
+
+// WithRemoteTCP allows listening on a TCP address that is not a loopback
+// one. The agent protocol is not encrypted, anybody reaching the address can
+// use the keys.
+func WithRemoteTCP(allow bool) Option {
+	return func(ssha *SSHAgent) {
+		ssha.remoteTCP = allow
+	}
+}
+
+// WithPeerCheck only serves the unix socket connections of processes running
+// as one of the allowed user ids, or as the user of the agent if none are
+// given. Other connections, TCP ones included, are closed right away.
+func WithPeerCheck(enabled bool, allowedUIDs ...uint32) Option {
+	return func(ssha *SSHAgent) {
+		ssha.peerCheck = enabled
+		ssha.allowedUIDs = allowedUIDs
+	}
+}
+
+// WithBunkrClient uses client instead of connecting to the Bunkr daemon on
+// the Bunkr socket path, e.g. to embed the agent with another client.
+func WithBunkrClient(client BunkrClient) Option {
+	return func(ssha *SSHAgent) {
+		ssha.bunkrClient = client
+	}
+}
+
+// WithBunkrTimeout bounds how long any Bunkr call may take, signatures
+// included unless a sign timeout is set. It is DefaultBunkrTimeout by
+// default, zero waits forever.
+func WithBunkrTimeout(timeout time.Duration) Option {
+	return func(ssha *SSHAgent) {
+		ssha.bunkrTimeout = timeout
+	}
+}
+
+// WithBunkrRetries attempts the Bunkr calls failing because the daemon could
+// not be reached, e.g. while it restarts, up to attempts times. The wait
+// between attempts starts at about backoff and doubles each time. Answers of
+// the daemon, like a secret not being found, are not retried.
+func WithBunkrRetries(attempts int, backoff time.Duration) Option {
+	return func(ssha *SSHAgent) {
+		ssha.bunkrRetry = retryPolicy{attempts, backoff}
+	}
+}
@@ -0,0 +1,40 @@
+package ssh_agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// peerAllowed reports whether the connection con may be served, always true
+// unless the peer check is enabled. Rejections are logged.
+func (ssha *SSHAgent) peerAllowed(con net.Conn) bool {
+	if !ssha.peerCheck {
+		return true
+	}
+	uid, err := peerUID(con)
+	if err != nil {
+		ssha.logger.Warn(fmt.Sprintf("Rejected connection from %s: %v", con.RemoteAddr(), err))
+		return false
+	}
+	allowed := ssha.allowedUIDs
+	if len(allowed) == 0 {
+		allowed = []uint32{uint32(os.Getuid())}
+	}
+	for _, a := range allowed {
+		if uid == a {
+			return true
+		}
+	}
+	ssha.logger.Warn(fmt.Sprintf("Rejected connection from uid %d, not an allowed user", uid))
+	return false
+}
+
+// remoteAddr returns the address of the other end of con, empty for unnamed
+// unix sockets and pipes.
+func remoteAddr(con net.Conn) string {
+	if addr := con.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
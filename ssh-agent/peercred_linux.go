@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerUID returns the user id of the process on the other end of the unix
+// socket connection con, read with SO_PEERCRED.
+func peerUID(con net.Conn) (uint32, error) {
+	cred, err := peerCred(con)
+	if err != nil {
+		return 0, err
+	}
+	return cred.Uid, nil
+}
+
+// peerDescription identifies the process on the other end of con by its pid
+// and user id, or by its address when they can not be read.
+func peerDescription(con net.Conn) string {
+	cred, err := peerCred(con)
+	if err != nil {
+		return remoteAddr(con)
+	}
+	return fmt.Sprintf("pid=%d uid=%d", cred.Pid, cred.Uid)
+}
+
+func peerCred(con net.Conn) (*syscall.Ucred, error) {
+	unixCon, ok := con.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("peer credentials are only available on unix sockets")
+	}
+	raw, err := unixCon.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return cred, nil
+}
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package ssh_agent
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestPeerCheck(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A client running as the agent user is served
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	WithPeerCheck(true)(ssha)
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+	require.NoError(ssha.WaitReady(ctx))
+	conn := dialTestAgent(t, ssha.agentSocketPath)
+	_, err := agent.NewClient(conn).List()
+	require.NoError(err)
+	conn.Close()
+	require.NoError(ssha.Stop())
+
+	// One outside the allowed users is disconnected
+	other, _, cleanupOther := newTestAgent(t)
+	defer cleanupOther()
+	WithPeerCheck(true, uint32(os.Getuid())+1)(other)
+	go func() {
+		_ = other.Run(context.Background())
+	}()
+	require.NoError(other.WaitReady(ctx))
+	conn = dialTestAgent(t, other.agentSocketPath)
+	_, err = agent.NewClient(conn).List()
+	require.Error(err)
+	conn.Close()
+	require.NoError(other.Stop())
+}
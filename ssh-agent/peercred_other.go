@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package ssh_agent
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID is not implemented outside Linux, every connection is rejected when
+// the peer check is enabled.
+func peerUID(con net.Conn) (uint32, error) {
+	return 0, errors.New("peer credentials are only supported on Linux")
+}
+
+// peerDescription identifies the other end of con by its address.
+func peerDescription(con net.Conn) string {
+	return remoteAddr(con)
+}
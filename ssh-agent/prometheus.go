@@ -0,0 +1,142 @@
+package ssh_agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bunkrCallBuckets are the upper bounds, in seconds, of the Bunkr call
+// latency histogram buckets.
+var bunkrCallBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type signLabels struct {
+	algorithm string
+	keyType   string
+}
+
+// prometheusSink is an AgentMetricsSink keeping the metrics in memory and
+// serving them in the Prometheus text exposition format.
+type prometheusSink struct {
+	mu           sync.Mutex
+	signs        map[signLabels]uint64
+	signErrors   map[signLabels]uint64
+	bunkrBuckets []uint64
+	bunkrSum     float64
+	bunkrCount   uint64
+	keys         int
+	connections  int
+}
+
+func newPrometheusSink() *prometheusSink {
+	return &prometheusSink{
+		signs:        make(map[signLabels]uint64),
+		signErrors:   make(map[signLabels]uint64),
+		bunkrBuckets: make([]uint64, len(bunkrCallBuckets)),
+	}
+}
+
+func (p *prometheusSink) SignRequest(algorithm, keyType string, duration time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	labels := signLabels{algorithm, keyType}
+	p.signs[labels]++
+	if err != nil {
+		p.signErrors[labels]++
+	}
+}
+
+func (p *prometheusSink) BunkrCall(duration time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seconds := duration.Seconds()
+	for i, bound := range bunkrCallBuckets {
+		if seconds <= bound {
+			p.bunkrBuckets[i]++
+		}
+	}
+	p.bunkrSum += seconds
+	p.bunkrCount++
+}
+
+func (p *prometheusSink) KeysLoaded(count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = count
+}
+
+func (p *prometheusSink) ActiveConnections(count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connections = count
+}
+
+// labelValue escapes a label value for the text exposition format.
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSignCounter(buf *bytes.Buffer, name, help string, counts map[signLabels]uint64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	labels := make([]signLabels, 0, len(counts))
+	for l := range counts {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].algorithm != labels[j].algorithm {
+			return labels[i].algorithm < labels[j].algorithm
+		}
+		return labels[i].keyType < labels[j].keyType
+	})
+	for _, l := range labels {
+		fmt.Fprintf(buf, "%s{algorithm=\"%s\",key_type=\"%s\"} %d\n", name, labelValue.Replace(l.algorithm), labelValue.Replace(l.keyType), counts[l])
+	}
+}
+
+// ServeHTTP writes the current metrics, every name starting with
+// "bunkr_agent_".
+func (p *prometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	p.mu.Lock()
+	writeSignCounter(&buf, "bunkr_agent_sign_requests_total", "Sign requests received.", p.signs)
+	writeSignCounter(&buf, "bunkr_agent_sign_errors_total", "Sign requests that failed.", p.signErrors)
+	name := "bunkr_agent_bunkr_call_duration_seconds"
+	fmt.Fprintf(&buf, "# HELP %s Time Bunkr took to answer sign calls.\n# TYPE %s histogram\n", name, name)
+	for i, bound := range bunkrCallBuckets {
+		fmt.Fprintf(&buf, "%s_bucket{le=\"%g\"} %d\n", name, bound, p.bunkrBuckets[i])
+	}
+	fmt.Fprintf(&buf, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, p.bunkrCount, name, p.bunkrSum, name, p.bunkrCount)
+	fmt.Fprintf(&buf, "# HELP bunkr_agent_keys_loaded Keys held by the agent.\n# TYPE bunkr_agent_keys_loaded gauge\nbunkr_agent_keys_loaded %d\n", p.keys)
+	fmt.Fprintf(&buf, "# HELP bunkr_agent_active_connections Agent connections being served.\n# TYPE bunkr_agent_active_connections gauge\nbunkr_agent_active_connections %d\n", p.connections)
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// serveMetrics serves the Prometheus metrics on /metrics at the configured
+// address, until the agent is stopped.
+func (ssha *SSHAgent) serveMetrics() error {
+	l, err := net.Listen("tcp", ssha.metricsAddr)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error listening for metrics on %s: %v", ssha.metricsAddr, err))
+	}
+	if !ssha.trackListener(l, "") {
+		return nil
+	}
+	ssha.mu.Lock()
+	ssha.metricsListener = l
+	ssha.mu.Unlock()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", ssha.prometheus)
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !ssha.isStopping() {
+			ssha.logger.Error(fmt.Sprintf("Metrics server error: %v", err))
+		}
+	}()
+	return nil
+}
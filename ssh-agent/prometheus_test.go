@@ -0,0 +1,57 @@
+package ssh_agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	ssha.metricsAddr = "127.0.0.1:0"
+	ssha.prometheus = newPrometheusSink()
+	WithMetrics(ssha.prometheus)(ssha)
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.AddKey(secret))
+
+	l := newMemListener()
+	go func() {
+		_ = ssha.RunWithListener(context.Background(), l)
+	}()
+	defer ssha.Stop()
+	require.NoError(ssha.WaitReady(ctx))
+	conn, err := l.dial()
+	require.NoError(err)
+	defer conn.Close()
+	_, err = agent.NewClient(conn).Sign(pub, []byte("data"))
+	require.NoError(err)
+
+	ssha.mu.Lock()
+	addr := ssha.metricsListener.Addr().String()
+	ssha.mu.Unlock()
+	res, err := http.Get(fmt.Sprintf("http://%s/metrics", addr))
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	metrics := string(body)
+	require.Contains(metrics, `bunkr_agent_sign_requests_total{algorithm="ecdsa-sha2-nistp256",key_type="ecdsa-sha2-nistp256"} 1`)
+	require.NotContains(metrics, `bunkr_agent_sign_errors_total{`)
+	require.Contains(metrics, "bunkr_agent_bunkr_call_duration_seconds_count 1\n")
+	require.Contains(metrics, "bunkr_agent_keys_loaded 1\n")
+	require.Contains(metrics, "bunkr_agent_active_connections 1\n")
+}
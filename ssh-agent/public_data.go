@@ -0,0 +1,86 @@
+package ssh_agent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+// decodePublicData returns the public key held by the public data Bunkr
+// exports for a secret of secretType.
+func decodePublicData(secretType storage.SecretType, data []byte) (ssh.PublicKey, error) {
+	switch secretType {
+	case storage.SecretTypeECDSAP256:
+		pk, err := decodeECDSAPublicData(data)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.NewPublicKey(pk)
+	case storage.SecretTypeEd25519:
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errors.New(fmt.Sprintf("Invalid Ed25519 public key of %d bytes, expected %d", len(data), ed25519.PublicKeySize))
+		}
+		return ssh.NewPublicKey(ed25519.PublicKey(data))
+	case storage.SecretTypeRSA:
+		pk, err := decodeRSAPublicData(data)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.NewPublicKey(pk)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported secret type %q, only %s, %s and %s keys can be imported", secretType, storage.SecretTypeECDSAP256, storage.SecretTypeEd25519, storage.SecretTypeRSA))
+	}
+}
+
+// decodeECDSAPublicData decodes the gob encoded text marshalled [X, Y]
+// coordinates of a P-256 point.
+func decodeECDSAPublicData(b []byte) (*ecdsa.PublicKey, error) {
+	res, err := decodeBigInts(b, 2)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid ECDSA public data: %v", err))
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: res[0], Y: res[1]}, nil
+}
+
+// decodeRSAPublicData decodes the gob encoded text marshalled [N, E] modulus
+// and public exponent of an RSA key.
+func decodeRSAPublicData(b []byte) (*rsa.PublicKey, error) {
+	res, err := decodeBigInts(b, 2)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid RSA public data: %v", err))
+	}
+	if !res[1].IsInt64() || res[1].Int64() < 3 || res[1].Int64() > 1<<31-1 {
+		return nil, errors.New(fmt.Sprintf("Invalid RSA public exponent %s", res[1]))
+	}
+	return &rsa.PublicKey{N: res[0], E: int(res[1].Int64())}, nil
+}
+
+// decodeBigInts decodes count gob encoded text marshalled integers, the
+// format Bunkr exports public key components in.
+func decodeBigInts(b []byte, count int) ([]*big.Int, error) {
+	var res [][]byte
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&res); err != nil {
+		return nil, err
+	}
+	if len(res) != count {
+		return nil, errors.New(fmt.Sprintf("got %d values, expected %d", len(res), count))
+	}
+	ints := make([]*big.Int, count)
+	for i, text := range res {
+		ints[i] = new(big.Int)
+		if err := ints[i].UnmarshalText(text); err != nil {
+			return nil, err
+		}
+	}
+	return ints, nil
+}
@@ -0,0 +1,142 @@
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// reconnectingClient is a BunkrClient dialing the Bunkr daemon again when a
+// call fails because the connection broke, e.g. after the daemon restarted,
+// and retrying the call once on the new connection.
+type reconnectingClient struct {
+	dial func() (BunkrClient, error)
+
+	mu     sync.Mutex
+	client BunkrClient
+}
+
+func newReconnectingClient(client BunkrClient, dial func() (BunkrClient, error)) *reconnectingClient {
+	return &reconnectingClient{dial: dial, client: client}
+}
+
+func (c *reconnectingClient) current() BunkrClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// redial replaces the broken client with a new connection, unless another
+// call already did, and returns the client to retry with.
+func (c *reconnectingClient) redial(broken BunkrClient) (BunkrClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != broken {
+		return c.client, nil
+	}
+	client, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := broken.(io.Closer); ok {
+		closer.Close()
+	}
+	c.client = client
+	return client, nil
+}
+
+// call runs fn with the current client, and once more with a new one if the
+// connection was broken. A client created without a connection dials first.
+func (c *reconnectingClient) call(fn func(client BunkrClient) (string, error)) (string, error) {
+	client := c.current()
+	if client == nil {
+		var err error
+		if client, err = c.redial(nil); err != nil {
+			return "", err
+		}
+	}
+	answer, err := fn(client)
+	if err == nil || !isConnectionError(err) {
+		return answer, err
+	}
+	client, dialErr := c.redial(client)
+	if dialErr != nil {
+		return "", err
+	}
+	return fn(client)
+}
+
+func (c *reconnectingClient) SignECDSA(secretName, digest, groupName string) (string, error) {
+	return c.call(func(client BunkrClient) (string, error) {
+		return client.SignECDSA(secretName, digest, groupName)
+	})
+}
+
+func (c *reconnectingClient) ExportPublicData(secretName string) (string, error) {
+	return c.call(func(client BunkrClient) (string, error) {
+		return client.ExportPublicData(secretName)
+	})
+}
+
+// SignECDSAWithTouch reports waiting for a touch if the client can, or else
+// signs without reporting it.
+func (c *reconnectingClient) SignECDSAWithTouch(secretName, digest, groupName string, waitingForTouch func()) (string, error) {
+	return c.call(func(client BunkrClient) (string, error) {
+		if touchSigner, ok := client.(bunkrTouchSigner); ok {
+			return touchSigner.SignECDSAWithTouch(secretName, digest, groupName, waitingForTouch)
+		}
+		return client.SignECDSA(secretName, digest, groupName)
+	})
+}
+
+// SignECDSABatch signs the digests in one call if the client can, or else
+// with a call per digest.
+func (c *reconnectingClient) SignECDSABatch(secretName string, digests []string, groupName string) ([]string, error) {
+	var signatures []string
+	_, err := c.call(func(client BunkrClient) (string, error) {
+		if batchSigner, ok := client.(bunkrBatchSigner); ok {
+			var err error
+			signatures, err = batchSigner.SignECDSABatch(secretName, digests, groupName)
+			return "", err
+		}
+		signatures = make([]string, len(digests))
+		for i, digest := range digests {
+			signature, err := client.SignECDSA(secretName, digest, groupName)
+			if err != nil {
+				return "", err
+			}
+			signatures[i] = signature
+		}
+		return "", nil
+	})
+	return signatures, err
+}
+
+func (c *reconnectingClient) SignRSA(secretName, digest, hash, groupName string) (string, error) {
+	return c.call(func(client BunkrClient) (string, error) {
+		rsaSigner, ok := client.(bunkrRSASigner)
+		if !ok {
+			return "", errors.New(fmt.Sprintf("The Bunkr client can not sign with the RSA key %s", secretName))
+		}
+		return rsaSigner.SignRSA(secretName, digest, hash, groupName)
+	})
+}
+
+func (c *reconnectingClient) SignEd25519(secretName, data, groupName string) (string, error) {
+	return c.call(func(client BunkrClient) (string, error) {
+		edSigner, ok := client.(bunkrEd25519Signer)
+		if !ok {
+			return "", errors.New(fmt.Sprintf("The Bunkr client can not sign with the Ed25519 key %s", secretName))
+		}
+		return edSigner.SignEd25519(secretName, data, groupName)
+	})
+}
+
+// Close closes the current connection.
+func (c *reconnectingClient) Close() error {
+	if closer, ok := c.current().(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
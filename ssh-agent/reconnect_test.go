@@ -0,0 +1,76 @@
+package ssh_agent
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// closedBunkr is a client whose connection to the daemon was closed.
+type closedBunkr struct {
+	*fakeBunkr
+}
+
+func (b *closedBunkr) SignECDSA(secretName, digest, groupName string) (string, error) {
+	return "", rpc.ErrShutdown
+}
+
+func (b *closedBunkr) ExportPublicData(secretName string) (string, error) {
+	return "", rpc.ErrShutdown
+}
+
+func TestReconnectingClient(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	// The daemon restarted, the keys are still there
+	bunkr := newFakeBunkr()
+	var mu sync.Mutex
+	dials := 0
+	client := newReconnectingClient(&closedBunkr{bunkr}, func() (BunkrClient, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dials++
+		return bunkr, nil
+	})
+	ssha.bunkrClient = client
+	ssha.signClient = client
+	secret, pub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.AddKey(secret))
+
+	// Concurrent signers share a single new connection
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ssha.Agent.Sign(pub, []byte("data"))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(err)
+	}
+	require.Equal(1, dials)
+
+	// Answers of the daemon do not reconnect
+	_, err := client.ExportPublicData("missing")
+	require.EqualError(err, "secret not found")
+	require.Equal(1, dials)
+}
+
+func TestReconnectingClientDialFailure(t *testing.T) {
+	require := require.New(t)
+	client := newReconnectingClient(&closedBunkr{newFakeBunkr()}, func() (BunkrClient, error) {
+		return nil, errors.New("daemon not running")
+	})
+	_, err := client.SignECDSA("deploy", "ZGlnZXN0", "")
+	require.Equal(rpc.ErrShutdown, err)
+}
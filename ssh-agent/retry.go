@@ -0,0 +1,70 @@
+package ssh_agent
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"syscall"
+	"time"
+)
+
+// Retries of the Bunkr calls failing because the daemon could not be reached,
+// unless configured otherwise with WithBunkrRetries.
+const (
+	DefaultBunkrRetries = 3
+	DefaultBunkrBackoff = 100 * time.Millisecond
+)
+
+// retryPolicy is how many times a Bunkr call is attempted, the wait before
+// attempt n being about backoff * 2^(n-1). Zero attempts means one.
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// do runs call until it succeeds, fails with an error that is not a
+// connection one, the attempts are exhausted or ctx is done.
+func (p retryPolicy) do(ctx context.Context, call func() (string, error)) (string, error) {
+	for attempt := 1; ; attempt++ {
+		answer, err := call()
+		if err == nil || attempt >= p.attempts || !isConnectionError(err) {
+			return answer, err
+		}
+		select {
+		case <-time.After(p.wait(attempt)):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// wait returns the backoff before the attempt following attempt, doubling
+// each time with up to half of it taken off at random so that agents
+// restarted together do not retry in lockstep.
+func (p retryPolicy) wait(attempt int) time.Duration {
+	d := p.backoff << uint(attempt-1)
+	if d <= 0 {
+		return 0
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// isConnectionError reports whether err means the Bunkr daemon could not be
+// reached, e.g. while it restarts, rather than an answer from it like a
+// secret not being found.
+func isConnectionError(err error) bool {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, rpc.ErrShutdown:
+		return true
+	}
+	// Errno is a net.Error too, it is checked first
+	switch e := err.(type) {
+	case syscall.Errno:
+		return e == syscall.ECONNREFUSED || e == syscall.ECONNRESET || e == syscall.EPIPE || e == syscall.ENOENT
+	case net.Error:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package ssh_agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakyBunkr fails the first calls as if the daemon was restarting.
+type flakyBunkr struct {
+	*fakeBunkr
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (b *flakyBunkr) fail() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls++
+	if b.calls <= b.failures {
+		return &net.OpError{Op: "dial", Net: "unix", Err: syscall.ECONNREFUSED}
+	}
+	return nil
+}
+
+func (b *flakyBunkr) ExportPublicData(secretName string) (string, error) {
+	if err := b.fail(); err != nil {
+		return "", err
+	}
+	return b.fakeBunkr.ExportPublicData(secretName)
+}
+
+func (b *flakyBunkr) SignECDSA(secretName, digest, groupName string) (string, error) {
+	if err := b.fail(); err != nil {
+		return "", err
+	}
+	return b.fakeBunkr.SignECDSA(secretName, digest, groupName)
+}
+
+func TestBunkrRetries(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := &flakyBunkr{fakeBunkr: newFakeBunkr(), failures: 2}
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	WithBunkrRetries(3, time.Millisecond)(ssha)
+	_, pub := bunkr.newSecret(t, "deploy")
+
+	require.NoError(ssha.ImportKey("deploy"))
+	require.Equal(3, bunkr.calls)
+
+	bunkr.calls = 0
+	_, err := ssha.Agent.Sign(pub, []byte("data"))
+	require.NoError(err)
+	require.Equal(3, bunkr.calls)
+
+	// Out of attempts
+	bunkr.calls, bunkr.failures = 0, 3
+	_, err = ssha.Agent.Sign(pub, []byte("data"))
+	require.Error(err)
+	require.Equal(3, bunkr.calls)
+
+	// Answers of the daemon are not retried
+	bunkr.calls, bunkr.failures = 0, 0
+	require.EqualError(ssha.ImportKey("missing"), "secret not found")
+	require.Equal(1, bunkr.calls)
+}
+
+func TestRetryHonorsTimeout(t *testing.T) {
+	require := require.New(t)
+	var calls int32
+	start := time.Now()
+	_, err := callBunkr(50*time.Millisecond, retryPolicy{10, time.Second}, func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "", syscall.ECONNRESET
+	})
+	require.Equal(context.DeadlineExceeded, err)
+	require.True(time.Since(start) < time.Second)
+	require.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestIsConnectionError(t *testing.T) {
+	require := require.New(t)
+	require.True(isConnectionError(&net.OpError{Op: "read", Net: "unix", Err: syscall.ECONNRESET}))
+	require.True(isConnectionError(syscall.EPIPE))
+	require.False(isConnectionError(syscall.EACCES))
+	require.False(isConnectionError(errors.New("secret not found")))
+}
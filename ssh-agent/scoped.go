@@ -0,0 +1,171 @@
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// KeyFilter selects a subset of the loaded keys. Empty fields match every
+// key, a key must match every non empty field to be selected.
+type KeyFilter struct {
+	// Groups are the accepted Bunkr group names.
+	Groups []string
+	// Types are the accepted SSH key types, e.g. "ecdsa-sha2-nistp256".
+	Types []string
+}
+
+// ParseKeyFilter parses a comma separated list of "group=NAME" and
+// "type=KEYTYPE" selectors.
+func ParseKeyFilter(selector string) (KeyFilter, error) {
+	var filter KeyFilter
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return filter, errors.New(fmt.Sprintf("Invalid key selector %q, expected group=NAME or type=KEYTYPE", part))
+		}
+		switch kv[0] {
+		case "group":
+			filter.Groups = append(filter.Groups, kv[1])
+		case "type":
+			filter.Types = append(filter.Types, kv[1])
+		default:
+			return filter, errors.New(fmt.Sprintf("Unknown key selector %q, expected group or type", kv[0]))
+		}
+	}
+	return filter, nil
+}
+
+func (f KeyFilter) matches(k privKey) bool {
+	return matchesAny(f.Groups, k.group) && matchesAny(f.Types, k.signer.PublicKey().Type())
+}
+
+func matchesAny(accepted []string, value string) bool {
+	if len(accepted) == 0 {
+		return true
+	}
+	for _, a := range accepted {
+		if a == value {
+			return true
+		}
+	}
+	return false
+}
+
+// scopedSocket is an additional listening socket presenting only the keys
+// selected by its filter.
+type scopedSocket struct {
+	path   string
+	filter KeyFilter
+}
+
+// errScoped is returned for the requests changing the whole keyring, which
+// scoped sockets refuse.
+var errScoped = errors.New("agent: not allowed on a scoped socket")
+
+// scopedAgent restricts a keyring to the keys matching a filter, keys out of
+// scope are neither listed, usable for signing nor removable. Adding keys
+// and locking are refused, they would change the keys of every socket.
+type scopedAgent struct {
+	*keyring
+	filter KeyFilter
+}
+
+func (s *scopedAgent) inScope(key ssh.PublicKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[string(key.Marshal())]
+	return ok && s.filter.matches(k)
+}
+
+func (s *scopedAgent) List() ([]*Key, error) {
+	keys, err := s.keyring.List()
+	if err != nil {
+		return nil, err
+	}
+	var scoped []*Key
+	for _, k := range keys {
+		if s.inScope(k) {
+			scoped = append(scoped, k)
+		}
+	}
+	return scoped, nil
+}
+
+func (s *scopedAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return s.SignWithFlags(key, data, 0)
+}
+
+func (s *scopedAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error) {
+	if !s.inScope(key) {
+		return nil, errors.New("not found")
+	}
+	return s.keyring.SignWithFlags(key, data, flags)
+}
+
+func (s *scopedAgent) Signers() ([]ssh.Signer, error) {
+	signers, err := s.keyring.Signers()
+	if err != nil {
+		return nil, err
+	}
+	var scoped []ssh.Signer
+	for _, signer := range signers {
+		if s.inScope(signer.PublicKey()) {
+			scoped = append(scoped, signer)
+		}
+	}
+	return scoped, nil
+}
+
+// Remove removes key if it is in scope, the others are not found.
+func (s *scopedAgent) Remove(key ssh.PublicKey) error {
+	if s.isLocked() {
+		return errLocked
+	}
+	if !s.inScope(key) {
+		return errors.New("agent: key not found")
+	}
+	return s.keyring.Remove(key)
+}
+
+// RemoveAll removes the keys in scope, leaving the others loaded.
+func (s *scopedAgent) RemoveAll() error {
+	s.mu.Lock()
+	if s.locked {
+		s.mu.Unlock()
+		return errLocked
+	}
+	var scoped []ssh.PublicKey
+	for _, k := range s.keys {
+		if s.filter.matches(k) {
+			scoped = append(scoped, k.signer.PublicKey())
+		}
+	}
+	s.mu.Unlock()
+	for _, key := range scoped {
+		// A key removed meanwhile is not found, that is fine
+		_ = s.keyring.Remove(key)
+	}
+	return nil
+}
+
+func (s *scopedAgent) Add(key AddedKey) error {
+	return errScoped
+}
+
+func (s *scopedAgent) Lock(passphrase []byte) error {
+	return errScoped
+}
+
+func (s *scopedAgent) Unlock(passphrase []byte) error {
+	return errScoped
+}
+
+var _ agent.ExtendedAgent = &scopedAgent{}
@@ -0,0 +1,107 @@
+package ssh_agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+func TestScopedSockets(t *testing.T) {
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	prodFilter, err := ParseKeyFilter("group=prod")
+	require.NoError(err)
+	devFilter, err := ParseKeyFilter("group=dev,type=ecdsa-sha2-nistp256")
+	require.NoError(err)
+	_, err = ParseKeyFilter("colour=blue")
+	require.Error(err)
+
+	prodPath := filepath.Join(dir, "prod.sock")
+	devPath := filepath.Join(dir, "dev.sock")
+	WithScopedSocket(prodPath, prodFilter)(ssha)
+	WithScopedSocket(devPath, devFilter)(ssha)
+
+	prod, _ := newTestSecret(t, "prod")
+	dev, _ := newTestSecret(t, "dev")
+	prodKey, prodPub := newTestSecret(t, "prodKey")
+	prodKey.Group = prod
+	devKey, devPub := newTestSecret(t, "devKey")
+	devKey.Group = dev
+	for _, s := range []*storage.Secret{prod, dev, prodKey, devKey} {
+		require.NoError(ssha.storage.StoreSecret(s))
+	}
+	require.NoError(ssha.Start())
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+
+	listBlobs := func(path string) [][]byte {
+		conn := dialTestAgent(t, path)
+		defer conn.Close()
+		keys, err := agent.NewClient(conn).List()
+		require.NoError(err)
+		var blobs [][]byte
+		for _, k := range keys {
+			blobs = append(blobs, k.Blob)
+		}
+		return blobs
+	}
+	require.Len(listBlobs(ssha.agentSocketPath), 4)
+	require.Equal([][]byte{prodPub.Marshal()}, listBlobs(prodPath))
+	require.Equal([][]byte{devPub.Marshal()}, listBlobs(devPath))
+
+	// Out of scope keys can not be used to sign
+	conn := dialTestAgent(t, devPath)
+	defer conn.Close()
+	devClient := agent.NewClient(conn)
+	_, err = devClient.Sign(prodPub, []byte("data"))
+	require.Error(err)
+
+	// Nor removed, and the whole keyring can not be changed
+	require.Error(devClient.Remove(prodPub))
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err)
+	require.Error(devClient.Add(agent.AddedKey{PrivateKey: otherKey}))
+	require.Error(devClient.Lock([]byte("passphrase")))
+	require.Error(devClient.Unlock([]byte("passphrase")))
+
+	// Removing every key only removes the keys in scope
+	require.NoError(devClient.RemoveAll())
+	require.Empty(listBlobs(devPath))
+	require.Equal([][]byte{prodPub.Marshal()}, listBlobs(prodPath))
+	require.Len(listBlobs(ssha.agentSocketPath), 3)
+}
+
+func TestScopedSocketFailureStopsAgent(t *testing.T) {
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	notDir := filepath.Join(dir, "file")
+	require.NoError(ioutil.WriteFile(notDir, nil, 0600))
+	filter, err := ParseKeyFilter("group=prod")
+	require.NoError(err)
+	WithScopedSocket(filepath.Join(notDir, "prod.sock"), filter)(ssha)
+
+	err = ssha.Run(context.Background())
+	require.Error(err)
+	require.Contains(err.Error(), "is not a directory")
+
+	// The main socket does not stay behind listening
+	_, err = net.Dial("unix", ssha.agentSocketPath)
+	require.Error(err)
+	_, err = os.Stat(ssha.agentSocketPath)
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,158 @@
+package ssh_agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// maxSessionBindings is how many sessions a connection can be bound to, one
+// per forwarding hop, like OpenSSH.
+const maxSessionBindings = 16
+
+// msgUserAuthRequest is SSH_MSG_USERAUTH_REQUEST, following the session
+// identifier in the data signed for a user authentication.
+const msgUserAuthRequest = 50
+
+// sessionBindMsg is the content of a session-bind@openssh.com request.
+type sessionBindMsg struct {
+	HostKey    []byte
+	SessionID  []byte
+	Signature  []byte
+	Forwarding bool
+}
+
+// sessionBinding is a session a connection was bound to.
+type sessionBinding struct {
+	hostKey    ssh.PublicKey
+	sessionID  []byte
+	forwarding bool
+}
+
+// sessionBoundAgent wraps the BunkrAgent serving one connection, recording
+// the sessions OpenSSH binds the connection to with session-bind@openssh.com.
+// Once bound for authentication, the connection only signs user
+// authentication requests for that session, so a host the agent is
+// forwarded to can not use it to authenticate other sessions. The bindings
+// are also the hops the destination constraints of the keys are checked
+// against.
+type sessionBoundAgent struct {
+	BunkrAgent
+	ssha *SSHAgent
+
+	mu            sync.Mutex
+	bindings      []sessionBinding
+	bindAttempted bool
+}
+
+func newSessionBoundAgent(a BunkrAgent, ssha *SSHAgent) *sessionBoundAgent {
+	return &sessionBoundAgent{BunkrAgent: a, ssha: ssha}
+}
+
+// bind verifies the session-bind request, the session identifier must be
+// signed by the host key, and records the binding.
+func (a *sessionBoundAgent) bind(contents []byte) error {
+	a.mu.Lock()
+	a.bindAttempted = true
+	a.mu.Unlock()
+	var msg sessionBindMsg
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return errors.New(fmt.Sprintf("Invalid session-bind request: %v", err))
+	}
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid session-bind host key: %v", err))
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(msg.Signature, &sig); err != nil {
+		return errors.New(fmt.Sprintf("Invalid session-bind signature: %v", err))
+	}
+	if err := hostKey.Verify(msg.SessionID, &sig); err != nil {
+		return errors.New(fmt.Sprintf("Session-bind signature does not verify with host key %s", ssh.FingerprintSHA256(hostKey)))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, b := range a.bindings {
+		if !bytes.Equal(b.sessionID, msg.SessionID) {
+			continue
+		}
+		if b.forwarding == msg.Forwarding && bytes.Equal(b.hostKey.Marshal(), hostKey.Marshal()) {
+			return nil
+		}
+		return errors.New("Session already bound to a different host key")
+	}
+	if n := len(a.bindings); n > 0 && !a.bindings[n-1].forwarding {
+		return errors.New("Connection already bound to a session for authentication")
+	}
+	if len(a.bindings) >= maxSessionBindings {
+		return errors.New(fmt.Sprintf("Connection bound to %d sessions already", maxSessionBindings))
+	}
+	a.bindings = append(a.bindings, sessionBinding{hostKey, msg.SessionID, msg.Forwarding})
+	a.ssha.logger.Debug(fmt.Sprintf("Connection bound to a session with host key %s, forwarding: %v", ssh.FingerprintSHA256(hostKey), msg.Forwarding))
+	return nil
+}
+
+// checkSession refuses to sign a user authentication request for another
+// session than the one the connection was bound to for authentication, and
+// to sign with key if its destination constraints do not permit it.
+func (a *sessionBoundAgent) checkSession(key ssh.PublicKey, data []byte) error {
+	var destinations []destinationConstraint
+	if kr, ok := a.ssha.Agent.(*keyring); ok {
+		destinations = kr.destinations(key)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(destinations) > 0 {
+		return checkDestination(destinations, a.bindings, a.bindAttempted, key, data)
+	}
+	n := len(a.bindings)
+	if n == 0 || a.bindings[n-1].forwarding {
+		return nil
+	}
+	var req struct {
+		SessionID []byte
+		Type      byte
+		Rest      []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &req); err != nil || req.Type != msgUserAuthRequest {
+		return nil
+	}
+	if !bytes.Equal(req.SessionID, a.bindings[n-1].sessionID) {
+		return errors.New("Refusing to sign a user authentication request for a session the connection is not bound to")
+	}
+	return nil
+}
+
+func (a *sessionBoundAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	if err := a.checkSession(key, data); err != nil {
+		return nil, err
+	}
+	return a.BunkrAgent.Sign(key, data)
+}
+
+func (a *sessionBoundAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error) {
+	extended, ok := a.BunkrAgent.(agent.ExtendedAgent)
+	if !ok {
+		return a.Sign(key, data)
+	}
+	if err := a.checkSession(key, data); err != nil {
+		return nil, err
+	}
+	return extended.SignWithFlags(key, data, flags)
+}
+
+func (a *sessionBoundAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType == extensionSessionBind {
+		return nil, a.bind(contents)
+	}
+	extended, ok := a.BunkrAgent.(agent.ExtendedAgent)
+	if !ok {
+		return nil, ErrExtensionUnsupported
+	}
+	return extended.Extension(extensionType, contents)
+}
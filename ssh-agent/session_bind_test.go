@@ -0,0 +1,120 @@
+package ssh_agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sessionBind returns the session-bind request of hostKey for sessionID.
+func sessionBind(t *testing.T, hostKey ssh.Signer, sessionID []byte, forwarding bool) []byte {
+	sig, err := hostKey.Sign(rand.Reader, sessionID)
+	require.NoError(t, err)
+	return ssh.Marshal(sessionBindMsg{
+		HostKey:    hostKey.PublicKey().Marshal(),
+		SessionID:  sessionID,
+		Signature:  ssh.Marshal(sig),
+		Forwarding: forwarding,
+	})
+}
+
+func newHostKey(t *testing.T) ssh.Signer {
+	_, pk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(pk)
+	require.NoError(t, err)
+	return signer
+}
+
+// userAuthData returns the start of the data signed for a user
+// authentication in sessionID.
+func userAuthData(sessionID []byte) []byte {
+	return ssh.Marshal(struct {
+		SessionID []byte
+		Type      byte
+		User      string
+	}{sessionID, msgUserAuthRequest, "user"})
+}
+
+func TestSessionBind(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "key")
+	require.NoError(ssha.AddKey(secret))
+
+	bound := newSessionBoundAgent(ssha.Agent, ssha)
+	hostKey := newHostKey(t)
+	session := []byte("session-1")
+
+	_, err := bound.Extension(extensionSessionBind, []byte("garbage"))
+	require.Error(err)
+	// A signature by another key is refused
+	forged := sessionBind(t, newHostKey(t), session, false)
+	var msg sessionBindMsg
+	require.NoError(ssh.Unmarshal(forged, &msg))
+	msg.HostKey = hostKey.PublicKey().Marshal()
+	_, err = bound.Extension(extensionSessionBind, ssh.Marshal(msg))
+	require.Error(err)
+	require.Empty(bound.bindings)
+
+	res, err := bound.Extension(extensionSessionBind, sessionBind(t, hostKey, session, false))
+	require.NoError(err)
+	require.Nil(res)
+	require.Len(bound.bindings, 1)
+	require.Equal(session, bound.bindings[0].sessionID)
+	require.False(bound.bindings[0].forwarding)
+
+	// Binding the same session again is accepted, another one is not
+	_, err = bound.Extension(extensionSessionBind, sessionBind(t, hostKey, session, false))
+	require.NoError(err)
+	_, err = bound.Extension(extensionSessionBind, sessionBind(t, newHostKey(t), session, false))
+	require.Error(err)
+	_, err = bound.Extension(extensionSessionBind, sessionBind(t, hostKey, []byte("session-2"), false))
+	require.Error(err)
+	require.Len(bound.bindings, 1)
+
+	// Only user authentications of the bound session are signed
+	_, err = bound.Sign(pub, userAuthData(session))
+	require.NoError(err)
+	_, err = bound.Sign(pub, userAuthData([]byte("session-2")))
+	require.Error(err)
+	_, err = bound.SignWithFlags(pub, userAuthData([]byte("session-2")), 0)
+	require.Error(err)
+	_, err = bound.Sign(pub, []byte("not a user authentication"))
+	require.NoError(err)
+}
+
+func TestSessionBindForwarding(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	bound := newSessionBoundAgent(ssha.Agent, ssha)
+
+	// Each forwarding hop binds its session
+	for _, session := range []string{"hop-1", "hop-2"} {
+		_, err := bound.Extension(extensionSessionBind, sessionBind(t, newHostKey(t), []byte(session), true))
+		require.NoError(err)
+	}
+	_, err := bound.Extension(extensionSessionBind, sessionBind(t, newHostKey(t), []byte("auth"), false))
+	require.NoError(err)
+	require.Len(bound.bindings, 3)
+
+	// Through the agent protocol the binding is acknowledged with a success
+	// and a rejected one with an extension failure
+	bound = newSessionBoundAgent(ssha.Agent, ssha)
+	client, closeClient := serveTestAgent(bound)
+	defer closeClient()
+	res, err := client.Extension(extensionSessionBind, sessionBind(t, newHostKey(t), []byte("auth"), false))
+	require.NoError(err)
+	require.Equal([]byte{agentSuccess}, res)
+	_, err = client.Extension(extensionSessionBind, sessionBind(t, newHostKey(t), []byte("other"), false))
+	require.Error(err)
+	require.NotEqual(agent.ErrExtensionUnsupported, err)
+}
@@ -1,14 +1,15 @@
 package ssh_agent
 
 import (
+	"context"
 	"crypto"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/big"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
@@ -21,18 +22,93 @@ type Signature struct {
 }
 
 type wrappedSigner struct {
-	signer     *bunkr_client.BunkrRPCClient
+	signer     bunkrSigner
 	pubKey     ssh.PublicKey
 	secretName string
 	groupName  string
+	// onTouch is called when Bunkr waits for the user to touch the hardware
+	// token backing the key.
+	onTouch func()
+	// timeout bounds how long Bunkr may take to sign, zero waits forever.
+	timeout time.Duration
+	// retry is how signing is retried when Bunkr can not be reached.
+	retry retryPolicy
+	// onBunkrCall is called with the time each Bunkr call took and its
+	// error.
+	onBunkrCall func(time.Duration, error)
+	logger      *Logger
+}
+
+// BunkrClient is the part of the Bunkr client used by the agent, implemented
+// by *bunkr_client.BunkrRPCClient. Optional operations, like signing with RSA
+// or Ed25519 keys, are used when the client implements them too.
+type BunkrClient interface {
+	bunkrSigner
+	ExportPublicData(secretName string) (string, error)
+}
+
+var _ BunkrClient = (*bunkr_client.BunkrRPCClient)(nil)
+
+// bunkrTouchSigner is implemented by Bunkr clients able to report that a sign
+// operation is waiting for the user to touch a hardware token.
+type bunkrTouchSigner interface {
+	SignECDSAWithTouch(secretName, digest, groupName string, waitingForTouch func()) (string, error)
+}
+
+// bunkrRSASigner is implemented by Bunkr clients able to sign with RSA keys.
+// digest is base64 encoded and hash names the algorithm that produced it,
+// SHA1, SHA256 or SHA512. The answer is the base64 encoded PKCS #1 v1.5
+// signature.
+type bunkrRSASigner interface {
+	SignRSA(secretName, digest, hash, groupName string) (string, error)
+}
+
+// bunkrEd25519Signer is implemented by Bunkr clients able to sign with
+// Ed25519 keys. Ed25519 signs the message itself, data is the base64 encoded
+// message and the answer the base64 encoded signature.
+type bunkrEd25519Signer interface {
+	SignEd25519(secretName, data, groupName string) (string, error)
 }
 
 // NewSignerFromSigner takes any crypto.Signer implementation and
 // returns a corresponding Signer interface. This can be used, for
 // example, with keys kept in hardware modules.
 
-func NewSignerFromBunkr(pubKey ssh.PublicKey, bunkrClient *bunkr_client.BunkrRPCClient, secretName, groupName string) (ssh.Signer, error) {
-	return &wrappedSigner{bunkrClient, pubKey, secretName, groupName}, nil
+func NewSignerFromBunkr(pubKey ssh.PublicKey, bunkrClient BunkrClient, secretName, groupName string) (ssh.Signer, error) {
+	return newBunkrSigner(pubKey, bunkrClient, secretName, groupName)
+}
+
+func newBunkrSigner(pubKey ssh.PublicKey, client bunkrSigner, secretName, groupName string) (ssh.Signer, error) {
+	return &wrappedSigner{
+		signer:     client,
+		pubKey:     pubKey,
+		secretName: secretName,
+		groupName:  groupName,
+	}, nil
+}
+
+// bunkrSign asks Bunkr to sign the base64 encoded digest, giving up after
+// the signer timeout.
+func (s *wrappedSigner) bunkrSign(digest string) (string, error) {
+	return s.withTimeout(func() (string, error) {
+		if touchSigner, ok := s.signer.(bunkrTouchSigner); ok && s.onTouch != nil {
+			return touchSigner.SignECDSAWithTouch(s.secretName, digest, s.groupName, s.onTouch)
+		}
+		return s.signer.SignECDSA(s.secretName, digest, s.groupName)
+	})
+}
+
+// withTimeout runs the Bunkr call, giving up after the signer timeout.
+func (s *wrappedSigner) withTimeout(call func() (string, error)) (string, error) {
+	start := time.Now()
+	signature, err := callBunkr(s.timeout, s.retry, call)
+	if s.onBunkrCall != nil {
+		s.onBunkrCall(time.Since(start), err)
+	}
+	if err == context.DeadlineExceeded {
+		return "", errors.New(fmt.Sprintf("Bunkr did not sign with %s within %v", s.secretName, s.timeout))
+	}
+	return signature, err
 }
 
 func (s *wrappedSigner) PublicKey() ssh.PublicKey {
@@ -40,11 +116,93 @@ func (s *wrappedSigner) PublicKey() ssh.PublicKey {
 }
 
 func (s *wrappedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
-	log.Print("signing with bunkr...")
+	s.logger.Debug("signing with bunkr...")
 	return s.SignWithAlgorithm(rand, data, "")
 }
 
+// SignWithAlgorithm signs data with the Bunkr key using the Bunkr operation
+// of its type. The algorithm only matters for RSA keys, picking the hash:
+// ssh-rsa or empty for SHA-1, rsa-sha2-256 or rsa-sha2-512.
 func (s *wrappedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	switch underlyingKeyType(s.pubKey) {
+	case ssh.KeyAlgoRSA:
+		return s.signRSA(data, algorithm)
+	case ssh.KeyAlgoED25519:
+		return s.signEd25519(data)
+	default:
+		return s.signECDSA(data)
+	}
+}
+
+func (s *wrappedSigner) signEd25519(data []byte) (*ssh.Signature, error) {
+	edSigner, ok := s.signer.(bunkrEd25519Signer)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("The Bunkr client can not sign with the Ed25519 key %s", s.secretName))
+	}
+	message := base64.StdEncoding.EncodeToString(data)
+	stringSignature, err := s.withTimeout(func() (string, error) {
+		return edSigner.SignEd25519(s.secretName, message, s.groupName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	blob, err := base64.StdEncoding.DecodeString(stringSignature)
+	if err != nil {
+		return nil, err
+	}
+	return s.verified(data, &ssh.Signature{Format: ssh.KeyAlgoED25519, Blob: blob})
+}
+
+// rsaHashes are the hash used by each RSA signature algorithm and its name
+// in the Bunkr protocol.
+var rsaHashes = map[string]struct {
+	hash crypto.Hash
+	name string
+}{
+	ssh.SigAlgoRSA:        {crypto.SHA1, "SHA1"},
+	ssh.SigAlgoRSASHA2256: {crypto.SHA256, "SHA256"},
+	ssh.SigAlgoRSASHA2512: {crypto.SHA512, "SHA512"},
+}
+
+func (s *wrappedSigner) signRSA(data []byte, algorithm string) (*ssh.Signature, error) {
+	if algorithm == "" {
+		algorithm = ssh.SigAlgoRSA
+	}
+	hash, ok := rsaHashes[algorithm]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unsupported RSA signature algorithm %s", algorithm))
+	}
+	rsaSigner, ok := s.signer.(bunkrRSASigner)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("The Bunkr client can not sign with the RSA key %s", s.secretName))
+	}
+	h := hash.hash.New()
+	h.Write(data)
+	digest := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	stringSignature, err := s.withTimeout(func() (string, error) {
+		return rsaSigner.SignRSA(s.secretName, digest, hash.name, s.groupName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	blob, err := base64.StdEncoding.DecodeString(stringSignature)
+	if err != nil {
+		return nil, err
+	}
+	return s.verified(data, &ssh.Signature{Format: algorithm, Blob: blob})
+}
+
+// verified returns signature once checked against the public key.
+func (s *wrappedSigner) verified(data []byte, signature *ssh.Signature) (*ssh.Signature, error) {
+	if err := s.pubKey.Verify(data, signature); err != nil {
+		s.logger.Error(fmt.Sprintf("Bunkr signature incorrect: %v", err))
+		return nil, errors.New(fmt.Sprintf("Error verifiying signature: %v", err))
+	}
+	return signature, nil
+}
+
+func (s *wrappedSigner) signECDSA(data []byte) (*ssh.Signature, error) {
 	hashFunc := crypto.SHA256
 	h := hashFunc.New()
 	h.Write(data)
@@ -53,11 +211,10 @@ func (s *wrappedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm
 	var signature []byte
 	var rawSignature Signature
 
-	stringSignature, err := s.signer.SignECDSA(s.secretName, b64Digest, s.groupName)
+	stringSignature, err := s.bunkrSign(b64Digest)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Operation content: %s", stringSignature)
 
 	strSigs := strings.Split(stringSignature, " ")
 	rSig, err := base64.StdEncoding.DecodeString(strSigs[0])
@@ -83,10 +240,5 @@ func (s *wrappedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm
 		Format: s.pubKey.Type(),
 		Blob:   signature,
 	}
-	if err := s.pubKey.Verify(data, sshSignature); err != nil {
-		log.Print(fmt.Sprintf("Bunkr signature incorrect: %v", err))
-		return nil, errors.New(fmt.Sprintf("Error verifiying signature: %v", err))
-	}
-
-	return sshSignature, nil
+	return s.verified(data, sshSignature)
 }
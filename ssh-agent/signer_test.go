@@ -0,0 +1,460 @@
+package ssh_agent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+// fakeBunkr signs with in memory ECDSA keys mimicking the Bunkr answers.
+type fakeBunkr struct {
+	mu   sync.Mutex
+	keys map[string]*ecdsa.PrivateKey
+}
+
+func newFakeBunkr() *fakeBunkr {
+	return &fakeBunkr{keys: make(map[string]*ecdsa.PrivateKey)}
+}
+
+// newSecret creates a key for name in Bunkr and returns its storage entry.
+func (b *fakeBunkr) newSecret(t *testing.T, name string) (*storage.Secret, ssh.PublicKey) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	b.mu.Lock()
+	b.keys[name] = pk
+	b.mu.Unlock()
+	sshPub, err := ssh.NewPublicKey(&pk.PublicKey)
+	require.NoError(t, err)
+	return &storage.Secret{
+		Name:       name,
+		FileId:     "fid-" + name,
+		CapId:      "cid-" + name,
+		SecretType: "ECDSA-P256",
+		PublicData: ssh.MarshalAuthorizedKey(sshPub),
+	}, sshPub
+}
+
+// ExportPublicData answers like Bunkr with the base64 encoded JSON
+// description of the secret, its public data being the gob encoded text
+// marshalled point coordinates.
+func (b *fakeBunkr) ExportPublicData(secretName string) (string, error) {
+	b.mu.Lock()
+	pk, ok := b.keys[secretName]
+	b.mu.Unlock()
+	if !ok {
+		return "", errors.New("secret not found")
+	}
+	x, err := pk.X.MarshalText()
+	if err != nil {
+		return "", err
+	}
+	y, err := pk.Y.MarshalText()
+	if err != nil {
+		return "", err
+	}
+	var publicData bytes.Buffer
+	if err := gob.NewEncoder(&publicData).Encode([][]byte{x, y}); err != nil {
+		return "", err
+	}
+	secret, err := json.Marshal(&storage.Secret{
+		Name:       secretName,
+		FileId:     "fid-" + secretName,
+		CapId:      "cid-" + secretName,
+		SecretType: "ECDSA-P256",
+		PublicData: publicData.Bytes(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+func (b *fakeBunkr) SignECDSA(secretName, digest, groupName string) (string, error) {
+	b.mu.Lock()
+	pk, ok := b.keys[secretName]
+	b.mu.Unlock()
+	if !ok {
+		return "", errors.New("secret not found")
+	}
+	raw, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil {
+		return "", err
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, pk, raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString([]byte(r.String())) + " " +
+		base64.StdEncoding.EncodeToString([]byte(s.String())), nil
+}
+
+// touchBunkr is a fakeBunkr backed by hardware tokens that need a touch.
+type touchBunkr struct {
+	*fakeBunkr
+}
+
+func (b *touchBunkr) SignECDSAWithTouch(secretName, digest, groupName string, waitingForTouch func()) (string, error) {
+	waitingForTouch()
+	return b.SignECDSA(secretName, digest, groupName)
+}
+
+func TestTouchRequiredHook(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	var touched []string
+	WithOnTouchRequired(func(fingerprint, name string) {
+		touched = append(touched, name+" "+fingerprint)
+	})(ssha)
+
+	bunkr := &touchBunkr{newFakeBunkr()}
+	secret, sshPub := bunkr.newSecret(t, "token")
+	ssha.signClient = bunkr
+	require.NoError(ssha.AddKey(secret))
+
+	_, err := ssha.Agent.Sign(sshPub, []byte("data"))
+	require.NoError(err)
+	require.Equal([]string{"token " + ssh.FingerprintSHA256(sshPub)}, touched)
+}
+
+// slowBunkr takes delay to answer every sign request.
+type slowBunkr struct {
+	*fakeBunkr
+	delay time.Duration
+}
+
+func (b *slowBunkr) SignECDSA(secretName, digest, groupName string) (string, error) {
+	time.Sleep(b.delay)
+	return b.fakeBunkr.SignECDSA(secretName, digest, groupName)
+}
+
+func TestPerKeySignTimeout(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := &slowBunkr{newFakeBunkr(), 100 * time.Millisecond}
+	ssha.signClient = bunkr
+	WithSignTimeout(20 * time.Millisecond)(ssha)
+
+	fast, fastPub := bunkr.newSecret(t, "fast")
+	slow, slowPub := bunkr.newSecret(t, "hardware")
+	slow.SignTimeout = 2 * time.Second
+	require.NoError(ssha.storage.StoreSecret(fast))
+	require.NoError(ssha.storage.StoreSecret(slow))
+	require.NoError(ssha.Start())
+
+	_, err := ssha.Agent.Sign(fastPub, []byte("data"))
+	require.Error(err)
+	require.Contains(err.Error(), "did not sign")
+	sig, err := ssha.Agent.Sign(slowPub, []byte("data"))
+	require.NoError(err)
+	require.NoError(slowPub.Verify([]byte("data"), sig))
+
+	invalid, _ := bunkr.newSecret(t, "invalid")
+	invalid.SignTimeout = -time.Second
+	require.Error(ssha.storage.StoreSecret(invalid))
+}
+
+// rsaBunkr is a fakeBunkr also holding RSA keys.
+type rsaBunkr struct {
+	*fakeBunkr
+	rsaKeys map[string]*rsa.PrivateKey
+}
+
+func newRSABunkr() *rsaBunkr {
+	return &rsaBunkr{newFakeBunkr(), make(map[string]*rsa.PrivateKey)}
+}
+
+// newRSASigner creates an RSA key for name in Bunkr and returns its signer.
+func (b *rsaBunkr) newRSASigner(t *testing.T, name string) (ssh.Signer, ssh.PublicKey) {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b.mu.Lock()
+	b.rsaKeys[name] = pk
+	b.mu.Unlock()
+	sshPub, err := ssh.NewPublicKey(&pk.PublicKey)
+	require.NoError(t, err)
+	signer, err := newBunkrSigner(sshPub, b, name, "")
+	require.NoError(t, err)
+	return signer, sshPub
+}
+
+func (b *rsaBunkr) SignRSA(secretName, digest, hash, groupName string) (string, error) {
+	b.mu.Lock()
+	pk, ok := b.rsaKeys[secretName]
+	b.mu.Unlock()
+	if !ok {
+		return "", errors.New("secret not found")
+	}
+	raw, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil {
+		return "", err
+	}
+	hashes := map[string]crypto.Hash{"SHA1": crypto.SHA1, "SHA256": crypto.SHA256, "SHA512": crypto.SHA512}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, pk, hashes[hash], raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// ExportPublicData answers with the gob encoded text marshalled modulus and
+// exponent for RSA secrets.
+func (b *rsaBunkr) ExportPublicData(secretName string) (string, error) {
+	b.mu.Lock()
+	pk, ok := b.rsaKeys[secretName]
+	b.mu.Unlock()
+	if !ok {
+		return b.fakeBunkr.ExportPublicData(secretName)
+	}
+	n, err := pk.N.MarshalText()
+	if err != nil {
+		return "", err
+	}
+	e, err := big.NewInt(int64(pk.E)).MarshalText()
+	if err != nil {
+		return "", err
+	}
+	var publicData bytes.Buffer
+	if err := gob.NewEncoder(&publicData).Encode([][]byte{n, e}); err != nil {
+		return "", err
+	}
+	secret, err := json.Marshal(&storage.Secret{
+		Name:       secretName,
+		FileId:     "fid-" + secretName,
+		CapId:      "cid-" + secretName,
+		SecretType: "RSA",
+		PublicData: publicData.Bytes(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+func TestRSASignatureFlags(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newRSABunkr()
+	signer, rsaPub := bunkr.newRSASigner(t, "rsa")
+	require.NoError(ssha.Agent.AddFromBunkr(BunkrAddedKey{Signer: signer, Name: "rsa"}))
+	ecSecret, ecPub := bunkr.newSecret(t, "ecdsa")
+	ssha.signClient = bunkr
+	require.NoError(ssha.AddKey(ecSecret))
+
+	kr := ssha.Agent.(*keyring)
+	for flags, format := range map[SignatureFlags]string{
+		0:                      ssh.SigAlgoRSA,
+		SignatureFlagRsaSha256: ssh.SigAlgoRSASHA2256,
+		SignatureFlagRsaSha512: ssh.SigAlgoRSASHA2512,
+	} {
+		sig, err := kr.SignWithFlags(rsaPub, []byte("data"), flags)
+		require.NoError(err)
+		require.Equal(format, sig.Format)
+		require.NoError(rsaPub.Verify([]byte("data"), sig))
+
+		// Other keys ignore the flags
+		sig, err = kr.SignWithFlags(ecPub, []byte("data"), flags)
+		require.NoError(err)
+		require.Equal(ssh.KeyAlgoECDSA256, sig.Format)
+	}
+
+	// A Bunkr client without RSA support
+	plain, err := newBunkrSigner(rsaPub, newFakeBunkr(), "rsa", "")
+	require.NoError(err)
+	_, err = plain.Sign(rand.Reader, []byte("data"))
+	require.Error(err)
+}
+
+func TestImportRSAKey(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newRSABunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	_, rsaPub := bunkr.newRSASigner(t, "rsa")
+	require.NoError(ssha.ImportKey("rsa"))
+
+	secret, err := ssha.storage.GetSecret("rsa")
+	require.NoError(err)
+	require.Equal(storage.SecretTypeRSA, secret.SecretType)
+	require.Equal(ssh.MarshalAuthorizedKey(rsaPub), secret.PublicData)
+
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal(rsaPub.Marshal(), keys[0].Blob)
+	require.Equal("rsa", keys[0].Comment)
+	sig, err := ssha.Agent.(*keyring).SignWithFlags(rsaPub, []byte("data"), SignatureFlagRsaSha256)
+	require.NoError(err)
+	require.NoError(rsaPub.Verify([]byte("data"), sig))
+}
+
+// ed25519Bunkr is a fakeBunkr also holding Ed25519 keys.
+type ed25519Bunkr struct {
+	*fakeBunkr
+	edKeys map[string]ed25519.PrivateKey
+}
+
+func newEd25519Bunkr() *ed25519Bunkr {
+	return &ed25519Bunkr{newFakeBunkr(), make(map[string]ed25519.PrivateKey)}
+}
+
+// newEd25519Key creates an Ed25519 key for name in Bunkr.
+func (b *ed25519Bunkr) newEd25519Key(t *testing.T, name string) ssh.PublicKey {
+	pub, pk, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	b.mu.Lock()
+	b.edKeys[name] = pk
+	b.mu.Unlock()
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return sshPub
+}
+
+// ExportPublicData answers with the raw 32 bytes public key for Ed25519
+// secrets.
+func (b *ed25519Bunkr) ExportPublicData(secretName string) (string, error) {
+	b.mu.Lock()
+	pk, ok := b.edKeys[secretName]
+	b.mu.Unlock()
+	if !ok {
+		return b.fakeBunkr.ExportPublicData(secretName)
+	}
+	secret, err := json.Marshal(&storage.Secret{
+		Name:       secretName,
+		FileId:     "fid-" + secretName,
+		CapId:      "cid-" + secretName,
+		SecretType: "ED25519",
+		PublicData: pk.Public().(ed25519.PublicKey),
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+func (b *ed25519Bunkr) SignEd25519(secretName, data, groupName string) (string, error) {
+	b.mu.Lock()
+	pk, ok := b.edKeys[secretName]
+	b.mu.Unlock()
+	if !ok {
+		return "", errors.New("secret not found")
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(pk, raw)), nil
+}
+
+func TestImportEd25519Key(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newEd25519Bunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	edPub := bunkr.newEd25519Key(t, "ed25519")
+	require.NoError(ssha.ImportKey("ed25519"))
+
+	secret, err := ssha.storage.GetSecret("ed25519")
+	require.NoError(err)
+	require.Equal(storage.SecretTypeEd25519, secret.SecretType)
+	require.Equal(ssh.MarshalAuthorizedKey(edPub), secret.PublicData)
+
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal(edPub.Marshal(), keys[0].Blob)
+	sig, err := ssha.Agent.Sign(edPub, []byte("data"))
+	require.NoError(err)
+	require.Equal(ssh.KeyAlgoED25519, sig.Format)
+	require.NoError(edPub.Verify([]byte("data"), sig))
+
+	// A Bunkr client without Ed25519 support
+	plain, err := newBunkrSigner(edPub, newFakeBunkr(), "ed25519", "")
+	require.NoError(err)
+	_, err = plain.Sign(rand.Reader, []byte("data"))
+	require.Error(err)
+}
+
+func TestDecodePublicData(t *testing.T) {
+	require := require.New(t)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err)
+	sshPub, err := decodePublicData("ED25519", pub)
+	require.NoError(err)
+	require.Equal(ssh.KeyAlgoED25519, sshPub.Type())
+
+	_, err = decodePublicData("ED25519", pub[:31])
+	require.EqualError(err, "Invalid Ed25519 public key of 31 bytes, expected 32")
+	_, err = decodePublicData("DSA", pub)
+	require.EqualError(err, `Unsupported secret type "DSA", only ECDSA-P256, ED25519 and RSA keys can be imported`)
+	_, err = decodePublicData("RSA", pub)
+	require.Error(err)
+	// Unlike before, Ed25519 public data is not misparsed as ECDSA coordinates
+	_, err = decodePublicData("ECDSA-P256", pub)
+	require.Error(err)
+}
+
+// typedBunkr exports every secret with the given type.
+type typedBunkr struct {
+	*fakeBunkr
+	secretType string
+}
+
+func (b *typedBunkr) ExportPublicData(secretName string) (string, error) {
+	secret, err := json.Marshal(map[string]interface{}{
+		"Name":       secretName,
+		"SecretType": b.secretType,
+		"PublicData": []byte("data"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+func TestImportKeyUnsupportedType(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	ssha.bunkrClient = &typedBunkr{newFakeBunkr(), "ECDSA-P265"}
+	err := ssha.ImportKey("typo")
+	require.Error(err)
+	require.Contains(err.Error(), `Cannot import typo: Unsupported secret type "ECDSA-P265"`)
+	require.False(ssha.storage.SecretExists("typo"))
+
+	// Groups can be stored but not served as keys
+	ssha.bunkrClient = &typedBunkr{newFakeBunkr(), "GENERIC-GF256"}
+	err = ssha.ImportKey("group")
+	require.Error(err)
+	require.Contains(err.Error(), "Unsupported secret type")
+}
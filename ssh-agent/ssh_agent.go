@@ -2,17 +2,17 @@ package ssh_agent
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"context"
 	"encoding/base64"
-	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -25,178 +25,1042 @@ import (
 type SSHAgent struct {
 	bunkrSocketPath string
 	agentSocketPath string
-	bunkrClient     *bunkr_client.BunkrRPCClient
+	storagePath     string
+	bunkrClient     BunkrClient
+	signClient      bunkrSigner
 	Agent           BunkrAgent
-	storage         *storage.AgentStorage
+	storage         storage.Store
+	scopedSockets   []scopedSocket
+
+	// Settings applied through options
+	coalesceWindow     time.Duration
+	trace              bool
+	allowEmpty         bool
+	strict             bool
+	metrics            []MetricsSink
+	statsdAddr         string
+	statsdPrefix       string
+	onKeyExpired       func(fingerprint, name string)
+	onTouch            func(fingerprint, name string)
+	removalGracePeriod time.Duration
+	fingerprintFormat  FingerprintFormat
+	upstreamAgentPath  string
+	immutableStorage   bool
+	confirmer          Confirmer
+	signTimeout        time.Duration
+	allowedAlgorithms  map[string]bool
+	commentHostname    string
+	storageReadRetries int
+	storageOptions     []storage.StorageOption
+	startLocked        bool
+	lockPassphrase     []byte
+	offerOrder         OfferOrder
+	remoteTCP          bool
+	bunkrTimeout       time.Duration
+	bunkrRetry         retryPolicy
+	peerCheck          bool
+	allowedUIDs        []uint32
+	auditLogPath       string
+	auditLog           *auditLog
+	logger             *Logger
+	metricsAddr        string
+	prometheus         *prometheusSink
+	metricsListener    net.Listener
+	maxConns           int
+	connQueueWait      time.Duration
+	idleTimeout        time.Duration
+	loadGroups         map[string]bool
+	loadTags           map[string]bool
+	importBackend      string
+
+	// backends are the Bunkr daemons other than the default one by name,
+	// see WithBunkrBackend. Unreachable ones are tried again every
+	// backendRetryInterval until the agent stops.
+	backends             map[string]*bunkrBackend
+	backendRetryInterval time.Duration
+
+	recentErrors errorLog
+
+	// connSlots holds a value per connection being served when their number
+	// is limited, see acquireConnSlot
+	connSlots chan struct{}
+
+	readyOnce sync.Once
+	ready     chan struct{}
+
+	// Shutdown state, see Stop
+	mu              sync.Mutex
+	listeners       []net.Listener
+	socketPaths     []string
+	conns           map[net.Conn]struct{}
+	connsWG         sync.WaitGroup
+	stopping        bool
+	stopGracePeriod time.Duration
+	onStopStep      func(step string)
+	stopOnce        sync.Once
+	stopErr         error
+	// stopped is closed once the agent stops, see stoppedChan
+	stopped chan struct{}
 }
 
-func NewSSHAgent(bunkrSocketPath, agentSocketPath, storagePath string) (*SSHAgent, error) {
-	bunkrClient, err := bunkr_client.NewBunkrClient(bunkrSocketPath)
-	if err != nil {
-		return nil, err
-	}
-	storage, err := storage.NewBunkrStorage(storagePath)
-	if err != nil {
-		return nil, err
-	}
+func NewSSHAgent(bunkrSocketPath, agentSocketPath, storagePath string, opts ...Option) (*SSHAgent, error) {
 	agent := &SSHAgent{
 		bunkrSocketPath: bunkrSocketPath,
 		agentSocketPath: agentSocketPath,
-		bunkrClient:     bunkrClient,
-		storage:         storage,
+		storagePath:     storagePath,
+
+		fingerprintFormat:  FingerprintSHA256,
+		storageReadRetries: storage.DefaultReadRetries,
+		bunkrTimeout:       DefaultBunkrTimeout,
+		bunkrRetry:         retryPolicy{DefaultBunkrRetries, DefaultBunkrBackoff},
+		maxConns:           DefaultMaxConnections,
+		connQueueWait:      time.Second,
+	}
+	for _, opt := range opts {
+		opt(agent)
+	}
+	if c, ok := agent.confirmer.(interface{ setLogger(*Logger) }); ok {
+		c.setLogger(agent.logger)
+	}
+	if agent.startLocked && len(agent.lockPassphrase) == 0 {
+		return nil, errors.New("Starting locked requires a lock passphrase")
+	}
+	if agent.storage == nil {
+		if err := storage.CheckOwnership(storagePath); err != nil {
+			if agent.strict {
+				return nil, err
+			}
+			agent.logger.Warn(err.Error())
+		}
+	}
+
+	if agent.statsdAddr != "" {
+		sink, err := newStatsdSink(agent.statsdAddr, agent.statsdPrefix)
+		if err != nil {
+			return nil, err
+		}
+		agent.metrics = append(agent.metrics, sink)
+	}
+	if agent.metricsAddr != "" {
+		agent.prometheus = newPrometheusSink()
+		agent.metrics = append(agent.metrics, agent.prometheus)
+	}
+
+	if agent.auditLogPath != "" {
+		auditLog, err := openAuditLog(agent.auditLogPath, agent.logger)
+		if err != nil {
+			return nil, err
+		}
+		agent.auditLog = auditLog
+	}
+
+	dialBunkr := func() (BunkrClient, error) {
+		return bunkr_client.NewBunkrClient(bunkrSocketPath)
+	}
+	bunkrClient := agent.bunkrClient
+	if bunkrClient == nil {
+		rpcClient, err := dialBunkr()
+		if err != nil {
+			return nil, err
+		}
+		bunkrClient = rpcClient
+	}
+	if _, err := callBunkr(agent.bunkrTimeout, agent.bunkrRetry, func() (string, error) {
+		return "", checkBunkrVersion(bunkrClient)
+	}); err != nil {
+		if err == context.DeadlineExceeded {
+			return nil, errors.New(fmt.Sprintf("The bunkr daemon did not report its version within %v", agent.bunkrTimeout))
+		}
+		return nil, err
+	}
+	if agent.bunkrClient == nil {
+		bunkrClient = newReconnectingClient(bunkrClient, dialBunkr)
+	}
+	if agent.storage == nil {
+		storageOptions := append([]storage.StorageOption{storage.WithWarningLogger(agent.logger.Warn)}, agent.storageOptions...)
+		agentStorage, err := storage.NewBunkrStorage(storagePath, storageOptions...)
+		if err != nil {
+			return nil, err
+		}
+		agentStorage.SetReadRetries(agent.storageReadRetries)
+		agent.storage = agentStorage
+	}
+	if agent.immutableStorage {
+		readOnly, ok := agent.storage.(interface{ SetReadOnly(bool) })
+		if !ok {
+			return nil, errors.New("The configured storage can not be made read only")
+		}
+		readOnly.SetReadOnly(true)
+	}
+	agent.bunkrClient = bunkrClient
+	agent.signClient = bunkrClient
+	if agent.coalesceWindow > 0 {
+		agent.signClient = newSignCoalescer(bunkrClient, agent.coalesceWindow)
+	}
+	if err := agent.setupBackends(); err != nil {
+		return nil, err
 	}
 	agent.Agent = NewKeyring(agent)
 	return agent, nil
 }
 
 func (ssha *SSHAgent) Start() error {
+	ssha.checkBackends()
 	if err := ssha.loadKeys(); err != nil {
+		if !ssha.allowEmpty {
+			return err
+		}
+		ssha.logger.Warn(fmt.Sprintf("Starting without keys, they will be loaded later: %v", err))
+	}
+	if ssha.startLocked {
+		err := ssha.Agent.Lock(ssha.lockPassphrase)
+		// The keyring keeps its own hash of it
+		ssha.lockPassphrase = nil
 		return err
 	}
 	return nil
 }
 
-func (ssha *SSHAgent) Run() error {
-	sock, err := net.Listen("unix", ssha.agentSocketPath)
+// Run serves the agent until ctx is done or Stop is called, then returns once
+// the agent is stopped with the result of Stop. It listens on the socket
+// passed by systemd socket activation, or else on the agent address.
+func (ssha *SSHAgent) Run(ctx context.Context) error {
+	sock, err := activationListener()
 	if err != nil {
-		return errors.New(fmt.Sprintf("listen error: %v", err))
+		return err
+	}
+	var sockPath string
+	if sock == nil {
+		if sock, sockPath, err = ssha.listen(ssha.agentSocketPath); err != nil {
+			return err
+		}
+	}
+	// else the socket belongs to systemd, which may activate us again
+	return ssha.run(ctx, sock, sockPath)
+}
+
+// RunWithListener serves the agent on l like Run, e.g. on a socket bound by
+// the caller or an in memory listener. The agent takes over l, it is closed
+// when stopping.
+func (ssha *SSHAgent) RunWithListener(ctx context.Context, l net.Listener) error {
+	return ssha.run(ctx, l, "")
+}
+
+// run serves the agent on sock, sockPath being the socket file to remove
+// when stopping, if any.
+func (ssha *SSHAgent) run(ctx context.Context, sock net.Listener, sockPath string) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ssha.Stop()
+		case <-done:
+		}
+	}()
+
+	if !ssha.trackListener(sock, sockPath) {
+		return ssha.Stop()
 	}
+	if ssha.maxConns > 0 {
+		ssha.connSlots = make(chan struct{}, ssha.maxConns)
+	}
+	for _, scoped := range ssha.scopedSockets {
+		scopedSock, scopedPath, err := listenLocal(scoped.path)
+		if err != nil {
+			return ssha.stopAfter(err)
+		}
+		if !ssha.trackListener(scopedSock, scopedPath) {
+			return ssha.Stop()
+		}
+		go ssha.serve(scopedSock, &scopedAgent{ssha.Agent.(*keyring), scoped.filter})
+	}
+	if ssha.prometheus != nil {
+		if err := ssha.serveMetrics(); err != nil {
+			return ssha.stopAfter(err)
+		}
+	}
+	close(ssha.readyChan())
+	var served BunkrAgent = ssha.Agent
+	if ssha.upstreamAgentPath != "" {
+		served = newUpstreamAgent(ssha.Agent.(*keyring), ssha.upstreamAgentPath)
+	}
+	ssha.serve(sock, served)
+	return ssha.Stop()
+}
+
+// stopAfter stops the agent once Run failed with err, closing the sockets
+// already listening, and returns err together with any error stopping.
+func (ssha *SSHAgent) stopAfter(err error) error {
+	if stopErr := ssha.Stop(); stopErr != nil {
+		return errors.New(fmt.Sprintf("%v, %v", err, stopErr))
+	}
+	return err
+}
+
+// ErrAgentAlreadyRunning is returned by Run when another agent answers on
+// the socket.
+var ErrAgentAlreadyRunning = errors.New("another agent is already running on the socket")
+
+// listenUnix listens on the unix socket path once its parent directories
+// have been checked. A leftover socket file nobody answers on, e.g. after
+// an unclean shutdown, is removed. One a live agent answers on is left alone.
+func listenUnix(path string) (net.Listener, error) {
+	if err := checkSocketParents(path); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		if con, err := net.Dial("unix", path); err == nil {
+			con.Close()
+			return nil, ErrAgentAlreadyRunning
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("listen error: %v", err))
+	}
+	return sock, nil
+}
+
+// checkSocketParents makes sure that every existing parent component of the
+// socket path is a directory, naming the first one that is not.
+func checkSocketParents(path string) error {
+	dir := filepath.Dir(filepath.Clean(path))
+	var parents []string
+	for {
+		parents = append(parents, dir)
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		info, err := os.Stat(parents[i])
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return errors.New(fmt.Sprintf("Cannot create socket %s: %s is not a directory", path, parents[i]))
+		}
+	}
+	return nil
+}
+
+// Ready returns a channel that is closed once Run is listening on every
+// configured socket and connections can be made.
+func (ssha *SSHAgent) Ready() <-chan struct{} {
+	return ssha.readyChan()
+}
+
+func (ssha *SSHAgent) readyChan() chan struct{} {
+	ssha.readyOnce.Do(func() {
+		ssha.ready = make(chan struct{})
+	})
+	return ssha.ready
+}
+
+// WaitReady blocks until the agent accepts connections or ctx is done.
+func (ssha *SSHAgent) WaitReady(ctx context.Context) error {
+	select {
+	case <-ssha.Ready():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DefaultMaxConnections is how many connections the agent serves at once
+// unless configured otherwise with WithMaxConnections.
+const DefaultMaxConnections = 64
+
+// acquireConnSlot takes a connection slot, waiting up to connQueueWait for
+// one to be released when all of them are taken. It reports whether a slot
+// was obtained, always true without a limit.
+func (ssha *SSHAgent) acquireConnSlot() bool {
+	if ssha.connSlots == nil {
+		return true
+	}
+	select {
+	case ssha.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(ssha.connQueueWait)
+	defer timer.Stop()
+	select {
+	case ssha.connSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (ssha *SSHAgent) releaseConnSlot() {
+	if ssha.connSlots != nil {
+		<-ssha.connSlots
+	}
+}
+
+// serve accepts connections on sock serving a on each of them, until the
+// agent is stopped.
+func (ssha *SSHAgent) serve(sock net.Listener, a BunkrAgent) {
+	var connID uint64
 	for {
 		con, err := sock.Accept()
 		if err != nil {
-			log.Print(fmt.Sprintf("Accept error. Retrying in 1 second... [%v]", err))
+			if ssha.isStopping() {
+				return
+			}
+			ssha.logger.Error(fmt.Sprintf("Accept error. Retrying in 1 second... [%v]", err))
 			time.Sleep(time.Second)
 			continue
 		}
+		if !ssha.peerAllowed(con) {
+			con.Close()
+			continue
+		}
+		if !ssha.acquireConnSlot() {
+			ssha.logger.Warn(fmt.Sprintf("Rejected connection, %d connections are already being served", ssha.maxConns))
+			con.Close()
+			continue
+		}
+		connID++
+		var served BunkrAgent = newSessionBoundAgent(a, ssha)
+		if ssha.trace {
+			served = newTracingAgent(served, connID, ssha.fingerprintFormat, ssha.logger)
+		}
+		if ssha.auditLog != nil {
+			served = newAuditingAgent(served, ssha, peerDescription(con))
+		}
+		ssha.trackConn(con)
+		id := connID
 		go func() {
-			if err := agent.ServeAgent(ssha.Agent, con); err != nil {
+			defer ssha.releaseConnSlot()
+			defer ssha.untrackConn(con)
+			defer con.Close()
+			var rw io.ReadWriter = con
+			if ssha.idleTimeout > 0 {
+				rw = &idleConn{con, ssha.idleTimeout}
+			}
+			if err := agent.ServeAgent(served, rw); err != nil {
+				if ssha.idleTimeout > 0 && isTimeout(err) {
+					ssha.logger.Info(fmt.Sprintf("Closing connection %d, no request for %v", id, ssha.idleTimeout))
+					return
+				}
 				// The EOF when the agent communications are shutdown makes the function
 				// to return an error that we should skip
 				if err != io.EOF {
-					log.Print(fmt.Sprintf("ServerAgent error: %v", err))
+					ssha.logger.Warn(fmt.Sprintf("ServerAgent error: %v", err))
 				}
 			}
 		}()
 	}
 }
 
-func (ssha *SSHAgent) Shutdown() {
-	if err := os.Remove(ssha.agentSocketPath); err != nil {
-		log.Print(fmt.Sprintf("Could not remove the agent socket file: %v", err))
-	}
-}
-
 func (ssha *SSHAgent) loadKeys() error {
 	bunkrSSHPubKeysData, err := ssha.ListPubKeys()
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error retrieving public keys: %v", err))
 	}
 
+	loaded := 0
 	for _, secretInfo := range bunkrSSHPubKeysData {
+		if !ssha.selectedForLoading(secretInfo) || !ssha.backendReachable(secretInfo) {
+			continue
+		}
 		err = ssha.AddKey(secretInfo)
 		if err != nil {
 			return err
 		}
+		loaded++
 	}
+	ssha.logger.Info(fmt.Sprintf("Loaded %d keys", loaded))
 	return nil
 }
 
+// inLoadedGroups reports whether the keys of secret are loaded given the
+// groups selected with WithGroups, a group secret belonging to its own
+// group. Every secret is loaded when no group was selected.
+func (ssha *SSHAgent) inLoadedGroups(secret *storage.Secret) bool {
+	if len(ssha.loadGroups) == 0 {
+		return true
+	}
+	return ssha.loadGroups[secretGroupName(secret)] || ssha.loadGroups[secret.Name]
+}
+
+// inLoadedTags reports whether secret carries one of the tags selected with
+// WithTags. Every secret is loaded when no tag was selected.
+func (ssha *SSHAgent) inLoadedTags(secret *storage.Secret) bool {
+	if len(ssha.loadTags) == 0 {
+		return true
+	}
+	for _, tag := range secret.Tags {
+		if ssha.loadTags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// selectedForLoading reports whether the keys of secret are loaded, it must
+// be in one of the selected groups and carry one of the selected tags.
+func (ssha *SSHAgent) selectedForLoading(secret *storage.Secret) bool {
+	return ssha.inLoadedGroups(secret) && ssha.inLoadedTags(secret)
+}
+
 func (ssha *SSHAgent) ListPubKeys() ([]*storage.Secret, error) {
 	if err := ssha.storage.ReloadStorageData(); err != nil {
 		return nil, err
 	}
-	secrets, err := ssha.storage.GetSecrets()
-	if err != nil {
-		return nil, err
+	secrets, failed := ssha.storage.GetSecretsLenient()
+	for name, err := range failed {
+		ssha.logger.Warn(fmt.Sprintf("Skipping secret %s, it could not be decoded: %v", name, err))
+	}
+	if kr, ok := ssha.Agent.(*keyring); ok {
+		stored := make(map[string]bool)
+		for _, secret := range secrets {
+			stored[secret.Name] = true
+		}
+		for name := range failed {
+			stored[name] = true
+		}
+		kr.pruneDismissed(stored)
 	}
 	return secrets, nil
 }
 
-func (ssha *SSHAgent) AddKey(secret *storage.Secret) error {
+// secretSigner returns a signer asking Bunkr to sign with secret.
+func (ssha *SSHAgent) secretSigner(secret *storage.Secret) (ssh.Signer, error) {
 	sshPub, _, _, _, err := ssh.ParseAuthorizedKey(secret.PublicData)
 	if err != nil {
-		log.Print(err)
-		return err
+		return nil, err
 	}
-	groupName := ""
-	if secret.Group != nil {
-		groupName = secret.Group.Name
+	_, signClient, err := ssha.backendClients(secret.Backend)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newBunkrSigner(sshPub, signClient, secret.BunkrSecretName(), bunkrGroupName(secret))
+	if err != nil {
+		return nil, err
+	}
+	if ws, ok := signer.(*wrappedSigner); ok {
+		ws.timeout = ssha.signTimeout
+		if ws.timeout == 0 {
+			ws.timeout = ssha.bunkrTimeout
+		}
+		ws.retry = ssha.bunkrRetry
+		ws.logger = ssha.logger
+		ws.onBunkrCall = func(duration time.Duration, err error) {
+			ssha.agentMetrics(func(sink AgentMetricsSink) { sink.BunkrCall(duration, err) })
+		}
+		if secret.SignTimeout > 0 {
+			ws.timeout = secret.SignTimeout
+		}
+		name := secret.Name
+		ws.onTouch = func() {
+			ssha.touchRequired(sshPub, name)
+		}
 	}
-	signer, err := NewSignerFromBunkr(sshPub, ssha.bunkrClient, secret.Name, groupName)
+	cert, err := secretCertificate(secret, sshPub)
 	if err != nil {
-		log.Print(err)
+		return nil, err
+	}
+	if cert != nil {
+		// Signs with the Bunkr key, listing the certificate
+		return ssh.NewCertSigner(cert, signer)
+	}
+	return signer, nil
+}
+
+func secretGroupName(secret *storage.Secret) string {
+	if secret.Group == nil {
+		return ""
+	}
+	return secret.Group.Name
+}
+
+// bunkrGroupName returns the name Bunkr knows the group of secret by, empty
+// if it has none.
+func bunkrGroupName(secret *storage.Secret) string {
+	if secret.Group == nil {
+		return ""
+	}
+	return secret.Group.BunkrSecretName()
+}
+
+// secretComment returns the comment the key of secret is listed with, its
+// name when it has none.
+func secretComment(secret *storage.Secret) string {
+	if secret.Comment == "" {
+		return secret.Name
+	}
+	return secret.Comment
+}
+
+func (ssha *SSHAgent) AddKey(secret *storage.Secret) error {
+	signer, err := ssha.secretSigner(secret)
+	if err != nil {
+		ssha.logger.Error(fmt.Sprintf("Error loading key %s: %v", secret.Name, err))
 		return err
 	}
+	groupName := secretGroupName(secret)
+	comment := secretComment(secret)
 	key := BunkrAddedKey{
 		// PrivateKey must be a *rsa.PrivateKey, *dsa.PrivateKey or
 		// *ecdsa.PrivateKey, which will be inserted into the agent.
 		Signer: signer,
+		// Name is the name of the Bunkr secret backing the key.
+		Name: secret.Name,
+		// Group is the name of the Bunkr group of the secret, if any.
+		Group: groupName,
 		// Comment is an optional, free-form string.
-		Comment: "hmm",
+		Comment: comment,
 		// LifetimeSecs, if not zero, is the number of seconds that the
 		// agent will store the key for.
-		LifetimeSecs: 0,
+		LifetimeSecs: secret.LifetimeSecs,
 		// ConfirmBeforeUse, if true, requests that the agent confirm with the
 		// user before each use of this key.
-		ConfirmBeforeUse: false,
+		ConfirmBeforeUse: secret.RequireConfirm,
 	}
 
 	if err = ssha.Agent.AddFromBunkr(key); err != nil {
-		log.Print(err)
+		ssha.logger.Error(fmt.Sprintf("Error loading key %s: %v", secret.Name, err))
 		return err
 	}
+	ssha.logger.Debug(fmt.Sprintf("Loaded key %s (%s)", secret.Name, ssha.fingerprintFormat.Fingerprint(signer.PublicKey())))
 	return nil
 }
 
-func (ssha *SSHAgent) ImportKey(secretName string) error {
-	secretData, err := ssha.bunkrClient.ExportPublicData(secretName)
+// ExportPublicKeyFile writes the public key of the stored secret name to path
+// in OpenSSH authorized_keys format. Existing files are only replaced when
+// overwrite is set.
+func (ssha *SSHAgent) ExportPublicKeyFile(name, path string, overwrite bool) error {
+	secret, err := ssha.storage.GetSecret(name)
 	if err != nil {
 		return err
 	}
-
-	byteContent, err := base64.StdEncoding.DecodeString(secretData)
+	sshPub, _, _, _, err := ssh.ParseAuthorizedKey(secret.PublicData)
 	if err != nil {
 		return err
 	}
+	line := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(sshPub), []byte("\n"))
+	line = append(line, []byte(fmt.Sprintf(" %s\n", secret.Name))...)
 
-	var secret storage.Secret
-	if err := json.NewDecoder(bytes.NewReader(byteContent)).Decode(&secret); err != nil {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return errors.New(fmt.Sprintf("File %s already exists, refusing to overwrite it", path))
+		}
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
 		return err
 	}
+	return f.Close()
+}
 
-	unmarshalPubKeyData := func(b []byte) (*ecdsa.PublicKey, error) {
-		pk := new(ecdsa.PublicKey)
-		var res [][]byte
-		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&res); err != nil {
-			return nil, err
+// ExportAuthorizedKeys writes the public keys of every stored secret to w in
+// OpenSSH authorized_keys format, sorted by name. Each key is commented with
+// the secret name followed by its group, if any, in parentheses.
+func (ssha *SSHAgent) ExportAuthorizedKeys(w io.Writer) error {
+	secrets, err := ssha.ListPubKeys()
+	if err != nil {
+		return err
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	var out bytes.Buffer
+	for _, secret := range secrets {
+		sshPub, _, _, _, err := ssh.ParseAuthorizedKey(secret.PublicData)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid public key of secret %s: %v", secret.Name, err))
+		}
+		comment := secret.Name
+		if group := secretGroupName(secret); group != "" {
+			comment = fmt.Sprintf("%s (%s)", secret.Name, group)
 		}
+		out.Write(bytes.TrimSuffix(ssh.MarshalAuthorizedKey(sshPub), []byte("\n")))
+		fmt.Fprintf(&out, " %s\n", comment)
+	}
+	_, err = w.Write(out.Bytes())
+	return err
+}
 
-		if err := pk.X.UnmarshalText(res[0]); err != nil {
-			return nil, err
+// algorithmAllowed checks the signature algorithm policy for a sign request
+// for key with the given flags.
+func (ssha *SSHAgent) algorithmAllowed(key ssh.PublicKey, flags SignatureFlags) error {
+	if ssha.allowedAlgorithms == nil {
+		return nil
+	}
+	if underlyingKeyType(key) != ssh.KeyAlgoRSA {
+		// The flags only pick the hash of RSA signatures
+		flags = 0
+	}
+	if algorithm := signAlgorithm(key, flags); !ssha.allowedAlgorithms[algorithm] {
+		return errors.New(fmt.Sprintf("agent: signature algorithm %s is not allowed by the policy", algorithm))
+	}
+	return nil
+}
+
+// persistLastUsed records in the storage that the key of the secret name
+// signed at at. A read only storage keeps no record, failing to write is
+// only logged as signing succeeded.
+func (ssha *SSHAgent) persistLastUsed(name string, at time.Time) {
+	if err := ssha.storage.TouchSecret(name, at); err != nil && err != storage.ErrReadOnly {
+		ssha.logger.Debug(fmt.Sprintf("Could not record the use of %s: %v", name, err))
+	}
+}
+
+// touchRequired tells the user that signing with the key is waiting for its
+// hardware token to be touched.
+func (ssha *SSHAgent) touchRequired(pubKey ssh.PublicKey, name string) {
+	fingerprint := ssha.fingerprintFormat.Fingerprint(pubKey)
+	if ssha.onTouch != nil {
+		ssha.onTouch(fingerprint, name)
+		return
+	}
+	ssha.logger.Info(fmt.Sprintf("Touch your security key to sign with %s (%s)", name, fingerprint))
+}
+
+func (ssha *SSHAgent) ImportKey(secretName string) error {
+	return ssha.ImportKeyToGroup(secretName, "")
+}
+
+// ImportKeyToGroup imports the Bunkr secret secretName like ImportKey,
+// storing it as a member of the already stored group groupName.
+func (ssha *SSHAgent) ImportKeyToGroup(secretName, groupName string) error {
+	group, err := ssha.importGroup(groupName)
+	if err != nil {
+		return err
+	}
+
+	secret, err := ssha.exportSecret(secretName)
+	if err != nil {
+		return err
+	}
+	if group != nil {
+		secret.Group = group
+	}
+
+	return ssha.storeAndAdd(secret)
+}
+
+// importGroup returns the stored group secrets are imported to, nil when
+// groupName is empty. The group must have been imported first.
+func (ssha *SSHAgent) importGroup(groupName string) (*storage.Secret, error) {
+	if groupName == "" {
+		return nil, nil
+	}
+	if !ssha.storage.SecretExists(groupName) {
+		return nil, errors.New(fmt.Sprintf("Group %s does not exist, import it first", groupName))
+	}
+	return ssha.storage.GetSecret(groupName)
+}
+
+// ImportKeys imports the Bunkr secrets names like ImportKeyToGroup, writing
+// the storage once for all of them. The result of every name is reported in
+// order, an error is only returned if the group can not be used.
+func (ssha *SSHAgent) ImportKeys(names []string, groupName string) (Report, error) {
+	group, err := ssha.importGroup(groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	report := make(Report, len(names))
+	var exported []*storage.Secret
+	var exportedAt []int
+	for i, name := range names {
+		report[i] = ManifestResult{Secret: name, Status: ManifestImported}
+		secret, err := ssha.exportSecret(name)
+		if err != nil {
+			report[i].Status, report[i].Err = ManifestFailed, err
+			continue
 		}
-		if err := pk.Y.UnmarshalText(res[1]); err != nil {
-			return nil, err
+		secret.Group = group
+		exported = append(exported, secret)
+		exportedAt = append(exportedAt, i)
+	}
+	if len(exported) == 0 {
+		return report, nil
+	}
+	if err := ssha.storage.UpsertSecrets(exported); err != nil {
+		for _, i := range exportedAt {
+			report[i].Status, report[i].Err = ManifestFailed, err
 		}
-		pk.Curve = elliptic.P256()
-		return pk, nil
+		return report, nil
 	}
-	bunkrPubKey, err := unmarshalPubKeyData(secret.PublicData)
-	if err != nil {
+	for j, secret := range exported {
+		if err := ssha.addStored(secret.Name); err != nil {
+			i := exportedAt[j]
+			report[i].Status, report[i].Err = ManifestFailed, err
+		}
+	}
+	return report, nil
+}
+
+// storeAndAdd stores an imported secret and loads it in the keyring with
+// the settings resolved by the storage. A secret imported again replaces
+// the stored one and its key.
+func (ssha *SSHAgent) storeAndAdd(secret *storage.Secret) error {
+	if err := ssha.storage.UpsertSecret(secret); err != nil {
 		return err
 	}
-	sshPub, err := ssh.NewPublicKey(bunkrPubKey)
+	return ssha.addStored(secret.Name)
+}
+
+// addStored loads the stored secret name in the keyring, replacing its key
+// if it was already loaded.
+func (ssha *SSHAgent) addStored(name string) error {
+	kr := ssha.Agent.(*keyring)
+	kr.removeNamed(name)
+	kr.restore(name)
+	stored, err := ssha.storage.GetSecret(name)
 	if err != nil {
 		return err
 	}
-	secret.PublicData = ssh.MarshalAuthorizedKey(sshPub)
+	return ssha.AddKey(stored)
+}
 
-	if err := ssha.storage.StoreSecret(&secret); err != nil {
+// ReloadKey re-reads the stored secret name, refreshing its public data from
+// Bunkr, and rebuilds its signer. The rest of the loaded keys are untouched.
+// Secrets outside the groups and tags selected for loading are left unloaded.
+func (ssha *SSHAgent) ReloadKey(name string) error {
+	if err := ssha.storage.ReloadStorageData(); err != nil {
+		return err
+	}
+	if !ssha.storage.SecretExists(name) {
+		return errors.New(fmt.Sprintf("Secret %s is not stored in the agent", name))
+	}
+	secret, err := ssha.storage.GetSecret(name)
+	if err != nil {
+		return err
+	}
+	exported, err := ssha.exportFromBackend(secret.Backend, secret.BunkrSecretName())
+	if err != nil {
 		return err
 	}
+	if !bytes.Equal(secret.PublicData, exported.PublicData) {
+		secret.PublicData = exported.PublicData
+		if err := ssha.storage.UpdateSecret(secret); err != nil {
+			return err
+		}
+	}
+	kr := ssha.Agent.(*keyring)
+	kr.removeNamed(name)
+	kr.restore(name)
+	if !ssha.selectedForLoading(secret) {
+		// Not in the selected groups or tags, it stays unloaded
+		return nil
+	}
+	return ssha.AddKey(secret)
+}
 
-	if err := ssha.AddKey(&secret); err != nil {
+// RemoveKey removes the secret name from the storage, together with the
+// secrets belonging to it, and drops their keys from the agent.
+func (ssha *SSHAgent) RemoveKey(name string) error {
+	if !ssha.storage.SecretExists(name) {
+		return errors.New(fmt.Sprintf("Secret %s is not stored in the agent", name))
+	}
+	if err := ssha.storage.RemoveSecret(name); err != nil {
 		return err
 	}
+	kr := ssha.Agent.(*keyring)
+	for loaded := range kr.bunkrKeys() {
+		if !ssha.storage.SecretExists(loaded) {
+			kr.removeNamed(loaded)
+		}
+	}
+	kr.restore(name)
+	return nil
+}
+
+// RemoveStoredKey removes the secret name like RemoveKey and asks the agent
+// serving on the agent address, if one is running, to unload the keys of the
+// removed secrets. The names of the removed secrets are returned.
+func (ssha *SSHAgent) RemoveStoredKey(name string) ([]string, error) {
+	before, err := ssha.ListPubKeys()
+	if err != nil {
+		return nil, err
+	}
+	if err := ssha.RemoveKey(name); err != nil {
+		return nil, err
+	}
+	var removed []string
+	var keys []ssh.PublicKey
+	for _, secret := range before {
+		if ssha.storage.SecretExists(secret.Name) {
+			continue
+		}
+		removed = append(removed, secret.Name)
+		if key, err := secretPublicKey(secret); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(removed)
+
+	conn, err := dialAgent(ssha.agentSocketPath)
+	if err != nil {
+		// No agent running, nothing is loaded
+		return removed, nil
+	}
+	defer conn.Close()
+	client := agent.NewClient(conn)
+	for _, key := range keys {
+		// Keys not loaded by the running agent fail, that is fine
+		_ = client.Remove(key)
+	}
+	return removed, nil
+}
+
+// ReloadPlan returns the names of the stored secrets a ReloadKeys would load
+// and of the loaded keys it would remove, without changing the keyring. A
+// secret loaded again, e.g. because its public key changed, is in both lists.
+func (ssha *SSHAgent) ReloadPlan() (toAdd, toRemove []string, err error) {
+	toAdd, toRemove, _, err = ssha.reloadDiff()
+	return toAdd, toRemove, err
+}
 
+// ReloadKeys brings the keyring in line with the storage file, loading the
+// new secrets and removing the keys of the ones no longer stored.
+func (ssha *SSHAgent) ReloadKeys() error {
+	_, _, err := ssha.reload()
+	return err
+}
+
+// Reload reloads the keys like ReloadKeys, logging how many were added and
+// removed. Unchanged keys are kept as they are.
+func (ssha *SSHAgent) Reload() error {
+	added, removed, err := ssha.reload()
+	if err != nil {
+		return err
+	}
+	ssha.logger.Info(fmt.Sprintf("reloaded: +%d -%d keys", added, removed))
 	return nil
 }
+
+// reload applies the reloadDiff changes to the keyring, returning how many
+// keys were added and removed.
+func (ssha *SSHAgent) reload() (added, removed int, err error) {
+	toAdd, toRemove, secrets, err := ssha.reloadDiff()
+	if err != nil {
+		return 0, 0, err
+	}
+	kr := ssha.Agent.(*keyring)
+	for _, name := range toRemove {
+		kr.removeNamed(name)
+	}
+	for _, name := range toAdd {
+		if err := ssha.AddKey(secrets[name]); err != nil {
+			return added, len(toRemove), err
+		}
+		added++
+	}
+	return added, len(toRemove), nil
+}
+
+// reloadDiff compares the loaded keys with the stored secrets, which are
+// returned by name too. A key is loaded again when any of the configuration
+// it is loaded with changed: its public key or certificate, group, comment,
+// lifetime or confirmation.
+func (ssha *SSHAgent) reloadDiff() (toAdd, toRemove []string, secrets map[string]*storage.Secret, err error) {
+	stored, err := ssha.ListPubKeys()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	secrets = make(map[string]*storage.Secret)
+	storedKeys := make(map[string]loadedKey)
+	kr := ssha.Agent.(*keyring)
+	for _, secret := range stored {
+		if kr.isDismissed(secret.Name) || !ssha.selectedForLoading(secret) || !ssha.backendReachable(secret) {
+			continue
+		}
+		sshPub, err := secretPublicKey(secret)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		secrets[secret.Name] = secret
+		storedKeys[secret.Name] = loadedKey{
+			publicKey:    string(sshPub.Marshal()),
+			group:        secretGroupName(secret),
+			comment:      secretComment(secret),
+			lifetimeSecs: secret.LifetimeSecs,
+			confirm:      secret.RequireConfirm,
+		}
+	}
+
+	loaded := kr.bunkrLoaded()
+	for name, keys := range loaded {
+		if want, ok := storedKeys[name]; !ok || len(keys) != 1 || keys[0] != want {
+			toRemove = append(toRemove, name)
+		}
+	}
+	for name, key := range storedKeys {
+		if keys := loaded[name]; len(keys) != 1 || keys[0] != key {
+			toAdd = append(toAdd, name)
+		}
+	}
+	sort.Strings(toAdd)
+	sort.Strings(toRemove)
+	return toAdd, toRemove, secrets, nil
+}
+
+// exportSecret retrieves the description of secretName from the Bunkr
+// backend secrets are imported from, its public data converted to the
+// authorized_keys format used in the storage.
+func (ssha *SSHAgent) exportSecret(secretName string) (*storage.Secret, error) {
+	secret, err := ssha.exportFromBackend(ssha.importBackend, secretName)
+	if err != nil {
+		return nil, err
+	}
+	secret.Backend = ssha.importBackend
+	return secret, nil
+}
+
+// exportFromBackend retrieves the description of secretName like
+// exportSecret from the Bunkr backend named backend.
+func (ssha *SSHAgent) exportFromBackend(backend, secretName string) (*storage.Secret, error) {
+	client, _, err := ssha.backendClients(backend)
+	if err != nil {
+		return nil, err
+	}
+	secretData, err := callBunkr(ssha.bunkrTimeout, ssha.bunkrRetry, func() (string, error) {
+		return client.ExportPublicData(secretName)
+	})
+	if err == context.DeadlineExceeded {
+		return nil, errors.New(fmt.Sprintf("Bunkr did not export %s within %v", secretName, ssha.bunkrTimeout))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	byteContent, err := base64.StdEncoding.DecodeString(secretData)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret storage.Secret
+	if err := json.NewDecoder(bytes.NewReader(byteContent)).Decode(&secret); err != nil {
+		return nil, err
+	}
+
+	if secret.SecretType, err = storage.ParseSecretType(string(secret.SecretType)); err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot import %s: %v", secretName, err))
+	}
+	sshPub, err := decodePublicData(secret.SecretType, secret.PublicData)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot import %s: %v", secretName, err))
+	}
+	secret.PublicData = ssh.MarshalAuthorizedKey(sshPub)
+	return &secret, nil
+}
@@ -0,0 +1,1041 @@
+package ssh_agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+// newTestAgent returns an agent backed by a storage file in a temporary
+// directory, the returned function removes it.
+func newTestAgent(t *testing.T) (*SSHAgent, string, func()) {
+	dir, err := ioutil.TempDir("", "ssh-agent-test")
+	require.NoError(t, err)
+	storagePath := filepath.Join(dir, "storage.json")
+	st, err := storage.NewBunkrStorage(storagePath)
+	require.NoError(t, err)
+	require.NoError(t, st.Dump())
+	ssha := &SSHAgent{
+		agentSocketPath: filepath.Join(dir, "agent.sock"),
+		storagePath:     storagePath,
+		storage:         st,
+
+		fingerprintFormat: FingerprintSHA256,
+	}
+	ssha.Agent = NewKeyring(ssha)
+	return ssha, dir, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// newTestSecret returns a secret holding a freshly generated P-256 public key.
+func newTestSecret(t *testing.T, name string) (*storage.Secret, ssh.PublicKey) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(&pk.PublicKey)
+	require.NoError(t, err)
+	return &storage.Secret{
+		Name:       name,
+		FileId:     "fid-" + name,
+		CapId:      "cid-" + name,
+		SecretType: "ECDSA-P256",
+		PublicData: ssh.MarshalAuthorizedKey(sshPub),
+	}, sshPub
+}
+
+func TestExportPublicKeyFile(t *testing.T) {
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	secret, sshPub := newTestSecret(t, "key1")
+	require.NoError(ssha.storage.StoreSecret(secret))
+
+	path := filepath.Join(dir, "key1.pub")
+	require.NoError(ssha.ExportPublicKeyFile("key1", path, false))
+
+	info, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0644), info.Mode().Perm())
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	exported, comment, _, _, err := ssh.ParseAuthorizedKey(b)
+	require.NoError(err)
+	require.Equal(sshPub.Marshal(), exported.Marshal())
+	require.Equal("key1", comment)
+
+	// Existing files are protected unless overwrite is requested
+	require.Error(ssha.ExportPublicKeyFile("key1", path, false))
+	require.NoError(ssha.ExportPublicKeyFile("key1", path, true))
+
+	require.Error(ssha.ExportPublicKeyFile("missing", filepath.Join(dir, "missing.pub"), false))
+}
+
+func TestGroupConfirmationPolicyLoad(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	yes := true
+	prod, _ := newTestSecret(t, "prod")
+	prod.ConfirmBeforeUse = &yes
+	dev, _ := newTestSecret(t, "dev")
+	prodKey, prodPub := newTestSecret(t, "prodKey")
+	prodKey.Group = prod
+	devKey, devPub := newTestSecret(t, "devKey")
+	devKey.Group = dev
+	for _, s := range []*storage.Secret{prod, dev, prodKey, devKey} {
+		require.NoError(ssha.storage.StoreSecret(s))
+	}
+	require.NoError(ssha.loadKeys())
+
+	keys := ssha.Agent.(*keyring).keys
+	require.True(keys[string(prodPub.Marshal())].confirm)
+	require.False(keys[string(devPub.Marshal())].confirm)
+}
+
+// dialTestAgent waits for the agent socket to be connectable and dials it.
+func dialTestAgent(t *testing.T, path string) net.Conn {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("unix", path); err == nil {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("agent socket %s never became connectable", path)
+	return nil
+}
+
+func TestAllowEmpty(t *testing.T) {
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	// Without a storage file loading keys fails
+	require.NoError(os.Remove(filepath.Join(dir, "storage.json")))
+	require.Error(ssha.Start())
+
+	WithAllowEmpty(true)(ssha)
+	require.NoError(ssha.Start())
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+
+	conn := dialTestAgent(t, ssha.agentSocketPath)
+	defer conn.Close()
+	keys, err := agent.NewClient(conn).List()
+	require.NoError(err)
+	require.Len(keys, 0)
+}
+
+func TestWaitReady(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	require.Error(ssha.WaitReady(ctx))
+	cancel()
+
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(ssha.WaitReady(ctx))
+
+	conn, err := net.Dial("unix", ssha.agentSocketPath)
+	require.NoError(err)
+	defer conn.Close()
+	_, err = agent.NewClient(conn).List()
+	require.NoError(err)
+}
+
+func TestImmutableStorage(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, sshPub := bunkr.newSecret(t, "golden")
+	require.NoError(ssha.storage.StoreSecret(secret))
+	ssha.storage.(*storage.AgentStorage).SetReadOnly(true)
+
+	other, _ := bunkr.newSecret(t, "other")
+	require.Equal(storage.ErrReadOnly, ssha.storage.StoreSecret(other))
+	require.Equal(storage.ErrReadOnly, ssha.storage.RemoveSecret("golden"))
+
+	require.NoError(ssha.Start())
+	sig, err := ssha.Agent.Sign(sshPub, []byte("data"))
+	require.NoError(err)
+	require.NoError(sshPub.Verify([]byte("data"), sig))
+}
+
+func TestImportKeyWithBunkrClient(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "ssh-agent-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// No Bunkr daemon is running on the Bunkr socket path
+	bunkr := newFakeBunkr()
+	ssha, err := NewSSHAgent(filepath.Join(dir, "bunkr.sock"), filepath.Join(dir, "agent.sock"), filepath.Join(dir, "storage.json"), WithBunkrClient(bunkr))
+	require.NoError(err)
+	_, pub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.ImportKey("deploy"))
+	require.Error(ssha.ImportKey("missing"))
+
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal(pub.Marshal(), keys[0].Blob)
+	sig, err := ssha.Agent.Sign(pub, []byte("data"))
+	require.NoError(err)
+	require.NoError(pub.Verify([]byte("data"), sig))
+
+	signer, err := NewSignerFromBunkr(pub, bunkr, "deploy", "")
+	require.NoError(err)
+	sig, err = signer.Sign(rand.Reader, []byte("data"))
+	require.NoError(err)
+	require.NoError(pub.Verify([]byte("data"), sig))
+}
+
+func TestStorageEncryption(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "ssh-agent-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	storagePath := filepath.Join(dir, "storage.json")
+
+	bunkr := newFakeBunkr()
+	ssha, err := NewSSHAgent(filepath.Join(dir, "bunkr.sock"), filepath.Join(dir, "agent.sock"), storagePath, WithBunkrClient(bunkr), WithStorageEncryption("hunter2"))
+	require.NoError(err)
+	bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.ImportKey("deploy"))
+
+	// The storage written by the agent is encrypted with the passphrase
+	content, err := ioutil.ReadFile(storagePath)
+	require.NoError(err)
+	require.NotContains(string(content), "fid-deploy")
+	_, err = storage.NewBunkrStorage(storagePath)
+	require.Error(err)
+	encrypted, err := storage.NewBunkrStorage(storagePath, storage.WithEncryption("hunter2"))
+	require.NoError(err)
+	require.True(encrypted.SecretExists("deploy"))
+
+	_, err = NewSSHAgent(filepath.Join(dir, "bunkr.sock"), filepath.Join(dir, "agent.sock"), storagePath, WithBunkrClient(bunkr), WithStorageEncryption("wrong"))
+	require.Equal(storage.ErrWrongPassphrase, err)
+}
+
+func TestImportKeyToGroup(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	_, prodPub := bunkr.newSecret(t, "prod")
+	_, memberPub := bunkr.newSecret(t, "member")
+
+	require.Error(ssha.ImportKeyToGroup("member", "prod"))
+	require.NoError(ssha.ImportKey("prod"))
+	require.NoError(ssha.ImportKeyToGroup("member", "prod"))
+
+	member, err := ssha.storage.GetSecret("member")
+	require.NoError(err)
+	require.NotNil(member.Group)
+	require.Equal("prod", member.Group.Name)
+	members, err := ssha.storage.GroupMembers("prod")
+	require.NoError(err)
+	require.Equal([]string{"member"}, members)
+
+	// Both keys are loaded and usable
+	for _, pub := range []ssh.PublicKey{prodPub, memberPub} {
+		sig, err := ssha.Agent.Sign(pub, []byte("data"))
+		require.NoError(err)
+		require.NoError(pub.Verify([]byte("data"), sig))
+	}
+}
+
+func TestKeyComment(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	group, _ := bunkr.newSecret(t, "team")
+	require.NoError(ssha.storage.StoreSecret(group))
+	member, _ := bunkr.newSecret(t, "deploy")
+	member.Group = group
+	require.NoError(ssha.storage.StoreSecret(member))
+	aliased, _ := bunkr.newSecret(t, "laptop")
+	aliased.Comment = "work laptop"
+	require.NoError(ssha.storage.StoreSecret(aliased))
+
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	comments := map[string]bool{}
+	for _, key := range keys {
+		comments[key.Comment] = true
+	}
+	require.Equal(map[string]bool{"team": true, "deploy": true, "work laptop": true}, comments)
+}
+
+func TestSocketParentNotDirectory(t *testing.T) {
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	file := filepath.Join(dir, "regular")
+	require.NoError(ioutil.WriteFile(file, []byte("not a dir"), 0600))
+	ssha.agentSocketPath = filepath.Join(file, "sub", "agent.sock")
+
+	err := ssha.Run(context.Background())
+	require.Error(err)
+	require.Contains(err.Error(), file+" is not a directory")
+}
+
+func TestReloadKey(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	_, oldPub := bunkr.newSecret(t, "rotated")
+	_, keptPub := bunkr.newSecret(t, "kept")
+	require.NoError(ssha.ImportKey("rotated"))
+	require.NoError(ssha.ImportKey("kept"))
+
+	kr := ssha.Agent.(*keyring)
+	kept := kr.keys[string(keptPub.Marshal())].signer
+
+	// Rotate the secret in Bunkr
+	_, newPub := bunkr.newSecret(t, "rotated")
+	require.NoError(ssha.ReloadKey("rotated"))
+	require.Error(ssha.ReloadKey("missing"))
+
+	require.False(kr.hasKey(oldPub))
+	require.True(kr.hasKey(newPub))
+	require.True(kept == kr.keys[string(keptPub.Marshal())].signer)
+
+	stored, err := ssha.storage.GetSecret("rotated")
+	require.NoError(err)
+	require.Equal(ssh.MarshalAuthorizedKey(newPub), stored.PublicData)
+
+	sig, err := ssha.Agent.Sign(newPub, []byte("data"))
+	require.NoError(err)
+	require.NoError(newPub.Verify([]byte("data"), sig))
+
+	// Secrets outside the selected tags are not loaded again
+	WithTags("prod")(ssha)
+	require.NoError(ssha.ReloadKey("rotated"))
+	require.False(kr.hasKey(newPub))
+}
+
+func TestReloadPlan(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	for _, name := range []string{"kept", "removed", "rotated"} {
+		secret, _ := bunkr.newSecret(t, name)
+		require.NoError(ssha.storage.StoreSecret(secret))
+	}
+	require.NoError(ssha.ReloadKeys())
+	toAdd, toRemove, err := ssha.ReloadPlan()
+	require.NoError(err)
+	require.Empty(toAdd)
+	require.Empty(toRemove)
+
+	require.NoError(ssha.storage.RemoveSecret("removed"))
+	added, addedPub := bunkr.newSecret(t, "added")
+	require.NoError(ssha.storage.StoreSecret(added))
+	rotated, rotatedPub := bunkr.newSecret(t, "rotated")
+	require.NoError(ssha.storage.UpdateSecret(rotated))
+
+	kr := ssha.Agent.(*keyring)
+	before := kr.bunkrKeys()
+	toAdd, toRemove, err = ssha.ReloadPlan()
+	require.NoError(err)
+	require.Equal([]string{"added", "rotated"}, toAdd)
+	require.Equal([]string{"removed", "rotated"}, toRemove)
+	require.Equal(before, kr.bunkrKeys())
+
+	require.NoError(ssha.ReloadKeys())
+	after := kr.bunkrKeys()
+	require.Len(after, 3)
+	require.Equal(before["kept"], after["kept"])
+	require.NotContains(after, "removed")
+	require.Equal([]string{string(addedPub.Marshal())}, after["added"])
+	require.Equal([]string{string(rotatedPub.Marshal())}, after["rotated"])
+
+	toAdd, toRemove, err = ssha.ReloadPlan()
+	require.NoError(err)
+	require.Empty(toAdd)
+	require.Empty(toRemove)
+
+	// Changing how a key is loaded loads it again
+	for _, change := range []func(secret *storage.Secret){
+		func(secret *storage.Secret) { secret.Comment = "new comment" },
+		func(secret *storage.Secret) { secret.LifetimeSecs = 3600 },
+		func(secret *storage.Secret) {
+			confirm := true
+			secret.ConfirmBeforeUse = &confirm
+		},
+	} {
+		kept, err := ssha.storage.GetSecret("kept")
+		require.NoError(err)
+		change(kept)
+		require.NoError(ssha.storage.UpdateSecret(kept))
+		toAdd, toRemove, err = ssha.ReloadPlan()
+		require.NoError(err)
+		require.Equal([]string{"kept"}, toAdd)
+		require.Equal([]string{"kept"}, toRemove)
+		require.NoError(ssha.ReloadKeys())
+		toAdd, toRemove, err = ssha.ReloadPlan()
+		require.NoError(err)
+		require.Empty(toAdd)
+		require.Empty(toRemove)
+	}
+}
+
+func TestListenExistingSocket(t *testing.T) {
+	require := require.New(t)
+	first, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	go func() {
+		_ = first.Run(context.Background())
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(first.WaitReady(ctx))
+
+	second, _, cleanupSecond := newTestAgent(t)
+	defer cleanupSecond()
+	second.agentSocketPath = first.agentSocketPath
+	before, err := os.Stat(first.agentSocketPath)
+	require.NoError(err)
+	// Without any option a live agent is never taken over
+	require.Equal(ErrAgentAlreadyRunning, second.Run(context.Background()))
+	// Stopping the agent that failed to start leaves the socket alone
+	require.NoError(second.Stop())
+	after, err := os.Stat(first.agentSocketPath)
+	require.NoError(err)
+	require.True(os.SameFile(before, after))
+
+	// The running agent keeps serving
+	conn := dialTestAgent(t, first.agentSocketPath)
+	defer conn.Close()
+	_, err = agent.NewClient(conn).List()
+	require.NoError(err)
+
+	// A socket nobody answers on is reclaimed
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", stale)
+	require.NoError(err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(l.Close())
+	third, _, cleanupThird := newTestAgent(t)
+	defer cleanupThird()
+	third.agentSocketPath = stale
+	go func() {
+		_ = third.Run(context.Background())
+	}()
+	require.NoError(third.WaitReady(ctx))
+}
+
+func TestRemoveStoredKeyFromRunningAgent(t *testing.T) {
+	require := require.New(t)
+	running, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	bunkr := newFakeBunkr()
+	running.signClient = bunkr
+	team, _ := bunkr.newSecret(t, "team")
+	require.NoError(running.storage.StoreSecret(team))
+	deploy, _ := bunkr.newSecret(t, "deploy")
+	deploy.Group = team
+	require.NoError(running.storage.StoreSecret(deploy))
+	solo, _ := bunkr.newSecret(t, "solo")
+	require.NoError(running.storage.StoreSecret(solo))
+
+	go func() {
+		_ = running.Run(context.Background())
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(running.WaitReady(ctx))
+	conn := dialTestAgent(t, running.agentSocketPath)
+	defer conn.Close()
+	client := agent.NewClient(conn)
+	keys, err := client.List()
+	require.NoError(err)
+	require.Len(keys, 3)
+
+	// The CLI works on the same storage and agent socket
+	st, err := storage.NewBunkrStorage(running.storagePath)
+	require.NoError(err)
+	cli := &SSHAgent{agentSocketPath: running.agentSocketPath, storage: st}
+	cli.Agent = NewKeyring(cli)
+
+	removed, err := cli.RemoveStoredKey("solo")
+	require.NoError(err)
+	require.Equal([]string{"solo"}, removed)
+	keys, err = client.List()
+	require.NoError(err)
+	require.Len(keys, 2)
+
+	// Removing a group removes its members too
+	removed, err = cli.RemoveStoredKey("team")
+	require.NoError(err)
+	require.Equal([]string{"deploy", "team"}, removed)
+	keys, err = client.List()
+	require.NoError(err)
+	require.Empty(keys)
+
+	_, err = cli.RemoveStoredKey("solo")
+	require.EqualError(err, "Secret solo is not stored in the agent")
+
+	// A secret imported again under a removed name is loaded
+	require.NoError(cli.storage.StoreSecret(solo))
+	keys, err = client.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+}
+
+// memListener is a net.Listener handing out in memory connections.
+type memListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newMemListener() *memListener {
+	return &memListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "memory", Net: "unix"}
+}
+
+// dial returns the client end of a new connection accepted by l.
+func (l *memListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func TestRunWithListener(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.storage.StoreSecret(secret))
+
+	l := newMemListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- ssha.RunWithListener(ctx, l)
+	}()
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	require.NoError(ssha.WaitReady(waitCtx))
+
+	conn, err := l.dial()
+	require.NoError(err)
+	keys, err := agent.NewClient(conn).List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal(pub.Marshal(), keys[0].Blob)
+	conn.Close()
+
+	// No socket file is involved, stopping closes the listener
+	cancel()
+	require.NoError(<-stopped)
+	_, err = l.dial()
+	require.Error(err)
+	_, err = os.Stat(ssha.agentSocketPath)
+	require.True(os.IsNotExist(err))
+}
+
+func TestStartLocked(t *testing.T) {
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	_, err := NewSSHAgent("", ssha.agentSocketPath, filepath.Join(dir, "storage.json"), WithStartLocked(true))
+	require.Error(err)
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.storage.StoreSecret(secret))
+	WithStartLocked(true)(ssha)
+	WithLockPassphrase([]byte("passphrase"))(ssha)
+	require.NoError(ssha.Start())
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+
+	conn := dialTestAgent(t, ssha.agentSocketPath)
+	defer conn.Close()
+	client := agent.NewClient(conn)
+	keys, err := client.List()
+	require.NoError(err)
+	require.Len(keys, 0)
+	_, err = client.Sign(pub, []byte("data"))
+	require.Error(err)
+
+	require.Error(client.Unlock([]byte("wrong")))
+	require.NoError(client.Unlock([]byte("passphrase")))
+	keys, err = client.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	require.Equal(pub.Marshal(), keys[0].Blob)
+}
+
+func TestImportKeyAgain(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	_, oldPub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.ImportKey("deploy"))
+
+	// The capability was rotated in Bunkr
+	_, newPub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.ImportKey("deploy"))
+
+	kr := ssha.Agent.(*keyring)
+	require.False(kr.hasKey(oldPub))
+	require.True(kr.hasKey(newPub))
+	stored, err := ssha.storage.GetSecret("deploy")
+	require.NoError(err)
+	require.Equal(ssh.MarshalAuthorizedKey(newPub), stored.PublicData)
+}
+
+// groupCheckingBunkr only signs with secrets given the Bunkr group they were
+// created in.
+type groupCheckingBunkr struct {
+	*fakeBunkr
+	groups map[string]string
+}
+
+func (b *groupCheckingBunkr) SignECDSA(secretName, digest, groupName string) (string, error) {
+	if b.groups[secretName] != groupName {
+		return "", errors.New("wrong group")
+	}
+	return b.fakeBunkr.SignECDSA(secretName, digest, groupName)
+}
+
+func TestSignAfterRename(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := &groupCheckingBunkr{newFakeBunkr(), map[string]string{"member": "team"}}
+	ssha.signClient = bunkr
+	team, teamPub := bunkr.newSecret(t, "team")
+	member, memberPub := bunkr.newSecret(t, "member")
+	member.Group = team
+	require.NoError(ssha.storage.StoreSecret(team))
+	require.NoError(ssha.storage.StoreSecret(member))
+	require.NoError(ssha.storage.RenameSecret("team", "ops"))
+	require.NoError(ssha.storage.RenameSecret("member", "deploy"))
+	require.NoError(ssha.loadKeys())
+
+	// Bunkr is asked with the names it knows the secrets by
+	for _, pub := range []ssh.PublicKey{teamPub, memberPub} {
+		sig, err := ssha.Agent.Sign(pub, []byte("data"))
+		require.NoError(err)
+		require.NoError(pub.Verify([]byte("data"), sig))
+	}
+	require.True(ssha.TestSignOK("deploy"))
+}
+
+func TestSignRecordsLastUse(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	_, pub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.ImportKey("deploy"))
+	stored, err := ssha.storage.GetSecret("deploy")
+	require.NoError(err)
+	require.True(stored.LastUsedAt.IsZero())
+
+	kr := ssha.Agent.(*keyring)
+	clock := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	kr.now = func() time.Time { return clock }
+	_, err = kr.Sign(pub, []byte("data"))
+	require.NoError(err)
+	stored, err = ssha.storage.GetSecret("deploy")
+	require.NoError(err)
+	require.True(clock.Equal(stored.LastUsedAt))
+
+	// A key imported by another process, like -addBunkrKey, is kept
+	other, err := storage.NewBunkrStorage(ssha.storagePath)
+	require.NoError(err)
+	imported, _ := bunkr.newSecret(t, "imported")
+	require.NoError(other.StoreSecret(imported))
+	clock = clock.Add(lastUsedPersistInterval)
+	_, err = kr.Sign(pub, []byte("data"))
+	require.NoError(err)
+	other, err = storage.NewBunkrStorage(ssha.storagePath)
+	require.NoError(err)
+	require.True(other.SecretExists("imported"))
+	stored, err = other.GetSecret("deploy")
+	require.NoError(err)
+	require.True(clock.Equal(stored.LastUsedAt))
+
+	// Signing again shortly after does not record it again
+	clock = clock.Add(time.Second)
+	_, err = kr.Sign(pub, []byte("data"))
+	require.NoError(err)
+	stored, err = ssha.storage.GetSecret("deploy")
+	require.NoError(err)
+	require.True(clock.Add(-time.Second).Equal(stored.LastUsedAt))
+
+	clock = clock.Add(lastUsedPersistInterval)
+	_, err = kr.Sign(pub, []byte("data"))
+	require.NoError(err)
+	stored, err = ssha.storage.GetSecret("deploy")
+	require.NoError(err)
+	require.True(clock.Equal(stored.LastUsedAt))
+}
+
+func TestReload(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	kept, _ := bunkr.newSecret(t, "kept")
+	require.NoError(ssha.storage.StoreSecret(kept))
+	require.NoError(ssha.Start())
+	kr := ssha.Agent.(*keyring)
+	before := kr.bunkrKeys()
+
+	added, addedPub := bunkr.newSecret(t, "added")
+	require.NoError(ssha.storage.StoreSecret(added))
+	require.NoError(ssha.Reload())
+
+	after := kr.bunkrKeys()
+	require.Len(after, 2)
+	require.Equal(before["kept"], after["kept"])
+	require.Equal([]string{string(addedPub.Marshal())}, after["added"])
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 2)
+}
+
+func TestRemoveKey(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	group, groupPub := bunkr.newSecret(t, "group")
+	require.NoError(ssha.storage.StoreSecret(group))
+	member, memberPub := bunkr.newSecret(t, "member")
+	member.Group = group
+	require.NoError(ssha.storage.StoreSecret(member))
+	other, _ := bunkr.newSecret(t, "other")
+	require.NoError(ssha.storage.StoreSecret(other))
+	require.NoError(ssha.Start())
+
+	require.NoError(ssha.RemoveKey("group"))
+	require.False(ssha.storage.SecretExists("group"))
+	require.False(ssha.storage.SecretExists("member"))
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	for _, pub := range []ssh.PublicKey{groupPub, memberPub} {
+		_, err = ssha.Agent.Sign(pub, []byte("data"))
+		require.Error(err)
+	}
+	require.Error(ssha.RemoveKey("group"))
+}
+
+func TestMaxConnections(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	ssha.maxConns = 2
+	ssha.connQueueWait = 50 * time.Millisecond
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+	defer ssha.Stop()
+	require.NoError(ssha.WaitReady(ctx))
+
+	var open []net.Conn
+	for i := 0; i < 2; i++ {
+		conn := dialTestAgent(t, ssha.agentSocketPath)
+		_, err := agent.NewClient(conn).List()
+		require.NoError(err)
+		open = append(open, conn)
+	}
+
+	// The third connection is closed once it waited for a slot
+	conn := dialTestAgent(t, ssha.agentSocketPath)
+	_, err := agent.NewClient(conn).List()
+	require.Error(err)
+	conn.Close()
+
+	// Closing a connection, even a broken one, releases its slot
+	_, err = open[0].Write([]byte("garbage that is not an agent request"))
+	require.NoError(err)
+	open[0].Close()
+	var served bool
+	for i := 0; i < 100 && !served; i++ {
+		conn = dialTestAgent(t, ssha.agentSocketPath)
+		_, err = agent.NewClient(conn).List()
+		served = err == nil
+		conn.Close()
+	}
+	require.True(served)
+	open[1].Close()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	ssha.idleTimeout = 200 * time.Millisecond
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+	defer ssha.Stop()
+	require.NoError(ssha.WaitReady(ctx))
+
+	// Each request restarts the wait
+	active := dialTestAgent(t, ssha.agentSocketPath)
+	defer active.Close()
+	client := agent.NewClient(active)
+	for i := 0; i < 4; i++ {
+		_, err := client.List()
+		require.NoError(err)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// A silent connection is closed by the agent
+	silent := dialTestAgent(t, ssha.agentSocketPath)
+	defer silent.Close()
+	start := time.Now()
+	require.NoError(silent.SetReadDeadline(time.Now().Add(3 * time.Second)))
+	_, err := silent.Read(make([]byte, 1))
+	require.Equal(io.EOF, err)
+	require.True(time.Since(start) >= 200*time.Millisecond)
+}
+
+func TestLoadGroups(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	stored := make(map[string]ssh.PublicKey)
+	store := func(name string, group *storage.Secret) *storage.Secret {
+		secret, pub := bunkr.newSecret(t, name)
+		secret.Group = group
+		require.NoError(ssha.storage.StoreSecret(secret))
+		stored[name] = pub
+		return secret
+	}
+	ci := store("ci", nil)
+	store("ci-runner", ci)
+	deploy := store("deploy", nil)
+	store("deploy-prod", deploy)
+	store("personal", nil)
+
+	WithGroups("ci")(ssha)
+	require.NoError(ssha.Start())
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	var loaded []string
+	for _, key := range keys {
+		loaded = append(loaded, key.Comment)
+	}
+	require.ElementsMatch([]string{"ci", "ci-runner"}, loaded)
+	_, err = ssha.Agent.Sign(stored["personal"], []byte("data"))
+	require.Error(err)
+
+	// Reloading keeps the selection
+	toAdd, _, err := ssha.ReloadPlan()
+	require.NoError(err)
+	require.Empty(toAdd)
+}
+
+func TestLoadTags(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	store := func(name string, group *storage.Secret, tags ...string) *storage.Secret {
+		secret, _ := bunkr.newSecret(t, name)
+		secret.Group = group
+		secret.Tags = tags
+		require.NoError(ssha.storage.StoreSecret(secret))
+		return secret
+	}
+	ci := store("ci", nil, "ci")
+	store("ci-runner", ci, "ci", "prod")
+	store("ci-staging", ci)
+	store("deploy", nil, "prod")
+	store("personal", nil, "personal")
+
+	WithTags("prod")(ssha)
+	WithGroups("ci")(ssha)
+	require.NoError(ssha.Start())
+	keys, err := ssha.Agent.List()
+	require.NoError(err)
+	var loaded []string
+	for _, key := range keys {
+		loaded = append(loaded, key.Comment)
+	}
+	require.ElementsMatch([]string{"ci-runner"}, loaded)
+
+	// Reloading keeps the selection
+	toAdd, _, err := ssha.ReloadPlan()
+	require.NoError(err)
+	require.Empty(toAdd)
+}
+
+func TestExportAuthorizedKeys(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	stored := func(name, publicData string, group *storage.Secret) *storage.Secret {
+		secret := &storage.Secret{Name: name, SecretType: "ED25519", PublicData: []byte(publicData), Group: group}
+		require.NoError(ssha.storage.StoreSecret(secret))
+		return secret
+	}
+	ci := stored("ci", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIqI4910CfGV/VLbLTy6XXLKZwm/HZQSG/N0iAG0D29c old comment\n", nil)
+	stored("runner", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIE5dw6ofRdfVqNUZsNMfszLjYqRtO43ol32D1uPybOU\n", ci)
+	stored("a-laptop", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIO1JKMYo0cLG6ukDOJBZlWEpWSc6XGP5NjbBRhSshzfR\n", nil)
+
+	var out bytes.Buffer
+	require.NoError(ssha.ExportAuthorizedKeys(&out))
+	require.Equal(
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIO1JKMYo0cLG6ukDOJBZlWEpWSc6XGP5NjbBRhSshzfR a-laptop\n"+
+			"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIqI4910CfGV/VLbLTy6XXLKZwm/HZQSG/N0iAG0D29c ci\n"+
+			"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIE5dw6ofRdfVqNUZsNMfszLjYqRtO43ol32D1uPybOU runner (ci)\n",
+		out.String())
+}
+
+// countingStore counts the writes of imported secrets.
+type countingStore struct {
+	*storage.InMemoryStore
+	writes int
+}
+
+func (s *countingStore) UpsertSecret(secret *storage.Secret) error {
+	s.writes++
+	return s.InMemoryStore.UpsertSecret(secret)
+}
+
+func (s *countingStore) UpsertSecrets(secrets []*storage.Secret) error {
+	s.writes++
+	return s.InMemoryStore.UpsertSecrets(secrets)
+}
+
+func TestImportKeys(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	store := &countingStore{InMemoryStore: storage.NewInMemoryStore()}
+	ssha.storage = store
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	_, ciPub := bunkr.newSecret(t, "ci")
+	_, deployPub := bunkr.newSecret(t, "deploy")
+
+	report, err := ssha.ImportKeys([]string{"ci", "missing", "deploy"}, "")
+	require.NoError(err)
+	require.True(report.Failed())
+	require.Len(report, 3)
+	require.Equal(ManifestResult{Secret: "ci", Status: ManifestImported}, report[0])
+	require.Equal("missing", report[1].Secret)
+	require.Equal(ManifestFailed, report[1].Status)
+	require.Error(report[1].Err)
+	require.Equal(ManifestResult{Secret: "deploy", Status: ManifestImported}, report[2])
+
+	require.Equal(1, store.writes)
+	require.True(store.SecretExists("ci"))
+	require.True(store.SecretExists("deploy"))
+	require.False(store.SecretExists("missing"))
+	kr := ssha.Agent.(*keyring)
+	require.True(kr.hasKey(ciPub))
+	require.True(kr.hasKey(deployPub))
+
+	_, err = ssha.ImportKeys([]string{"ci"}, "missing")
+	require.Error(err)
+}
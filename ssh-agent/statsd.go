@@ -0,0 +1,47 @@
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdSink is a MetricsSink sending every event as a statsd packet. The
+// labels are part of the metric names as plain statsd has no tags, e.g.
+// "prefix.sign.rsa-sha2-512.ssh-rsa.count:1|c".
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+func newStatsdSink(addr, prefix string) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error connecting to statsd at %s: %v", addr, err))
+	}
+	prefix = strings.TrimSuffix(prefix, ".")
+	if prefix != "" {
+		prefix += "."
+	}
+	return &statsdSink{conn, prefix}, nil
+}
+
+// statsdName makes a label safe to use as a statsd metric name component.
+var statsdName = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", " ", "_")
+
+func (s *statsdSink) SignRequest(algorithm, keyType string, duration time.Duration, err error) {
+	name := fmt.Sprintf("%ssign.%s.%s", s.prefix, statsdName.Replace(algorithm), statsdName.Replace(keyType))
+	packets := []string{
+		fmt.Sprintf("%s.count:1|c", name),
+		fmt.Sprintf("%s.latency:%d|ms", name, duration.Nanoseconds()/int64(time.Millisecond)),
+	}
+	if err != nil {
+		packets = append(packets, fmt.Sprintf("%s.failures:1|c", name))
+	}
+	// Metrics are best effort, a missing statsd server must not break signing
+	for _, p := range packets {
+		_, _ = s.conn.Write([]byte(p))
+	}
+}
@@ -0,0 +1,209 @@
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultStopGracePeriod is how long Stop waits for the open connections to
+// be closed by their clients before closing them.
+const defaultStopGracePeriod = 5 * time.Second
+
+// Stop steps, in the order they are run.
+const (
+	stopStepAccept      = "accept"
+	stopStepConnections = "connections"
+	stopStepBunkr       = "bunkr"
+	stopStepSockets     = "sockets"
+)
+
+// Stop shuts the agent down: it stops accepting connections, waits for the
+// open ones to finish, closes the Bunkr client and removes the socket files.
+// Every step is run even if a previous one failed, the returned error
+// gathers all failures. Calling Stop again returns the same result.
+func (ssha *SSHAgent) Stop() error {
+	ssha.stopOnce.Do(func() {
+		steps := []struct {
+			name string
+			run  func() error
+		}{
+			{stopStepAccept, ssha.stopAccepting},
+			{stopStepConnections, ssha.waitConnections},
+			{stopStepBunkr, ssha.closeBunkr},
+			{stopStepSockets, ssha.removeSockets},
+		}
+		var failures []string
+		for _, step := range steps {
+			if ssha.onStopStep != nil {
+				ssha.onStopStep(step.name)
+			}
+			if err := step.run(); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", step.name, err))
+			}
+		}
+		if len(failures) > 0 {
+			ssha.stopErr = errors.New(fmt.Sprintf("unclean shutdown: %s", strings.Join(failures, "; ")))
+		}
+	})
+	return ssha.stopErr
+}
+
+// Shutdown stops the agent logging any failure, see Stop.
+func (ssha *SSHAgent) Shutdown() {
+	if err := ssha.Stop(); err != nil {
+		ssha.logger.Error(err.Error())
+	}
+}
+
+// stopAccepting closes the listeners so Run returns, and ends the background
+// work waiting on stoppedChan.
+func (ssha *SSHAgent) stopAccepting() error {
+	ssha.mu.Lock()
+	ssha.stopping = true
+	if ssha.stopped == nil {
+		ssha.stopped = make(chan struct{})
+	}
+	close(ssha.stopped)
+	listeners := ssha.listeners
+	ssha.listeners = nil
+	ssha.mu.Unlock()
+
+	var err error
+	for _, l := range listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// waitConnections waits for the served connections to be closed, closing the
+// ones still open once the grace period elapses.
+func (ssha *SSHAgent) waitConnections() error {
+	grace := ssha.stopGracePeriod
+	if grace <= 0 {
+		grace = defaultStopGracePeriod
+	}
+	done := make(chan struct{})
+	go func() {
+		ssha.connsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(grace):
+	}
+
+	ssha.mu.Lock()
+	open := len(ssha.conns)
+	for con := range ssha.conns {
+		con.Close()
+	}
+	ssha.mu.Unlock()
+	<-done
+	return errors.New(fmt.Sprintf("%d connections still open after %v", open, grace))
+}
+
+// closeBunkr closes the Bunkr clients holding resources, the ones of the
+// backends included.
+func (ssha *SSHAgent) closeBunkr() error {
+	err := ssha.closeBackends()
+	if closer, ok := ssha.bunkrClient.(io.Closer); ok {
+		if cerr := closer.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// removeSockets removes the socket files the agent created, so that the
+// socket of another agent, or one passed by systemd, is left.
+func (ssha *SSHAgent) removeSockets() error {
+	ssha.mu.Lock()
+	paths := ssha.socketPaths
+	ssha.mu.Unlock()
+	var failures []string
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// stoppedChan returns a channel closed once the agent stops.
+func (ssha *SSHAgent) stoppedChan() <-chan struct{} {
+	ssha.mu.Lock()
+	defer ssha.mu.Unlock()
+	if ssha.stopped == nil {
+		ssha.stopped = make(chan struct{})
+	}
+	return ssha.stopped
+}
+
+// trackListener registers l to be closed by Stop, and the socket file path
+// the agent created for it, if any, to be removed. It returns false, closing
+// l, if the agent is already stopping.
+func (ssha *SSHAgent) trackListener(l net.Listener, path string) bool {
+	ssha.mu.Lock()
+	defer ssha.mu.Unlock()
+	if ssha.stopping {
+		l.Close()
+		return false
+	}
+	ssha.listeners = append(ssha.listeners, l)
+	if path != "" {
+		ssha.socketPaths = append(ssha.socketPaths, path)
+	}
+	return true
+}
+
+// isStopping reports whether Stop has been called.
+func (ssha *SSHAgent) isStopping() bool {
+	ssha.mu.Lock()
+	defer ssha.mu.Unlock()
+	return ssha.stopping
+}
+
+// hasOpenConns reports whether any served connection is still open.
+func (ssha *SSHAgent) hasOpenConns() bool {
+	ssha.mu.Lock()
+	defer ssha.mu.Unlock()
+	return len(ssha.conns) > 0
+}
+
+// trackConn registers an accepted connection until untrackConn is called.
+func (ssha *SSHAgent) trackConn(con net.Conn) {
+	ssha.mu.Lock()
+	defer ssha.mu.Unlock()
+	if ssha.conns == nil {
+		ssha.conns = make(map[net.Conn]struct{})
+	}
+	ssha.conns[con] = struct{}{}
+	ssha.connsWG.Add(1)
+	ssha.connectionsMetricLocked()
+}
+
+func (ssha *SSHAgent) untrackConn(con net.Conn) {
+	ssha.mu.Lock()
+	defer ssha.mu.Unlock()
+	delete(ssha.conns, con)
+	ssha.connsWG.Done()
+	ssha.connectionsMetricLocked()
+}
+
+// connectionsMetricLocked reports the number of connections being served.
+// The caller must be holding the agent mutex.
+func (ssha *SSHAgent) connectionsMetricLocked() {
+	count := len(ssha.conns)
+	ssha.agentMetrics(func(sink AgentMetricsSink) { sink.ActiveConnections(count) })
+}
@@ -0,0 +1,127 @@
+package ssh_agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// closingBunkr records when the agent closes it.
+type closingBunkr struct {
+	*fakeBunkr
+	closed func() error
+}
+
+func (b *closingBunkr) Close() error {
+	return b.closed()
+}
+
+func TestStopOrder(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	var steps []string
+	ssha.onStopStep = func(step string) {
+		steps = append(steps, step)
+	}
+	ssha.bunkrClient = &closingBunkr{newFakeBunkr(), func() error {
+		// Nothing is served anymore when Bunkr is closed
+		require.False(ssha.hasOpenConns())
+		return nil
+	}}
+
+	ran := make(chan error, 1)
+	go func() {
+		ran <- ssha.Run(context.Background())
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(ssha.WaitReady(ctx))
+
+	conn := dialTestAgent(t, ssha.agentSocketPath)
+	_, err := agent.NewClient(conn).List()
+	require.NoError(err)
+	conn.Close()
+
+	require.NoError(ssha.Stop())
+	require.NoError(<-ran)
+	require.Equal([]string{stopStepAccept, stopStepConnections, stopStepBunkr, stopStepSockets}, steps)
+	_, err = os.Stat(ssha.agentSocketPath)
+	require.True(os.IsNotExist(err))
+
+	// Stopping again does not run the steps twice
+	require.NoError(ssha.Stop())
+	require.Len(steps, 4)
+}
+
+func TestStopAggregatesErrors(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	ssha.stopGracePeriod = 50 * time.Millisecond
+	ssha.bunkrClient = &closingBunkr{newFakeBunkr(), func() error {
+		return errors.New("bunkr went away")
+	}}
+
+	go func() {
+		_ = ssha.Run(context.Background())
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(ssha.WaitReady(ctx))
+
+	// A client that never hangs up
+	conn := dialTestAgent(t, ssha.agentSocketPath)
+	defer conn.Close()
+	_, err := agent.NewClient(conn).List()
+	require.NoError(err)
+
+	err = ssha.Stop()
+	require.Error(err)
+	require.Contains(err.Error(), "connections: 1 connections still open")
+	require.Contains(err.Error(), "bunkr: bunkr went away")
+	require.NotContains(err.Error(), "sockets:")
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	runCtx, stop := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() {
+		ran <- ssha.Run(runCtx)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(ssha.WaitReady(ctx))
+
+	// An in flight connection is waited for before Run returns
+	conn := dialTestAgent(t, ssha.agentSocketPath)
+	_, err := agent.NewClient(conn).List()
+	require.NoError(err)
+	stop()
+	select {
+	case <-ran:
+		t.Fatal("Run returned with a connection still open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Close()
+
+	select {
+	case err := <-ran:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+	_, err = os.Stat(ssha.agentSocketPath)
+	require.True(os.IsNotExist(err))
+}
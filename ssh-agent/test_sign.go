@@ -0,0 +1,70 @@
+package ssh_agent
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SignTestResult is the outcome of TestSign.
+type SignTestResult struct {
+	// Name is the stored secret signed with.
+	Name string
+	// Fingerprint is the fingerprint of its public key, in the agent log
+	// format.
+	Fingerprint string
+	// Algorithm is the format of the produced signature.
+	Algorithm string
+	// Duration is how long Bunkr took to sign.
+	Duration time.Duration
+	// Err is set if signing or verifying the signature failed.
+	Err error
+}
+
+// OK reports whether the test signature succeeded.
+func (r SignTestResult) OK() bool {
+	return r.Err == nil
+}
+
+// TestSign asks Bunkr to sign a random challenge with the stored secret name
+// and verifies the signature against its public key. The keyring, and so
+// the confirmation and lifetime constraints, is not involved.
+func (ssha *SSHAgent) TestSign(name string) SignTestResult {
+	result := SignTestResult{Name: name}
+	secret, err := ssha.storage.GetSecret(name)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	signer, err := ssha.secretSigner(secret)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	pub := signer.PublicKey()
+	result.Fingerprint = ssha.fingerprintFormat.Fingerprint(pub)
+
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		result.Err = err
+		return result
+	}
+	start := time.Now()
+	sig, err := signer.Sign(rand.Reader, challenge)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Algorithm = sig.Format
+	if err := pub.Verify(challenge, sig); err != nil {
+		result.Err = errors.New(fmt.Sprintf("Bunkr returned an invalid signature for %s: %v", name, err))
+	}
+	return result
+}
+
+// TestSignOK is TestSign reduced to whether the signature succeeded.
+func (ssha *SSHAgent) TestSignOK(name string) bool {
+	return ssha.TestSign(name).OK()
+}
@@ -0,0 +1,33 @@
+package ssh_agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTestSign(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := &slowBunkr{newFakeBunkr(), 20 * time.Millisecond}
+	ssha.signClient = bunkr
+	secret, pub := bunkr.newSecret(t, "deploy")
+	require.NoError(ssha.storage.StoreSecret(secret))
+
+	result := ssha.TestSign("deploy")
+	require.NoError(result.Err)
+	require.True(result.OK())
+	require.Equal("deploy", result.Name)
+	require.Equal(ssha.fingerprintFormat.Fingerprint(pub), result.Fingerprint)
+	require.Equal(ssh.KeyAlgoECDSA256, result.Algorithm)
+	require.True(result.Duration >= 20*time.Millisecond)
+	require.True(ssha.TestSignOK("deploy"))
+
+	result = ssha.TestSign("missing")
+	require.Error(result.Err)
+	require.False(ssha.TestSignOK("missing"))
+}
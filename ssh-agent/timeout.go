@@ -0,0 +1,34 @@
+package ssh_agent
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultBunkrTimeout is how long a Bunkr call may take unless configured
+// otherwise with WithBunkrTimeout.
+const DefaultBunkrTimeout = 10 * time.Second
+
+// callBunkr runs the Bunkr call, retried following retry, giving up with
+// context.DeadlineExceeded once timeout elapsed, retries included. The Bunkr
+// client does not take a context, so a call given up on keeps running in the
+// background until the daemon answers. Zero waits forever.
+func callBunkr(timeout time.Duration, retry retryPolicy, call func() (string, error)) (string, error) {
+	if timeout <= 0 {
+		return retry.do(context.Background(), call)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := make(chan signResult, 1)
+	go func() {
+		answer, err := retry.do(ctx, call)
+		result <- signResult{answer, err}
+	}()
+	select {
+	case r := <-result:
+		return r.signature, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
@@ -0,0 +1,63 @@
+package ssh_agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hangingBunkr answers every call after delay, like a wedged daemon.
+type hangingBunkr struct {
+	*fakeBunkr
+	delay time.Duration
+}
+
+func (b *hangingBunkr) ExportPublicData(secretName string) (string, error) {
+	time.Sleep(b.delay)
+	return b.fakeBunkr.ExportPublicData(secretName)
+}
+
+func (b *hangingBunkr) SignECDSA(secretName, digest, groupName string) (string, error) {
+	time.Sleep(b.delay)
+	return b.fakeBunkr.SignECDSA(secretName, digest, groupName)
+}
+
+func TestBunkrTimeout(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	bunkr := &hangingBunkr{newFakeBunkr(), 200 * time.Millisecond}
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	WithBunkrTimeout(20 * time.Millisecond)(ssha)
+	secret, pub := bunkr.newSecret(t, "deploy")
+
+	start := time.Now()
+	require.EqualError(ssha.ImportKey("deploy"), "Bunkr did not export deploy within 20ms")
+	require.True(time.Since(start) < bunkr.delay)
+
+	// Signing uses the Bunkr timeout unless a sign timeout is set
+	require.NoError(ssha.AddKey(secret))
+	_, err := ssha.Agent.Sign(pub, []byte("data"))
+	require.EqualError(err, "Bunkr did not sign with deploy within 20ms")
+	WithSignTimeout(time.Second)(ssha)
+	require.NoError(ssha.AddKey(secret))
+	_, err = ssha.Agent.Sign(pub, []byte("data"))
+	require.NoError(err)
+}
+
+func TestCallBunkr(t *testing.T) {
+	require := require.New(t)
+	answer, err := callBunkr(0, retryPolicy{}, func() (string, error) { return "answer", nil })
+	require.NoError(err)
+	require.Equal("answer", answer)
+
+	_, err = callBunkr(10*time.Millisecond, retryPolicy{}, func() (string, error) {
+		time.Sleep(100 * time.Millisecond)
+		return "late", nil
+	})
+	require.Equal(context.DeadlineExceeded, err)
+}
@@ -0,0 +1,103 @@
+package ssh_agent
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// tracingAgent wraps a BunkrAgent logging the type and outcome of every
+// request served on one connection. Only request types, key fingerprints and
+// errors are logged, never data to be signed, signatures or passphrases.
+type tracingAgent struct {
+	BunkrAgent
+	connID uint64
+	format FingerprintFormat
+	logger *Logger
+}
+
+func newTracingAgent(a BunkrAgent, connID uint64, format FingerprintFormat, logger *Logger) *tracingAgent {
+	return &tracingAgent{a, connID, format, logger}
+}
+
+func (t *tracingAgent) trace(request string, key ssh.PublicKey, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	if key != nil {
+		t.logger.Debug(fmt.Sprintf("trace conn=%d request=%s key=%s result=%s", t.connID, request, t.format.Fingerprint(key), result))
+		return
+	}
+	t.logger.Debug(fmt.Sprintf("trace conn=%d request=%s result=%s", t.connID, request, result))
+}
+
+func (t *tracingAgent) List() ([]*Key, error) {
+	keys, err := t.BunkrAgent.List()
+	t.trace("list", nil, err)
+	return keys, err
+}
+
+func (t *tracingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	sig, err := t.BunkrAgent.Sign(key, data)
+	t.trace("sign", key, err)
+	return sig, err
+}
+
+func (t *tracingAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error) {
+	extended, ok := t.BunkrAgent.(agent.ExtendedAgent)
+	if !ok {
+		return t.Sign(key, data)
+	}
+	sig, err := extended.SignWithFlags(key, data, flags)
+	t.trace("sign", key, err)
+	return sig, err
+}
+
+func (t *tracingAgent) Add(key AddedKey) error {
+	err := t.BunkrAgent.Add(key)
+	t.trace("add", nil, err)
+	return err
+}
+
+func (t *tracingAgent) Remove(key ssh.PublicKey) error {
+	err := t.BunkrAgent.Remove(key)
+	t.trace("remove", key, err)
+	return err
+}
+
+func (t *tracingAgent) RemoveAll() error {
+	err := t.BunkrAgent.RemoveAll()
+	t.trace("remove-all", nil, err)
+	return err
+}
+
+func (t *tracingAgent) Lock(passphrase []byte) error {
+	err := t.BunkrAgent.Lock(passphrase)
+	t.trace("lock", nil, err)
+	return err
+}
+
+func (t *tracingAgent) Unlock(passphrase []byte) error {
+	err := t.BunkrAgent.Unlock(passphrase)
+	t.trace("unlock", nil, err)
+	return err
+}
+
+func (t *tracingAgent) Signers() ([]ssh.Signer, error) {
+	signers, err := t.BunkrAgent.Signers()
+	t.trace("signers", nil, err)
+	return signers, err
+}
+
+func (t *tracingAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	extended, ok := t.BunkrAgent.(agent.ExtendedAgent)
+	if !ok {
+		t.trace("extension "+extensionType, nil, ErrExtensionUnsupported)
+		return nil, ErrExtensionUnsupported
+	}
+	res, err := extended.Extension(extensionType, contents)
+	t.trace("extension "+extensionType, nil, err)
+	return res, err
+}
@@ -0,0 +1,72 @@
+package ssh_agent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTracingAgent(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	require.NoError(ssha.Agent.Add(AddedKey{PrivateKey: pk, Comment: "local"}))
+	sshPub, err := ssh.NewPublicKey(&pk.PublicKey)
+	require.NoError(err)
+
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogDebug, LogFormatText)
+
+	traced := newTracingAgent(ssha.Agent, 7, FingerprintSHA256, logger)
+	keys, err := traced.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+	data := []byte("very secret payload")
+	sig, err := traced.Sign(sshPub, data)
+	require.NoError(err)
+
+	out := buf.String()
+	require.Contains(out, "trace conn=7 request=list result=ok")
+	require.Contains(out, "trace conn=7 request=sign key="+ssh.FingerprintSHA256(sshPub)+" result=ok")
+	require.NotContains(out, string(data))
+	require.NotContains(out, string(sig.Blob))
+
+	// Traces are debug messages
+	buf.Reset()
+	traced = newTracingAgent(ssha.Agent, 7, FingerprintSHA256, NewLogger(&buf, LogInfo, LogFormatText))
+	_, err = traced.List()
+	require.NoError(err)
+	require.Empty(buf.String())
+}
+
+func TestTraceFingerprintFormat(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	require.NoError(ssha.Agent.Add(AddedKey{PrivateKey: pk}))
+	sshPub, err := ssh.NewPublicKey(&pk.PublicKey)
+	require.NoError(err)
+
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogDebug, LogFormatText)
+
+	format, err := ParseFingerprintFormat("md5")
+	require.NoError(err)
+	_, err = newTracingAgent(ssha.Agent, 1, format, logger).Sign(sshPub, []byte("data"))
+	require.NoError(err)
+	require.Contains(buf.String(), "request=sign key=MD5:"+ssh.FingerprintLegacyMD5(sshPub)+" result=ok")
+
+	_, err = ParseFingerprintFormat("crc32")
+	require.Error(err)
+}
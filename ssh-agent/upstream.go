@@ -0,0 +1,93 @@
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// upstreamAgent serves the Bunkr keyring and falls through to another
+// ssh-agent listening at path for the keys it does not hold. A new
+// connection is made to the upstream agent for every request so restarts of
+// it are picked up transparently.
+type upstreamAgent struct {
+	*keyring
+	path string
+}
+
+func newUpstreamAgent(r *keyring, path string) *upstreamAgent {
+	return &upstreamAgent{r, path}
+}
+
+func (u *upstreamAgent) dial() (agent.ExtendedAgent, net.Conn, error) {
+	conn, err := net.Dial("unix", u.path)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("[upstream] could not connect to %s: %v", u.path, err))
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// List returns the keys of the keyring followed by the upstream ones, none
+// while the agent is locked.
+func (u *upstreamAgent) List() ([]*Key, error) {
+	if u.isLocked() {
+		// section 2.7: locked agents return empty.
+		return nil, nil
+	}
+	keys, err := u.keyring.List()
+	if err != nil {
+		return nil, err
+	}
+	upstream, conn, err := u.dial()
+	if err != nil {
+		u.ssha.logger.Warn(err.Error())
+		return keys, nil
+	}
+	defer conn.Close()
+	upstreamKeys, err := upstream.List()
+	if err != nil {
+		u.ssha.logger.Warn(fmt.Sprintf("[upstream] error listing keys: %v", err))
+		return keys, nil
+	}
+	for _, k := range upstreamKeys {
+		if !u.hasKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (u *upstreamAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return u.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs with the keyring when it holds key, or else forwards
+// the request upstream. A locked agent signs with neither, and the upstream
+// signs follow the algorithm policy like the local ones.
+func (u *upstreamAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags SignatureFlags) (*ssh.Signature, error) {
+	if u.isLocked() {
+		return nil, errLocked
+	}
+	if u.hasKey(key) {
+		return u.keyring.SignWithFlags(key, data, flags)
+	}
+	if err := u.ssha.algorithmAllowed(key, flags); err != nil {
+		return nil, err
+	}
+	upstream, conn, err := u.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	u.ssha.logger.Debug(fmt.Sprintf("[upstream] signing with %s", u.ssha.fingerprintFormat.Fingerprint(key)))
+	sig, err := upstream.SignWithFlags(key, data, flags)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("[upstream] %v", err))
+	}
+	return sig, nil
+}
+
+var _ agent.ExtendedAgent = &upstreamAgent{}
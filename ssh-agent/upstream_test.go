@@ -0,0 +1,87 @@
+package ssh_agent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestUpstreamAgent(t *testing.T) {
+	require := require.New(t)
+	ssha, dir, cleanup := newTestAgent(t)
+	defer cleanup()
+	var logged bytes.Buffer
+	ssha.logger = NewLogger(&logged, LogDebug, LogFormatText)
+	ssha.fingerprintFormat = FingerprintMD5
+
+	// Upstream agent holding a software key
+	upstreamPub, upstreamKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err)
+	upstream := agent.NewKeyring()
+	require.NoError(upstream.Add(agent.AddedKey{PrivateKey: upstreamKey, Comment: "upstream"}))
+	upstreamPath := filepath.Join(dir, "upstream.sock")
+	l, err := net.Listen("unix", upstreamPath)
+	require.NoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(upstream, conn)
+		}
+	}()
+
+	bunkr := newFakeBunkr()
+	ssha.signClient = bunkr
+	secret, bunkrPub := bunkr.newSecret(t, "bunkr")
+	require.NoError(ssha.storage.StoreSecret(secret))
+
+	served := newUpstreamAgent(ssha.Agent.(*keyring), upstreamPath)
+	keys, err := served.List()
+	require.NoError(err)
+	require.Len(keys, 2)
+
+	sshUpstreamPub, err := ssh.NewPublicKey(upstreamPub)
+	require.NoError(err)
+	sig, err := served.Sign(sshUpstreamPub, []byte("data"))
+	require.NoError(err)
+	require.NoError(sshUpstreamPub.Verify([]byte("data"), sig))
+	require.Contains(logged.String(), "[upstream] signing with "+FingerprintMD5.Fingerprint(sshUpstreamPub))
+	sig, err = served.Sign(bunkrPub, []byte("data"))
+	require.NoError(err)
+	require.NoError(bunkrPub.Verify([]byte("data"), sig))
+
+	// The algorithm policy applies to the upstream keys too
+	WithAllowedAlgorithms([]string{ssh.KeyAlgoECDSA256})(ssha)
+	_, err = served.Sign(sshUpstreamPub, []byte("data"))
+	require.EqualError(err, "agent: signature algorithm ssh-ed25519 is not allowed by the policy")
+	_, err = served.Sign(bunkrPub, []byte("data"))
+	require.NoError(err)
+	ssha.allowedAlgorithms = nil
+
+	// Locking hides and protects the upstream keys too
+	require.NoError(served.Lock([]byte("passphrase")))
+	keys, err = served.List()
+	require.NoError(err)
+	require.Empty(keys)
+	_, err = served.Sign(sshUpstreamPub, []byte("data"))
+	require.Equal(errLocked, err)
+	_, err = served.Signers()
+	require.Equal(errLocked, err)
+	require.NoError(served.Unlock([]byte("passphrase")))
+
+	// Without upstream only the Bunkr keys are offered
+	l.Close()
+	keys, err = served.List()
+	require.NoError(err)
+	require.Len(keys, 1)
+}
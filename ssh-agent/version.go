@@ -0,0 +1,81 @@
+package ssh_agent
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Range of Bunkr daemon versions this agent knows how to talk to. The
+// minimum is inclusive, the maximum major version is the last one tested.
+const (
+	minBunkrVersion      = "1.0.0"
+	maxBunkrMajorVersion = 1
+)
+
+// bunkrVersioner is implemented by Bunkr clients able to report the version
+// of the daemon they are connected to.
+type bunkrVersioner interface {
+	DaemonVersion() (string, error)
+}
+
+// checkBunkrVersion asks the daemon for its version and fails with a readable
+// error if it is outside the supported range. Clients that can not report a
+// version are accepted as they are.
+func checkBunkrVersion(client interface{}) error {
+	versioner, ok := client.(bunkrVersioner)
+	if !ok {
+		return nil
+	}
+	version, err := versioner.DaemonVersion()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error querying bunkr daemon version: %v", err))
+	}
+	current, err := parseVersion(version)
+	if err != nil {
+		return errors.New(fmt.Sprintf("incompatible bunkr daemon version %s (need %s+): %v", version, minBunkrVersion, err))
+	}
+	min, _ := parseVersion(minBunkrVersion)
+	if compareVersions(current, min) < 0 {
+		return errors.New(fmt.Sprintf("incompatible bunkr daemon version %s (need %s+)", version, minBunkrVersion))
+	}
+	if current[0] > maxBunkrMajorVersion {
+		return errors.New(fmt.Sprintf("incompatible bunkr daemon version %s (need >=%s, <%d)", version, minBunkrVersion, maxBunkrMajorVersion+1))
+	}
+	return nil
+}
+
+// parseVersion parses a "major.minor.patch" string, an optional leading "v"
+// and missing trailing components are allowed.
+func parseVersion(version string) ([3]int, error) {
+	var parsed [3]int
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return parsed, errors.New(fmt.Sprintf("malformed version %q", version))
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, errors.New(fmt.Sprintf("malformed version %q", version))
+		}
+		parsed[i] = n
+	}
+	return parsed, nil
+}
+
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
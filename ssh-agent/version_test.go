@@ -0,0 +1,41 @@
+package ssh_agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mockVersionClient struct {
+	version string
+	err     error
+}
+
+func (c *mockVersionClient) DaemonVersion() (string, error) {
+	return c.version, c.err
+}
+
+func TestCheckBunkrVersion(t *testing.T) {
+	require := require.New(t)
+
+	// Supported versions
+	require.NoError(checkBunkrVersion(&mockVersionClient{version: "1.0.0"}))
+	require.NoError(checkBunkrVersion(&mockVersionClient{version: "v1.4"}))
+	require.NoError(checkBunkrVersion(&mockVersionClient{version: "1.2.3-rc1"}))
+
+	// Unsupported versions
+	err := checkBunkrVersion(&mockVersionClient{version: "0.9.1"})
+	require.Error(err)
+	require.Equal("incompatible bunkr daemon version 0.9.1 (need 1.0.0+)", err.Error())
+	err = checkBunkrVersion(&mockVersionClient{version: "2.0.0"})
+	require.Error(err)
+	require.Equal("incompatible bunkr daemon version 2.0.0 (need >=1.0.0, <2)", err.Error())
+	require.Error(checkBunkrVersion(&mockVersionClient{version: "banana"}))
+
+	// Daemon errors are reported
+	require.Error(checkBunkrVersion(&mockVersionClient{err: errors.New("boom")}))
+
+	// Clients without version information are accepted
+	require.NoError(checkBunkrVersion(struct{}{}))
+}
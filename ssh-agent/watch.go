@@ -0,0 +1,67 @@
+package ssh_agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// storageWatchDebounce is how long the storage file must stay unchanged
+// before the keys are reloaded, editors and Dump often write more than once.
+var storageWatchDebounce = 250 * time.Millisecond
+
+// WatchStorage reloads the keys, see Reload, every time the storage file
+// changes on disk, until ctx is done. The directory holding the file is
+// watched since the storage is replaced by a rename when written.
+func (ssha *SSHAgent) WatchStorage(ctx context.Context) error {
+	if ssha.storagePath == "" {
+		return errors.New("The storage has no file to watch")
+	}
+	path := filepath.Clean(ssha.storagePath)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return errors.New(fmt.Sprintf("Cannot watch storage %s: %v", path, err))
+	}
+
+	var reload <-chan time.Time
+	var timer *time.Timer
+	for {
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) != path || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(storageWatchDebounce)
+			reload = timer.C
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			ssha.logger.Error(fmt.Sprintf("Error watching storage %s: %v", path, err))
+		case <-reload:
+			reload = nil
+			if err := ssha.Reload(); err != nil {
+				ssha.logger.Error(fmt.Sprintf("Error reloading keys after a storage change: %v", err))
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package ssh_agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/off-the-grid-inc/murmur/ssh-agent/storage"
+)
+
+func TestWatchStorage(t *testing.T) {
+	require := require.New(t)
+	ssha, _, cleanup := newTestAgent(t)
+	defer cleanup()
+	debounce := storageWatchDebounce
+	storageWatchDebounce = 10 * time.Millisecond
+	defer func() {
+		storageWatchDebounce = debounce
+	}()
+
+	bunkr := newFakeBunkr()
+	ssha.bunkrClient = bunkr
+	ssha.signClient = bunkr
+	kept, _ := bunkr.newSecret(t, "kept")
+	require.NoError(ssha.storage.StoreSecret(kept))
+	require.NoError(ssha.ReloadKeys())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ssha.WatchStorage(ctx)
+	}()
+	// Give the watcher time to be set up before changing the file.
+	time.Sleep(50 * time.Millisecond)
+
+	// Another process, e.g. addBunkrKey, rewrites the storage file.
+	other, err := storage.NewBunkrStorage(ssha.storagePath)
+	require.NoError(err)
+	added, _ := bunkr.newSecret(t, "added")
+	require.NoError(other.StoreSecret(added))
+	require.NoError(other.RemoveSecret("kept"))
+
+	kr := ssha.Agent.(*keyring)
+	require.Eventually(func() bool {
+		keys := kr.bunkrKeys()
+		_, hasAdded := keys["added"]
+		_, hasKept := keys["kept"]
+		return hasAdded && !hasKept
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchStorage did not return after the context was cancelled")
+	}
+}
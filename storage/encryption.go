@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// StorageOption configures an AgentStorage created by NewBunkrStorage.
+type StorageOption func(*AgentStorage)
+
+// WithEncryption encrypts the storage file with a key derived from
+// passphrase. A plaintext storage file is still loaded and is encrypted the
+// next time it is written.
+func WithEncryption(passphrase string) StorageOption {
+	return func(storage *AgentStorage) {
+		storage.encryption = &encryption{passphrase: passphrase}
+	}
+}
+
+// encryptedMagic starts every encrypted storage file, followed by the scrypt
+// salt, the AES-GCM nonce and the sealed JSON.
+var encryptedMagic = []byte("BUNKRAGENTENC1\n")
+
+const (
+	saltSize = 16
+	keySize  = 32
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrWrongPassphrase is returned when the storage file can not be decrypted.
+var ErrWrongPassphrase = errors.New("storage could not be decrypted, wrong passphrase or corrupted file")
+
+// encryption holds the passphrase and the key derived for the current salt,
+// so that the key is only derived again when the salt changes. mu guards the
+// key, the storage file and the last use file being written concurrently.
+type encryption struct {
+	mu         sync.Mutex
+	passphrase string
+	salt       []byte
+	key        []byte
+}
+
+func (e *encryption) deriveKey(salt []byte) error {
+	if e.key != nil && bytes.Equal(e.salt, salt) {
+		return nil
+	}
+	key, err := scrypt.Key([]byte(e.passphrase), salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return err
+	}
+	e.salt, e.key = salt, key
+	return nil
+}
+
+func (e *encryption) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(e.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext, picking a salt the first time and a fresh nonce on
+// every call.
+func (e *encryption) seal(plaintext []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.key == nil {
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, err
+		}
+		if err := e.deriveKey(salt); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := e.gcm()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(encryptedMagic)+saltSize+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, encryptedMagic...)
+	out = append(out, e.salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, encryptedMagic), nil
+}
+
+// open decrypts data written by seal.
+func (e *encryption) open(data []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	data = data[len(encryptedMagic):]
+	if len(data) < saltSize {
+		return nil, ErrWrongPassphrase
+	}
+	if err := e.deriveKey(data[:saltSize]); err != nil {
+		return nil, err
+	}
+	aead, err := e.gcm()
+	if err != nil {
+		return nil, err
+	}
+	data = data[saltSize:]
+	if len(data) < aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], encryptedMagic)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// decodeFile returns the JSON held by the storage file contents.
+func (storage *AgentStorage) decodeFile(data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	if storage.encryption == nil {
+		return nil, errors.New(fmt.Sprintf("Storage %s is encrypted, a passphrase is needed", storage.storagePath))
+	}
+	return storage.encryption.open(data)
+}
+
+// encodeFile returns the storage file contents for the JSON data.
+func (storage *AgentStorage) encodeFile(data []byte) ([]byte, error) {
+	if storage.encryption == nil {
+		return data, nil
+	}
+	return storage.encryption.seal(data)
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedStorageRoundTrip(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "storage-encryption")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.json")
+
+	bunkrStorage, err := NewBunkrStorage(path, WithEncryption("passphrase"))
+	require.NoError(err)
+	group := &Secret{Name: "group", FileId: "fid1", CapId: "cid1", SecretType: "ECDSA-P256", PublicData: []byte("data")}
+	require.NoError(bunkrStorage.StoreSecret(group))
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "member", FileId: "fid2", CapId: "cid2", SecretType: "ECDSA-P256", Group: group}))
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.True(isEncrypted(b))
+	require.False(bytes.Contains(b, []byte("cid1")))
+	require.False(bytes.Contains(b, []byte("member")))
+
+	reloaded, err := NewBunkrStorage(path, WithEncryption("passphrase"))
+	require.NoError(err)
+	secret, err := reloaded.GetSecret("member")
+	require.NoError(err)
+	require.Equal("cid2", secret.CapId)
+	require.Equal("group", secret.Group.Name)
+
+	// Every write uses a fresh nonce.
+	require.NoError(reloaded.RemoveSecret("member"))
+	again, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.NotEqual(b[len(encryptedMagic)+saltSize:], again[len(encryptedMagic)+saltSize:])
+	require.NoError(reloaded.ReloadStorageData())
+	require.True(reloaded.SecretExists("group"))
+	require.False(reloaded.SecretExists("member"))
+}
+
+func TestEncryptedStorageWrongPassphrase(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "storage-encryption")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.json")
+
+	bunkrStorage, err := NewBunkrStorage(path, WithEncryption("passphrase"))
+	require.NoError(err)
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "secret1", SecretType: "ECDSA-P256"}))
+
+	_, err = NewBunkrStorage(path, WithEncryption("wrong"))
+	require.Equal(ErrWrongPassphrase, err)
+	_, err = NewBunkrStorage(path)
+	require.Error(err)
+}
+
+func TestEncryptedStorageMigratesPlaintext(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "storage-encryption")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.json")
+
+	plaintext, err := NewBunkrStorage(path)
+	require.NoError(err)
+	require.NoError(plaintext.StoreSecret(&Secret{Name: "secret1", CapId: "cid1", SecretType: "ECDSA-P256"}))
+
+	bunkrStorage, err := NewBunkrStorage(path, WithEncryption("passphrase"))
+	require.NoError(err)
+	secret, err := bunkrStorage.GetSecret("secret1")
+	require.NoError(err)
+	require.Equal("cid1", secret.CapId)
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.False(isEncrypted(b))
+
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "secret2", SecretType: "ECDSA-P256"}))
+	b, err = ioutil.ReadFile(path)
+	require.NoError(err)
+	require.True(isEncrypted(b))
+
+	reloaded, err := NewBunkrStorage(path, WithEncryption("passphrase"))
+	require.NoError(err)
+	require.True(reloaded.SecretExists("secret1"))
+	require.True(reloaded.SecretExists("secret2"))
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LastUsedPath returns the path of the file recording when the keys of the
+// storage at path last signed. It is kept apart from the storage file so that
+// signing never rewrites the secrets, replaces their backup or wakes up
+// -watchStorage.
+func LastUsedPath(path string) string {
+	return path + ".lastused"
+}
+
+// readLastUsed reads the last use times by secret name. A missing file is
+// empty, and so is a corrupted one: the times are informational and the
+// next TouchSecret writes the file again.
+func (storage *AgentStorage) readLastUsed() (map[string]string, error) {
+	times := make(map[string]string)
+	b, err := ioutil.ReadFile(LastUsedPath(storage.storagePath))
+	if os.IsNotExist(err) {
+		return times, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b, err = storage.decodeFile(b); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &times); err != nil {
+		return make(map[string]string), nil
+	}
+	return times, nil
+}
+
+// writeLastUsed replaces the last use file with times, through a file
+// unique to this write renamed over it.
+func (storage *AgentStorage) writeLastUsed(times map[string]string) error {
+	data, err := json.MarshalIndent(times, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if data, err = storage.encodeFile(data); err != nil {
+		return err
+	}
+	path := LastUsedPath(storage.storagePath)
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// reloadLastUsed reads the last use times again, keeping the known ones if
+// the file can not be read.
+func (storage *AgentStorage) reloadLastUsed() {
+	storage.lastUsedMu.Lock()
+	defer storage.lastUsedMu.Unlock()
+	if times, err := storage.readLastUsed(); err == nil {
+		storage.lastUsed = times
+	}
+}
+
+// TouchSecret records that the key of the secret name signed at at. The
+// time is written to the last use file, see LastUsedPath, read again first
+// so the times recorded by other agents are kept.
+func (storage *AgentStorage) TouchSecret(name string, at time.Time) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.readOnly {
+		return ErrReadOnly
+	}
+	if _, ok := storage.data.Secrets[name]; !ok {
+		return errors.New(fmt.Sprintf("No secret exists with name: %s", name))
+	}
+	storage.lastUsedMu.Lock()
+	defer storage.lastUsedMu.Unlock()
+	times := storage.lastUsed
+	if !storage.inMemory {
+		var err error
+		if times, err = storage.readLastUsed(); err != nil {
+			return err
+		}
+	}
+	if times == nil {
+		times = make(map[string]string)
+	}
+	if last, err := parseTimestamp(times[name]); err != nil || at.After(last) {
+		times[name] = formatTimestamp(at)
+	}
+	if !storage.inMemory {
+		if err := storage.writeLastUsed(times); err != nil {
+			return err
+		}
+	}
+	storage.lastUsed = times
+	return nil
+}
+
+// updateLastUsed applies change to the last use times, read again first, and
+// writes them if change reports it changed any.
+func (storage *AgentStorage) updateLastUsed(change func(times map[string]string) bool) error {
+	storage.lastUsedMu.Lock()
+	defer storage.lastUsedMu.Unlock()
+	times := storage.lastUsed
+	if !storage.inMemory {
+		var err error
+		if times, err = storage.readLastUsed(); err != nil {
+			return err
+		}
+	}
+	if times == nil {
+		times = make(map[string]string)
+	}
+	if !change(times) {
+		return nil
+	}
+	if !storage.inMemory {
+		if err := storage.writeLastUsed(times); err != nil {
+			return err
+		}
+	}
+	storage.lastUsed = times
+	return nil
+}
+
+// withLastUse returns the data of the secret name with the later of the last
+// use time of the storage file, written by older versions, and the one of the
+// last use file.
+func (storage *AgentStorage) withLastUse(name string, secretData *SecretData) *SecretData {
+	if secretData == nil {
+		return nil
+	}
+	storage.lastUsedMu.Lock()
+	recorded := storage.lastUsed[name]
+	storage.lastUsedMu.Unlock()
+	if recorded == "" {
+		return secretData
+	}
+	inFile, err := parseTimestamp(secretData.LastUsedAt)
+	if last, lastErr := parseTimestamp(recorded); err != nil || lastErr != nil || !last.After(inFile) {
+		return secretData
+	}
+	merged := *secretData
+	merged.LastUsedAt = recorded
+	return &merged
+}
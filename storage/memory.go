@@ -0,0 +1,21 @@
+package storage
+
+// InMemoryStore is a Store keeping the secrets in memory only, with the same
+// behaviour as the JSON storage, groups included, but no file access. It is
+// meant for tests.
+type InMemoryStore struct {
+	*AgentStorage
+}
+
+var _ Store = (*InMemoryStore)(nil)
+
+// NewInMemoryStore returns an empty in memory store.
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{&AgentStorage{
+		data: &AgentData{
+			Version: CurrentVersion,
+			Secrets: make(map[string]*SecretData),
+		},
+		inMemory: true,
+	}}
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testStores returns a JSON and a SQLite storage in a temporary directory
+// and an in memory store to run the same scenarios against.
+func testStores(t *testing.T) (map[string]Store, func()) {
+	dir, err := ioutil.TempDir("", "storage-test")
+	require.NoError(t, err)
+	jsonStorage, err := NewBunkrStorage(filepath.Join(dir, "storage.json"))
+	require.NoError(t, err)
+	sqliteStorage, err := NewSQLiteStorage(filepath.Join(dir, "storage.db"))
+	require.NoError(t, err)
+	return map[string]Store{
+		"json":   jsonStorage,
+		"sqlite": sqliteStorage,
+		"memory": NewInMemoryStore(),
+	}, func() {
+		_ = sqliteStorage.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestInMemoryStoreParity(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for backend, store := range stores {
+		t.Run(backend, func(t *testing.T) {
+			require := require.New(t)
+
+			group := &Secret{Name: "group", FileId: "fid", CapId: "cid", SecretType: "ECDSA-P256", PublicData: []byte("group"), Certificate: []byte("group-cert"), Backend: "office"}
+			require.NoError(store.StoreSecret(group))
+			require.NoError(store.StoreSecret(&Secret{Name: "member", SecretType: "ECDSA-P256", PublicData: []byte("member"), Group: group}))
+			require.NoError(store.StoreSecret(&Secret{Name: "rsa", SecretType: "RSA"}))
+			require.Error(store.StoreSecret(&Secret{Name: "rsa", SecretType: "RSA"}))
+			require.NoError(store.ReloadStorageData())
+
+			secret, err := store.GetSecret("group")
+			require.NoError(err)
+			require.WithinDuration(time.Now(), secret.CreatedAt, time.Minute)
+			group.CreatedAt = secret.CreatedAt
+			require.Equal(*group, *secret)
+			member, err := store.GetSecret("member")
+			require.NoError(err)
+			require.Equal("group", member.Group.Name)
+			require.Equal([]byte("member"), member.PublicData)
+
+			secrets, err := store.GetSecrets()
+			require.NoError(err)
+			require.Len(secrets, 3)
+			ecdsa, err := store.GetSecretsByType("ECDSA-P256")
+			require.NoError(err)
+			require.Len(ecdsa, 2)
+			// Every backend accepts the legacy spellings
+			ecdsa, err = store.GetSecretsByType("ecdsa")
+			require.NoError(err)
+			require.Len(ecdsa, 2)
+			_, err = store.GetSecretsByType("DSA")
+			require.Error(err)
+
+			require.NoError(store.UpdateSecret(&Secret{Name: "rsa", SecretType: "RSA", CapId: "cid2", LifetimeSecs: 30}))
+			secret, err = store.GetSecret("rsa")
+			require.NoError(err)
+			require.Equal("cid2", secret.CapId)
+			require.Equal(uint32(30), secret.LifetimeSecs)
+
+			// Removing the group removes its members
+			require.NoError(store.RemoveSecret("group"))
+			require.False(store.SecretExists("group"))
+			require.False(store.SecretExists("member"))
+			require.True(store.SecretExists("rsa"))
+		})
+	}
+}
+
+func TestInMemoryStoreCycles(t *testing.T) {
+	require := require.New(t)
+	store := NewInMemoryStore()
+	store.data.Secrets["a"] = &SecretData{SecretType: "ECDSA-P256", Group: "b"}
+	store.data.Secrets["b"] = &SecretData{SecretType: "ECDSA-P256", Group: "a"}
+
+	_, err := store.GetSecret("a")
+	require.EqualError(err, "cyclic group reference detected involving a")
+}
+
+func TestSecretTimestamps(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for backend, store := range stores {
+		t.Run(backend, func(t *testing.T) {
+			require := require.New(t)
+
+			before := time.Now()
+			require.NoError(store.StoreSecret(&Secret{Name: "key", SecretType: "ED25519"}))
+			secret, err := store.GetSecret("key")
+			require.NoError(err)
+			require.False(secret.CreatedAt.Before(before.Truncate(time.Second)))
+			require.True(secret.LastUsedAt.IsZero())
+			created := secret.CreatedAt
+
+			used := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			require.NoError(store.TouchSecret("key", used))
+			require.Error(store.TouchSecret("missing", used))
+			require.NoError(store.ReloadStorageData())
+			secret, err = store.GetSecret("key")
+			require.NoError(err)
+			require.True(used.Equal(secret.LastUsedAt))
+
+			// Importing the secret again keeps its timestamps
+			require.NoError(store.UpsertSecret(&Secret{Name: "key", SecretType: "ED25519", CapId: "cid2"}))
+			secret, err = store.GetSecret("key")
+			require.NoError(err)
+			require.Equal("cid2", secret.CapId)
+			require.True(created.Equal(secret.CreatedAt))
+			require.True(used.Equal(secret.LastUsedAt))
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CurrentVersion is the schema version of the storage files written.
+const CurrentVersion = 1
+
+// migrations upgrade the data of each version to the next one, the data of
+// version i is upgraded by migrations[i].
+var migrations = []func(data *AgentData) error{
+	migrateV0,
+}
+
+// migrate upgrades data read from a storage file to CurrentVersion in
+// memory, the upgraded form is written on the next Dump. Files of a newer
+// version are refused rather than having their unknown fields dropped.
+func migrate(data *AgentData) error {
+	if data.Version > CurrentVersion {
+		return errors.New(fmt.Sprintf("Storage version %d is newer than the supported version %d, upgrade the agent", data.Version, CurrentVersion))
+	}
+	if data.Version < 0 {
+		return errors.New(fmt.Sprintf("Invalid storage version %d", data.Version))
+	}
+	if data.Secrets == nil {
+		data.Secrets = make(map[string]*SecretData)
+	}
+	for data.Version < CurrentVersion {
+		if err := migrations[data.Version](data); err != nil {
+			return errors.New(fmt.Sprintf("Error upgrading the storage from version %d: %v", data.Version, err))
+		}
+		data.Version++
+	}
+	return nil
+}
+
+// migrateV0 upgrades the unversioned files, whose secret types may use the
+// legacy names, to version 1 using the current names.
+func migrateV0(data *AgentData) error {
+	for _, secretData := range data.Secrets {
+		if secretType, err := ParseSecretType(secretData.SecretType); err == nil {
+			secretData.SecretType = string(secretType)
+		}
+	}
+	return nil
+}
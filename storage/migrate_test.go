@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// v0Storage is a storage file written before the schema was versioned.
+const v0Storage = `{"Secrets":{"group":{"FileId":"fid1","CapId":"cid1","SecretType":"GENERIC-GF256","PublicData":"","Group":""},"key":{"FileId":"fid2","CapId":"cid2","SecretType":"ecdsa","PublicData":"ZGF0YQ==","Group":"group"}}}`
+
+func TestMigrateV0(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "storage-migrate")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.json")
+	require.NoError(ioutil.WriteFile(path, []byte(v0Storage), 0600))
+
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	require.Equal(CurrentVersion, bunkrStorage.data.Version)
+	secret, err := bunkrStorage.GetSecret("key")
+	require.NoError(err)
+	require.Equal(SecretTypeECDSAP256, secret.SecretType)
+	require.Equal("group", secret.Group.Name)
+	require.Equal([]byte("data"), secret.PublicData)
+
+	// The file is only upgraded on the next write
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal(v0Storage, string(b))
+	require.NoError(bunkrStorage.Dump())
+	var written AgentData
+	b, err = ioutil.ReadFile(path)
+	require.NoError(err)
+	require.NoError(json.Unmarshal(b, &written))
+	require.Equal(CurrentVersion, written.Version)
+	require.Equal("ECDSA-P256", written.Secrets["key"].SecretType)
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	require := require.New(t)
+	data := &AgentData{Version: CurrentVersion + 1}
+	require.Error(migrate(data))
+
+	data = &AgentData{Version: CurrentVersion}
+	require.NoError(migrate(data))
+	require.NotNil(data.Secrets)
+}
@@ -1,10 +1,94 @@
 package storage
 
+import (
+	"time"
+)
+
 type Secret struct {
 	Name       string
 	FileId     string
 	CapId      string
-	SecretType string
+	SecretType SecretType
 	PublicData []byte
 	Group      *Secret
+	// Comment is shown for the key instead of its name when listing the
+	// agent identities, empty uses the name.
+	Comment string
+	// ConfirmBeforeUse overrides the confirmation policy inherited from the
+	// group, nil means inherit.
+	ConfirmBeforeUse *bool
+	// RequireConfirm is the effective confirmation policy once the group
+	// chain is resolved.
+	RequireConfirm bool
+	// SignTimeout overrides the agent sign timeout for this secret, zero
+	// uses the agent default.
+	SignTimeout time.Duration
+	// LifetimeSecs, if not zero, is how many seconds the key of the secret
+	// is kept in the agent once loaded.
+	LifetimeSecs uint32
+	// Certificate, if set, is the OpenSSH certificate of the key in
+	// authorized_keys format, served instead of the bare public key.
+	Certificate []byte
+	// CreatedAt is when the secret was first stored and LastUsedAt when
+	// its key last signed, zero if unknown, e.g. for secrets stored by
+	// older versions.
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	// BunkrName is the name of the secret in Bunkr, used to sign, when it
+	// differs from Name since the secret was renamed. Empty means Name.
+	BunkrName string
+	// Tags are free form labels, e.g. prod or ci, the agent can be started
+	// with only the keys carrying one of them.
+	Tags []string
+	// Backend is the name of the Bunkr daemon holding the secret when the
+	// agent talks to several of them. Empty means the default one.
+	Backend string
+}
+
+// BunkrSecretName returns the name Bunkr knows the secret by.
+func (secret *Secret) BunkrSecretName() string {
+	if secret.BunkrName != "" {
+		return secret.BunkrName
+	}
+	return secret.Name
+}
+
+// Store is the storage of the secrets the agent serves keys for.
+// AgentStorage, backed by a JSON file, is the default implementation.
+type Store interface {
+	// ReloadStorageData reads the secrets again from the backend.
+	ReloadStorageData() error
+	GetSecrets() ([]*Secret, error)
+	// GetSecretsLenient returns the secrets that could be decoded and the
+	// decoding error of the others by name.
+	GetSecretsLenient() ([]*Secret, map[string]error)
+	GetSecret(name string) (*Secret, error)
+	// GetSecretsByType returns the secrets of the type secretType, given in
+	// any spelling ParseSecretType accepts.
+	GetSecretsByType(secretType SecretType) ([]*Secret, error)
+	// GetSecretsByGroup returns the secrets belonging to the group groupName.
+	GetSecretsByGroup(groupName string) ([]*Secret, error)
+	// GetSecretsByTag returns the secrets tagged with tag.
+	GetSecretsByTag(tag string) ([]*Secret, error)
+	// ListGroups returns the sorted names of the secrets used as a group.
+	ListGroups() ([]string, error)
+	// GroupMembers returns the sorted names of the secrets in the group name.
+	GroupMembers(name string) ([]string, error)
+	SecretExists(name string) bool
+	// StoreSecret stores a new secret, failing if the name is taken.
+	StoreSecret(secret *Secret) error
+	// UpdateSecret replaces an existing secret.
+	UpdateSecret(secret *Secret) error
+	// UpsertSecret stores the secret, replacing it if it exists.
+	UpsertSecret(secret *Secret) error
+	// UpsertSecrets stores the secrets like UpsertSecret, all at once.
+	UpsertSecrets(secrets []*Secret) error
+	// RenameSecret moves the secret oldName to newName in the storage, the
+	// secrets belonging to it stay its members. The secret keeps its name in
+	// Bunkr, see BunkrName.
+	RenameSecret(oldName, newName string) error
+	// RemoveSecret removes the secret and the secrets belonging to it.
+	RemoveSecret(name string) error
+	// TouchSecret records that the key of the secret name signed at at.
+	TouchSecret(name string, at time.Time) error
 }
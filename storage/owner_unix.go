@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// CheckOwnership verifies that the storage file at path, if it exists, and
+// its directory are owned by the current user.
+func CheckOwnership(path string) error {
+	uid := os.Getuid()
+	for _, p := range []string{path, filepath.Dir(path)} {
+		info, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			continue
+		}
+		if int(stat.Uid) != uid {
+			return errors.New(fmt.Sprintf("%s is owned by uid %d, not by the current user (uid %d)", p, stat.Uid, uid))
+		}
+	}
+	return nil
+}
+
+// restrictPermissions makes the storage file at path, if it exists, only
+// accessible by its owner, reporting the change through warn.
+func restrictPermissions(path string, warn func(msg string)) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&^0600 == 0 {
+		return nil
+	}
+	warn(fmt.Sprintf("storage file %s had mode %v, restricting it to 0600", path, info.Mode().Perm()))
+	return os.Chmod(path, 0600)
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package storage
+
+// CheckOwnership is not implemented on Windows, where file ownership is
+// expressed through ACLs.
+func CheckOwnership(path string) error {
+	return nil
+}
+
+// restrictPermissions does nothing on Windows, where file permissions are
+// expressed through ACLs.
+func restrictPermissions(path string, warn func(msg string)) error {
+	return nil
+}
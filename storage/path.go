@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExpandPath resolves a leading ~ to the home directory of the current user
+// and expands $VAR and ${VAR} references. Other paths are left untouched.
+func ExpandPath(path string) (string, error) {
+	path = os.ExpandEnv(path)
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, strings.TrimPrefix(path, "~"))
+	}
+	return path, nil
+}
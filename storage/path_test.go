@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandPath(t *testing.T) {
+	require := require.New(t)
+	home, err := os.UserHomeDir()
+	require.NoError(err)
+	require.NoError(os.Setenv("BUNKR_TEST_DIR", "/var/bunkr"))
+	defer os.Unsetenv("BUNKR_TEST_DIR")
+
+	for path, expected := range map[string]string{
+		"~":                            home,
+		"~/.bunkr/agent_storage.json":  filepath.Join(home, ".bunkr", "agent_storage.json"),
+		"$BUNKR_TEST_DIR/agent.sock":   "/var/bunkr/agent.sock",
+		"${BUNKR_TEST_DIR}/agent.sock": "/var/bunkr/agent.sock",
+		"/tmp/agent.sock":              "/tmp/agent.sock",
+		"relative/agent.sock":          "relative/agent.sock",
+		"/tmp/~user/agent.sock":        "/tmp/~user/agent.sock",
+	} {
+		expanded, err := ExpandPath(path)
+		require.NoError(err)
+		require.Equal(expected, expanded, path)
+	}
+}
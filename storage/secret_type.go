@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SecretType is the Bunkr type of a secret.
+type SecretType string
+
+const (
+	// SecretTypeECDSAP256, SecretTypeEd25519 and SecretTypeRSA are the
+	// signing key types served as ssh keys.
+	SecretTypeECDSAP256 SecretType = "ECDSA-P256"
+	SecretTypeEd25519   SecretType = "ED25519"
+	SecretTypeRSA       SecretType = "RSA"
+	// SecretTypeGenericGF256 and SecretTypeGenericPF are the generic
+	// secrets Bunkr groups are made of.
+	SecretTypeGenericGF256 SecretType = "GENERIC-GF256"
+	SecretTypeGenericPF    SecretType = "GENERIC-PF"
+)
+
+var secretTypes = []SecretType{
+	SecretTypeECDSAP256,
+	SecretTypeEd25519,
+	SecretTypeRSA,
+	SecretTypeGenericGF256,
+	SecretTypeGenericPF,
+}
+
+// legacySecretTypes maps the names older Bunkr versions gave the key types
+// to the current ones. Lower case names and underscores instead of dashes,
+// e.g. ecdsa_p256, are accepted too.
+var legacySecretTypes = map[string]SecretType{
+	"ECDSA": SecretTypeECDSAP256,
+	"EDDSA": SecretTypeEd25519,
+}
+
+// ParseSecretType returns the secret type named name, accepting the legacy
+// spellings of the known types.
+func ParseSecretType(name string) (SecretType, error) {
+	normalized := strings.ToUpper(strings.Replace(strings.TrimSpace(name), "_", "-", -1))
+	for _, secretType := range secretTypes {
+		if string(secretType) == normalized {
+			return secretType, nil
+		}
+	}
+	if secretType, ok := legacySecretTypes[normalized]; ok {
+		return secretType, nil
+	}
+	names := make([]string, len(secretTypes))
+	for i, secretType := range secretTypes {
+		names[i] = string(secretType)
+	}
+	return "", errors.New(fmt.Sprintf("Unsupported secret type %q, use one of %s", name, strings.Join(names, ", ")))
+}
+
+// storedSecretType returns the type a secret stored with the type name has,
+// the name itself if it is not a known type.
+func storedSecretType(name string) SecretType {
+	if secretType, err := ParseSecretType(name); err == nil {
+		return secretType
+	}
+	return SecretType(name)
+}
+
+// IsSSHKey tells if secrets of the type can be served as ssh keys.
+func (secretType SecretType) IsSSHKey() bool {
+	return secretType == SecretTypeECDSAP256 || secretType == SecretTypeEd25519 || secretType == SecretTypeRSA
+}
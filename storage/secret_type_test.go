@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSecretType(t *testing.T) {
+	require := require.New(t)
+
+	for name, expected := range map[string]SecretType{
+		"ECDSA-P256":    SecretTypeECDSAP256,
+		"ED25519":       SecretTypeEd25519,
+		"RSA":           SecretTypeRSA,
+		"GENERIC-GF256": SecretTypeGenericGF256,
+		"GENERIC-PF":    SecretTypeGenericPF,
+		// Legacy names
+		"ecdsa-p256": SecretTypeECDSAP256,
+		"ECDSA_P256": SecretTypeECDSAP256,
+		"ECDSA":      SecretTypeECDSAP256,
+		"EdDSA":      SecretTypeEd25519,
+		"ed25519":    SecretTypeEd25519,
+	} {
+		secretType, err := ParseSecretType(name)
+		require.NoError(err, name)
+		require.Equal(expected, secretType, name)
+	}
+
+	for _, name := range []string{"", "DSA", "ECDSA-P384"} {
+		_, err := ParseSecretType(name)
+		require.Error(err, name)
+		require.Contains(err.Error(), "Unsupported secret type")
+	}
+
+	require.True(SecretTypeRSA.IsSSHKey())
+	require.False(SecretTypeGenericPF.IsSSHKey())
+}
+
+func TestStoreSecretType(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for backend, store := range stores {
+		t.Run(backend, func(t *testing.T) {
+			require := require.New(t)
+
+			err := store.StoreSecret(&Secret{Name: "typo", SecretType: "ECDSA-P265"})
+			require.Error(err)
+			require.Contains(err.Error(), `Unsupported secret type "ECDSA-P265"`)
+			require.False(store.SecretExists("typo"))
+
+			// Legacy names are stored with the current name
+			require.NoError(store.StoreSecret(&Secret{Name: "legacy", SecretType: "ecdsa"}))
+			secret, err := store.GetSecret("legacy")
+			require.NoError(err)
+			require.Equal(SecretTypeECDSAP256, secret.SecretType)
+		})
+	}
+}
+
+func TestLoadLegacySecretType(t *testing.T) {
+	require := require.New(t)
+	storage := NewInMemoryStore()
+	storage.data.Secrets["legacy"] = &SecretData{SecretType: "ed25519"}
+
+	secret, err := storage.GetSecret("legacy")
+	require.NoError(err)
+	require.Equal(SecretTypeEd25519, secret.SecretType)
+}
@@ -0,0 +1,514 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStorage is a Store keeping the secrets in a SQLite database, every
+// change only writes the affected rows.
+type SQLiteStorage struct {
+	db       *sql.DB
+	readOnly bool
+	// maxGroupDepth bounds the group chains decoded, see SetMaxGroupDepth.
+	maxGroupDepth int
+}
+
+var _ Store = (*SQLiteStorage)(nil)
+
+// sqliteSchema creates the secrets table, it is run every time the database
+// is opened.
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS secrets (
+	name               TEXT PRIMARY KEY,
+	file_id            TEXT NOT NULL,
+	cap_id             TEXT NOT NULL,
+	secret_type        TEXT NOT NULL,
+	public_data        BLOB,
+	group_name         TEXT NOT NULL DEFAULT '',
+	comment            TEXT NOT NULL DEFAULT '',
+	confirm_before_use INTEGER,
+	sign_timeout       TEXT NOT NULL DEFAULT '',
+	lifetime_secs      INTEGER NOT NULL DEFAULT 0,
+	certificate        TEXT NOT NULL DEFAULT '',
+	created_at         TEXT NOT NULL DEFAULT '',
+	last_used_at       TEXT NOT NULL DEFAULT '',
+	tags               TEXT NOT NULL DEFAULT '',
+	bunkr_name         TEXT NOT NULL DEFAULT '',
+	backend            TEXT NOT NULL DEFAULT ''
+)`
+
+// sqliteAddedColumns are the columns added after the secrets table was first
+// released, added to the databases created before them.
+var sqliteAddedColumns = []struct {
+	name       string
+	definition string
+}{
+	{"lifetime_secs", "INTEGER NOT NULL DEFAULT 0"},
+	{"certificate", "TEXT NOT NULL DEFAULT ''"},
+	{"created_at", "TEXT NOT NULL DEFAULT ''"},
+	{"last_used_at", "TEXT NOT NULL DEFAULT ''"},
+	{"tags", "TEXT NOT NULL DEFAULT ''"},
+	{"bunkr_name", "TEXT NOT NULL DEFAULT ''"},
+	{"backend", "TEXT NOT NULL DEFAULT ''"},
+}
+
+const sqliteColumns = "name, file_id, cap_id, secret_type, public_data, group_name, comment, confirm_before_use, sign_timeout, lifetime_secs, certificate, created_at, last_used_at, tags, bunkr_name, backend"
+
+// NewSQLiteStorage opens, creating it if needed, the SQLite database at path.
+func NewSQLiteStorage(path string) (*SQLiteStorage, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, errors.New(fmt.Sprintf("Error creating the storage database %s: %v", path, err))
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, errors.New(fmt.Sprintf("Error migrating the storage database %s: %v", path, err))
+	}
+	return &SQLiteStorage{db: db}, nil
+}
+
+// migrateSQLite adds the columns missing from a secrets table created by an
+// older version, and replaces the legacy spellings of the secret types so
+// they can be queried by type.
+func migrateSQLite(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(secrets)")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, column := range sqliteAddedColumns {
+		if existing[column.name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE secrets ADD COLUMN %s %s", column.name, column.definition)); err != nil {
+			return err
+		}
+	}
+	return normalizeSQLiteTypes(db)
+}
+
+// normalizeSQLiteTypes rewrites the secret types stored with a legacy
+// spelling, e.g. ECDSA, to the name ParseSecretType returns for them.
+// Unknown types are left as they are.
+func normalizeSQLiteTypes(db *sql.DB) error {
+	rows, err := db.Query("SELECT DISTINCT secret_type FROM secrets")
+	if err != nil {
+		return err
+	}
+	var stored []string
+	for rows.Next() {
+		var secretType string
+		if err := rows.Scan(&secretType); err != nil {
+			rows.Close()
+			return err
+		}
+		stored = append(stored, secretType)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, secretType := range stored {
+		normalized := string(storedSecretType(secretType))
+		if normalized == secretType {
+			continue
+		}
+		if _, err := db.Exec("UPDATE secrets SET secret_type = ? WHERE secret_type = ?", normalized, secretType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database.
+func (storage *SQLiteStorage) Close() error {
+	return storage.db.Close()
+}
+
+// SetReadOnly prevents, or allows again, any change of the stored secrets.
+func (storage *SQLiteStorage) SetReadOnly(readOnly bool) {
+	storage.readOnly = readOnly
+}
+
+// SetMaxGroupDepth sets how many groups a secret can be nested in, secrets
+// nested deeper fail to decode. Zero uses DefaultMaxGroupDepth.
+func (storage *SQLiteStorage) SetMaxGroupDepth(depth int) {
+	storage.maxGroupDepth = depth
+}
+
+// ReloadStorageData only checks the database is reachable, every read goes
+// to the database.
+func (storage *SQLiteStorage) ReloadStorageData() error {
+	return storage.db.Ping()
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSecretData(row rowScanner) (string, *SecretData, error) {
+	var name string
+	var publicData []byte
+	var confirm sql.NullBool
+	var tags string
+	sd := &SecretData{}
+	if err := row.Scan(&name, &sd.FileId, &sd.CapId, &sd.SecretType, &publicData, &sd.Group, &sd.Comment, &confirm, &sd.SignTimeout, &sd.LifetimeSecs, &sd.Certificate, &sd.CreatedAt, &sd.LastUsedAt, &tags, &sd.BunkrName, &sd.Backend); err != nil {
+		return "", nil, err
+	}
+	if tags != "" {
+		sd.Tags = strings.Split(tags, ",")
+	}
+	sd.PublicData = base64.StdEncoding.EncodeToString(publicData)
+	if confirm.Valid {
+		sd.ConfirmBeforeUse = &confirm.Bool
+	}
+	return name, sd, nil
+}
+
+// lookup returns the data of the stored secret name, nil if there is none.
+func (storage *SQLiteStorage) lookup(name string) (*SecretData, error) {
+	row := storage.db.QueryRow("SELECT "+sqliteColumns+" FROM secrets WHERE name = ?", name)
+	_, sd, err := scanSecretData(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sd, err
+}
+
+// query returns the data of the secrets selected by the where clause.
+func (storage *SQLiteStorage) query(where string, args ...interface{}) (map[string]*SecretData, error) {
+	rows, err := storage.db.Query("SELECT "+sqliteColumns+" FROM secrets "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	secrets := make(map[string]*SecretData)
+	for rows.Next() {
+		name, sd, err := scanSecretData(rows)
+		if err != nil {
+			return nil, err
+		}
+		secrets[name] = sd
+	}
+	return secrets, rows.Err()
+}
+
+// decodeAll decodes the secrets in data, resolving their groups from the
+// database.
+func (storage *SQLiteStorage) decodeAll(data map[string]*SecretData) ([]*Secret, map[string]error) {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	secrets := make([]*Secret, 0, len(data))
+	failed := make(map[string]error)
+	for _, name := range names {
+		s, err := decodeSecretChain(name, data[name], storage.lookup, groupDepthLimit(storage.maxGroupDepth), make(map[string]bool))
+		if err != nil {
+			failed[name] = err
+			continue
+		}
+		secrets = append(secrets, s)
+	}
+	return secrets, failed
+}
+
+func (storage *SQLiteStorage) GetSecrets() ([]*Secret, error) {
+	data, err := storage.query("")
+	if err != nil {
+		return nil, err
+	}
+	secrets, failed := storage.decodeAll(data)
+	for _, err := range failed {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// GetSecretsLenient returns the secrets that could be decoded and, by name,
+// the error of the ones that could not.
+func (storage *SQLiteStorage) GetSecretsLenient() ([]*Secret, map[string]error) {
+	data, err := storage.query("")
+	if err != nil {
+		return nil, map[string]error{"": err}
+	}
+	return storage.decodeAll(data)
+}
+
+// GetSecretsByType returns the secrets of the type secretType, which may be
+// given with any spelling ParseSecretType accepts. Rows written with a legacy
+// spelling of the type are matched too.
+func (storage *SQLiteStorage) GetSecretsByType(secretType SecretType) ([]*Secret, error) {
+	secretType, err := ParseSecretType(string(secretType))
+	if err != nil {
+		return nil, err
+	}
+	// The legacy spellings were normalized when opening, see migrateSQLite
+	data, err := storage.query("WHERE secret_type = ?", string(secretType))
+	if err != nil {
+		return nil, err
+	}
+	secrets, failed := storage.decodeAll(data)
+	for _, err := range failed {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// GetSecretsByGroup returns the secrets whose group is the secret groupName.
+func (storage *SQLiteStorage) GetSecretsByGroup(groupName string) ([]*Secret, error) {
+	data, err := storage.query("WHERE group_name = ?", groupName)
+	if err != nil {
+		return nil, err
+	}
+	secrets, failed := storage.decodeAll(data)
+	for _, err := range failed {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// GetSecretsByTag returns the secrets tagged with tag.
+func (storage *SQLiteStorage) GetSecretsByTag(tag string) ([]*Secret, error) {
+	allSecrets, err := storage.GetSecrets()
+	if err != nil {
+		return nil, err
+	}
+	return secretsTagged(allSecrets, tag), nil
+}
+
+func (storage *SQLiteStorage) GetSecret(name string) (*Secret, error) {
+	sd, err := storage.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if sd == nil {
+		return nil, errors.New(fmt.Sprintf("No secret exists with name: %s", name))
+	}
+	return decodeSecretChain(name, sd, storage.lookup, groupDepthLimit(storage.maxGroupDepth), make(map[string]bool))
+}
+
+func (storage *SQLiteStorage) SecretExists(name string) bool {
+	sd, err := storage.lookup(name)
+	return err == nil && sd != nil
+}
+
+// ListGroups returns the sorted names of the secrets used as a group.
+func (storage *SQLiteStorage) ListGroups() ([]string, error) {
+	return storage.names("SELECT DISTINCT group_name FROM secrets WHERE group_name != '' ORDER BY group_name")
+}
+
+// GroupMembers returns the sorted names of the secrets in the group name.
+func (storage *SQLiteStorage) GroupMembers(name string) ([]string, error) {
+	return storage.names("SELECT name FROM secrets WHERE group_name = ? ORDER BY name", name)
+}
+
+func (storage *SQLiteStorage) names(query string, args ...interface{}) ([]string, error) {
+	rows, err := storage.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// write runs fn in a transaction, committing it if fn succeeds.
+func (storage *SQLiteStorage) write(fn func(tx *sql.Tx) error) error {
+	if storage.readOnly {
+		return ErrReadOnly
+	}
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func secretExistsTx(tx *sql.Tx, name string) (bool, error) {
+	var one int
+	err := tx.QueryRow("SELECT 1 FROM secrets WHERE name = ?", name).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func replaceSecretTx(tx *sql.Tx, secret *Secret) error {
+	sd, err := encodeSecret(secret)
+	if err != nil {
+		return err
+	}
+	_, existing, err := scanSecretData(tx.QueryRow("SELECT "+sqliteColumns+" FROM secrets WHERE name = ?", secret.Name))
+	if err == sql.ErrNoRows {
+		existing = nil
+	} else if err != nil {
+		return err
+	}
+	keepTimestamps(sd, existing, time.Now())
+	var confirm sql.NullBool
+	if sd.ConfirmBeforeUse != nil {
+		confirm = sql.NullBool{Bool: *sd.ConfirmBeforeUse, Valid: true}
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO secrets ("+sqliteColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		secret.Name, sd.FileId, sd.CapId, sd.SecretType, secret.PublicData, sd.Group, sd.Comment, confirm, sd.SignTimeout, sd.LifetimeSecs, sd.Certificate, sd.CreatedAt, sd.LastUsedAt, strings.Join(sd.Tags, ","), sd.BunkrName, sd.Backend)
+	return err
+}
+
+func (storage *SQLiteStorage) StoreSecret(secret *Secret) error {
+	return storage.write(func(tx *sql.Tx) error {
+		exists, err := secretExistsTx(tx, secret.Name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errors.New(fmt.Sprintf("Secret with name %s already exists, please chose a different name", secret.Name))
+		}
+		return replaceSecretTx(tx, secret)
+	})
+}
+
+// UpdateSecret replaces the data of the already stored secret.
+func (storage *SQLiteStorage) UpdateSecret(secret *Secret) error {
+	return storage.write(func(tx *sql.Tx) error {
+		exists, err := secretExistsTx(tx, secret.Name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New(fmt.Sprintf("No secret exists with name: %s, store it first", secret.Name))
+		}
+		return replaceSecretTx(tx, secret)
+	})
+}
+
+// UpsertSecret stores the secret, replacing it if it already exists.
+func (storage *SQLiteStorage) UpsertSecret(secret *Secret) error {
+	return storage.write(func(tx *sql.Tx) error {
+		return replaceSecretTx(tx, secret)
+	})
+}
+
+// UpsertSecrets stores the secrets like UpsertSecret in a single
+// transaction.
+func (storage *SQLiteStorage) UpsertSecrets(secrets []*Secret) error {
+	return storage.write(func(tx *sql.Tx) error {
+		for _, secret := range secrets {
+			if err := replaceSecretTx(tx, secret); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TouchSecret records that the key of the secret name signed at at.
+func (storage *SQLiteStorage) TouchSecret(name string, at time.Time) error {
+	return storage.write(func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE secrets SET last_used_at = ? WHERE name = ?", formatTimestamp(at), name)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return errors.New(fmt.Sprintf("No secret exists with name: %s", name))
+		}
+		return nil
+	})
+}
+
+// RenameSecret moves the secret oldName to newName, keeping the secrets
+// belonging to it as members of the renamed group. The name of the secret in
+// Bunkr does not change, it is kept in BunkrName to sign.
+func (storage *SQLiteStorage) RenameSecret(oldName, newName string) error {
+	if newName == "" {
+		return errors.New("The new name of the secret can not be empty")
+	}
+	return storage.write(func(tx *sql.Tx) error {
+		_, sd, err := scanSecretData(tx.QueryRow("SELECT "+sqliteColumns+" FROM secrets WHERE name = ?", oldName))
+		if err == sql.ErrNoRows {
+			return errors.New(fmt.Sprintf("No secret exists with name: %s", oldName))
+		} else if err != nil {
+			return err
+		}
+		exists, err := secretExistsTx(tx, newName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errors.New(fmt.Sprintf("Secret with name %s already exists, please chose a different name", newName))
+		}
+		if _, err := tx.Exec("UPDATE secrets SET name = ?, bunkr_name = ? WHERE name = ?", newName, renamedBunkrName(sd.BunkrName, oldName, newName), oldName); err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE secrets SET group_name = ? WHERE group_name = ?", newName, oldName)
+		return err
+	})
+}
+
+// RemoveSecret removes the secret name together with every secret belonging,
+// directly or through nested groups, to it.
+func (storage *SQLiteStorage) RemoveSecret(name string) error {
+	return storage.write(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT name, group_name FROM secrets")
+		if err != nil {
+			return err
+		}
+		groups := make(map[string]string)
+		for rows.Next() {
+			var secret, group string
+			if err := rows.Scan(&secret, &group); err != nil {
+				rows.Close()
+				return err
+			}
+			groups[secret] = group
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for removed := range descendants(name, groups) {
+			if _, err := tx.Exec("DELETE FROM secrets WHERE name = ?", removed); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testSQLiteStorage(t *testing.T) (string, *SQLiteStorage, func()) {
+	dir, err := ioutil.TempDir("", "sqlite-test")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "storage.db")
+	store, err := NewSQLiteStorage(path)
+	require.NoError(t, err)
+	return path, store, func() {
+		_ = store.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestSQLiteMigratesEmptyDatabase(t *testing.T) {
+	require := require.New(t)
+	path, store, cleanup := testSQLiteStorage(t)
+	defer cleanup()
+
+	secrets, err := store.GetSecrets()
+	require.NoError(err)
+	require.Empty(secrets)
+	require.NoError(store.StoreSecret(&Secret{Name: "secret1", SecretType: "ECDSA-P256"}))
+	require.NoError(store.Close())
+
+	// Opening it again keeps the table and its rows.
+	reopened, err := NewSQLiteStorage(path)
+	require.NoError(err)
+	defer reopened.Close()
+	require.True(reopened.SecretExists("secret1"))
+}
+
+func TestSQLiteAddsMissingColumns(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "sqlite-test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.db")
+
+	// A database created before lifetime_secs and certificate were added
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(err)
+	_, err = db.Exec(`CREATE TABLE secrets (
+		name TEXT PRIMARY KEY, file_id TEXT NOT NULL, cap_id TEXT NOT NULL,
+		secret_type TEXT NOT NULL, public_data BLOB,
+		group_name TEXT NOT NULL DEFAULT '', comment TEXT NOT NULL DEFAULT '',
+		confirm_before_use INTEGER, sign_timeout TEXT NOT NULL DEFAULT '')`)
+	require.NoError(err)
+	_, err = db.Exec("INSERT INTO secrets (name, file_id, cap_id, secret_type) VALUES ('old', 'fid', 'cid', 'ECDSA-P256')")
+	require.NoError(err)
+	require.NoError(db.Close())
+
+	store, err := NewSQLiteStorage(path)
+	require.NoError(err)
+	defer store.Close()
+	old, err := store.GetSecret("old")
+	require.NoError(err)
+	require.Equal(uint32(0), old.LifetimeSecs)
+	require.Nil(old.Certificate)
+	require.Empty(old.Backend)
+	require.NoError(store.StoreSecret(&Secret{Name: "new", SecretType: "ECDSA-P256", LifetimeSecs: 60, Certificate: []byte("cert"), Backend: "office"}))
+	secret, err := store.GetSecret("new")
+	require.NoError(err)
+	require.Equal(uint32(60), secret.LifetimeSecs)
+	require.Equal([]byte("cert"), secret.Certificate)
+	require.Equal("office", secret.Backend)
+}
+
+func TestSQLiteStoreGetRemove(t *testing.T) {
+	require := require.New(t)
+	_, store, cleanup := testSQLiteStorage(t)
+	defer cleanup()
+
+	confirm := true
+	group := &Secret{Name: "group", FileId: "fid", CapId: "cid", SecretType: "ECDSA-P256", PublicData: []byte("group"), ConfirmBeforeUse: &confirm}
+	require.NoError(store.StoreSecret(group))
+	require.NoError(store.StoreSecret(&Secret{Name: "member", SecretType: "ECDSA-P256", Group: group, Comment: "laptop"}))
+	require.NoError(store.StoreSecret(&Secret{Name: "nested", SecretType: "ECDSA-P256", Group: &Secret{Name: "member"}}))
+	require.NoError(store.StoreSecret(&Secret{Name: "other", SecretType: "RSA"}))
+
+	member, err := store.GetSecret("member")
+	require.NoError(err)
+	require.Equal("laptop", member.Comment)
+	require.Equal("group", member.Group.Name)
+	require.True(member.RequireConfirm)
+	_, err = store.GetSecret("missing")
+	require.Error(err)
+
+	groups, err := store.ListGroups()
+	require.NoError(err)
+	require.Equal([]string{"group", "member"}, groups)
+	members, err := store.GroupMembers("group")
+	require.NoError(err)
+	require.Equal([]string{"member"}, members)
+
+	require.NoError(store.RemoveSecret("group"))
+	require.False(store.SecretExists("group"))
+	require.False(store.SecretExists("member"))
+	require.False(store.SecretExists("nested"))
+	require.True(store.SecretExists("other"))
+
+	store.SetReadOnly(true)
+	require.Equal(ErrReadOnly, store.RemoveSecret("other"))
+	require.True(store.SecretExists("other"))
+}
+
+func TestSQLiteGetSecretsByType(t *testing.T) {
+	require := require.New(t)
+	path, store, cleanup := testSQLiteStorage(t)
+	defer cleanup()
+
+	require.NoError(store.StoreSecret(&Secret{Name: "ecdsa1", SecretType: "ECDSA-P256"}))
+	require.NoError(store.StoreSecret(&Secret{Name: "ecdsa2", SecretType: "ECDSA-P256"}))
+	require.NoError(store.StoreSecret(&Secret{Name: "rsa", SecretType: "RSA"}))
+
+	secrets, err := store.GetSecretsByType("ECDSA-P256")
+	require.NoError(err)
+	require.Len(secrets, 2)
+	require.Equal("ecdsa1", secrets[0].Name)
+	require.Equal("ecdsa2", secrets[1].Name)
+	secrets, err = store.GetSecretsByType("ED25519")
+	require.NoError(err)
+	require.Empty(secrets)
+
+	// Rows written by older versions with the legacy type name match too
+	// once the database is opened again
+	_, err = store.db.Exec("UPDATE secrets SET secret_type = 'ECDSA' WHERE name = 'ecdsa2'")
+	require.NoError(err)
+	require.NoError(store.Close())
+	reopened, err := NewSQLiteStorage(path)
+	require.NoError(err)
+	defer reopened.Close()
+	var stored string
+	require.NoError(reopened.db.QueryRow("SELECT secret_type FROM secrets WHERE name = 'ecdsa2'").Scan(&stored))
+	require.Equal("ECDSA-P256", stored)
+	secrets, err = reopened.GetSecretsByType(SecretTypeECDSAP256)
+	require.NoError(err)
+	require.Len(secrets, 2)
+	require.Equal(SecretTypeECDSAP256, secrets[1].SecretType)
+}
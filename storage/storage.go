@@ -6,15 +6,64 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 type AgentStorage struct {
+	// mu guards data, the agent signs, reloads and imports keys
+	// concurrently.
+	mu          sync.Mutex
 	data        *AgentData
 	storagePath string
+	readOnly    bool
+
+	// readFile and writeFile access the storage files, replaceable in tests.
+	readFile    func(path string) ([]byte, error)
+	writeFile   func(path string, data []byte, perm os.FileMode) error
+	readRetries int
+	// maxGroupDepth bounds the group chains decoded, see SetMaxGroupDepth.
+	maxGroupDepth int
+	// inMemory storages have no file, see NewInMemoryStore.
+	inMemory bool
+	// encryption, when set, encrypts the storage file, see WithEncryption.
+	encryption *encryption
+	// warn logs the warnings, see WithWarningLogger.
+	warn func(msg string)
+
+	// lastUsedMu guards lastUsed, the times of the last use file by secret
+	// name, see TouchSecret.
+	lastUsedMu sync.Mutex
+	lastUsed   map[string]string
 }
 
+// DefaultReadRetries is how many times a storage read failing with a
+// transient error is retried.
+const DefaultReadRetries = 3
+
+// DefaultMaxGroupDepth is how many groups a secret can be nested in, its
+// group, the group of its group and so on, unless set otherwise.
+const DefaultMaxGroupDepth = 16
+
+// readRetryBackoff is the wait before the first read retry, doubled on each
+// following one.
+const readRetryBackoff = 10 * time.Millisecond
+
+var _ Store = (*AgentStorage)(nil)
+
+// ErrReadOnly is returned by mutating methods of a read only storage.
+var ErrReadOnly = errors.New("storage is read only, secrets can not be added or removed")
+
 type AgentData struct {
+	// Version is the schema version of the data, see migrate. Files written
+	// before it existed have none and are version 0.
+	Version int
 	Secrets map[string]*SecretData
 }
 
@@ -24,44 +73,117 @@ type SecretData struct {
 	SecretType string
 	PublicData string
 	Group      string
+
+	ConfirmBeforeUse *bool    `json:",omitempty"`
+	SignTimeout      string   `json:",omitempty"`
+	Comment          string   `json:",omitempty"`
+	LifetimeSecs     uint32   `json:",omitempty"`
+	Certificate      string   `json:",omitempty"`
+	CreatedAt        string   `json:",omitempty"`
+	LastUsedAt       string   `json:",omitempty"`
+	Tags             []string `json:",omitempty"`
+	BunkrName        string   `json:",omitempty"`
+	Backend          string   `json:",omitempty"`
 }
 
-func NewBunkrStorage(path string) (*AgentStorage, error) {
-	var bunkrData AgentData
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		bunkrData = AgentData{
+// WithWarningLogger logs the warnings of the storage, like a storage file
+// readable by other users, through warn instead of the standard logger.
+func WithWarningLogger(warn func(msg string)) StorageOption {
+	return func(storage *AgentStorage) {
+		storage.warn = warn
+	}
+}
+
+func NewBunkrStorage(path string, opts ...StorageOption) (*AgentStorage, error) {
+	storage := &AgentStorage{
+		data: &AgentData{
+			Version: CurrentVersion,
 			Secrets: make(map[string]*SecretData),
+		},
+		storagePath: path,
+		readFile:    ioutil.ReadFile,
+		writeFile:   writeFileSync,
+		readRetries: DefaultReadRetries,
+		warn: func(msg string) {
+			log.Print(fmt.Sprintf("Warning: %s", msg))
+		},
+	}
+	for _, opt := range opts {
+		opt(storage)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return storage, nil
+	}
+	if err := restrictPermissions(path, storage.warn); err != nil {
+		return nil, err
+	}
+	if err := storage.ReloadStorageData(); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// SetReadRetries sets how many times a storage read failing with a transient
+// error is retried, zero disables retrying.
+func (storage *AgentStorage) SetReadRetries(retries int) {
+	storage.readRetries = retries
+}
+
+// SetMaxGroupDepth sets how many groups a secret can be nested in, secrets
+// nested deeper fail to decode. Zero uses DefaultMaxGroupDepth.
+func (storage *AgentStorage) SetMaxGroupDepth(depth int) {
+	storage.maxGroupDepth = depth
+}
+
+// read reads the storage file, retrying with backoff on transient errors. A
+// missing or unreadable file is not retried, see transientReadError.
+func (storage *AgentStorage) read() ([]byte, error) {
+	backoff := readRetryBackoff
+	for attempt := 0; ; attempt++ {
+		b, err := storage.readFile(storage.storagePath)
+		if err == nil || !transientReadError(err) || attempt >= storage.readRetries {
+			return b, err
 		}
-	} else {
-		b, err := ioutil.ReadFile(path)
-		if err != nil {
-			return nil, err
-		}
-		if err := json.Unmarshal(b, &bunkrData); err != nil {
-			return nil, err
-		}
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+}
 
-	return &AgentStorage{
-		data:        &bunkrData,
-		storagePath: path,
-	}, nil
+// transientReadError reports whether reading the storage file again may
+// succeed. A missing file or one the agent is not allowed to read stays so
+// until someone fixes it.
+func transientReadError(err error) bool {
+	return !os.IsNotExist(err) && !os.IsPermission(err)
 }
 
 func (storage *AgentStorage) ReloadStorageData() error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.inMemory {
+		return nil
+	}
 	var bunkrData AgentData
-	b, err := ioutil.ReadFile(storage.storagePath)
+	b, err := storage.read()
 	if err != nil {
 		return err
 	}
+	if b, err = storage.decodeFile(b); err != nil {
+		return err
+	}
 	if err := json.Unmarshal(b, &bunkrData); err != nil {
 		return err
 	}
+	if err := migrate(&bunkrData); err != nil {
+		return err
+	}
 	storage.data = &bunkrData
+	storage.reloadLastUsed()
 	return nil
 }
 
 func (storage *AgentStorage) GetSecrets() ([]*Secret, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
 	secrets := make([]*Secret, len(storage.data.Secrets))
 	i := 0
 	for k, v := range storage.data.Secrets {
@@ -75,39 +197,222 @@ func (storage *AgentStorage) GetSecrets() ([]*Secret, error) {
 	return secrets, nil
 }
 
+// GetSecretsLenient returns every secret that can be decoded, secrets that
+// fail to decode are skipped and reported by name in the returned map.
+func (storage *AgentStorage) GetSecretsLenient() ([]*Secret, map[string]error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	secrets := make([]*Secret, 0, len(storage.data.Secrets))
+	failed := make(map[string]error)
+	for k, v := range storage.data.Secrets {
+		s, err := storage.decodeSecret(k, v)
+		if err != nil {
+			failed[k] = err
+			continue
+		}
+		secrets = append(secrets, s)
+	}
+	return secrets, failed
+}
+
+// SetReadOnly prevents, or allows again, any change of the stored secrets.
+// While read only StoreSecret and RemoveSecret fail and Dump does nothing.
+func (storage *AgentStorage) SetReadOnly(readOnly bool) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.readOnly = readOnly
+}
+
 func (storage *AgentStorage) StoreSecret(secret *Secret) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.readOnly {
+		return ErrReadOnly
+	}
 	if _, ok := storage.data.Secrets[secret.Name]; ok {
 		return errors.New(fmt.Sprintf("Secret with name %s already exists, please chose a different name", secret.Name))
 	}
-	secretData, err := storage.encodeSecret(secret)
+	secretData, err := encodeSecret(secret)
 	if err != nil {
 		return err
 	}
+	keepTimestamps(secretData, nil, time.Now())
+	secretData.LastUsedAt = ""
 	storage.data.Secrets[secret.Name] = secretData
-	if err := storage.Dump(); err != nil {
+	if err := storage.dump(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// UpdateSecret replaces the data of the already stored secret, e.g. after
+// its Bunkr capability was rotated.
+func (storage *AgentStorage) UpdateSecret(secret *Secret) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if _, ok := storage.data.Secrets[secret.Name]; !ok {
+		return errors.New(fmt.Sprintf("No secret exists with name: %s, store it first", secret.Name))
+	}
+	return storage.upsertSecret(secret)
+}
+
+// UpsertSecret stores the secret, replacing it if it already exists.
+func (storage *AgentStorage) UpsertSecret(secret *Secret) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return storage.upsertSecret(secret)
+}
+
+func (storage *AgentStorage) upsertSecret(secret *Secret) error {
+	if storage.readOnly {
+		return ErrReadOnly
+	}
+	secretData, err := encodeSecret(secret)
+	if err != nil {
+		return err
+	}
+	keepTimestamps(secretData, storage.data.Secrets[secret.Name], time.Now())
+	secretData.LastUsedAt = ""
+	storage.data.Secrets[secret.Name] = secretData
+	return storage.dump()
+}
+
+// UpsertSecrets stores the secrets like UpsertSecret, writing the file once.
+// Nothing is stored if any of them can not be encoded.
+func (storage *AgentStorage) UpsertSecrets(secrets []*Secret) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.readOnly {
+		return ErrReadOnly
+	}
+	encoded := make(map[string]*SecretData, len(secrets))
+	now := time.Now()
+	for _, secret := range secrets {
+		secretData, err := encodeSecret(secret)
+		if err != nil {
+			return err
+		}
+		keepTimestamps(secretData, storage.data.Secrets[secret.Name], now)
+		secretData.LastUsedAt = ""
+		encoded[secret.Name] = secretData
+	}
+	for name, secretData := range encoded {
+		storage.data.Secrets[name] = secretData
+	}
+	return storage.dump()
+}
+
+// RenameSecret moves the secret oldName to newName, keeping the secrets
+// belonging to it as members of the renamed group. The name of the secret in
+// Bunkr does not change, it is kept in BunkrName to sign.
+func (storage *AgentStorage) RenameSecret(oldName, newName string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.readOnly {
+		return ErrReadOnly
+	}
+	if newName == "" {
+		return errors.New("The new name of the secret can not be empty")
+	}
+	secretData, ok := storage.data.Secrets[oldName]
+	if !ok {
+		return errors.New(fmt.Sprintf("No secret exists with name: %s", oldName))
+	}
+	if _, ok := storage.data.Secrets[newName]; ok {
+		return errors.New(fmt.Sprintf("Secret with name %s already exists, please chose a different name", newName))
+	}
+	delete(storage.data.Secrets, oldName)
+	secretData.BunkrName = renamedBunkrName(secretData.BunkrName, oldName, newName)
+	storage.data.Secrets[newName] = secretData
+	for _, v := range storage.data.Secrets {
+		if v.Group == oldName {
+			v.Group = newName
+		}
+	}
+	if err := storage.dump(); err != nil {
+		return err
+	}
+	return storage.updateLastUsed(func(times map[string]string) bool {
+		last, ok := times[oldName]
+		if ok {
+			delete(times, oldName)
+			times[newName] = last
+		}
+		return ok
+	})
+}
+
+// renamedBunkrName returns the Bunkr name of a secret named bunkrName in
+// Bunkr, empty if it is its name, once renamed from oldName to newName.
+func renamedBunkrName(bunkrName, oldName, newName string) string {
+	if bunkrName == "" {
+		bunkrName = oldName
+	}
+	if bunkrName == newName {
+		return ""
+	}
+	return bunkrName
+}
+
+// RemoveSecret removes the secret name together with every secret belonging,
+// directly or through nested groups, to it.
 func (storage *AgentStorage) RemoveSecret(name string) error {
-	delete(storage.data.Secrets, name)
-	if err := storage.Dump(); err != nil {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.readOnly {
+		return ErrReadOnly
+	}
+	removed := descendants(name, storage.groupsByName())
+	for name := range removed {
+		delete(storage.data.Secrets, name)
+	}
+	if err := storage.dump(); err != nil {
 		return err
 	}
-	for k, v := range storage.data.Secrets {
-		if v.Group == name {
-			if err := storage.RemoveSecret(k); err != nil {
-				return err
+	// A secret stored again under one of the removed names starts unused
+	return storage.updateLastUsed(func(times map[string]string) bool {
+		changed := false
+		for name := range removed {
+			if _, ok := times[name]; ok {
+				delete(times, name)
+				changed = true
 			}
 		}
+		return changed
+	})
+}
+
+// groupsByName returns the group of every stored secret by name.
+func (storage *AgentStorage) groupsByName() map[string]string {
+	groups := make(map[string]string, len(storage.data.Secrets))
+	for k, v := range storage.data.Secrets {
+		groups[k] = v.Group
 	}
+	return groups
+}
 
-	return nil
+// descendants returns name and the names of the secrets whose group chain,
+// following groups, leads to it. The whole set is computed before anything
+// is removed so the result does not depend on the map iteration order, and
+// group cycles end.
+func descendants(name string, groups map[string]string) map[string]bool {
+	set := map[string]bool{name: true}
+	for grown := true; grown; {
+		grown = false
+		for k, group := range groups {
+			if !set[k] && group != "" && set[group] {
+				set[k] = true
+				grown = true
+			}
+		}
+	}
+	return set
 }
 
 func (storage *AgentStorage) GetSecret(name string) (*Secret, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
 	secretData, ok := storage.data.Secrets[name]
 	if !ok {
 		return nil, errors.New(fmt.Sprintf("No secret exists with name: %s", name))
@@ -117,18 +422,42 @@ func (storage *AgentStorage) GetSecret(name string) (*Secret, error) {
 }
 
 func (storage *AgentStorage) SecretExists(name string) bool {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
 	_, ok := storage.data.Secrets[name]
 	return ok
 }
 
-func (storage *AgentStorage) GetSecretsByType(secretType string) ([]*Secret, error) {
+// GetSecretsByType returns the secrets of the type secretType, which may be
+// given with any spelling ParseSecretType accepts.
+func (storage *AgentStorage) GetSecretsByType(secretType SecretType) ([]*Secret, error) {
+	secretType, err := ParseSecretType(string(secretType))
+	if err != nil {
+		return nil, err
+	}
+	allSecrets, err := storage.GetSecrets()
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]*Secret, 0)
+	for _, secret := range allSecrets {
+		if secret.SecretType == secretType {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets, nil
+}
+
+// GetSecretsByGroup returns the secrets whose group is the secret groupName.
+func (storage *AgentStorage) GetSecretsByGroup(groupName string) ([]*Secret, error) {
 	allSecrets, err := storage.GetSecrets()
 	if err != nil {
 		return nil, err
 	}
 	secrets := make([]*Secret, 0)
 	for _, secret := range allSecrets {
-		if string(secret.SecretType) == secretType {
+		if secret.Group != nil && secret.Group.Name == groupName {
 			secrets = append(secrets, secret)
 		}
 	}
@@ -136,19 +465,203 @@ func (storage *AgentStorage) GetSecretsByType(secretType string) ([]*Secret, err
 	return secrets, nil
 }
 
+// GetSecretsByTag returns the secrets tagged with tag.
+func (storage *AgentStorage) GetSecretsByTag(tag string) ([]*Secret, error) {
+	allSecrets, err := storage.GetSecrets()
+	if err != nil {
+		return nil, err
+	}
+	return secretsTagged(allSecrets, tag), nil
+}
+
+// GetSecretByFingerprint returns the secret whose public key has the SHA256
+// fingerprint fp, as shown by ssh-keygen -l and in the sshd logs. The
+// "SHA256:" prefix is optional. Secrets that can not be decoded or hold no
+// ssh public key are skipped.
+func (storage *AgentStorage) GetSecretByFingerprint(fp string) (*Secret, error) {
+	if !strings.HasPrefix(fp, "SHA256:") {
+		fp = "SHA256:" + fp
+	}
+	secrets, _ := storage.GetSecretsLenient()
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	for _, secret := range secrets {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(secret.PublicData)
+		if err != nil {
+			continue
+		}
+		if ssh.FingerprintSHA256(pub) == fp {
+			return secret, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("No stored secret has the fingerprint %s", fp))
+}
+
+// ListGroups returns the sorted names of the secrets referenced as the group
+// of another secret.
+func (storage *AgentStorage) ListGroups() ([]string, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	seen := make(map[string]bool)
+	groups := make([]string, 0)
+	for _, v := range storage.data.Secrets {
+		if v.Group != "" && !seen[v.Group] {
+			seen[v.Group] = true
+			groups = append(groups, v.Group)
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// GroupMembers returns the sorted names of the secrets whose group is name.
+func (storage *AgentStorage) GroupMembers(name string) ([]string, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	members := make([]string, 0)
+	for k, v := range storage.data.Secrets {
+		if v.Group == name {
+			members = append(members, k)
+		}
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
 func (storage *AgentStorage) Dump() error {
-	data, err := json.Marshal(storage.data)
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return storage.dump()
+}
+
+// dump writes the storage file, storage.mu must be held.
+func (storage *AgentStorage) dump() error {
+	if storage.readOnly || storage.inMemory {
+		return nil
+	}
+	// Indented, with the map keys sorted by encoding/json, so the file can
+	// be read and changing one secret changes a few lines only.
+	data, err := json.MarshalIndent(storage.data, "", "  ")
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(storage.storagePath, data, 0755); err != nil {
+	data = append(data, '\n')
+	if data, err = storage.encodeFile(data); err != nil {
+		return err
+	}
+	if err := storage.backup(); err != nil {
+		return errors.New(fmt.Sprintf("Error backing up storage before writing it: %v", err))
+	}
+	// Write a sibling file and rename it over the storage, so a crash never
+	// leaves a truncated file behind.
+	tmpPath := fmt.Sprintf("%s.tmp-%d", storage.storagePath, os.Getpid())
+	if err := storage.writeFile(tmpPath, data, 0600); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, storage.storagePath); err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 
 	return nil
 }
 
+// BackupPath returns the path of the copy of the storage at path made before
+// each write.
+func BackupPath(path string) string {
+	return path + ".bak"
+}
+
+// backup copies the storage file, if there is one, to its backup path,
+// replacing the previous backup.
+func (storage *AgentStorage) backup() error {
+	data, err := storage.readFile(storage.storagePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	backupPath := BackupPath(storage.storagePath)
+	tmpPath := fmt.Sprintf("%s.tmp-%d", backupPath, os.Getpid())
+	if err := storage.writeFile(tmpPath, data, 0600); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, backupPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// RestoreBackup swaps the storage file at path with its backup, so the
+// version before the last write is used again and the replaced one becomes
+// the backup.
+func RestoreBackup(path string) error {
+	backupPath := BackupPath(path)
+	if _, err := os.Stat(backupPath); err != nil {
+		return errors.New(fmt.Sprintf("No backup of the storage to restore: %v", err))
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return os.Rename(backupPath, path)
+	}
+	tmpPath := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	if err := os.Rename(path, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(backupPath, path); err != nil {
+		// Put the storage back where it was
+		os.Rename(tmpPath, path)
+		return err
+	}
+	return os.Rename(tmpPath, backupPath)
+}
+
+// writeFileSync writes data to path and flushes it to disk.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func (storage *AgentStorage) decodeSecret(name string, secretData *SecretData) (*Secret, error) {
+	return decodeSecretChain(name, storage.withLastUse(name, secretData), storage.lookup, groupDepthLimit(storage.maxGroupDepth), make(map[string]bool))
+}
+
+// lookup returns the data of the stored secret name, nil if there is none.
+func (storage *AgentStorage) lookup(name string) (*SecretData, error) {
+	return storage.withLastUse(name, storage.data.Secrets[name]), nil
+}
+
+// groupDepthLimit returns the group nesting limit set to depth, the default
+// one if it is not set.
+func groupDepthLimit(depth int) int {
+	if depth <= 0 {
+		return DefaultMaxGroupDepth
+	}
+	return depth
+}
+
+// decodeSecretChain decodes a secret and its groups, found through lookup.
+// visited holds the secrets of the chain already being decoded so that
+// cycles are reported instead of recursing forever, and chains nesting more
+// than maxDepth groups are refused.
+func decodeSecretChain(name string, secretData *SecretData, lookup func(name string) (*SecretData, error), maxDepth int, visited map[string]bool) (*Secret, error) {
+	if visited[name] {
+		return nil, errors.New(fmt.Sprintf("cyclic group reference detected involving %s", name))
+	}
+	visited[name] = true
 	data, err := base64.StdEncoding.DecodeString(secretData.PublicData)
 	if err != nil {
 		return nil, err
@@ -157,31 +670,127 @@ func (storage *AgentStorage) decodeSecret(name string, secretData *SecretData) (
 		Name:       name,
 		FileId:     secretData.FileId,
 		CapId:      secretData.CapId,
-		SecretType: secretData.SecretType,
+		SecretType: storedSecretType(secretData.SecretType),
 		PublicData: data,
 		Group:      nil,
+		Comment:    secretData.Comment,
+		BunkrName:  secretData.BunkrName,
+		Backend:    secretData.Backend,
+
+		ConfirmBeforeUse: secretData.ConfirmBeforeUse,
+		LifetimeSecs:     secretData.LifetimeSecs,
+	}
+	if len(secretData.Tags) > 0 {
+		s.Tags = append([]string(nil), secretData.Tags...)
+	}
+	if secretData.Certificate != "" {
+		s.Certificate = []byte(secretData.Certificate)
+	}
+	if s.CreatedAt, err = parseTimestamp(secretData.CreatedAt); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid creation time for secret %s: %v", name, err))
+	}
+	if s.LastUsedAt, err = parseTimestamp(secretData.LastUsedAt); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid last use time for secret %s: %v", name, err))
+	}
+	if secretData.SignTimeout != "" {
+		if s.SignTimeout, err = time.ParseDuration(secretData.SignTimeout); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid sign timeout for secret %s: %v", name, err))
+		}
 	}
 	if secretData.Group != "" {
-		group, err := storage.decodeSecret(secretData.Group, storage.data.Secrets[secretData.Group])
+		if len(visited) > maxDepth {
+			return nil, errors.New(fmt.Sprintf("Group %s of secret %s is nested more than %d groups deep", secretData.Group, name, maxDepth))
+		}
+		groupData, err := lookup(secretData.Group)
+		if err != nil {
+			return nil, err
+		}
+		if groupData == nil {
+			return nil, errors.New(fmt.Sprintf("Group %s of secret %s does not exist", secretData.Group, name))
+		}
+		group, err := decodeSecretChain(secretData.Group, groupData, lookup, maxDepth, visited)
 		if err != nil {
 			return nil, err
 		}
 		s.Group = group
+		s.RequireConfirm = group.RequireConfirm
+	}
+	if s.ConfirmBeforeUse != nil {
+		s.RequireConfirm = *s.ConfirmBeforeUse
 	}
 	return s, nil
 }
 
-func (storage *AgentStorage) encodeSecret(secret *Secret) (*SecretData, error) {
+func encodeSecret(secret *Secret) (*SecretData, error) {
+	if secret.SignTimeout < 0 {
+		return nil, errors.New(fmt.Sprintf("Sign timeout of secret %s must be positive, got %v", secret.Name, secret.SignTimeout))
+	}
+	secretType, err := ParseSecretType(string(secret.SecretType))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot store secret %s: %v", secret.Name, err))
+	}
+	tags, err := normalizeTags(secret.Tags)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Cannot store secret %s: %v", secret.Name, err))
+	}
 	sd := &SecretData{
 		FileId:     secret.FileId,
 		CapId:      secret.CapId,
-		SecretType: string(secret.SecretType),
+		SecretType: string(secretType),
 		PublicData: base64.StdEncoding.EncodeToString(secret.PublicData),
 		Group:      "",
+		Comment:    secret.Comment,
+		BunkrName:  secret.BunkrName,
+		Backend:    secret.Backend,
+
+		ConfirmBeforeUse: secret.ConfirmBeforeUse,
+		LifetimeSecs:     secret.LifetimeSecs,
+		Certificate:      string(secret.Certificate),
+		CreatedAt:        formatTimestamp(secret.CreatedAt),
+		LastUsedAt:       formatTimestamp(secret.LastUsedAt),
+		Tags:             tags,
 	}
 	if secret.Group != nil {
 		sd.Group = secret.Group.Name
 	}
+	if secret.SignTimeout > 0 {
+		sd.SignTimeout = secret.SignTimeout.String()
+	}
 
 	return sd, nil
 }
+
+// keepTimestamps fills the timestamps sd was stored without from the data
+// existing it replaces. A secret stored for the first time is created now,
+// one replacing a secret of unknown creation time keeps it unknown.
+func keepTimestamps(sd *SecretData, existing *SecretData, now time.Time) {
+	if existing == nil {
+		if sd.CreatedAt == "" {
+			sd.CreatedAt = formatTimestamp(now)
+		}
+		return
+	}
+	if sd.CreatedAt == "" {
+		sd.CreatedAt = existing.CreatedAt
+	}
+	if sd.LastUsedAt == "" {
+		sd.LastUsedAt = existing.LastUsedAt
+	}
+}
+
+// formatTimestamp formats t for the storage, empty for the zero time.
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// parseTimestamp parses a timestamp of the storage, empty being the zero
+// time.
+func parseTimestamp(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
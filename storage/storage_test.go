@@ -1,14 +1,21 @@
 package storage
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestAgentStorage(t *testing.T) {
@@ -116,6 +123,800 @@ func removeTestStorage() error {
 	if err := os.Remove(path); err != nil {
 		return err
 	}
+	os.Remove(BackupPath(path))
+	os.Remove(LastUsedPath(path))
 
 	return nil
 }
+
+func TestGroupConfirmationPolicy(t *testing.T) {
+	require := require.New(t)
+
+	path, err := getTestPath()
+	require.NoError(err)
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	defer func() {
+		_ = removeTestStorage()
+	}()
+
+	yes, no := true, false
+	prod := &Secret{Name: "prod", SecretType: "ECDSA-P256", ConfirmBeforeUse: &yes}
+	dev := &Secret{Name: "dev", SecretType: "ECDSA-P256", ConfirmBeforeUse: &no}
+	require.NoError(bunkrStorage.StoreSecret(prod))
+	require.NoError(bunkrStorage.StoreSecret(dev))
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "prodKey", SecretType: "ECDSA-P256", Group: prod}))
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "prodOverride", SecretType: "ECDSA-P256", Group: prod, ConfirmBeforeUse: &no}))
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "devKey", SecretType: "ECDSA-P256", Group: dev}))
+
+	for name, expected := range map[string]bool{
+		"prodKey":      true,
+		"prodOverride": false,
+		"devKey":       false,
+	} {
+		s, err := bunkrStorage.GetSecret(name)
+		require.NoError(err)
+		require.Equal(expected, s.RequireConfirm, name)
+	}
+}
+
+func TestGetSecretsLenient(t *testing.T) {
+	require := require.New(t)
+
+	path, err := getTestPath()
+	require.NoError(err)
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	defer func() {
+		_ = removeTestStorage()
+	}()
+
+	for _, name := range []string{"good1", "good2", "good3"} {
+		require.NoError(bunkrStorage.StoreSecret(&Secret{Name: name, SecretType: "ECDSA-P256", PublicData: []byte(name)}))
+	}
+	bunkrStorage.data.Secrets["corrupt"] = &SecretData{SecretType: "ECDSA-P256", PublicData: "not base64!"}
+
+	_, err = bunkrStorage.GetSecrets()
+	require.Error(err)
+
+	secrets, failed := bunkrStorage.GetSecretsLenient()
+	require.Len(secrets, 3)
+	require.Len(failed, 1)
+	require.Error(failed["corrupt"])
+}
+
+func TestCheckOwnership(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "storage-owner")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.json")
+
+	// Missing files only have their directory checked
+	require.NoError(CheckOwnership(path))
+	require.NoError(ioutil.WriteFile(path, []byte("{}"), 0600))
+	require.NoError(CheckOwnership(path))
+
+	if runtime.GOOS == "windows" || os.Geteuid() != 0 {
+		t.Skip("changing the file owner requires root")
+	}
+	require.NoError(os.Chown(path, 65534, 65534))
+	require.Error(CheckOwnership(path))
+}
+
+func TestListGroups(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for backend, store := range stores {
+		t.Run(backend, func(t *testing.T) {
+			require := require.New(t)
+			prod := &Secret{Name: "prod", SecretType: "ECDSA-P256"}
+			dev := &Secret{Name: "dev", SecretType: "ECDSA-P256"}
+			require.NoError(store.StoreSecret(prod))
+			require.NoError(store.StoreSecret(dev))
+			require.NoError(store.StoreSecret(&Secret{Name: "web", SecretType: "ECDSA-P256", Group: prod}))
+			require.NoError(store.StoreSecret(&Secret{Name: "db", SecretType: "ECDSA-P256", Group: prod}))
+			require.NoError(store.StoreSecret(&Secret{Name: "laptop", SecretType: "ECDSA-P256", Group: dev}))
+			require.NoError(store.StoreSecret(&Secret{Name: "loose", SecretType: "ECDSA-P256"}))
+
+			// Map iteration order must not leak into the result
+			for i := 0; i < 20; i++ {
+				groups, err := store.ListGroups()
+				require.NoError(err)
+				require.Equal([]string{"dev", "prod"}, groups)
+			}
+			members, err := store.GroupMembers("prod")
+			require.NoError(err)
+			require.Equal([]string{"db", "web"}, members)
+			members, err = store.GroupMembers("dev")
+			require.NoError(err)
+			require.Equal([]string{"laptop"}, members)
+			members, err = store.GroupMembers("loose")
+			require.NoError(err)
+			require.Empty(members)
+		})
+	}
+}
+
+func TestReadOnlyStorage(t *testing.T) {
+	require := require.New(t)
+
+	path, err := getTestPath()
+	require.NoError(err)
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	defer func() {
+		_ = removeTestStorage()
+	}()
+
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "secret1", SecretType: "ECDSA-P256"}))
+	bunkrStorage.SetReadOnly(true)
+	require.Equal(ErrReadOnly, bunkrStorage.StoreSecret(&Secret{Name: "secret2", SecretType: "ECDSA-P256"}))
+	require.Equal(ErrReadOnly, bunkrStorage.RemoveSecret("secret1"))
+	require.NoError(bunkrStorage.ReloadStorageData())
+	require.True(bunkrStorage.SecretExists("secret1"))
+
+	// Dump is a no-op, the file keeps its previous content
+	bunkrStorage.data.Secrets["secret3"] = &SecretData{SecretType: "ECDSA-P256"}
+	require.NoError(bunkrStorage.Dump())
+	require.NoError(bunkrStorage.ReloadStorageData())
+	require.False(bunkrStorage.SecretExists("secret3"))
+}
+
+func TestUpdateSecret(t *testing.T) {
+	require := require.New(t)
+
+	path, err := getTestPath()
+	require.NoError(err)
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	defer func() {
+		_ = removeTestStorage()
+	}()
+
+	require.Error(bunkrStorage.UpdateSecret(&Secret{Name: "secret1", SecretType: "ECDSA-P256"}))
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "secret1", FileId: "fid1", CapId: "cid1", SecretType: "ECDSA-P256", PublicData: []byte("old")}))
+	require.Error(bunkrStorage.StoreSecret(&Secret{Name: "secret1", SecretType: "ECDSA-P256"}))
+	require.NoError(bunkrStorage.UpdateSecret(&Secret{Name: "secret1", FileId: "fid2", CapId: "cid2", SecretType: "ECDSA-P256", PublicData: []byte("new")}))
+
+	reloaded, err := NewBunkrStorage(path)
+	require.NoError(err)
+	secret, err := reloaded.GetSecret("secret1")
+	require.NoError(err)
+	require.Equal("fid2", secret.FileId)
+	require.Equal("cid2", secret.CapId)
+	require.Equal([]byte("new"), secret.PublicData)
+
+	// Upserting stores new secrets and replaces existing ones
+	require.NoError(reloaded.UpsertSecret(&Secret{Name: "secret2", FileId: "fid3", CapId: "cid3", SecretType: "ECDSA-P256"}))
+	require.NoError(reloaded.UpsertSecret(&Secret{Name: "secret1", FileId: "fid4", CapId: "cid4", SecretType: "ECDSA-P256"}))
+	require.NoError(reloaded.ReloadStorageData())
+	secret, err = reloaded.GetSecret("secret1")
+	require.NoError(err)
+	require.Equal("cid4", secret.CapId)
+	secret, err = reloaded.GetSecret("secret2")
+	require.NoError(err)
+	require.Equal("cid3", secret.CapId)
+
+	reloaded.SetReadOnly(true)
+	require.Equal(ErrReadOnly, reloaded.UpdateSecret(secret))
+}
+
+func TestRemoveSecretCascade(t *testing.T) {
+	require := require.New(t)
+
+	path, err := getTestPath()
+	require.NoError(err)
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	defer func() {
+		_ = removeTestStorage()
+	}()
+
+	// root <- mid <- leaf, root <- sibling, and an unrelated tree whose
+	// names share prefixes with the removed one.
+	for name, group := range map[string]string{
+		"root":      "",
+		"mid":       "root",
+		"leaf":      "mid",
+		"sibling":   "root",
+		"root2":     "",
+		"root-leaf": "root2",
+		"a":         "b",
+		"b":         "a",
+		"dangling":  "gone",
+	} {
+		bunkrStorage.data.Secrets[name] = &SecretData{SecretType: "ECDSA-P256", Group: group}
+	}
+	require.NoError(bunkrStorage.Dump())
+
+	require.NoError(bunkrStorage.RemoveSecret("root"))
+	require.NoError(bunkrStorage.ReloadStorageData())
+	for _, name := range []string{"root", "mid", "leaf", "sibling"} {
+		require.False(bunkrStorage.SecretExists(name), name)
+	}
+	for _, name := range []string{"root2", "root-leaf", "a", "b", "dangling"} {
+		require.True(bunkrStorage.SecretExists(name), name)
+	}
+
+	// Removing a member leaves its group alone
+	require.NoError(bunkrStorage.RemoveSecret("root-leaf"))
+	require.True(bunkrStorage.SecretExists("root2"))
+
+	// Group cycles terminate
+	require.NoError(bunkrStorage.RemoveSecret("a"))
+	require.False(bunkrStorage.SecretExists("a"))
+	require.False(bunkrStorage.SecretExists("b"))
+
+	// Members of a group that is not stored anymore go with its name
+	require.NoError(bunkrStorage.RemoveSecret("gone"))
+	require.False(bunkrStorage.SecretExists("dangling"))
+	require.True(bunkrStorage.SecretExists("root2"))
+}
+
+func TestStorageReadRetries(t *testing.T) {
+	require := require.New(t)
+
+	path, err := getTestPath()
+	require.NoError(err)
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	defer func() {
+		_ = removeTestStorage()
+	}()
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "secret1", SecretType: "ECDSA-P256"}))
+
+	// A transient failure is retried
+	reads := 0
+	bunkrStorage.readFile = func(path string) ([]byte, error) {
+		reads++
+		if reads == 1 {
+			return nil, errors.New("input/output error")
+		}
+		return ioutil.ReadFile(path)
+	}
+	require.NoError(bunkrStorage.ReloadStorageData())
+	require.Equal(2, reads)
+	require.True(bunkrStorage.SecretExists("secret1"))
+
+	// Retries are bounded
+	reads = 0
+	bunkrStorage.readFile = func(path string) ([]byte, error) {
+		reads++
+		return nil, errors.New("input/output error")
+	}
+	bunkrStorage.SetReadRetries(2)
+	require.Error(bunkrStorage.ReloadStorageData())
+	require.Equal(3, reads)
+
+	// A missing file is not retried
+	reads = 0
+	bunkrStorage.readFile = func(path string) ([]byte, error) {
+		reads++
+		return ioutil.ReadFile(path + ".missing")
+	}
+	err = bunkrStorage.ReloadStorageData()
+	require.True(os.IsNotExist(err))
+	require.Equal(1, reads)
+
+	// Neither is a file the agent can not read
+	reads = 0
+	bunkrStorage.readFile = func(path string) ([]byte, error) {
+		reads++
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrPermission}
+	}
+	err = bunkrStorage.ReloadStorageData()
+	require.True(os.IsPermission(err))
+	require.Equal(1, reads)
+}
+
+func TestDumpIsAtomic(t *testing.T) {
+	require := require.New(t)
+
+	path, err := getTestPath()
+	require.NoError(err)
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	defer func() {
+		_ = removeTestStorage()
+	}()
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "secret1", SecretType: "ECDSA-P256"}))
+	good, err := ioutil.ReadFile(path)
+	require.NoError(err)
+
+	// The process dies, or the disk fills up, halfway through the write
+	var written string
+	bunkrStorage.writeFile = func(path string, data []byte, perm os.FileMode) error {
+		written = path
+		if err := ioutil.WriteFile(path, data[:len(data)/2], perm); err != nil {
+			return err
+		}
+		return errors.New("no space left on device")
+	}
+	require.Error(bunkrStorage.StoreSecret(&Secret{Name: "secret2", SecretType: "ECDSA-P256"}))
+	require.Equal(filepath.Dir(path), filepath.Dir(written))
+	_, err = os.Stat(written)
+	require.True(os.IsNotExist(err))
+
+	current, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal(good, current)
+	reloaded, err := NewBunkrStorage(path)
+	require.NoError(err)
+	require.True(reloaded.SecretExists("secret1"))
+	require.False(reloaded.SecretExists("secret2"))
+}
+
+func TestStoragePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on Windows")
+	}
+	require := require.New(t)
+
+	path, err := getTestPath()
+	require.NoError(err)
+	require.NoError(ioutil.WriteFile(path, []byte(`{"Secrets":{}}`), 0644))
+	require.NoError(os.Chmod(path, 0644))
+	defer func() {
+		_ = removeTestStorage()
+	}()
+
+	var warnings []string
+	bunkrStorage, err := NewBunkrStorage(path, WithWarningLogger(func(msg string) {
+		warnings = append(warnings, msg)
+	}))
+	require.NoError(err)
+	info, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0600), info.Mode().Perm())
+	require.Equal([]string{fmt.Sprintf("storage file %s had mode -rw-r--r--, restricting it to 0600", path)}, warnings)
+
+	// Dumped files are private too
+	require.NoError(os.Remove(path))
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "secret1", SecretType: "ECDSA-P256"}))
+	info, err = os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestRenameSecret(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for backend, store := range stores {
+		t.Run(backend, func(t *testing.T) {
+			require := require.New(t)
+			parent := &Secret{Name: "parent", SecretType: "ECDSA-P256"}
+			require.NoError(store.StoreSecret(parent))
+			require.NoError(store.StoreSecret(&Secret{Name: "member1", SecretType: "ECDSA-P256", Group: parent}))
+			require.NoError(store.StoreSecret(&Secret{Name: "member2", SecretType: "ECDSA-P256", Group: parent}))
+			require.NoError(store.StoreSecret(&Secret{Name: "other", SecretType: "ECDSA-P256"}))
+
+			require.Error(store.RenameSecret("missing", "new"))
+			require.Error(store.RenameSecret("parent", "other"))
+			require.Error(store.RenameSecret("parent", ""))
+			require.NoError(store.RenameSecret("parent", "renamed"))
+
+			require.NoError(store.ReloadStorageData())
+			require.False(store.SecretExists("parent"))
+			renamed, err := store.GetSecret("renamed")
+			require.NoError(err)
+			// Bunkr still knows the secret by its first name
+			require.Equal("parent", renamed.BunkrSecretName())
+			for _, name := range []string{"member1", "member2"} {
+				member, err := store.GetSecret(name)
+				require.NoError(err)
+				require.NotNil(member.Group)
+				require.Equal("renamed", member.Group.Name)
+				require.Equal("parent", member.Group.BunkrSecretName())
+			}
+			members, err := store.GetSecretsByGroup("renamed")
+			require.NoError(err)
+			require.Len(members, 2)
+
+			// Renaming again keeps the Bunkr name, and back clears it
+			require.NoError(store.RenameSecret("renamed", "again"))
+			again, err := store.GetSecret("again")
+			require.NoError(err)
+			require.Equal("parent", again.BunkrName)
+			require.NoError(store.RenameSecret("again", "parent"))
+			parent, err = store.GetSecret("parent")
+			require.NoError(err)
+			require.Empty(parent.BunkrName)
+		})
+	}
+}
+
+func TestCyclicGroups(t *testing.T) {
+	require := require.New(t)
+
+	path, err := getTestPath()
+	require.NoError(err)
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	defer func() {
+		_ = removeTestStorage()
+	}()
+
+	bunkrStorage.data.Secrets["self"] = &SecretData{SecretType: "ECDSA-P256", Group: "self"}
+	bunkrStorage.data.Secrets["a"] = &SecretData{SecretType: "ECDSA-P256", Group: "b"}
+	bunkrStorage.data.Secrets["b"] = &SecretData{SecretType: "ECDSA-P256", Group: "a"}
+	bunkrStorage.data.Secrets["member"] = &SecretData{SecretType: "ECDSA-P256", Group: "a"}
+	bunkrStorage.data.Secrets["orphan"] = &SecretData{SecretType: "ECDSA-P256", Group: "gone"}
+	bunkrStorage.data.Secrets["fine"] = &SecretData{SecretType: "ECDSA-P256"}
+
+	_, err = bunkrStorage.GetSecret("self")
+	require.EqualError(err, "cyclic group reference detected involving self")
+	_, err = bunkrStorage.GetSecret("a")
+	require.EqualError(err, "cyclic group reference detected involving a")
+	_, err = bunkrStorage.GetSecret("member")
+	require.EqualError(err, "cyclic group reference detected involving a")
+	_, err = bunkrStorage.GetSecret("orphan")
+	require.EqualError(err, "Group gone of secret orphan does not exist")
+
+	secrets, failed := bunkrStorage.GetSecretsLenient()
+	require.Len(secrets, 1)
+	require.Equal("fine", secrets[0].Name)
+	require.Len(failed, 5)
+}
+
+func TestMaxGroupDepth(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for backend, store := range stores {
+		t.Run(backend, func(t *testing.T) {
+			require := require.New(t)
+			// level0 is in level1, in level2 and so on up to the ungrouped
+			// level<DefaultMaxGroupDepth+1>
+			var group *Secret
+			for i := DefaultMaxGroupDepth + 1; i >= 0; i-- {
+				secret := &Secret{Name: fmt.Sprintf("level%d", i), SecretType: "GENERIC-GF256", Group: group}
+				require.NoError(store.StoreSecret(secret))
+				group = secret
+			}
+
+			level1, err := store.GetSecret("level1")
+			require.NoError(err)
+			depth := 0
+			for g := level1.Group; g != nil; g = g.Group {
+				depth++
+			}
+			require.Equal(DefaultMaxGroupDepth, depth)
+			_, err = store.GetSecret("level0")
+			require.EqualError(err, fmt.Sprintf("Group level%d of secret level%d is nested more than %d groups deep", DefaultMaxGroupDepth+1, DefaultMaxGroupDepth, DefaultMaxGroupDepth))
+			_, failed := store.GetSecretsLenient()
+			require.Len(failed, 1)
+			require.Contains(failed, "level0")
+
+			store.(interface{ SetMaxGroupDepth(int) }).SetMaxGroupDepth(2)
+			_, err = store.GetSecret("level15")
+			require.NoError(err)
+			_, err = store.GetSecret("level14")
+			require.EqualError(err, "Group level17 of secret level16 is nested more than 2 groups deep")
+		})
+	}
+}
+
+func TestGetSecretsByGroup(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for backend, store := range stores {
+		t.Run(backend, func(t *testing.T) {
+			require := require.New(t)
+			ci := &Secret{Name: "ci", SecretType: "ECDSA-P256"}
+			deploy := &Secret{Name: "deploy", SecretType: "ECDSA-P256"}
+			require.NoError(store.StoreSecret(ci))
+			require.NoError(store.StoreSecret(deploy))
+			for _, secret := range []*Secret{
+				{Name: "runner1", SecretType: "ECDSA-P256", Group: ci},
+				{Name: "runner2", SecretType: "ECDSA-P256", Group: ci},
+				{Name: "prod", SecretType: "ECDSA-P256", Group: deploy},
+				{Name: "personal", SecretType: "ECDSA-P256"},
+			} {
+				require.NoError(store.StoreSecret(secret))
+			}
+
+			names := func(group string) []string {
+				secrets, err := store.GetSecretsByGroup(group)
+				require.NoError(err)
+				var names []string
+				for _, secret := range secrets {
+					require.Equal(group, secret.Group.Name)
+					names = append(names, secret.Name)
+				}
+				return names
+			}
+			require.ElementsMatch([]string{"runner1", "runner2"}, names("ci"))
+			require.Equal([]string{"prod"}, names("deploy"))
+			require.Empty(names("personal"))
+			require.Empty(names("missing"))
+		})
+	}
+}
+
+func TestGetSecretsByTag(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for backend, store := range stores {
+		t.Run(backend, func(t *testing.T) {
+			require := require.New(t)
+			for _, secret := range []*Secret{
+				{Name: "runner", SecretType: "ECDSA-P256", Tags: []string{"ci", "prod"}},
+				{Name: "deploy", SecretType: "ECDSA-P256", Tags: []string{"prod", "prod"}},
+				{Name: "personal", SecretType: "ECDSA-P256"},
+			} {
+				require.NoError(store.StoreSecret(secret))
+			}
+			require.Error(store.StoreSecret(&Secret{Name: "spaced", SecretType: "ECDSA-P256", Tags: []string{"two words"}}))
+			require.Error(store.StoreSecret(&Secret{Name: "listed", SecretType: "ECDSA-P256", Tags: []string{"a,b"}}))
+			require.Error(store.StoreSecret(&Secret{Name: "empty", SecretType: "ECDSA-P256", Tags: []string{""}}))
+			require.NoError(store.ReloadStorageData())
+
+			runner, err := store.GetSecret("runner")
+			require.NoError(err)
+			require.Equal([]string{"ci", "prod"}, runner.Tags)
+			require.True(runner.HasTag("ci"))
+			require.False(runner.HasTag("personal"))
+			// Repeated tags are stored once
+			deploy, err := store.GetSecret("deploy")
+			require.NoError(err)
+			require.Equal([]string{"prod"}, deploy.Tags)
+			personal, err := store.GetSecret("personal")
+			require.NoError(err)
+			require.Empty(personal.Tags)
+
+			names := func(tag string) []string {
+				secrets, err := store.GetSecretsByTag(tag)
+				require.NoError(err)
+				var names []string
+				for _, secret := range secrets {
+					names = append(names, secret.Name)
+				}
+				return names
+			}
+			require.ElementsMatch([]string{"runner", "deploy"}, names("prod"))
+			require.Equal([]string{"runner"}, names("ci"))
+			require.Empty(names("missing"))
+		})
+	}
+}
+
+func TestTagsJSON(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "storage-tags")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.json")
+
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "tagged", SecretType: "ECDSA-P256", Tags: []string{"ci", "prod"}}))
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "untagged", SecretType: "ECDSA-P256"}))
+	b, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	text := string(b)
+	require.Contains(text, "\"Tags\": [\n        \"ci\",\n        \"prod\"\n      ]")
+	require.Equal(1, strings.Count(text, "\"Tags\""))
+
+	reloaded, err := NewBunkrStorage(path)
+	require.NoError(err)
+	tagged, err := reloaded.GetSecret("tagged")
+	require.NoError(err)
+	require.Equal([]string{"ci", "prod"}, tagged.Tags)
+}
+
+func TestGetSecretByFingerprint(t *testing.T) {
+	require := require.New(t)
+	storage := NewInMemoryStore()
+
+	group := &Secret{Name: "ci", SecretType: "GENERIC-GF256", PublicData: []byte("not a key")}
+	require.NoError(storage.StoreSecret(group))
+	fingerprints := map[string]string{}
+	for _, name := range []string{"runner", "personal"} {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(err)
+		sshPub, err := ssh.NewPublicKey(pub)
+		require.NoError(err)
+		secret := &Secret{Name: name, SecretType: "ED25519", PublicData: ssh.MarshalAuthorizedKey(sshPub)}
+		if name == "runner" {
+			secret.Group = group
+		}
+		require.NoError(storage.StoreSecret(secret))
+		fingerprints[name] = ssh.FingerprintSHA256(sshPub)
+	}
+
+	secret, err := storage.GetSecretByFingerprint(fingerprints["runner"])
+	require.NoError(err)
+	require.Equal("runner", secret.Name)
+	require.Equal("ci", secret.Group.Name)
+
+	// The SHA256: prefix is optional
+	secret, err = storage.GetSecretByFingerprint(strings.TrimPrefix(fingerprints["personal"], "SHA256:"))
+	require.NoError(err)
+	require.Equal("personal", secret.Name)
+	require.Nil(secret.Group)
+
+	_, err = storage.GetSecretByFingerprint("SHA256:unknown")
+	require.Error(err)
+}
+
+func TestRestoreBackup(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "storage-backup")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.json")
+
+	require.Error(RestoreBackup(path))
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	// Nothing to back up on the first write
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "secret1", SecretType: "ECDSA-P256"}))
+	_, err = os.Stat(BackupPath(path))
+	require.True(os.IsNotExist(err))
+	require.NoError(bunkrStorage.StoreSecret(&Secret{Name: "secret2", SecretType: "ECDSA-P256"}))
+	info, err := os.Stat(BackupPath(path))
+	require.NoError(err)
+	if runtime.GOOS != "windows" {
+		require.Equal(os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// The storage gets corrupted
+	require.NoError(ioutil.WriteFile(path, []byte(`{"Secrets": {`), 0600))
+	_, err = NewBunkrStorage(path)
+	require.Error(err)
+
+	require.NoError(RestoreBackup(path))
+	restored, err := NewBunkrStorage(path)
+	require.NoError(err)
+	require.True(restored.SecretExists("secret1"))
+	require.False(restored.SecretExists("secret2"))
+	// The corrupted file is kept as the backup
+	backup, err := ioutil.ReadFile(BackupPath(path))
+	require.NoError(err)
+	require.Equal(`{"Secrets": {`, string(backup))
+}
+
+func TestDumpIsStable(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "storage-dump")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.json")
+
+	bunkrStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	for _, name := range []string{"zeta", "alpha", "mid"} {
+		require.NoError(bunkrStorage.StoreSecret(&Secret{Name: name, SecretType: "ECDSA-P256", PublicData: []byte(name)}))
+	}
+	first, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.NoError(bunkrStorage.Dump())
+	second, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal(string(first), string(second))
+
+	text := string(first)
+	require.True(strings.HasPrefix(text, "{\n  \"Version\": 1,\n  \"Secrets\": {\n    \"alpha\": {\n"), text)
+	require.True(strings.Index(text, `"alpha"`) < strings.Index(text, `"mid"`))
+	require.True(strings.Index(text, `"mid"`) < strings.Index(text, `"zeta"`))
+
+	reloaded, err := NewBunkrStorage(path)
+	require.NoError(err)
+	require.True(reloaded.SecretExists("mid"))
+}
+
+func TestMissingTimestamps(t *testing.T) {
+	require := require.New(t)
+	storage := NewInMemoryStore()
+	storage.data.Secrets["old"] = &SecretData{SecretType: "ED25519"}
+	storage.data.Secrets["broken"] = &SecretData{SecretType: "ED25519", CreatedAt: "yesterday"}
+
+	secret, err := storage.GetSecret("old")
+	require.NoError(err)
+	require.True(secret.CreatedAt.IsZero())
+	require.True(secret.LastUsedAt.IsZero())
+	_, err = storage.GetSecret("broken")
+	require.Error(err)
+
+	// Replacing a secret of unknown age does not make it new
+	require.NoError(storage.UpsertSecret(&Secret{Name: "old", SecretType: "ED25519"}))
+	require.Empty(storage.data.Secrets["old"].CreatedAt)
+}
+
+func TestLastUsedFile(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "storage-last-used")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.json")
+
+	agentStorage, err := NewBunkrStorage(path)
+	require.NoError(err)
+	require.NoError(agentStorage.StoreSecret(&Secret{Name: "deploy", SecretType: "ECDSA-P256"}))
+	// Another process imports a key meanwhile
+	cli, err := NewBunkrStorage(path)
+	require.NoError(err)
+	require.NoError(cli.StoreSecret(&Secret{Name: "imported", SecretType: "ECDSA-P256"}))
+	before, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	backup, err := ioutil.ReadFile(BackupPath(path))
+	require.NoError(err)
+
+	used := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(agentStorage.TouchSecret("deploy", used))
+	require.Error(agentStorage.TouchSecret("missing", used))
+	// Neither the storage nor its backup are written
+	after, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal(string(before), string(after))
+	afterBackup, err := ioutil.ReadFile(BackupPath(path))
+	require.NoError(err)
+	require.Equal(string(backup), string(afterBackup))
+
+	secret, err := agentStorage.GetSecret("deploy")
+	require.NoError(err)
+	require.True(used.Equal(secret.LastUsedAt))
+	reloaded, err := NewBunkrStorage(path)
+	require.NoError(err)
+	require.True(reloaded.SecretExists("imported"))
+	secret, err = reloaded.GetSecret("deploy")
+	require.NoError(err)
+	require.True(used.Equal(secret.LastUsedAt))
+
+	// An older time recorded by another agent does not go back
+	require.NoError(reloaded.TouchSecret("deploy", used.Add(-time.Hour)))
+	require.NoError(agentStorage.ReloadStorageData())
+	secret, err = agentStorage.GetSecret("deploy")
+	require.NoError(err)
+	require.True(used.Equal(secret.LastUsedAt))
+
+	// A removed secret stored again starts unused
+	require.NoError(agentStorage.RemoveSecret("deploy"))
+	require.NoError(agentStorage.StoreSecret(&Secret{Name: "deploy", SecretType: "ECDSA-P256"}))
+	secret, err = agentStorage.GetSecret("deploy")
+	require.NoError(err)
+	require.True(secret.LastUsedAt.IsZero())
+
+	// A corrupted last use file only loses the times
+	require.NoError(ioutil.WriteFile(LastUsedPath(path), []byte("{"), 0600))
+	_, err = NewBunkrStorage(path)
+	require.NoError(err)
+	require.NoError(agentStorage.TouchSecret("deploy", used))
+}
+
+func TestTouchWhileReloading(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "storage-last-used")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	agentStorage, err := NewBunkrStorage(filepath.Join(dir, "storage.json"))
+	require.NoError(err)
+	require.NoError(agentStorage.StoreSecret(&Secret{Name: "deploy", SecretType: "ECDSA-P256"}))
+	done := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			var err error
+			for j := 0; j < 20 && err == nil; j++ {
+				if i%2 == 0 {
+					err = agentStorage.TouchSecret("deploy", time.Now())
+				} else {
+					err = agentStorage.ReloadStorageData()
+				}
+			}
+			done <- err
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		require.NoError(<-done)
+	}
+	secret, err := agentStorage.GetSecret("deploy")
+	require.NoError(err)
+	require.False(secret.LastUsedAt.IsZero())
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HasTag tells if the secret is tagged with tag.
+func (secret *Secret) HasTag(tag string) bool {
+	for _, t := range secret.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTags checks the tags of a secret to store, dropping the repeated
+// ones. A tag can not be empty nor hold spaces or commas, so that tags can be
+// given as a comma separated list.
+func normalizeTags(tags []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if tag == "" || strings.ContainsAny(tag, ", \t\n") {
+			return nil, errors.New(fmt.Sprintf("Invalid tag %q, tags can not be empty nor hold spaces or commas", tag))
+		}
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized, nil
+}
+
+// secretsTagged returns the secrets among secrets tagged with tag.
+func secretsTagged(secrets []*Secret, tag string) []*Secret {
+	tagged := make([]*Secret, 0)
+	for _, secret := range secrets {
+		if secret.HasTag(tag) {
+			tagged = append(tagged, secret)
+		}
+	}
+	return tagged
+}